@@ -0,0 +1,827 @@
+package base
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the key-value store. Values are JSON documents
+var (
+	// uuid -> util.Row
+	boltMeta = []byte("meta")
+	// tenant, bucket, name, uuid -> empty. Secondary index on metadata, sorted by bucket and name:
+	// serves lookups by name and listings of tenants and buckets, through prefix scans
+	boltObjects = []byte("objects")
+	// tenant, terminated as in objects since it may be empty -> util.Usage, updated with metadata
+	boltUsage = []byte("usage")
+	// tenant, name, terminated as in objects -> util.Bucket
+	boltBuckets = []byte("buckets")
+	// name -> util.Bucket. Buckets of the releases keying them by name only, moved to buckets by Init
+	boltLegacyBuckets = []byte("bucket")
+	// sequence number, big endian -> util.AuditRecord
+	boltAudit = []byte("audit")
+	// uuid -> []util.SearchTerm, the words of the object in the search index
+	boltTerms = []byte("terms")
+
+	boltTables = [][]byte{boltMeta, boltObjects, boltUsage, boltBuckets, boltAudit, boltTerms}
+)
+
+// Stored forms of util.Row and util.Bucket, whose JSON encodings hide the tenant
+type (
+	boltRow struct {
+		Uuid        string
+		FileName    string
+		Bucket      string
+		Size        int64
+		CreatedAt   string
+		ContentType string
+		Tags        map[string]string
+		ETag        string
+		Tenant      string
+	}
+	boltBucket struct {
+		Name   string
+		Owner  string
+		Policy string
+		Tenant string
+	}
+)
+
+var (
+	errNoSQL        = errors.New("SQL statements are not supported by the key-value store")
+	errNotConnected = errors.New("key-value store not open")
+)
+
+// BoltDB is the implementation of DB on an embedded bbolt key-value store, for nodes without any SQL engine.
+// Writes touching several keys, e.g. metadata, index and usage, are atomic
+type BoltDB struct {
+	// Guards db, which is replaced when reconnecting
+	mu     sync.RWMutex
+	db     *bolt.DB
+	logger *util.Logger
+}
+
+func NewBoltDatabase(logger *util.Logger) DB {
+	return &BoltDB{logger: logger}
+}
+
+// Connect opens the store file at dsn, creating it if it doesn't exist. driver is ignored.
+// The file is locked by the process that opens it: Connect waits a second for the lock
+func (boltdb *BoltDB) Connect(driver string, dsn string) error {
+	boltdb.mu.Lock()
+	defer boltdb.mu.Unlock()
+
+	// The open handle would hold the lock
+	if boltdb.db != nil {
+		if err := boltdb.db.Close(); err != nil {
+			return err
+		}
+		boltdb.db = nil
+	}
+	db, err := bolt.Open(dsn, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	boltdb.db = db
+	boltdb.logger.Debug("Key-value store opened: " + dsn)
+
+	return nil
+}
+
+// conn returns the open store, nil if not connected
+func (boltdb *BoltDB) conn() *bolt.DB {
+	boltdb.mu.RLock()
+	defer boltdb.mu.RUnlock()
+	return boltdb.db
+}
+
+// open returns the open store. bbolt transactions can't be interrupted:
+// ctx is checked before starting them, and by the scans between keys
+func (boltdb *BoltDB) open(ctx context.Context) (*bolt.DB, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	db := boltdb.conn()
+	if db == nil {
+		return nil, errNotConnected
+	}
+	return db, nil
+}
+
+func (boltdb *BoltDB) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	db, err := boltdb.open(ctx)
+	if err != nil {
+		return err
+	}
+	return db.View(fn)
+}
+
+func (boltdb *BoltDB) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	db, err := boltdb.open(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Update(fn)
+}
+
+// batch is update for concurrent writers: their transactions are coalesced into one commit.
+// fn may run more than once
+func (boltdb *BoltDB) batch(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	db, err := boltdb.open(ctx)
+	if err != nil {
+		return err
+	}
+	return db.Batch(fn)
+}
+
+func (boltdb *BoltDB) ExecContext(ctx context.Context, statementString string, params ...any) (sql.Result, error) {
+	return nil, errNoSQL
+}
+
+func (boltdb *BoltDB) QueryContext(ctx context.Context, statementString string, params ...any) (*sql.Rows, error) {
+	return nil, errNoSQL
+}
+
+// Init() creates the buckets of the store
+func (boltdb *BoltDB) Init(ctx context.Context) error {
+	return boltdb.update(ctx, func(tx *bolt.Tx) error {
+		for _, name := range boltTables {
+			boltdb.logger.Debugf("Creating '%s' bucket, if doesn't exist", name)
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return boltdb.moveLegacyBuckets(tx)
+	})
+}
+
+// moveLegacyBuckets keys the buckets stored by name only by tenant and name
+func (boltdb *BoltDB) moveLegacyBuckets(tx *bolt.Tx) error {
+	legacy := tx.Bucket(boltLegacyBuckets)
+	if legacy == nil {
+		return nil
+	}
+	buckets := tx.Bucket(boltBuckets)
+	moved := 0
+	err := legacy.ForEach(func(_, value []byte) error {
+		var bucket boltBucket
+		if err := json.Unmarshal(value, &bucket); err != nil {
+			return err
+		}
+		moved++
+		return buckets.Put(objectKey(bucket.Tenant, bucket.Name), value)
+	})
+	if err != nil {
+		return err
+	}
+	boltdb.logger.Infof("Buckets keyed by tenant, %d moved", moved)
+	return tx.DeleteBucket(boltLegacyBuckets)
+}
+
+// tearDown() deletes all the buckets created by Init(). To be used in tests! Thus, unexported.
+func (boltdb *BoltDB) tearDown() error {
+	return boltdb.update(context.Background(), func(tx *bolt.Tx) error {
+		for _, name := range boltTables {
+			boltdb.logger.Debugf("Deleting bucket '%s'", name)
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (boltdb *BoltDB) InsertMetadata(ctx context.Context, row util.Row) error {
+
+	return boltdb.batch(ctx, func(tx *bolt.Tx) error {
+		return boltdb.insertRow(tx, row)
+	})
+}
+
+func (boltdb *BoltDB) ReplaceMetadata(ctx context.Context, uuid string, row util.Row) error {
+
+	return boltdb.batch(ctx, func(tx *bolt.Tx) error {
+		var old boltRow
+		if err := getJSON(tx.Bucket(boltMeta), []byte(uuid), &old); err != nil {
+			return err
+		}
+		if err := deleteRow(tx, util.Row(old)); err != nil {
+			return err
+		}
+		return boltdb.insertRow(tx, row)
+	})
+}
+
+// MoveMetadata renames the object in the same transaction deleting the object replaced, if set.
+// The words of its content are kept
+func (boltdb *BoltDB) MoveMetadata(ctx context.Context, row util.Row, replaced string) error {
+
+	return boltdb.batch(ctx, func(tx *bolt.Tx) error {
+		meta, index := tx.Bucket(boltMeta), tx.Bucket(boltTerms)
+		if replaced != "" {
+			var old boltRow
+			if err := getJSON(meta, []byte(replaced), &old); err != nil {
+				return err
+			}
+			if err := deleteRow(tx, util.Row(old)); err != nil {
+				return err
+			}
+		}
+		var moved boltRow
+		if err := getJSON(meta, []byte(row.Uuid), &moved); err != nil {
+			return err
+		}
+		var indexed []util.SearchTerm
+		if err := getJSON(index, []byte(row.Uuid), &indexed); err != nil && err != NotFoundError {
+			return err
+		}
+		if err := deleteRow(tx, util.Row(moved)); err != nil {
+			return err
+		}
+		moved.Bucket, moved.FileName = row.Bucket, row.FileName
+		if err := boltdb.insertRow(tx, util.Row(moved)); err != nil {
+			return err
+		}
+		terms := util.IndexTerms(util.Row(moved))
+		for _, term := range indexed {
+			if term.Field == util.SearchContent {
+				terms = append(terms, term)
+			}
+		}
+		return putJSON(index, []byte(row.Uuid), terms)
+	})
+}
+
+// UpdateTags replaces the tags of the object, if they are still row.Tags, and their words in the index
+func (boltdb *BoltDB) UpdateTags(ctx context.Context, row util.Row, tags map[string]string) error {
+
+	return boltdb.batch(ctx, func(tx *bolt.Tx) error {
+		meta, index := tx.Bucket(boltMeta), tx.Bucket(boltTerms)
+		var current boltRow
+		if err := getJSON(meta, []byte(row.Uuid), &current); err != nil {
+			return err
+		}
+		if !util.EqualTags(current.Tags, row.Tags) {
+			return NotFoundError
+		}
+		var indexed []util.SearchTerm
+		if err := getJSON(index, []byte(row.Uuid), &indexed); err != nil && err != NotFoundError {
+			return err
+		}
+		current.Tags = tags
+		if err := putJSON(meta, []byte(row.Uuid), current); err != nil {
+			return err
+		}
+		terms := util.IndexTerms(util.Row(current))
+		for _, term := range indexed {
+			if term.Field == util.SearchContent {
+				terms = append(terms, term)
+			}
+		}
+		return putJSON(index, []byte(row.Uuid), terms)
+	})
+}
+
+// insertRow stores row with its index entries and words, and accounts for its size.
+// Throws ConflictError if an object with the same uuid, or name in the bucket, exists
+func (boltdb *BoltDB) insertRow(tx *bolt.Tx, row util.Row) error {
+
+	meta := tx.Bucket(boltMeta)
+	if meta.Get([]byte(row.Uuid)) != nil {
+		return util.ConflictError{Message: "object " + row.Uuid + " already exists"}
+	}
+	prefix := objectKey(row.Tenant, row.Bucket, row.FileName)
+	if key, _ := tx.Bucket(boltObjects).Cursor().Seek(prefix); key != nil && bytes.HasPrefix(key, prefix) {
+		return util.ConflictError{Message: "object " + row.FileName + " already exists"}
+	}
+	if err := putJSON(meta, []byte(row.Uuid), boltRow(row)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltObjects).Put(objectKey(row.Tenant, row.Bucket, row.FileName, row.Uuid), []byte{}); err != nil {
+		return err
+	}
+	if err := putJSON(tx.Bucket(boltTerms), []byte(row.Uuid), util.IndexTerms(row)); err != nil {
+		return err
+	}
+	boltdb.logger.Debugf("Created object %s", row.Uuid)
+	return addUsage(tx, row.Tenant, row.Size, 1)
+}
+
+func (boltdb *BoltDB) RetrieveMetadata(ctx context.Context, uuid string) (util.Row, error) {
+
+	var ret boltRow
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(boltMeta), []byte(uuid), &ret)
+	})
+	if err != nil {
+		return util.Row{}, err
+	}
+	boltdb.logger.Debugf("Row read. Retrieved %+v\n", ret)
+
+	return util.Row(ret), nil
+}
+
+func (boltdb *BoltDB) RetrieveMetadataByName(ctx context.Context, tenant, bucket, name string) (util.Row, error) {
+
+	var ret boltRow
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		prefix := objectKey(tenant, bucket, name)
+		key, _ := tx.Bucket(boltObjects).Cursor().Seek(prefix)
+		if key == nil || !bytes.HasPrefix(key, prefix) {
+			return NotFoundError
+		}
+		return getJSON(tx.Bucket(boltMeta), uuidOf(key), &ret)
+	})
+	if err != nil {
+		return util.Row{}, err
+	}
+
+	return util.Row(ret), nil
+}
+
+func (boltdb *BoltDB) DeleteMetadata(ctx context.Context, uuid string) error {
+
+	return boltdb.batch(ctx, func(tx *bolt.Tx) error {
+		var ret boltRow
+		if err := getJSON(tx.Bucket(boltMeta), []byte(uuid), &ret); err == NotFoundError {
+			boltdb.logger.Errorf("Error: file %s non existing.", uuid)
+			return util.BadRequestError{Message: ("file " + uuid + " does not exist.")}
+		} else if err != nil {
+			return err
+		}
+
+		return deleteRow(tx, util.Row(ret))
+	})
+}
+
+// deleteRow deletes row with its index entries and words, and accounts for its size
+func deleteRow(tx *bolt.Tx, row util.Row) error {
+
+	if err := tx.Bucket(boltMeta).Delete([]byte(row.Uuid)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltObjects).Delete(objectKey(row.Tenant, row.Bucket, row.FileName, row.Uuid)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTerms).Delete([]byte(row.Uuid)); err != nil {
+		return err
+	}
+	return addUsage(tx, row.Tenant, -row.Size, -1)
+}
+
+// ListMetadata scans the objects of tenant, or of the bucket if query has one, then sorts the matching ones.
+// The store has no index by sort key: every page reads all the objects of the scan
+func (boltdb *BoltDB) ListMetadata(ctx context.Context, tenant string, query util.ListQuery) ([]util.Row, error) {
+
+	ret, err := boltdb.scanObjects(ctx, tenant, query)
+	if err != nil {
+		return []util.Row{}, err
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return compareListed(query, util.CursorAfter(query, ret[i]), util.CursorAfter(query, ret[j])) < 0
+	})
+	if query.After != nil {
+		ret = ret[sort.Search(len(ret), func(i int) bool {
+			return compareListed(query, util.CursorAfter(query, ret[i]), *query.After) > 0
+		}):]
+	}
+	if uint(len(ret)) > query.Limit {
+		ret = ret[:query.Limit]
+	}
+
+	return ret, nil
+}
+
+func (boltdb *BoltDB) QueryUsage(ctx context.Context, tenant string, query util.ListQuery) (util.Usage, error) {
+
+	rows, err := boltdb.scanObjects(ctx, tenant, query)
+	if err != nil {
+		return util.Usage{}, err
+	}
+	ret := util.Usage{Objects: int64(len(rows))}
+	for _, row := range rows {
+		ret.Bytes += row.Size
+	}
+	return ret, nil
+}
+
+// scanObjects returns the objects of tenant selected by the filters of query, in index order
+func (boltdb *BoltDB) scanObjects(ctx context.Context, tenant string, query util.ListQuery) ([]util.Row, error) {
+
+	ret := make([]util.Row, 0)
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMeta)
+		prefix := objectKey(tenant)
+		if query.Bucket != nil {
+			prefix = objectKey(tenant, *query.Bucket)
+		}
+		cursor := tx.Bucket(boltObjects).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var row boltRow
+			if err := getJSON(meta, uuidOf(key), &row); err != nil {
+				return err
+			}
+			if matchListQuery(query, util.Row(row)) {
+				ret = append(ret, util.Row(row))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SearchMetadata scans the objects of tenant with their words, then ranks the matching ones.
+// The store has no inverted index: every page reads all the objects of the tenant
+func (boltdb *BoltDB) SearchMetadata(ctx context.Context, tenant string, query util.SearchQuery) ([]util.SearchHit, error) {
+
+	ret := make([]util.SearchHit, 0)
+	err := boltdb.scanTerms(ctx, tenant, func(row util.Row, terms []util.SearchTerm) {
+		if query.Expr.Match(row, terms) {
+			hit := util.SearchHit{Row: row, Score: query.Expr.Score(terms)}
+			if query.After == nil || query.After.Precedes(hit) {
+				ret = append(ret, hit)
+			}
+		}
+	})
+	if err != nil {
+		return []util.SearchHit{}, err
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Score > ret[j].Score || (ret[i].Score == ret[j].Score && ret[i].Uuid < ret[j].Uuid)
+	})
+	if uint(len(ret)) > query.Limit {
+		ret = ret[:query.Limit]
+	}
+	return ret, nil
+}
+
+func (boltdb *BoltDB) SearchFacets(ctx context.Context, tenant string, expr util.SearchExpr) (util.SearchFacets, error) {
+
+	ret := util.SearchFacets{ContentTypes: make(map[string]int64), Buckets: make(map[string]int64)}
+	err := boltdb.scanTerms(ctx, tenant, func(row util.Row, terms []util.SearchTerm) {
+		if expr.Match(row, terms) {
+			ret.ContentTypes[row.ContentType]++
+			ret.Buckets[row.Bucket]++
+		}
+	})
+	if err != nil {
+		return util.SearchFacets{}, err
+	}
+	return ret, nil
+}
+
+// scanTerms calls fn with every object of tenant and its words in the index
+func (boltdb *BoltDB) scanTerms(ctx context.Context, tenant string, fn func(row util.Row, terms []util.SearchTerm)) error {
+
+	return boltdb.view(ctx, func(tx *bolt.Tx) error {
+		meta, index := tx.Bucket(boltMeta), tx.Bucket(boltTerms)
+		prefix := objectKey(tenant)
+		cursor := tx.Bucket(boltObjects).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var row boltRow
+			if err := getJSON(meta, uuidOf(key), &row); err != nil {
+				return err
+			}
+			var terms []util.SearchTerm
+			if err := getJSON(index, uuidOf(key), &terms); err != nil && err != NotFoundError {
+				return err
+			}
+			fn(util.Row(row), terms)
+		}
+		return nil
+	})
+}
+
+func (boltdb *BoltDB) IndexContent(ctx context.Context, tenant string, uuid string, terms []util.SearchTerm) error {
+
+	return boltdb.batch(ctx, func(tx *bolt.Tx) error {
+		index := tx.Bucket(boltTerms)
+		var indexed []util.SearchTerm
+		if err := getJSON(index, []byte(uuid), &indexed); err != nil && err != NotFoundError {
+			return err
+		}
+		kept := make([]util.SearchTerm, 0, len(indexed)+len(terms))
+		for _, term := range indexed {
+			if term.Field != util.SearchContent {
+				kept = append(kept, term)
+			}
+		}
+		return putJSON(index, []byte(uuid), append(kept, terms...))
+	})
+}
+
+// ReindexMetadata rewrites the words of names and tags of every object in a single transaction.
+// Words of the content are kept
+func (boltdb *BoltDB) ReindexMetadata(ctx context.Context) (int, error) {
+
+	count := 0
+	err := boltdb.update(ctx, func(tx *bolt.Tx) error {
+		index := tx.Bucket(boltTerms)
+		return tx.Bucket(boltMeta).ForEach(func(key, value []byte) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var row boltRow
+			if err := getJSON(tx.Bucket(boltMeta), key, &row); err != nil {
+				return err
+			}
+			var indexed []util.SearchTerm
+			if err := getJSON(index, key, &indexed); err != nil && err != NotFoundError {
+				return err
+			}
+			terms := util.IndexTerms(util.Row(row))
+			for _, term := range indexed {
+				if term.Field == util.SearchContent {
+					terms = append(terms, term)
+				}
+			}
+			count++
+			return putJSON(index, key, terms)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (boltdb *BoltDB) TenantUsage(ctx context.Context, tenant string) (util.Usage, error) {
+
+	var ret util.Usage
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		if value := tx.Bucket(boltUsage).Get(objectKey(tenant)); value != nil {
+			return json.Unmarshal(value, &ret)
+		}
+		return nil
+	})
+	if err != nil {
+		return util.Usage{}, err
+	}
+	boltdb.logger.Debugf("Tenant %s usage: %+v", tenant, ret)
+
+	return ret, nil
+}
+
+func (boltdb *BoltDB) TotalUsage(ctx context.Context) (util.Usage, error) {
+
+	var ret util.Usage
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsage).ForEach(func(_, value []byte) error {
+			var usage util.Usage
+			if err := json.Unmarshal(value, &usage); err != nil {
+				return err
+			}
+			ret.Bytes += usage.Bytes
+			ret.Objects += usage.Objects
+			return nil
+		})
+	})
+	if err != nil {
+		return util.Usage{}, err
+	}
+
+	return ret, nil
+}
+
+func (boltdb *BoltDB) InsertBucket(ctx context.Context, bucket util.Bucket) error {
+
+	return boltdb.update(ctx, func(tx *bolt.Tx) error {
+		buckets := tx.Bucket(boltBuckets)
+		key := objectKey(bucket.Tenant, bucket.Name)
+		if buckets.Get(key) != nil {
+			return util.ConflictError{Message: "bucket " + bucket.Name + " already exists"}
+		}
+		// Policies are attached by SetBucketPolicy only
+		bucket.Policy = ""
+		boltdb.logger.Debugf("Created bucket %s", bucket.Name)
+		return putJSON(buckets, key, boltBucket(bucket))
+	})
+}
+
+func (boltdb *BoltDB) RetrieveBucket(ctx context.Context, tenant string, name string) (util.Bucket, error) {
+
+	var ret boltBucket
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		return getJSON(tx.Bucket(boltBuckets), objectKey(tenant, name), &ret)
+	})
+	if err != nil {
+		return util.Bucket{}, err
+	}
+
+	return util.Bucket(ret), nil
+}
+
+func (boltdb *BoltDB) SetBucketPolicy(ctx context.Context, tenant string, name string, policy string) error {
+
+	return boltdb.update(ctx, func(tx *bolt.Tx) error {
+		buckets := tx.Bucket(boltBuckets)
+		var bucket boltBucket
+		if err := getJSON(buckets, objectKey(tenant, name), &bucket); err != nil {
+			return err
+		}
+		bucket.Policy = policy
+		return putJSON(buckets, objectKey(tenant, name), bucket)
+	})
+}
+
+func (boltdb *BoltDB) InsertAuditRecord(ctx context.Context, record util.AuditRecord) error {
+
+	return boltdb.update(ctx, func(tx *bolt.Tx) error {
+		audit := tx.Bucket(boltAudit)
+		key := seqKey(record.Seq)
+		if audit.Get(key) != nil {
+			return fmt.Errorf("audit record %d already exists", record.Seq)
+		}
+		return putJSON(audit, key, record)
+	})
+}
+
+func (boltdb *BoltDB) LastAuditRecord(ctx context.Context) (util.AuditRecord, error) {
+
+	var ret util.AuditRecord
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		_, value := tx.Bucket(boltAudit).Cursor().Last()
+		if value == nil {
+			return NotFoundError
+		}
+		return json.Unmarshal(value, &ret)
+	})
+	if err != nil {
+		return util.AuditRecord{}, err
+	}
+
+	return ret, nil
+}
+
+func (boltdb *BoltDB) ListAuditRecords(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
+
+	ret := make([]util.AuditRecord, 0)
+	err := boltdb.view(ctx, func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(boltAudit).Cursor()
+		var skipped uint
+		for key, value := cursor.First(); key != nil && uint(len(ret)) < limit; key, value = cursor.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var record util.AuditRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if !matchAuditRecord(filter, record) {
+				continue
+			}
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			ret = append(ret, record)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (boltdb *BoltDB) Ping(ctx context.Context) error {
+	return boltdb.view(ctx, func(*bolt.Tx) error { return nil })
+}
+
+func (boltdb *BoltDB) Close() error {
+	boltdb.mu.Lock()
+	defer boltdb.mu.Unlock()
+	if boltdb.db == nil {
+		return nil
+	}
+	err := boltdb.db.Close()
+	boltdb.db = nil
+	return err
+}
+
+//============
+// Miscellanea
+//============
+
+func matchAuditRecord(filter util.AuditFilter, r util.AuditRecord) bool {
+	return (filter.Tenant == nil || r.Tenant == *filter.Tenant) &&
+		(filter.Principal == "" || r.Principal == filter.Principal) &&
+		(filter.Action == "" || r.Action == filter.Action) &&
+		(filter.Object == "" || r.Object == filter.Object) &&
+		(filter.From == "" || r.Time >= filter.From) &&
+		(filter.To == "" || r.Time < filter.To)
+}
+
+func matchListQuery(query util.ListQuery, r util.Row) bool {
+	for key, value := range query.Tags {
+		if tag, ok := r.Tags[key]; !ok || tag != value {
+			return false
+		}
+	}
+	return strings.HasPrefix(r.FileName, query.Prefix) &&
+		(query.Bucket == nil || r.Bucket == *query.Bucket) &&
+		(query.MinSize == nil || r.Size >= *query.MinSize) &&
+		(query.MaxSize == nil || r.Size <= *query.MaxSize) &&
+		(query.CreatedFrom == "" || r.CreatedAt >= query.CreatedFrom) &&
+		(query.CreatedTo == "" || r.CreatedAt < query.CreatedTo) &&
+		(query.ContentType == "" || r.ContentType == query.ContentType)
+}
+
+// compareListed compares two positions in the listing sorted as query: by sort key, then by uuid.
+// Negative if a comes first
+func compareListed(query util.ListQuery, a, b util.ListCursor) int {
+	c := 0
+	switch query.Sort {
+	case util.SortBySize:
+		if a.Size < b.Size {
+			c = -1
+		} else if a.Size > b.Size {
+			c = 1
+		}
+	case util.SortByCreated:
+		c = strings.Compare(a.Created, b.Created)
+	default:
+		c = strings.Compare(a.Name, b.Name)
+	}
+	if c == 0 {
+		c = strings.Compare(a.Uuid, b.Uuid)
+	}
+	if query.Desc {
+		return -c
+	}
+	return c
+}
+
+// addUsage adds bytes and objects to the usage of tenant
+func addUsage(tx *bolt.Tx, tenant string, bytes int64, objects int64) error {
+	usages := tx.Bucket(boltUsage)
+	var usage util.Usage
+	if value := usages.Get(objectKey(tenant)); value != nil {
+		if err := json.Unmarshal(value, &usage); err != nil {
+			return err
+		}
+	}
+	usage.Bytes += bytes
+	usage.Objects += objects
+	return putJSON(usages, objectKey(tenant), usage)
+}
+
+// objectKey joins the parts of a key of the objects index. Every part is terminated,
+// so that a key made of the first parts only is the prefix of the keys under it
+func objectKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "\x00") + "\x00")
+}
+
+// uuidOf returns the uuid, last part of a key of the objects index
+func uuidOf(key []byte) []byte {
+	key = key[:len(key)-1]
+	return key[bytes.LastIndexByte(key, 0)+1:]
+}
+
+// Big endian, so that keys sort as numbers
+func seqKey(seq int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(seq))
+	return key
+}
+
+// getJSON decodes the value of key into v. Throws NotFoundError if key doesn't exist
+func getJSON(bucket *bolt.Bucket, key []byte, v any) error {
+	value := bucket.Get(key)
+	if value == nil {
+		return NotFoundError
+	}
+	return json.Unmarshal(value, v)
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, v any) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(key, value)
+}
@@ -0,0 +1,89 @@
+package base
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/erizzardi/storage/util"
+	bolt "go.etcd.io/bbolt"
+)
+
+//
+// This test inserts objects of two tenants, then deletes one.
+// Pass if lookups by name, listings and usage follow, and the deleted object is gone from all of them.
+func TestBoltIndexes(t *testing.T) {
+
+	ctx := context.Background()
+	store := NewBoltDatabase(testLogger)
+	if err := store.Connect("bbolt", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := []util.Row{
+		{Uuid: "1", FileName: "b", Bucket: "photos", Size: 10, Tenant: "acme"},
+		{Uuid: "2", FileName: "a", Bucket: "photos", Size: 20, Tenant: "acme"},
+		{Uuid: "3", FileName: "a", Bucket: "photos", Size: 40, Tenant: "globex"},
+	}
+	for _, row := range rows {
+		if err := store.InsertMetadata(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if row, err := store.RetrieveMetadataByName(ctx, "acme", "photos", "a"); err != nil || !reflect.DeepEqual(row, rows[1]) {
+		t.Errorf("Wrong object by name: %+v, %v", row, err)
+	}
+	after := util.CursorAfter(util.ListQuery{Sort: util.SortByName}, rows[1])
+	if list, err := store.ListMetadata(ctx, "acme", util.ListQuery{Sort: util.SortByName, Limit: 10, After: &after}); err != nil || len(list) != 1 || !reflect.DeepEqual(list[0], rows[0]) {
+		t.Errorf("Wrong listing, expected the second object sorted by name: %+v, %v", list, err)
+	}
+	if usage, _ := store.TotalUsage(ctx); usage != (util.Usage{Bytes: 70, Objects: 3}) {
+		t.Errorf("Wrong total usage: %+v", usage)
+	}
+
+	if err := store.DeleteMetadata(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RetrieveMetadataByName(ctx, "acme", "photos", "a"); err != NotFoundError {
+		t.Errorf("Deleted object found by name: %v", err)
+	}
+	if usage, _ := store.TenantUsage(ctx, "acme"); usage != (util.Usage{Bytes: 10, Objects: 1}) {
+		t.Errorf("Wrong tenant usage after delete: %+v", usage)
+	}
+}
+
+//
+// This test initializes a store holding a bucket keyed by name only, as stored by the releases before tenant keys.
+// Pass if the bucket is found in its tenant.
+func TestBoltLegacyBuckets(t *testing.T) {
+
+	ctx := context.Background()
+	store := NewBoltDatabase(testLogger).(*BoltDB)
+	if err := store.Connect("bbolt", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err := store.update(ctx, func(tx *bolt.Tx) error {
+		legacy, err := tx.CreateBucket(boltLegacyBuckets)
+		if err != nil {
+			return err
+		}
+		return putJSON(legacy, []byte("logs"), boltBucket{Name: "logs", Owner: "alice", Tenant: "acme"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if bucket, err := store.RetrieveBucket(ctx, "acme", "logs"); err != nil || bucket.Owner != "alice" {
+		t.Errorf("Bucket not moved: %+v, %v", bucket, err)
+	}
+}
@@ -1,22 +1,26 @@
 package base
 
 import (
+	"context"
 	"database/sql"
 
 	"github.com/erizzardi/storage/util"
 )
 
 // Interface for database connection and operations.
-// Implementation for sql database: sql.go
+// Implementation for sql database: sql.go.
+// Operations take the context of the request: they are abandoned when it's canceled.
+// DB has unexported methods, thus its decorators (instrumented, resilient, traced) live in this package
 type DB interface {
 	//
 	//
-	// Enstablishes connection to the database
+	// Enstablishes connection to the database.
+	// Can be called again to reconnect, e.g. with rotated credentials
 	Connect(driver string, dsl string) error
 	//
 	//
 	// Creates the table in the database
-	Init() error
+	Init(ctx context.Context) error
 	//
 	//
 	// Drops tables created by Init().
@@ -24,30 +28,109 @@ type DB interface {
 	tearDown() error
 	//
 	//
-	// Prepares and executes 'statement' operation.
+	// Executes 'statement' operation, prepared if it's one of the queries of the DB.
 	// Use with INSERT, CREATE, DELETE statements
-	Exec(statement string, params ...any) (sql.Result, error)
+	ExecContext(ctx context.Context, statement string, params ...any) (sql.Result, error)
 	//
 	//
-	// Prepares and executes 'statement' operation.
+	// Executes 'statement' operation, prepared if it's one of the queries of the DB.
 	// Use with SELECT statements
-	Query(statement string, params ...any) (*sql.Rows, error)
+	QueryContext(ctx context.Context, statement string, params ...any) (*sql.Rows, error)
 	//
 	//
-	// Inserts row in the database
-	InsertMetadata(row util.Row) error
+	// Inserts row in the database. Throws ConflictError if an object with the same name exists in the bucket
+	InsertMetadata(ctx context.Context, row util.Row) error
 	//
 	//
-	// Queries the metadata database for selected row. Throws an error if entry doesn't exist
-	RetrieveMetadata(key, value string) (util.Row, error)
+	// Replaces the object with ID uuid by row, atomically. Throws NotFoundError if it doesn't exist anymore
+	ReplaceMetadata(ctx context.Context, uuid string, row util.Row) error
 	//
 	//
-	// Deletes row in database
-	DeleteMetadata(key, value string) error
+	// Moves the object with ID row.Uuid to the bucket and name of row, deleting the object with ID replaced if not empty,
+	// atomically. Throws NotFoundError if either doesn't exist anymore, ConflictError if the name is taken
+	MoveMetadata(ctx context.Context, row util.Row, replaced string) error
 	//
 	//
-	// Select * from table, paged
-	ListAllPaged(limit uint, offset uint) ([]util.Row, error)
+	// Replaces the tags of the object row by tags, if they are still row.Tags.
+	// Throws NotFoundError if the object doesn't exist anymore, or its tags changed
+	UpdateTags(ctx context.Context, row util.Row, tags map[string]string) error
+	//
+	//
+	// Queries the metadata database for the object with ID uuid. Throws NotFoundError if it doesn't exist
+	RetrieveMetadata(ctx context.Context, uuid string) (util.Row, error)
+	//
+	//
+	// Queries the metadata database for the object named name in bucket, owned by tenant.
+	// Throws NotFoundError if it doesn't exist
+	RetrieveMetadataByName(ctx context.Context, tenant, bucket, name string) (util.Row, error)
+	//
+	//
+	// Deletes the metadata of the object with ID uuid. Throws BadRequestError if it doesn't exist
+	DeleteMetadata(ctx context.Context, uuid string) error
+	//
+	//
+	// Lists the objects of tenant selected by query, sorted by its key then by uuid.
+	// Returns at most query.Limit objects, following query.After
+	ListMetadata(ctx context.Context, tenant string, query util.ListQuery) ([]util.Row, error)
+	//
+	//
+	// Returns bytes and number of the objects of tenant selected by the filters of query
+	QueryUsage(ctx context.Context, tenant string, query util.ListQuery) (util.Usage, error)
+	//
+	//
+	// Returns the objects of tenant matching query.Expr, ranked by decreasing score then by uuid.
+	// Returns at most query.Limit objects, following query.After
+	SearchMetadata(ctx context.Context, tenant string, query util.SearchQuery) ([]util.SearchHit, error)
+	//
+	//
+	// Counts the objects of tenant matching expr by content type and by bucket
+	SearchFacets(ctx context.Context, tenant string, expr util.SearchExpr) (util.SearchFacets, error)
+	//
+	//
+	// Replaces the words of the content of the object with ID uuid in the search index.
+	// Words of name and tags are indexed by InsertMetadata
+	IndexContent(ctx context.Context, tenant string, uuid string, terms []util.SearchTerm) error
+	//
+	//
+	// Rebuilds the words of names and tags in the search index, for the objects stored before it existed.
+	// Returns the number of objects reindexed
+	ReindexMetadata(ctx context.Context) (int, error)
+	//
+	//
+	// Returns bytes and number of objects stored by tenant
+	TenantUsage(ctx context.Context, tenant string) (util.Usage, error)
+	//
+	//
+	// Returns bytes and number of objects stored by all tenants
+	TotalUsage(ctx context.Context) (util.Usage, error)
+	//
+	//
+	// Inserts bucket in the database. Throws ConflictError if the tenant has a bucket with the same name
+	InsertBucket(ctx context.Context, bucket util.Bucket) error
+	//
+	//
+	// Queries the bucket table by tenant and name. Throws NotFoundError if the bucket doesn't exist
+	RetrieveBucket(ctx context.Context, tenant string, name string) (util.Bucket, error)
+	//
+	//
+	// Attaches the policy document to the bucket of tenant. An empty document detaches the policy
+	SetBucketPolicy(ctx context.Context, tenant string, name string, policy string) error
+	//
+	//
+	// Appends a record to the audit log
+	InsertAuditRecord(ctx context.Context, record util.AuditRecord) error
+	//
+	//
+	// Returns the last record of the audit log. Throws NotFoundError if the log is empty
+	LastAuditRecord(ctx context.Context) (util.AuditRecord, error)
+	//
+	//
+	// Queries the audit log, ordered by sequence number, paged
+	ListAuditRecords(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error)
+	//
+	//
+	// Checks that the database is reachable
+	Ping(ctx context.Context) error
 	//
 	//
 	// Wrapper for db.Close()
@@ -0,0 +1,264 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+// dialect isolates the differences between SQL databases, so that SqlDB writes every statement once.
+// Statements are written with postgres placeholders ($1, $2, ...). The schema is in per-dialect migration scripts
+type dialect interface {
+	//
+	//
+	// Name of the database/sql driver
+	driverName() string
+	//
+	//
+	// Directory of the migration scripts, under migrations/
+	migrationsDir() string
+	//
+	//
+	// Whether schema changes can be rolled back, so that a migration is applied in one transaction
+	transactionalDDL() bool
+	//
+	//
+	// Takes the lock serializing migrations across replicas, on conn. Blocks until taken or ctx is done
+	lockMigrations(ctx context.Context, conn *sql.Conn) error
+	//
+	//
+	// Releases the lock taken by lockMigrations
+	unlockMigrations(ctx context.Context, conn *sql.Conn) error
+	//
+	//
+	// Rewrites the placeholders of statement, returning the parameters in the order they are bound
+	bind(statement string, params []any) (string, []any)
+	//
+	//
+	// Rewrites the placeholders of statement without parameters: the text bind returns, to prepare the statement
+	placeholders(statement string) string
+	//
+	//
+	// Paging clause, with placeholders $n for the limit and $n+1 for the offset
+	limitOffset(n int) string
+	//
+	//
+	// Inserts columns into table, affecting no rows if a row with the same key exists. key lists its columns, comma separated
+	insertIgnore(table string, columns []string, key string) string
+	//
+	//
+	// Whether err is the violation of a primary key or unique index
+	duplicateKey(err error) bool
+}
+
+// standardDialect implements what most databases have in common. Embedded by the actual dialects
+type standardDialect struct{}
+
+func (standardDialect) transactionalDDL() bool { return true }
+
+func (standardDialect) bind(statement string, params []any) (string, []any) {
+	return statement, params
+}
+
+func (standardDialect) placeholders(statement string) string {
+	return statement
+}
+
+func (standardDialect) limitOffset(n int) string {
+	return fmt.Sprintf(" LIMIT $%d OFFSET $%d", n, n+1)
+}
+
+func (standardDialect) insertIgnore(table string, columns []string, key string) string {
+	return insertStatement(table, columns) + " ON CONFLICT (" + key + ") DO NOTHING"
+}
+
+// Key of the postgres advisory lock taken by migrations
+const migrationLockKey = 4_224_001
+
+// Name of the MySQL lock taken by migrations
+const migrationLockName = "storage.schema_migrations"
+
+type postgresDialect struct{ standardDialect }
+
+func (postgresDialect) driverName() string { return "postgres" }
+
+func (postgresDialect) migrationsDir() string { return "postgres" }
+
+func (postgresDialect) lockMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	return err
+}
+
+func (postgresDialect) unlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	return err
+}
+
+// unique_violation, of cockroach too
+func (postgresDialect) duplicateKey(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// CockroachDB speaks the postgres protocol and dialect, but has no advisory locks
+type cockroachDialect struct{ postgresDialect }
+
+func (d cockroachDialect) lockMigrations(ctx context.Context, conn *sql.Conn) error {
+	return leaseLock(ctx, conn, d)
+}
+
+func (cockroachDialect) unlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	return leaseUnlock(ctx, conn)
+}
+
+type sqliteDialect struct{ standardDialect }
+
+func (sqliteDialect) driverName() string { return "sqlite" }
+
+func (sqliteDialect) migrationsDir() string { return "sqlite" }
+
+func (d sqliteDialect) lockMigrations(ctx context.Context, conn *sql.Conn) error {
+	return leaseLock(ctx, conn, d)
+}
+
+func (sqliteDialect) unlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	return leaseUnlock(ctx, conn)
+}
+
+// SQLITE_CONSTRAINT_PRIMARYKEY, SQLITE_CONSTRAINT_UNIQUE
+func (sqliteDialect) duplicateKey(err error) bool {
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code() == 1555 || sqliteErr.Code() == 2067)
+}
+
+// MySQL and MariaDB
+type mysqlDialect struct{ standardDialect }
+
+func (mysqlDialect) driverName() string { return "mysql" }
+
+func (mysqlDialect) migrationsDir() string { return "mysql" }
+
+// DDL statements commit implicitly
+func (mysqlDialect) transactionalDDL() bool { return false }
+
+func (mysqlDialect) lockMigrations(ctx context.Context, conn *sql.Conn) error {
+	var taken sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, -1)", migrationLockName).Scan(&taken); err != nil {
+		return err
+	}
+	if taken.Int64 != 1 {
+		return fmt.Errorf("cannot take lock %s", migrationLockName)
+	}
+	return nil
+}
+
+func (mysqlDialect) unlockMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLockName)
+	return err
+}
+
+// ER_DUP_ENTRY
+func (mysqlDialect) duplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// MySQL has ? placeholders, bound in order of appearance
+func (mysqlDialect) bind(statement string, params []any) (string, []any) {
+	bound := make([]any, 0, len(params))
+	statement = mysqlPlaceholders(statement, func(n int) bool {
+		if n > len(params) {
+			return false
+		}
+		bound = append(bound, params[n-1])
+		return true
+	})
+	return statement, bound
+}
+
+func (mysqlDialect) placeholders(statement string) string {
+	return mysqlPlaceholders(statement, func(int) bool { return true })
+}
+
+// mysqlPlaceholders replaces with ? every placeholder $n of statement for which bound(n) is true
+func mysqlPlaceholders(statement string, bound func(n int) bool) string {
+	var b strings.Builder
+	for i := 0; i < len(statement); i++ {
+		if statement[i] != '$' {
+			b.WriteByte(statement[i])
+			continue
+		}
+		j := i + 1
+		for j < len(statement) && statement[j] >= '0' && statement[j] <= '9' {
+			j++
+		}
+		n, err := strconv.Atoi(statement[i+1 : j])
+		if err != nil || n < 1 || !bound(n) {
+			b.WriteByte('$')
+			continue
+		}
+		b.WriteByte('?')
+		i = j - 1
+	}
+	return b.String()
+}
+
+// Updating a column of the key to itself affects no rows
+func (mysqlDialect) insertIgnore(table string, columns []string, key string) string {
+	column, _, _ := strings.Cut(key, ",")
+	return insertStatement(table, columns) + " ON DUPLICATE KEY UPDATE " + column + " = " + column
+}
+
+// Validity of the lease lock, after which it is considered abandoned by a dead replica
+const migrationLockTTL = 10 * time.Minute
+
+// leaseLock is the migration lock of the databases without advisory locks: the row of schema_migrations_lock,
+// inserted by the holder
+func leaseLock(ctx context.Context, conn *sql.Conn, d dialect) error {
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations_lock (id integer PRIMARY KEY, expires bigint NOT NULL)"); err != nil {
+		return err
+	}
+	insert := d.insertIgnore("schema_migrations_lock", []string{"id", "expires"}, "id")
+	for {
+		now := time.Now()
+		if _, err := conn.ExecContext(ctx, "DELETE FROM schema_migrations_lock WHERE id = 1 AND expires < $1", now.Unix()); err != nil {
+			return err
+		}
+		res, err := conn.ExecContext(ctx, insert, 1, now.Add(migrationLockTTL).Unix())
+		if err != nil {
+			return err
+		}
+		if taken, err := res.RowsAffected(); err != nil {
+			return err
+		} else if taken == 1 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func leaseUnlock(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "DELETE FROM schema_migrations_lock WHERE id = 1")
+	return err
+}
+
+// insertStatement returns INSERT INTO table (columns) VALUES ($1, ...)
+func insertStatement(table string, columns []string) string {
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")"
+}
@@ -0,0 +1,26 @@
+package base
+
+import (
+	"reflect"
+	"testing"
+)
+
+//
+// This test binds a statement with repeated and unordered placeholders to MySQL, with parameters and without.
+// Pass if every placeholder is ? and parameters follow the order of appearance, and the text is the same without parameters.
+func TestMysqlBind(t *testing.T) {
+
+	statement, params := mysqlDialect{}.bind("SELECT a FROM t WHERE b = $2 AND c = $1 OR d = $2 AND e = $x", []any{"one", "two"})
+	if statement != "SELECT a FROM t WHERE b = ? AND c = ? OR d = ? AND e = $x" {
+		t.Error("Statement not bound: " + statement)
+	}
+	if !reflect.DeepEqual(params, []any{"two", "one", "two"}) {
+		t.Errorf("Parameters not matching: %v", params)
+	}
+	if placeholders := (mysqlDialect{}).placeholders("SELECT a FROM t WHERE b = $2 AND c = $1 OR d = $2 AND e = $x"); placeholders != statement {
+		t.Error("Placeholders not rewritten without parameters: " + placeholders)
+	}
+	if statement, params := (mysqlDialect{}).bind("SELECT a FROM t WHERE b = $1", nil); statement != "SELECT a FROM t WHERE b = $1" || len(params) != 0 {
+		t.Errorf("Unbound placeholder rewritten: %s %v", statement, params)
+	}
+}
@@ -3,3 +3,9 @@ package base
 import "errors"
 
 var NotFoundError = errors.New("element not found")
+
+// Returned by ResilientDB without calling the database
+var CircuitOpenError = errors.New("database unavailable, circuit breaker open")
+
+// Returned by ResilientDB when an attempt exceeds its timeout, wrapping the error of the canceled call
+var TimeoutError = errors.New("database call timed out")
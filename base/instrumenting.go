@@ -0,0 +1,164 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+	"github.com/go-kit/kit/metrics"
+)
+
+// instrumentedDB decorates a DB, observing the latency of every method.
+type instrumentedDB struct {
+	next     DB
+	duration metrics.Histogram
+}
+
+// NewInstrumentedDB returns a DB that observes the latency of every call to next,
+// labeled with the name of the method
+func NewInstrumentedDB(next DB, duration metrics.Histogram) DB {
+	return &instrumentedDB{next: next, duration: duration}
+}
+
+func (db *instrumentedDB) observe(method string, begin time.Time) {
+	db.duration.With("method", method).Observe(time.Since(begin).Seconds())
+}
+
+func (db *instrumentedDB) Connect(driver string, dsn string) error {
+	defer db.observe("Connect", time.Now())
+	return db.next.Connect(driver, dsn)
+}
+
+func (db *instrumentedDB) Init(ctx context.Context) error {
+	defer db.observe("Init", time.Now())
+	return db.next.Init(ctx)
+}
+
+func (db *instrumentedDB) tearDown() error {
+	return db.next.tearDown()
+}
+
+func (db *instrumentedDB) ExecContext(ctx context.Context, statement string, params ...any) (sql.Result, error) {
+	defer db.observe("ExecContext", time.Now())
+	return db.next.ExecContext(ctx, statement, params...)
+}
+
+func (db *instrumentedDB) QueryContext(ctx context.Context, statement string, params ...any) (*sql.Rows, error) {
+	defer db.observe("QueryContext", time.Now())
+	return db.next.QueryContext(ctx, statement, params...)
+}
+
+func (db *instrumentedDB) InsertMetadata(ctx context.Context, row util.Row) error {
+	defer db.observe("InsertMetadata", time.Now())
+	return db.next.InsertMetadata(ctx, row)
+}
+
+func (db *instrumentedDB) ReplaceMetadata(ctx context.Context, uuid string, row util.Row) error {
+	defer db.observe("ReplaceMetadata", time.Now())
+	return db.next.ReplaceMetadata(ctx, uuid, row)
+}
+
+func (db *instrumentedDB) MoveMetadata(ctx context.Context, row util.Row, replaced string) error {
+	defer db.observe("MoveMetadata", time.Now())
+	return db.next.MoveMetadata(ctx, row, replaced)
+}
+
+func (db *instrumentedDB) UpdateTags(ctx context.Context, row util.Row, tags map[string]string) error {
+	defer db.observe("UpdateTags", time.Now())
+	return db.next.UpdateTags(ctx, row, tags)
+}
+
+func (db *instrumentedDB) RetrieveMetadata(ctx context.Context, uuid string) (util.Row, error) {
+	defer db.observe("RetrieveMetadata", time.Now())
+	return db.next.RetrieveMetadata(ctx, uuid)
+}
+
+func (db *instrumentedDB) RetrieveMetadataByName(ctx context.Context, tenant, bucket, name string) (util.Row, error) {
+	defer db.observe("RetrieveMetadataByName", time.Now())
+	return db.next.RetrieveMetadataByName(ctx, tenant, bucket, name)
+}
+
+func (db *instrumentedDB) DeleteMetadata(ctx context.Context, uuid string) error {
+	defer db.observe("DeleteMetadata", time.Now())
+	return db.next.DeleteMetadata(ctx, uuid)
+}
+
+func (db *instrumentedDB) ListMetadata(ctx context.Context, tenant string, query util.ListQuery) ([]util.Row, error) {
+	defer db.observe("ListMetadata", time.Now())
+	return db.next.ListMetadata(ctx, tenant, query)
+}
+
+func (db *instrumentedDB) QueryUsage(ctx context.Context, tenant string, query util.ListQuery) (util.Usage, error) {
+	defer db.observe("QueryUsage", time.Now())
+	return db.next.QueryUsage(ctx, tenant, query)
+}
+
+func (db *instrumentedDB) SearchMetadata(ctx context.Context, tenant string, query util.SearchQuery) ([]util.SearchHit, error) {
+	defer db.observe("SearchMetadata", time.Now())
+	return db.next.SearchMetadata(ctx, tenant, query)
+}
+
+func (db *instrumentedDB) SearchFacets(ctx context.Context, tenant string, expr util.SearchExpr) (util.SearchFacets, error) {
+	defer db.observe("SearchFacets", time.Now())
+	return db.next.SearchFacets(ctx, tenant, expr)
+}
+
+func (db *instrumentedDB) IndexContent(ctx context.Context, tenant string, uuid string, terms []util.SearchTerm) error {
+	defer db.observe("IndexContent", time.Now())
+	return db.next.IndexContent(ctx, tenant, uuid, terms)
+}
+
+func (db *instrumentedDB) ReindexMetadata(ctx context.Context) (int, error) {
+	defer db.observe("ReindexMetadata", time.Now())
+	return db.next.ReindexMetadata(ctx)
+}
+
+func (db *instrumentedDB) TenantUsage(ctx context.Context, tenant string) (util.Usage, error) {
+	defer db.observe("TenantUsage", time.Now())
+	return db.next.TenantUsage(ctx, tenant)
+}
+
+func (db *instrumentedDB) TotalUsage(ctx context.Context) (util.Usage, error) {
+	defer db.observe("TotalUsage", time.Now())
+	return db.next.TotalUsage(ctx)
+}
+
+func (db *instrumentedDB) InsertBucket(ctx context.Context, bucket util.Bucket) error {
+	defer db.observe("InsertBucket", time.Now())
+	return db.next.InsertBucket(ctx, bucket)
+}
+
+func (db *instrumentedDB) RetrieveBucket(ctx context.Context, tenant string, name string) (util.Bucket, error) {
+	defer db.observe("RetrieveBucket", time.Now())
+	return db.next.RetrieveBucket(ctx, tenant, name)
+}
+
+func (db *instrumentedDB) SetBucketPolicy(ctx context.Context, tenant string, name string, policy string) error {
+	defer db.observe("SetBucketPolicy", time.Now())
+	return db.next.SetBucketPolicy(ctx, tenant, name, policy)
+}
+
+func (db *instrumentedDB) InsertAuditRecord(ctx context.Context, record util.AuditRecord) error {
+	defer db.observe("InsertAuditRecord", time.Now())
+	return db.next.InsertAuditRecord(ctx, record)
+}
+
+func (db *instrumentedDB) LastAuditRecord(ctx context.Context) (util.AuditRecord, error) {
+	defer db.observe("LastAuditRecord", time.Now())
+	return db.next.LastAuditRecord(ctx)
+}
+
+func (db *instrumentedDB) ListAuditRecords(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
+	defer db.observe("ListAuditRecords", time.Now())
+	return db.next.ListAuditRecords(ctx, filter, limit, offset)
+}
+
+func (db *instrumentedDB) Ping(ctx context.Context) error {
+	defer db.observe("Ping", time.Now())
+	return db.next.Ping(ctx)
+}
+
+func (db *instrumentedDB) Close() error {
+	return db.next.Close()
+}
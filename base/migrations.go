@@ -0,0 +1,335 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration scripts, migrations/<dialect>/<version>_<name>.up.sql and .down.sql.
+// Versions start from 1 and have no gaps
+//
+//go:embed migrations
+var migrationScripts embed.FS
+
+// Table of the applied migrations, one row per version
+const schemaMigrationsTable = "schema_migrations"
+
+// ALTER TABLE <table> ADD COLUMN IF NOT EXISTS <column> ..., which MySQL and SQLite lack.
+// The runner checks the column itself, and drops IF NOT EXISTS
+var addColumnIfNotExists = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+(\w+)\s+ADD\s+COLUMN\s+IF\s+NOT\s+EXISTS\s+(\w+)\s`)
+
+var ifNotExists = regexp.MustCompile(`(?i)\s+IF\s+NOT\s+EXISTS`)
+
+// Migration is a versioned change of the schema, with the statements applying and reverting it
+type Migration struct {
+	Version int
+	Name    string
+	up      []string
+	down    []string
+}
+
+// MigrationStatus is a migration, and when it was applied. AppliedAt is empty if it's pending
+type MigrationStatus struct {
+	Version   int    `json:"version"`
+	Name      string `json:"name"`
+	AppliedAt string `json:"appliedAt,omitempty"`
+}
+
+// Migrator is implemented by the DBs whose schema is versioned.
+// Migrations are serialized across replicas by a lock held in the database
+type Migrator interface {
+	//
+	//
+	// Applies the pending migrations, in order. Returns the ones applied
+	MigrateUp(ctx context.Context) ([]MigrationStatus, error)
+	//
+	//
+	// Reverts the last steps applied migrations, in reverse order. Returns the ones reverted
+	MigrateDown(ctx context.Context, steps int) ([]MigrationStatus, error)
+	//
+	//
+	// Returns every known migration, applied or pending
+	MigrationStatus(ctx context.Context) ([]MigrationStatus, error)
+}
+
+// loadMigrations reads the migration scripts in dir, sorted by version
+func loadMigrations(dir string) ([]Migration, error) {
+
+	entries, err := migrationScripts.ReadDir(path.Join("migrations", dir))
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		file := entry.Name()
+		base := strings.TrimSuffix(file, ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+		version, name, found := strings.Cut(base, "_")
+		n, err := strconv.Atoi(version)
+		if !found || err != nil || n < 1 || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("invalid migration file name %s", file)
+		}
+		content, err := migrationScripts.ReadFile(path.Join("migrations", dir, file))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[n]
+		if !ok {
+			m = &Migration{Version: n, Name: name}
+			byVersion[n] = m
+		} else if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", n, m.Name, name)
+		}
+		if direction == ".up" {
+			m.up = splitStatements(string(content))
+		} else {
+			m.down = splitStatements(string(content))
+		}
+	}
+
+	ret := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		ret = append(ret, *m)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Version < ret[j].Version })
+	for i, m := range ret {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d missing", i+1)
+		}
+		if m.up == nil || m.down == nil {
+			return nil, fmt.Errorf("migration %d needs both up and down scripts", m.Version)
+		}
+	}
+	return ret, nil
+}
+
+// splitStatements splits a script on semicolons, dropping -- comments
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+	ret := make([]string, 0)
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			ret = append(ret, statement)
+		}
+	}
+	return ret
+}
+
+func (sqldb *SqlDB) MigrateUp(ctx context.Context) ([]MigrationStatus, error) {
+
+	migrations, err := loadMigrations(sqldb.dialect.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]MigrationStatus, 0)
+	err = sqldb.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := sqldb.appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			status := MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: time.Now().UTC().Format(time.RFC3339)}
+			sqldb.logger.Infof("Applying migration %d %s", m.Version, m.Name)
+			err := sqldb.runMigration(ctx, conn, m.up, "INSERT INTO "+schemaMigrationsTable+" (version, name, appliedAt) VALUES ($1, $2, $3)",
+				m.Version, m.Name, status.AppliedAt)
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			}
+			ret = append(ret, status)
+		}
+		return nil
+	})
+
+	return ret, err
+}
+
+func (sqldb *SqlDB) MigrateDown(ctx context.Context, steps int) ([]MigrationStatus, error) {
+
+	migrations, err := loadMigrations(sqldb.dialect.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]MigrationStatus, 0)
+	err = sqldb.withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := sqldb.appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && len(ret) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			sqldb.logger.Infof("Reverting migration %d %s", m.Version, m.Name)
+			err := sqldb.runMigration(ctx, conn, m.down, "DELETE FROM "+schemaMigrationsTable+" WHERE version = $1", m.Version)
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			}
+			ret = append(ret, MigrationStatus{Version: m.Version, Name: m.Name})
+		}
+		return nil
+	})
+
+	return ret, err
+}
+
+func (sqldb *SqlDB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+
+	migrations, err := loadMigrations(sqldb.dialect.migrationsDir())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sqldb.conn().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := sqldb.createSchemaMigrations(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := sqldb.appliedMigrations(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		ret = append(ret, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]})
+	}
+	return ret, nil
+}
+
+// withMigrationLock runs fn holding the migration lock, on the connection the lock is held by
+func (sqldb *SqlDB) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+
+	conn, err := sqldb.conn().Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sqldb.logger.Debug("Taking migration lock")
+	if err := sqldb.dialect.lockMigrations(ctx, conn); err != nil {
+		return fmt.Errorf("cannot take migration lock: %w", err)
+	}
+	defer func() {
+		if err := sqldb.dialect.unlockMigrations(context.Background(), conn); err != nil {
+			sqldb.logger.Error("Error: cannot release migration lock: " + err.Error())
+		}
+	}()
+
+	if err := sqldb.createSchemaMigrations(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func (sqldb *SqlDB) createSchemaMigrations(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+schemaMigrationsTable+
+		" (version bigint PRIMARY KEY, name varchar(255) NOT NULL, appliedAt varchar(64) NOT NULL)")
+	return err
+}
+
+// appliedMigrations returns the applied migrations: version -> time applied
+func (sqldb *SqlDB) appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]string, error) {
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, appliedAt FROM "+schemaMigrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ret := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		ret[version] = appliedAt
+	}
+	return ret, rows.Err()
+}
+
+// runMigration executes statements, then record with params to track it in schema_migrations.
+// Everything is in one transaction, if the dialect allows
+func (sqldb *SqlDB) runMigration(ctx context.Context, conn *sql.Conn, statements []string, record string, params ...any) error {
+
+	exec := func(e executor) error {
+		for _, statement := range statements {
+			if match := addColumnIfNotExists.FindStringSubmatch(statement); match != nil {
+				exists, err := hasColumn(ctx, e, match[1], match[2])
+				if err != nil {
+					return err
+				}
+				if exists {
+					sqldb.logger.Debugf("Column %s.%s exists", match[1], match[2])
+					continue
+				}
+				statement = ifNotExists.ReplaceAllString(statement, "")
+			}
+			sqldb.logger.Debug(statement)
+			if _, err := e.ExecContext(ctx, statement); err != nil {
+				return err
+			}
+		}
+		record, params := sqldb.dialect.bind(record, params)
+		_, err := e.ExecContext(ctx, record, params...)
+		return err
+	}
+
+	if !sqldb.dialect.transactionalDDL() {
+		return exec(conn)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := exec(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// executor is a connection or a transaction
+type executor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// hasColumn tells if table has column. Names are compared ignoring case, since postgres folds unquoted ones
+func hasColumn(ctx context.Context, e executor, table, column string) (bool, error) {
+
+	rows, err := e.QueryContext(ctx, "SELECT * FROM "+table+" WHERE 1 = 0")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return false, err
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
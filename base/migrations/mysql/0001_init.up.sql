@@ -0,0 +1,41 @@
+-- Tables created by the releases before migrations, thus IF NOT EXISTS
+CREATE TABLE IF NOT EXISTS meta (
+    uuid char(36) PRIMARY KEY,
+    fileName varchar(255) NOT NULL,
+    bucket varchar(255),
+    size bigint,
+    tenant varchar(255)
+);
+
+CREATE TABLE IF NOT EXISTS bucket (
+    name varchar(255) PRIMARY KEY,
+    owner varchar(255) NOT NULL,
+    policy text,
+    tenant varchar(255)
+);
+
+-- Columns added by the releases before migrations, missing in the tables created before them
+ALTER TABLE meta ADD COLUMN IF NOT EXISTS bucket varchar(255);
+ALTER TABLE meta ADD COLUMN IF NOT EXISTS size bigint;
+ALTER TABLE meta ADD COLUMN IF NOT EXISTS tenant varchar(255);
+ALTER TABLE bucket ADD COLUMN IF NOT EXISTS policy text;
+ALTER TABLE bucket ADD COLUMN IF NOT EXISTS tenant varchar(255);
+
+-- Objects stored before buckets and tenants are in no bucket of the default tenant. Their size is unknown
+UPDATE meta SET bucket = '' WHERE bucket IS NULL;
+UPDATE meta SET tenant = '' WHERE tenant IS NULL;
+UPDATE meta SET size = 0 WHERE size IS NULL;
+UPDATE bucket SET tenant = '' WHERE tenant IS NULL;
+
+CREATE TABLE IF NOT EXISTS audit (
+    seq bigint PRIMARY KEY,
+    time varchar(64) NOT NULL,
+    principal varchar(255) NOT NULL,
+    tenant varchar(255),
+    sourceIp varchar(64),
+    action varchar(64) NOT NULL,
+    object text,
+    code integer NOT NULL,
+    prevHash varchar(64) NOT NULL,
+    hash varchar(64) NOT NULL
+);
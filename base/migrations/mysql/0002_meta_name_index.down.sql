@@ -0,0 +1 @@
+DROP INDEX meta_name ON meta;
@@ -0,0 +1,2 @@
+-- Lookups by name and listings of tenants
+CREATE INDEX meta_name ON meta (tenant, bucket, fileName);
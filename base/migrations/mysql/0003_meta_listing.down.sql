@@ -0,0 +1,8 @@
+DROP TABLE meta_tag;
+DROP INDEX meta_content_type ON meta;
+DROP INDEX meta_list_size ON meta;
+DROP INDEX meta_list_created ON meta;
+DROP INDEX meta_list_name ON meta;
+ALTER TABLE meta DROP COLUMN tags;
+ALTER TABLE meta DROP COLUMN contentType;
+ALTER TABLE meta DROP COLUMN createdAt;
@@ -0,0 +1 @@
+ALTER TABLE meta MODIFY fileName varchar(255) NOT NULL;
@@ -0,0 +1,3 @@
+-- Names compare byte by byte, as in sqlite and cockroach: the names under a prefix are contiguous in the indexes,
+-- which then serve prefix matches, and delimiter listings skip whole folders. Names become case sensitive
+ALTER TABLE meta MODIFY fileName varchar(255) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL;
@@ -0,0 +1,4 @@
+DROP INDEX meta_name ON meta;
+CREATE INDEX meta_name ON meta (tenant, bucket, fileName);
+
+ALTER TABLE meta DROP COLUMN etag;
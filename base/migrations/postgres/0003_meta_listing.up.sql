@@ -0,0 +1,20 @@
+-- Attributes filtering listings, and indexes for the keyset pagination of every sort order.
+-- Tags are stored twice: as a JSON object with the metadata, and one per row to be filtered on
+ALTER TABLE meta ADD COLUMN createdAt varchar(32) NOT NULL DEFAULT '';
+ALTER TABLE meta ADD COLUMN contentType varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE meta ADD COLUMN tags varchar(4096) NOT NULL DEFAULT '';
+
+CREATE INDEX meta_list_name ON meta (tenant, fileName, uuid);
+CREATE INDEX meta_list_created ON meta (tenant, createdAt, uuid);
+CREATE INDEX meta_list_size ON meta (tenant, size, uuid);
+CREATE INDEX meta_content_type ON meta (tenant, contentType);
+
+CREATE TABLE meta_tag (
+    uuid uuid NOT NULL,
+    tenant varchar(255),
+    tagKey varchar(128) NOT NULL,
+    tagValue varchar(256) NOT NULL,
+    PRIMARY KEY (uuid, tagKey)
+);
+
+CREATE INDEX meta_tag_value ON meta_tag (tenant, tagKey, tagValue, uuid);
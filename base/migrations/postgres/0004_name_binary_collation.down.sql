@@ -0,0 +1 @@
+ALTER TABLE meta ALTER COLUMN fileName TYPE varchar(255) COLLATE "default";
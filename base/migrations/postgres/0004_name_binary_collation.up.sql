@@ -0,0 +1,3 @@
+-- Names compare byte by byte, as in sqlite and cockroach: the names under a prefix are contiguous in the indexes,
+-- which then serve prefix matches, and delimiter listings skip whole folders
+ALTER TABLE meta ALTER COLUMN fileName TYPE varchar(255) COLLATE "C";
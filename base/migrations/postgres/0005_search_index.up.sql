@@ -0,0 +1,12 @@
+-- Inverted index of the objects for search: the words of name, tags and content, weighted by field and occurrences.
+-- Terms compare byte by byte, so that prefix queries use the index
+CREATE TABLE search_term (
+    uuid uuid NOT NULL,
+    tenant varchar(255),
+    field varchar(16) NOT NULL,
+    term varchar(64) COLLATE "C" NOT NULL,
+    weight integer NOT NULL,
+    PRIMARY KEY (uuid, field, term)
+);
+
+CREATE INDEX search_term_lookup ON search_term (tenant, term, uuid);
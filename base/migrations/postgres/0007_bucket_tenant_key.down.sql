@@ -0,0 +1,11 @@
+-- Fails if tenants have buckets with the same name
+CREATE TABLE global_bucket (
+    name varchar(255) PRIMARY KEY,
+    owner varchar(255) NOT NULL,
+    policy text,
+    tenant varchar(255)
+);
+
+INSERT INTO global_bucket (name, owner, policy, tenant) SELECT name, owner, policy, tenant FROM bucket;
+DROP TABLE bucket;
+ALTER TABLE global_bucket RENAME TO bucket;
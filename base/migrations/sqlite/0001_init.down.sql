@@ -0,0 +1,3 @@
+DROP TABLE audit;
+DROP TABLE bucket;
+DROP TABLE meta;
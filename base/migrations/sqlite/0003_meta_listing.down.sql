@@ -0,0 +1,8 @@
+DROP TABLE meta_tag;
+DROP INDEX meta_content_type;
+DROP INDEX meta_list_size;
+DROP INDEX meta_list_created;
+DROP INDEX meta_list_name;
+ALTER TABLE meta DROP COLUMN tags;
+ALTER TABLE meta DROP COLUMN contentType;
+ALTER TABLE meta DROP COLUMN createdAt;
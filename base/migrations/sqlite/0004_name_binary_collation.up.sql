@@ -0,0 +1 @@
+-- SQLite compares names byte by byte already
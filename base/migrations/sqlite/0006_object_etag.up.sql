@@ -0,0 +1,6 @@
+-- Entity tags of the objects: the SHA-256 of their content, empty for the objects stored before.
+-- Names become unique, so that concurrent uploads of a name conflict in the database. Duplicates must be deleted first
+ALTER TABLE meta ADD COLUMN etag varchar(64) NOT NULL DEFAULT '';
+
+DROP INDEX meta_name;
+CREATE UNIQUE INDEX meta_name ON meta (tenant, bucket, fileName);
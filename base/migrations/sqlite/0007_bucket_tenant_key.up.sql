@@ -0,0 +1,13 @@
+-- Bucket names are unique per tenant, as object names: a tenant can't find out the buckets of the others
+-- by creating buckets with their names
+CREATE TABLE tenant_bucket (
+    tenant varchar(255) NOT NULL,
+    name varchar(255) NOT NULL,
+    owner varchar(255) NOT NULL,
+    policy text,
+    PRIMARY KEY (tenant, name)
+);
+
+INSERT INTO tenant_bucket (tenant, name, owner, policy) SELECT COALESCE(tenant, ''), name, owner, policy FROM bucket;
+DROP TABLE bucket;
+ALTER TABLE tenant_bucket RENAME TO bucket;
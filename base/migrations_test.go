@@ -0,0 +1,124 @@
+package base
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+//
+// This test loads the migration scripts of every dialect.
+// Pass if they load, and all dialects have the same migrations.
+func TestMigrationScripts(t *testing.T) {
+
+	expected, err := loadMigrations("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"mysql", "sqlite"} {
+		migrations, err := loadMigrations(dir)
+		if err != nil {
+			t.Fatalf("%s: %v", dir, err)
+		}
+		if len(migrations) != len(expected) {
+			t.Fatalf("%s: %d migrations, postgres has %d", dir, len(migrations), len(expected))
+		}
+		for i, m := range migrations {
+			if m.Version != expected[i].Version || m.Name != expected[i].Name {
+				t.Errorf("%s: migration %d %s, postgres has %d %s", dir, m.Version, m.Name, expected[i].Version, expected[i].Name)
+			}
+		}
+	}
+}
+
+//
+// This test migrates a database from two replicas at once, then reverts and applies the last migration.
+// Pass if every migration is applied once, and status follows.
+func TestMigrateUpDown(t *testing.T) {
+
+	ctx := context.Background()
+	file := filepath.Join(t.TempDir(), "test.db")
+	replicas := make([]*SqliteDB, 2)
+	for i := range replicas {
+		replicas[i] = NewSqliteDatabase(testLogger).(*SqliteDB)
+		if err := replicas[i].Connect("sqlite", file); err != nil {
+			t.Fatal(err)
+		}
+		defer replicas[i].Close()
+	}
+	migrations, _ := loadMigrations("sqlite")
+
+	var wg sync.WaitGroup
+	applied := make([][]MigrationStatus, len(replicas))
+	for i := range replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if applied[i], err = replicas[i].MigrateUp(ctx); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(applied[0]) + len(applied[1]); n != len(migrations) {
+		t.Errorf("%d migrations applied, expected %d", n, len(migrations))
+	}
+
+	reverted, err := replicas[0].MigrateDown(ctx, 1)
+	if err != nil || len(reverted) != 1 || reverted[0].Version != len(migrations) {
+		t.Fatalf("Last migration not reverted: %+v, %v", reverted, err)
+	}
+	status, err := replicas[1].MigrationStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if pending := s.AppliedAt == ""; pending != (s.Version == len(migrations)) {
+			t.Errorf("Wrong status of migration %d: %+v", s.Version, s)
+		}
+	}
+	if applied, err := replicas[1].MigrateUp(ctx); err != nil || len(applied) != 1 {
+		t.Errorf("Last migration not applied again: %+v, %v", applied, err)
+	}
+}
+
+//
+// This test migrates a database created by the releases before migrations, holding an object and a bucket.
+// Pass if every migration is applied, and object and bucket can be read, in the default tenant.
+func TestMigrateUpFromUnversioned(t *testing.T) {
+
+	ctx := context.Background()
+	store := NewSqliteDatabase(testLogger).(*SqliteDB)
+	if err := store.Connect("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for _, statement := range []string{
+		"CREATE TABLE meta (uuid char(36) PRIMARY KEY, fileName varchar(255) NOT NULL)",
+		"CREATE TABLE bucket (name varchar(255) PRIMARY KEY, owner varchar(255) NOT NULL)",
+		"INSERT INTO meta (uuid, fileName) VALUES ('3f2a7c4e-9b1d-4e8a-a5c6-0d7e1f2b3c4d', 'old.txt')",
+		"INSERT INTO bucket (name, owner) VALUES ('logs', 'alice')",
+	} {
+		if _, err := store.conn().ExecContext(ctx, statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrations, _ := loadMigrations("sqlite")
+	applied, err := store.MigrateUp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("%d migrations applied, expected %d", len(applied), len(migrations))
+	}
+	row, err := store.RetrieveMetadata(ctx, "3f2a7c4e-9b1d-4e8a-a5c6-0d7e1f2b3c4d")
+	if err != nil || row.FileName != "old.txt" {
+		t.Errorf("Object not migrated: %+v, %v", row, err)
+	}
+	if bucket, err := store.RetrieveBucket(ctx, "", "logs"); err != nil || bucket.Owner != "alice" {
+		t.Errorf("Bucket not migrated: %+v, %v", bucket, err)
+	}
+}
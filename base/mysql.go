@@ -0,0 +1,11 @@
+package base
+
+import (
+	"github.com/erizzardi/storage/util"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// NewMysqlDatabase returns the MySQL and MariaDB implementation of DB
+func NewMysqlDatabase(logger *util.Logger) DB {
+	return newSqlDB(logger, mysqlDialect{})
+}
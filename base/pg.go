@@ -1,248 +1,805 @@
 package base
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/erizzardi/storage/util"
 	_ "github.com/lib/pq"
 )
 
 type SqlDB struct {
-	db     *sql.DB
-	logger *util.Logger
-	tables []table
+	// Guards db and statements, which are replaced when reconnecting
+	mu        sync.RWMutex
+	db        *sql.DB
+	connected bool
+	// Prepared statements of db, by statement
+	statements map[string]*sql.Stmt
+	// Set by Init: the schema exists, so queries can be prepared
+	initialized bool
+	logger      *util.Logger
+	dialect     dialect
+	tables      []table
+	queries     queries
 }
 
+// NewSqlDatabase returns the postgres implementation of DB
 func NewSqlDatabase(logger *util.Logger) DB {
-	return &SqlDB{
-		db:     &sql.DB{},
-		logger: logger,
-		//-------------------
-		// Database Structure
-		//-------------------
+	return newSqlDB(logger, postgresDialect{})
+}
+
+// NewCockroachDatabase returns the CockroachDB implementation of DB
+func NewCockroachDatabase(logger *util.Logger) DB {
+	return newSqlDB(logger, cockroachDialect{})
+}
+
+func newSqlDB(logger *util.Logger, dialect dialect) *SqlDB {
+	sqldb := &SqlDB{
+		db:         &sql.DB{},
+		statements: make(map[string]*sql.Stmt),
+		logger:     logger,
+		dialect:    dialect,
+		//------------------------------------------------
+		// Tables, created by the scripts in migrations/
+		//------------------------------------------------
 		tables: []table{
 			{
 				name: "meta",
-				columns: []column{
-					newColumn("uuid", "uuid", true, false),
-					newColumn("fileName", "varchar(255)", false, true),
-				},
 				labels: map[string]any{
 					"content": "metadata",
 				},
 			},
 			{
-				name: "bucket",
-				columns: []column{
-					newColumn("name", "varchar(255)", true, false),
-					newColumn("owner", "varchar(255)", false, true),
+				name: "meta_tag",
+				labels: map[string]any{
+					"content": "tag",
+				},
+			},
+			{
+				name: "search_term",
+				labels: map[string]any{
+					"content": "term",
 				},
+			},
+			{
+				name: "bucket",
 				labels: map[string]any{
 					"content": "bucket",
 				},
 			},
+			{
+				name: "audit",
+				labels: map[string]any{
+					"content": "audit",
+				},
+			},
 		},
 	}
+	sqldb.queries = newQueries(dialect, sqldb.GetTableFromLabel)
+	return sqldb
 }
 
+// Connect opens a connection pool. If already connected, the pool is replaced only once the new one works,
+// e.g. with rotated credentials, and the queries are prepared on it. The old pool is closed, letting running queries complete.
+// The database/sql driver is the one of the dialect, whatever driver is
 func (sqldb *SqlDB) Connect(driver string, dsn string) error {
-	db, err := sql.Open(driver, dsn)
+	db, err := sql.Open(sqldb.dialect.driverName(), dsn)
 	if err != nil {
 		return err
 	}
 	sqldb.logger.Debug("Pinging database...")
 	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return err
 	}
+	statements := make(map[string]*sql.Stmt)
+	sqldb.mu.RLock()
+	initialized := sqldb.initialized
+	sqldb.mu.RUnlock()
+	if initialized {
+		for _, query := range sqldb.queries.all() {
+			query = sqldb.dialect.placeholders(query)
+			if statements[query], err = db.Prepare(query); err != nil {
+				db.Close()
+				return err
+			}
+		}
+	}
 
-	sqldb.db = db
+	sqldb.mu.Lock()
+	old, connected := sqldb.db, sqldb.connected
+	sqldb.db, sqldb.connected, sqldb.statements = db, true, statements
+	sqldb.mu.Unlock()
+	if connected {
+		sqldb.logger.Info("Database connection pool replaced")
+		// Statements are closed with their pool
+		go old.Close()
+	}
 
 	return nil
 }
 
-func (sqldb *SqlDB) Exec(statementString string, params ...any) (sql.Result, error) {
-	sqldb.logger.Debug(statementString)
-	statement, err := sqldb.db.Prepare(statementString)
-	if err != nil {
-		return nil, err
+// conn returns the current connection pool
+func (sqldb *SqlDB) conn() *sql.DB {
+	sqldb.mu.RLock()
+	defer sqldb.mu.RUnlock()
+	return sqldb.db
+}
+
+// prepared returns statementString prepared on the current pool, preparing it on first use. Only for the queries of
+// sqldb.queries, prepared by Init: the cache is never evicted
+func (sqldb *SqlDB) prepared(ctx context.Context, statementString string) (*sql.Stmt, error) {
+	sqldb.mu.RLock()
+	db, statement := sqldb.db, sqldb.statements[statementString]
+	sqldb.mu.RUnlock()
+	if statement != nil {
+		return statement, nil
 	}
-	res, err := statement.Exec(params...)
+
+	sqldb.logger.Debug("Preparing statement: " + statementString)
+	statement, err := db.PrepareContext(ctx, statementString)
 	if err != nil {
 		return nil, err
 	}
-	return res, nil
+	sqldb.mu.Lock()
+	defer sqldb.mu.Unlock()
+	// The pool has been replaced meanwhile: the statement is closed with its pool
+	if sqldb.db != db {
+		return statement, nil
+	}
+	if cached := sqldb.statements[statementString]; cached != nil {
+		statement.Close()
+		return cached, nil
+	}
+	sqldb.statements[statementString] = statement
+	return statement, nil
+}
+
+// statement returns the current pool and, if statementString is one of the queries prepared by Init, its statement.
+// Statements are cached by their text with the placeholders of the dialect. Statements built per request,
+// as listings with filters and searches, are not prepared: their number has no bound
+func (sqldb *SqlDB) statement(statementString string) (*sql.DB, *sql.Stmt) {
+	key := sqldb.dialect.placeholders(statementString)
+	sqldb.mu.RLock()
+	defer sqldb.mu.RUnlock()
+	return sqldb.db, sqldb.statements[key]
 }
 
-func (sqldb *SqlDB) Query(statementString string, params ...any) (*sql.Rows, error) {
+func (sqldb *SqlDB) ExecContext(ctx context.Context, statementString string, params ...any) (sql.Result, error) {
+	db, statement := sqldb.statement(statementString)
+	statementString, params = sqldb.dialect.bind(statementString, params)
 	sqldb.logger.Debug(statementString)
-	statement, err := sqldb.db.Prepare(statementString)
-	if err != nil {
-		return nil, err
+	if statement == nil {
+		return db.ExecContext(ctx, statementString, params...)
 	}
-	sqldb.logger.Debug("Select query prepared")
-	rows, err := statement.Query(params...)
-	if err != nil {
-		return nil, err
+	return statement.ExecContext(ctx, params...)
+}
+
+func (sqldb *SqlDB) QueryContext(ctx context.Context, statementString string, params ...any) (*sql.Rows, error) {
+	db, statement := sqldb.statement(statementString)
+	statementString, params = sqldb.dialect.bind(statementString, params)
+	sqldb.logger.Debug(statementString)
+	if statement == nil {
+		return db.QueryContext(ctx, statementString, params...)
 	}
-	return rows, nil
+	return statement.QueryContext(ctx, params...)
 }
 
-// Init() loads structure into database
-func (sqldb *SqlDB) Init() error {
+// Init() loads structure into database, applying the pending migrations, then prepares the queries
+func (sqldb *SqlDB) Init(ctx context.Context) error {
 
-	for _, table := range sqldb.tables {
-		sqldb.logger.Debugf("Creating '%s' table, if doesn't exist", table.name)
-		statementString := "CREATE TABLE IF NOT EXISTS " + table.name + " ("
-		for i, column := range table.columns {
-			if i != 0 {
-				statementString += ","
-			}
-			statementString += column.toString()
-		}
-		statementString += ")"
-		sqldb.logger.Debug("Table creation statement: " + statementString)
-		if _, err := sqldb.Exec(statementString); err != nil {
+	applied, err := sqldb.MigrateUp(ctx)
+	if err != nil {
+		return err
+	}
+	sqldb.logger.Debugf("Applied %d migrations", len(applied))
+
+	for _, query := range sqldb.queries.all() {
+		if _, err := sqldb.prepared(ctx, sqldb.dialect.placeholders(query)); err != nil {
 			return err
 		}
-		sqldb.logger.Debugf("Create Table '%s' executed", table.name)
 	}
+	sqldb.mu.Lock()
+	sqldb.initialized = true
+	sqldb.mu.Unlock()
 	return nil
 }
 
-// tearDown() drops all the tables created by Init(). To be used in tests! Thus, unexported.
+// tearDown() reverts all the migrations applied by Init(), and drops their bookkeeping.
+// To be used in tests! Thus, unexported.
 func (sqldb *SqlDB) tearDown() error {
 
-	for _, table := range sqldb.tables {
-		sqldb.logger.Debugf("Dropping table '%s'", table.name)
-		statementString := "DROP TABLE " + table.name
-		sqldb.logger.Debug("Table creation statement: " + statementString)
-		if _, err := sqldb.Exec(statementString); err != nil {
+	ctx := context.Background()
+	if _, err := sqldb.MigrateDown(ctx, math.MaxInt); err != nil {
+		return err
+	}
+	for _, table := range []string{schemaMigrationsTable, "schema_migrations_lock"} {
+		sqldb.logger.Debugf("Dropping table '%s'", table)
+		if _, err := sqldb.ExecContext(ctx, "DROP TABLE IF EXISTS " + table); err != nil {
 			return err
 		}
-		sqldb.logger.Debugf("Dropped table '%s'", table.name)
 	}
 	return nil
 }
 
-func (sqldb *SqlDB) InsertMetadata(row util.Row) error {
+// inTx runs fn in a transaction, committed if fn succeeds. Statements run by exec are bound, and the queries of
+// sqldb.queries run as their prepared statements
+func (sqldb *SqlDB) inTx(ctx context.Context, fn func(exec func(statement string, params ...any) (sql.Result, error)) error) error {
 
-	statementString := "INSERT INTO " + sqldb.GetTableFromLabel("metadata") + " VALUES( $1, $2 );"
-	sqldb.logger.Debug(statementString)
+	db := sqldb.conn()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	exec := func(statementString string, params ...any) (sql.Result, error) {
+		current, statement := sqldb.statement(statementString)
+		statementString, params = sqldb.dialect.bind(statementString, params)
+		sqldb.logger.Debug(statementString)
+		// Statements of a replaced pool can't run in the transaction
+		if statement != nil && current == db {
+			return tx.StmtContext(ctx, statement).ExecContext(ctx, params...)
+		}
+		return tx.ExecContext(ctx, statementString, params...)
+	}
+	if err := fn(exec); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertMetadata inserts the row, its tags and the words of name and tags in the search index, in one transaction
+func (sqldb *SqlDB) InsertMetadata(ctx context.Context, row util.Row) error {
+
+	return sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+		return sqldb.insertRow(exec, row)
+	})
+}
 
-	res, err := sqldb.Exec(statementString, row.Uuid, row.FileName)
+// ReplaceMetadata deletes the object with ID uuid and inserts row in one transaction.
+// Of two concurrent replacements of the same object, the second one finds it deleted
+func (sqldb *SqlDB) ReplaceMetadata(ctx context.Context, uuid string, row util.Row) error {
+
+	return sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+		if err := sqldb.deleteRow(exec, uuid); err != nil {
+			return err
+		}
+		return sqldb.insertRow(exec, row)
+	})
+}
+
+// MoveMetadata deletes the object replaced, if set, and renames the object of row in one transaction.
+// Its tags don't change, the words of its name are replaced in the search index
+func (sqldb *SqlDB) MoveMetadata(ctx context.Context, row util.Row, replaced string) error {
+
+	return sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+		if replaced != "" {
+			if err := sqldb.deleteRow(exec, replaced); err != nil {
+				return err
+			}
+		}
+		res, err := exec(sqldb.queries.moveMetadata, row.Bucket, row.FileName, row.Uuid)
+		if sqldb.dialect.duplicateKey(err) {
+			return util.ConflictError{Message: "object " + row.FileName + " already exists"}
+		} else if err != nil {
+			return err
+		}
+		if rowCnt, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowCnt == 0 {
+			return NotFoundError
+		}
+		if _, err := exec(sqldb.queries.deleteIndexTerms, row.Uuid, util.SearchContent); err != nil {
+			return err
+		}
+		return sqldb.insertTerms(exec, row.Tenant, row.Uuid, util.IndexTerms(row))
+	})
+}
+
+// UpdateTags replaces the tags of the object and their words in the search index in one transaction.
+// The update is conditional on the tags read before: of concurrent updates, the later ones find them changed
+func (sqldb *SqlDB) UpdateTags(ctx context.Context, row util.Row, tags map[string]string) error {
+
+	encoded, err := marshalTags(tags)
+	if err != nil {
+		return err
+	}
+	previous, err := marshalTags(row.Tags)
+	if err != nil {
+		return err
+	}
+	return sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+		res, err := exec(sqldb.queries.updateTags, encoded, row.Uuid, previous)
+		if err != nil {
+			return err
+		}
+		// MySQL counts the rows changed, thus the tags must differ
+		if rowCnt, err := res.RowsAffected(); err != nil {
+			return err
+		} else if rowCnt == 0 {
+			return NotFoundError
+		}
+		if _, err := exec(sqldb.queries.deleteTags, row.Uuid); err != nil {
+			return err
+		}
+		for key, value := range tags {
+			if _, err := exec(sqldb.queries.insertTag, row.Uuid, row.Tenant, key, value); err != nil {
+				return err
+			}
+		}
+		if _, err := exec(sqldb.queries.deleteIndexTerms, row.Uuid, util.SearchContent); err != nil {
+			return err
+		}
+		row.Tags = tags
+		return sqldb.insertTerms(exec, row.Tenant, row.Uuid, util.IndexTerms(row))
+	})
+}
+
+// deleteRow deletes the object with ID uuid, its tags and its words in the search index in the transaction of exec.
+// Throws NotFoundError if it doesn't exist
+func (sqldb *SqlDB) deleteRow(exec func(string, ...any) (sql.Result, error), uuid string) error {
+
+	res, err := exec(sqldb.queries.deleteMetadata, uuid)
 	if err != nil {
 		return err
 	}
+	if rowCnt, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rowCnt == 0 {
+		return NotFoundError
+	}
+	for _, statement := range []string{sqldb.queries.deleteTags, sqldb.queries.deleteTerms} {
+		if _, err := exec(statement, uuid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertRow inserts the row, its tags and its words in the search index in the transaction of exec.
+// Throws ConflictError if an object with the same uuid, or name in the bucket, exists
+func (sqldb *SqlDB) insertRow(exec func(string, ...any) (sql.Result, error), row util.Row) error {
 
-	rowCnt, err := res.RowsAffected()
+	tags, err := marshalTags(row.Tags)
 	if err != nil {
 		return err
 	}
-	sqldb.logger.Debugf("Created %d row/s", rowCnt)
 
+	_, err = exec(sqldb.queries.insertMetadata, row.Uuid, row.FileName, row.Bucket, row.Size, row.Tenant, row.CreatedAt, row.ContentType, tags, row.ETag)
+	if sqldb.dialect.duplicateKey(err) {
+		return util.ConflictError{Message: "object " + row.FileName + " already exists"}
+	} else if err != nil {
+		return err
+	}
+	for key, value := range row.Tags {
+		if _, err := exec(sqldb.queries.insertTag, row.Uuid, row.Tenant, key, value); err != nil {
+			return err
+		}
+	}
+	if err := sqldb.insertTerms(exec, row.Tenant, row.Uuid, util.IndexTerms(row)); err != nil {
+		return err
+	}
+	sqldb.logger.Debugf("Created object %s with %d tags", row.Uuid, len(row.Tags))
 	return nil
 }
 
-func (sqldb *SqlDB) RetrieveMetadata(key, value string) (util.Row, error) {
+func (sqldb *SqlDB) RetrieveMetadata(ctx context.Context, uuid string) (util.Row, error) {
+	return sqldb.queryMetadata(ctx, sqldb.queries.retrieveMetadata, uuid)
+}
 
-	var ret util.Row
+func (sqldb *SqlDB) RetrieveMetadataByName(ctx context.Context, tenant, bucket, name string) (util.Row, error) {
+	return sqldb.queryMetadata(ctx, sqldb.queries.retrieveMetadataByName, tenant, bucket, name)
+}
 
-	// POSSIBLE SQL INJECTION
-	statementString := "SELECT * FROM " + sqldb.GetTableFromLabel("metadata") + " WHERE " + key + " = $1;"
-	// sqldb.logger.Debug(statementString)
+// queryMetadata returns the first row of metadata selected by statementString. Throws NotFoundError if there is none
+func (sqldb *SqlDB) queryMetadata(ctx context.Context, statementString string, params ...any) (util.Row, error) {
 
-	rows, err := sqldb.Query(statementString, value)
+	rows, err := sqldb.QueryContext(ctx, statementString, params...)
 	if err != nil {
 		return util.Row{}, err
 	}
-	sqldb.logger.Debug("Select query executed")
-	for rows.Next() {
-		err := rows.Scan(&ret.Uuid, &ret.FileName)
-		if err != nil {
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
 			return util.Row{}, err
 		}
-		sqldb.logger.Debugf("Row read. Retrieved %+v\n", ret)
+		return util.Row{}, NotFoundError
 	}
-	err = rows.Err()
+	ret, err := scanMetadata(rows)
 	if err != nil {
 		return util.Row{}, err
 	}
-	sqldb.logger.Debug("Row scanning ended")
+	sqldb.logger.Debugf("Row read. Retrieved %+v\n", ret)
 
-	// Checks for empty response
-	if (ret == util.Row{}) {
-		return ret, NotFoundError
+	return ret, nil
+}
+
+// scanMetadata scans the metaColumns of the current row
+func scanMetadata(rows *sql.Rows) (util.Row, error) {
+
+	var ret util.Row
+	var bucket, tenant sql.NullString
+	var tags string
+	if err := rows.Scan(&ret.Uuid, &ret.FileName, &bucket, &ret.Size, &tenant, &ret.CreatedAt, &ret.ContentType, &tags, &ret.ETag); err != nil {
+		return util.Row{}, err
+	}
+	ret.Bucket, ret.Tenant = bucket.String, tenant.String
+	var err error
+	if ret.Tags, err = unmarshalTags(tags); err != nil {
+		return util.Row{}, err
+	}
+	return ret, nil
+}
+
+// DeleteMetadata deletes the row, its tags and its words in the search index in one transaction
+func (sqldb *SqlDB) DeleteMetadata(ctx context.Context, uuid string) error {
+
+	return sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+		if _, err := exec(sqldb.queries.deleteTags, uuid); err != nil {
+			return err
+		}
+		if _, err := exec(sqldb.queries.deleteTerms, uuid); err != nil {
+			return err
+		}
+		res, err := exec(sqldb.queries.deleteMetadata, uuid)
+		if err != nil {
+			return err
+		}
+		if rowCnt, err := res.RowsAffected(); err != nil {
+			return util.InternalServerError{Message: err.Error()}
+		} else if rowCnt == 0 {
+			sqldb.logger.Errorf("Error: file %s non existing.", uuid)
+			return util.BadRequestError{Message: ("file " + uuid + " does not exist.")}
+		}
+		return nil
+	})
+}
+
+// ListMetadata lists the objects of tenant selected by query, sorted by the key of query then by uuid.
+// Pages start after the position in query.After, i.e. the sort key and uuid of the last object of the previous page,
+// which is served by the (tenant, key, uuid) indexes
+func (sqldb *SqlDB) ListMetadata(ctx context.Context, tenant string, query util.ListQuery) ([]util.Row, error) {
+
+	column, order, after := sortColumns[query.Sort], "ASC", ">"
+	if query.Desc {
+		order, after = "DESC", "<"
+	}
+	where := sqldb.listConditions(tenant, query)
+	if query.After != nil {
+		where.add("("+column+", uuid) "+after+" ($%d, $%d)", query.After.Key(), query.After.Uuid)
+	}
+	where.params = append(where.params, query.Limit)
+	statementString := "SELECT " + strings.Join(metaColumns, ", ") + " FROM " + sqldb.GetTableFromLabel("metadata") + where.clause() +
+		" ORDER BY " + column + " " + order + ", uuid " + order + fmt.Sprintf(" LIMIT $%d", len(where.params))
+
+	return sqldb.queryRows(ctx, statementString, where.params...)
+}
+
+// queryRows returns all the rows of metadata selected by statementString
+func (sqldb *SqlDB) queryRows(ctx context.Context, statementString string, params ...any) ([]util.Row, error) {
+
+	ret := make([]util.Row, 0)
+	rows, err := sqldb.QueryContext(ctx, statementString, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row, err := scanMetadata(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	return ret, nil
 }
 
-func (sqldb *SqlDB) DeleteMetadata(key, value string) error {
+// QueryUsage sums the objects of tenant selected by query. Sort and pages are ignored
+func (sqldb *SqlDB) QueryUsage(ctx context.Context, tenant string, query util.ListQuery) (util.Usage, error) {
 
-	// POSSIBLE SQL INJECTION
-	statementString := "DELETE FROM " + sqldb.GetTableFromLabel("metadata") + " WHERE " + key + " = $1;"
-	sqldb.logger.Debug(statementString)
-	res, err := sqldb.Exec(statementString, value)
+	where := sqldb.listConditions(tenant, query)
+	return sqldb.queryUsage(ctx, "SELECT COALESCE(SUM(size), 0), COUNT(*) FROM "+sqldb.GetTableFromLabel("metadata")+where.clause(), where.params...)
+}
+
+// listConditions selects the objects of tenant by the filters of query
+func (sqldb *SqlDB) listConditions(tenant string, query util.ListQuery) *conditions {
+
+	where := &conditions{}
+	where.add("tenant = $%d", tenant)
+	if query.Prefix != "" {
+		where.add("fileName LIKE $%d ESCAPE '!'", likePrefix(query.Prefix))
+	}
+	if query.Bucket != nil {
+		where.add("bucket = $%d", *query.Bucket)
+	}
+	if query.MinSize != nil {
+		where.add("size >= $%d", *query.MinSize)
+	}
+	if query.MaxSize != nil {
+		where.add("size <= $%d", *query.MaxSize)
+	}
+	if query.CreatedFrom != "" {
+		where.add("createdAt >= $%d", query.CreatedFrom)
+	}
+	if query.CreatedTo != "" {
+		where.add("createdAt < $%d", query.CreatedTo)
+	}
+	if query.ContentType != "" {
+		where.add("contentType = $%d", query.ContentType)
+	}
+	// Sorted, so that the same tags make the same statement
+	keys := make([]string, 0, len(query.Tags))
+	for key := range query.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		where.add("uuid IN (SELECT uuid FROM "+sqldb.GetTableFromLabel("tag")+" WHERE tenant = $%d AND tagKey = $%d AND tagValue = $%d)", tenant, key, query.Tags[key])
+	}
+	return where
+}
+
+func (sqldb *SqlDB) TenantUsage(ctx context.Context, tenant string) (util.Usage, error) {
+
+	ret, err := sqldb.queryUsage(ctx, sqldb.queries.tenantUsage, tenant)
 	if err != nil {
-		return err
+		return util.Usage{}, err
+	}
+	sqldb.logger.Debugf("Tenant %s usage: %+v", tenant, ret)
+
+	return ret, nil
+}
+
+func (sqldb *SqlDB) TotalUsage(ctx context.Context) (util.Usage, error) {
+
+	return sqldb.queryUsage(ctx, sqldb.queries.totalUsage)
+}
+
+func (sqldb *SqlDB) queryUsage(ctx context.Context, statementString string, params ...any) (util.Usage, error) {
+
+	var ret util.Usage
+
+	rows, err := sqldb.QueryContext(ctx, statementString, params...)
+	if err != nil {
+		return util.Usage{}, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&ret.Bytes, &ret.Objects); err != nil {
+			return util.Usage{}, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return util.Usage{}, err
 	}
 
+	return ret, nil
+}
+
+func (sqldb *SqlDB) InsertBucket(ctx context.Context, bucket util.Bucket) error {
+
+	res, err := sqldb.ExecContext(ctx, sqldb.queries.insertBucket, bucket.Name, bucket.Owner, bucket.Tenant)
+	if err != nil {
+		return err
+	}
 	if rowCnt, err := res.RowsAffected(); err != nil {
-		return util.InternalServerError{Message: err.Error()}
-	} else if rowCnt > 1 {
-		sqldb.logger.Errorf("DELETE operation affected %d lines.", rowCnt)
-		return util.InternalServerError{Message: fmt.Sprintf("DELETE operation affected %d lines.", rowCnt)}
+		return err
 	} else if rowCnt == 0 {
-		sqldb.logger.Errorf("Error: file %s non existing.", value)
-		return util.BadRequestError{Message: ("file " + value + "does not exist.")}
+		return util.ConflictError{Message: "bucket " + bucket.Name + " already exists"}
 	}
+	sqldb.logger.Debugf("Created bucket %s", bucket.Name)
 
 	return nil
 }
 
-func (sqldb *SqlDB) ListAllPaged(limit uint, offset uint) ([]util.Row, error) {
+func (sqldb *SqlDB) RetrieveBucket(ctx context.Context, tenant string, name string) (util.Bucket, error) {
 
-	ret := make([]util.Row, 0)
-	var tempUuid, tempFileName string
+	var ret util.Bucket
+	var policy sql.NullString
 
-	statementString := "SELECT * FROM " + sqldb.GetTableFromLabel("metadata") + " LIMIT $1 OFFSET $2;"
-	sqldb.logger.Debug(statementString)
-	rows, err := sqldb.Query(statementString, limit, offset)
+	rows, err := sqldb.QueryContext(ctx, sqldb.queries.retrieveBucket, tenant, name)
 	if err != nil {
-		return []util.Row{}, err
+		return util.Bucket{}, err
 	}
-	sqldb.logger.Debug("Select query executed")
-	for i := 0; rows.Next(); i++ {
-		err := rows.Scan(&tempUuid, &tempFileName)
-		if err != nil {
-			return []util.Row{}, err
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return util.Bucket{}, err
 		}
-		ret = append(ret, util.Row{Uuid: tempUuid, FileName: tempFileName})
-		sqldb.logger.Debugf("Row read. Retrieved %+v\n", ret)
+		return util.Bucket{}, NotFoundError
+	}
+	if err := rows.Scan(&ret.Name, &ret.Owner, &policy, &ret.Tenant); err != nil {
+		return util.Bucket{}, err
+	}
+	ret.Policy = policy.String
+	sqldb.logger.Debugf("Row read. Retrieved %+v\n", ret)
+
+	return ret, nil
+}
+
+func (sqldb *SqlDB) SetBucketPolicy(ctx context.Context, tenant string, name string, policy string) error {
+
+	var value sql.NullString
+	if policy != "" {
+		value = sql.NullString{String: policy, Valid: true}
 	}
-	err = rows.Err()
+
+	res, err := sqldb.ExecContext(ctx, sqldb.queries.setBucketPolicy, value, tenant, name)
+	if err != nil {
+		return err
+	}
+	if rowCnt, err := res.RowsAffected(); err != nil {
+		return err
+	} else if rowCnt == 0 {
+		return NotFoundError
+	}
+
+	return nil
+}
+
+func (sqldb *SqlDB) InsertAuditRecord(ctx context.Context, record util.AuditRecord) error {
+
+	_, err := sqldb.ExecContext(ctx, sqldb.queries.insertAuditRecord, record.Seq, record.Time, record.Principal, record.Tenant, record.SourceIP,
+		record.Action, record.Object, record.Code, record.PrevHash, record.Hash)
+	return err
+}
+
+func (sqldb *SqlDB) LastAuditRecord(ctx context.Context) (util.AuditRecord, error) {
+
+	records, err := sqldb.queryAuditRecords(ctx, sqldb.queries.lastAuditRecord)
 	if err != nil {
-		return []util.Row{}, err
+		return util.AuditRecord{}, err
+	}
+	if len(records) == 0 {
+		return util.AuditRecord{}, NotFoundError
 	}
-	sqldb.logger.Debug("Row scanning ended")
+	return records[0], nil
+}
+
+func (sqldb *SqlDB) ListAuditRecords(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
 
+	where := &conditions{}
+	if filter.Tenant != nil {
+		where.add("tenant = $%d", *filter.Tenant)
+	}
+	if filter.Principal != "" {
+		where.add("principal = $%d", filter.Principal)
+	}
+	if filter.Action != "" {
+		where.add("action = $%d", filter.Action)
+	}
+	if filter.Object != "" {
+		where.add("object = $%d", filter.Object)
+	}
+	if filter.From != "" {
+		where.add("time >= $%d", filter.From)
+	}
+	if filter.To != "" {
+		where.add("time < $%d", filter.To)
+	}
+
+	statementString := "SELECT seq, time, principal, tenant, sourceIp, action, object, code, prevHash, hash FROM " + sqldb.GetTableFromLabel("audit") +
+		where.clause() + " ORDER BY seq" + sqldb.dialect.limitOffset(len(where.params)+1)
+
+	return sqldb.queryAuditRecords(ctx, statementString, append(where.params, limit, offset)...)
+}
+
+func (sqldb *SqlDB) queryAuditRecords(ctx context.Context, statementString string, params ...any) ([]util.AuditRecord, error) {
+
+	ret := make([]util.AuditRecord, 0)
+	rows, err := sqldb.QueryContext(ctx, statementString, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r util.AuditRecord
+		if err := rows.Scan(&r.Seq, &r.Time, &r.Principal, &r.Tenant, &r.SourceIP, &r.Action, &r.Object, &r.Code, &r.PrevHash, &r.Hash); err != nil {
+			return nil, err
+		}
+		ret = append(ret, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 	return ret, nil
 }
 
+func (sqldb *SqlDB) Ping(ctx context.Context) error {
+	return sqldb.conn().PingContext(ctx)
+}
+
 func (sqldb *SqlDB) Close() error {
-	return sqldb.db.Close()
+	return sqldb.conn().Close()
 }
 
 //============
 // Miscellanea
 //============
+
+// conditions build the WHERE clause of the statements whose filters vary. Column names are fixed,
+// only values are parameters. Statements are not prepared, see SqlDB.statement
+type conditions struct {
+	conditions []string
+	params     []any
+}
+
+// add appends condition, whose %d verbs are replaced by the placeholders of values
+func (c *conditions) add(condition string, values ...any) {
+	placeholders := make([]any, len(values))
+	for i, value := range values {
+		c.params = append(c.params, value)
+		placeholders[i] = len(c.params)
+	}
+	c.conditions = append(c.conditions, fmt.Sprintf(condition, placeholders...))
+}
+
+// param adds value, returning its placeholder
+func (c *conditions) param(value any) string {
+	c.params = append(c.params, value)
+	return fmt.Sprintf("$%d", len(c.params))
+}
+
+// clause returns the WHERE clause, empty if there are no conditions
+func (c *conditions) clause() string {
+	if len(c.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(c.conditions, " AND ")
+}
+
+// Columns of the sort keys of listings
+var sortColumns = map[string]string{
+	util.SortByName:    "fileName",
+	util.SortByCreated: "createdAt",
+	util.SortBySize:    "size",
+}
+
+// marshalTags encodes tags as stored in the metadata table: a JSON object, with sorted keys, or empty if there are none
+func marshalTags(tags map[string]string) (string, error) {
+	if len(tags) == 0 {
+		return "", nil
+	}
+	encoded, err := json.Marshal(tags)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+// unmarshalTags decodes the tags stored as a JSON object. Empty if there are none
+func unmarshalTags(encoded string) (map[string]string, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	var tags map[string]string
+	if err := json.Unmarshal([]byte(encoded), &tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// likePrefix returns the LIKE pattern matching the strings starting with prefix, escaped by '!'
+func likePrefix(prefix string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(prefix) + "%"
+}
+
 func (sqldb *SqlDB) GetTableFromLabel(label string) string {
 
 	var tableName string
 	for _, table := range sqldb.tables {
-		if table.labels["content"] == "metadata" {
+		if table.labels["content"] == label {
 			tableName = table.name
 		}
 	}
@@ -1,29 +1,59 @@
 package base
 
 import (
+	"context"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 
 	"github.com/erizzardi/storage/util"
 	"github.com/google/uuid"
 )
 
-// Unit tests for the postgres implementation of the db interface.
+// Unit tests for the SQL implementations of the db interface.
+// They run against the TEST_DB database (postgres, mysql or cockroach) if TEST_DB_CONN_STR is set,
+// against a temporary SQLite file otherwise, or bbolt file if TEST_DB is bbolt.
 
 var (
 	testDbConnStr = os.Getenv("TEST_DB_CONN_STR")
 	testLogger    = util.NewLogger()
-	db            = NewSqlDatabase(testLogger) // change
+	db            DB
 
-	driver = "postgres"
+	driver  = os.Getenv("TEST_DB")
+	testDir string // SQLite file directory, removed after the run
 )
 
 func TestMain(m *testing.M) {
 
+	if testDbConnStr == "" {
+		dir, err := os.MkdirTemp("", "storage-test")
+		if err != nil {
+			testLogger.Fatal("Cannot create temporary directory: " + err.Error())
+		}
+		testDir = dir
+		if driver == "bbolt" {
+			db = NewBoltDatabase(testLogger)
+		} else {
+			db = NewSqliteDatabase(testLogger)
+			driver = "sqlite"
+		}
+		testDbConnStr = filepath.Join(dir, "test.db")
+	} else {
+		switch driver {
+		case "mysql":
+			db = NewMysqlDatabase(testLogger)
+		case "cockroach":
+			db = NewCockroachDatabase(testLogger)
+		default:
+			db = NewSqlDatabase(testLogger)
+		}
+	}
+
 	if err := db.Connect(driver, testDbConnStr); err != nil {
 		testLogger.Error("Cannot connect to database: " + err.Error())
 	}
-	if err := db.Init(); err != nil {
+	if err := db.Init(context.Background()); err != nil {
 		testLogger.Error("Cannot init database: " + err.Error())
 	}
 
@@ -38,6 +68,10 @@ func TestMain(m *testing.M) {
 	if err := db.tearDown(); err != nil {
 		testLogger.Error("Cannot drop tables: " + err.Error())
 	}
+	if testDir != "" {
+		db.Close()
+		os.RemoveAll(testDir)
+	}
 	os.Exit(exitVal)
 }
 
@@ -46,6 +80,7 @@ func TestMain(m *testing.M) {
 // Pass if no errors.
 func TestInsertRetrieveDelete(t *testing.T) {
 
+	ctx := context.Background()
 	var ret util.Row
 	// count := 0
 
@@ -55,7 +90,7 @@ func TestInsertRetrieveDelete(t *testing.T) {
 	//----------------------------
 	// insert (uuid, testFile) row
 	//----------------------------
-	if err := db.InsertMetadata(util.Row{
+	if err := db.InsertMetadata(ctx, util.Row{
 		Uuid:     uuid,
 		FileName: fileName,
 	}); err != nil {
@@ -65,7 +100,7 @@ func TestInsertRetrieveDelete(t *testing.T) {
 	//----------------------------------------
 	// check if row exists - retrieve metadata
 	//----------------------------------------
-	ret, err := db.RetrieveMetadata("uuid", uuid)
+	ret, err := db.RetrieveMetadata(ctx, uuid)
 	if err != nil {
 		t.Error("Cannot insert row: " + err.Error())
 	}
@@ -87,19 +122,19 @@ func TestInsertRetrieveDelete(t *testing.T) {
 	// if _, err := db.Exec(statementString); err != nil {
 	// 	t.Error("Error deleting the row: " + err.Error())
 	// }
-	if err = db.DeleteMetadata("uuid", uuid); err != nil {
+	if err = db.DeleteMetadata(ctx, uuid); err != nil {
 		t.Error(err.Error())
 	}
 
 	//-------------------------------
 	// check if the row doesn't exist
 	//-------------------------------
-	ret, err = db.RetrieveMetadata("uuid", uuid)
-	if err != nil {
-		t.Error("Cannot insert row: " + err.Error())
+	ret, err = db.RetrieveMetadata(ctx, uuid)
+	if err != NotFoundError {
+		t.Errorf("Error should be %v, got %v", NotFoundError, err)
 	}
 
-	if (ret != util.Row{}) {
+	if ret.Uuid != "" {
 		t.Error("Found Row! Data not deleted correctly.")
 	}
 }
@@ -112,13 +147,298 @@ func TestDeleteNonexisting(t *testing.T) {
 	// Every uuid is unique by construction
 	// thus creating a new one is sufficient
 	uuid := uuid.New().String()
+	ctx := context.Background()
 
 	//-----------
 	// delete row
 	//-----------
-	if err := db.DeleteMetadata("uuid", uuid); err == nil {
+	if err := db.DeleteMetadata(ctx, uuid); err == nil {
 		t.Error("Should return error")
 	} else if util.ErrorIs(err, util.BadRequestError{}) == false {
 		t.Errorf("Error type should be %T", util.BadRequestError{})
 	}
 }
+
+//
+// This test stores two objects under the same name, then replaces the first one twice.
+// Pass if the second insertion and replacement conflict, and the replacement is found by name with its entity tag.
+func TestReplaceMetadata(t *testing.T) {
+
+	ctx := context.Background()
+	old := util.Row{Uuid: uuid.New().String(), FileName: "replaced", Bucket: "replace", Size: 1, Tenant: "replace", ETag: "old"}
+	if err := db.InsertMetadata(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+	duplicate := util.Row{Uuid: uuid.New().String(), FileName: "replaced", Bucket: "replace", Tenant: "replace"}
+	if err := db.InsertMetadata(ctx, duplicate); !util.ErrorIs(err, util.ConflictError{}) {
+		t.Errorf("Error should be %T, got %v", util.ConflictError{}, err)
+	}
+
+	replacement := util.Row{Uuid: uuid.New().String(), FileName: "replaced", Bucket: "replace", Size: 2, Tenant: "replace", ETag: "new"}
+	if err := db.ReplaceMetadata(ctx, old.Uuid, replacement); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteMetadata(ctx, replacement.Uuid)
+	if err := db.ReplaceMetadata(ctx, old.Uuid, duplicate); err != NotFoundError {
+		t.Errorf("Error should be %v, got %v", NotFoundError, err)
+	}
+
+	row, err := db.RetrieveMetadataByName(ctx, "replace", "replace", "replaced")
+	if err != nil || row.Uuid != replacement.Uuid || row.ETag != "new" {
+		t.Errorf("Wrong object found by name: %+v, %v", row, err)
+	}
+	if usage, err := db.TenantUsage(ctx, "replace"); err != nil || usage != (util.Usage{Bytes: 2, Objects: 1}) {
+		t.Errorf("Wrong usage: %+v, %v", usage, err)
+	}
+}
+
+//
+// This test creates buckets with the same name in two tenants, then one again, and attaches a policy to one of them.
+// Pass if the second tenant can create its bucket, the tenant that has one can't, and the policy is of one bucket only.
+func TestBucketsPerTenant(t *testing.T) {
+
+	ctx := context.Background()
+	for _, tenant := range []string{"buckets-a", "buckets-b"} {
+		if err := db.InsertBucket(ctx, util.Bucket{Name: "shared", Owner: "owner-" + tenant, Tenant: tenant}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.InsertBucket(ctx, util.Bucket{Name: "shared", Owner: "other", Tenant: "buckets-a"}); !util.ErrorIs(err, util.ConflictError{}) {
+		t.Errorf("Error should be %T, got %v", util.ConflictError{}, err)
+	}
+
+	if err := db.SetBucketPolicy(ctx, "buckets-b", "shared", `{"statements": []}`); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := db.RetrieveBucket(ctx, "buckets-a", "shared"); err != nil || b.Owner != "owner-buckets-a" || b.Policy != "" {
+		t.Errorf("Wrong bucket of the first tenant: %+v, %v", b, err)
+	}
+	if b, err := db.RetrieveBucket(ctx, "buckets-b", "shared"); err != nil || b.Owner != "owner-buckets-b" || b.Policy == "" {
+		t.Errorf("Wrong bucket of the second tenant: %+v, %v", b, err)
+	}
+	if _, err := db.RetrieveBucket(ctx, "buckets-c", "shared"); err != NotFoundError {
+		t.Errorf("Error should be %v, got %v", NotFoundError, err)
+	}
+}
+
+//
+// This test moves an object onto a name that is taken, then over the object of that name.
+// Pass if the first move conflicts, the moved object keeps its uuid and words of content, and is found by its new name only.
+func TestMoveMetadata(t *testing.T) {
+
+	ctx := context.Background()
+	moved := util.Row{Uuid: uuid.New().String(), FileName: "draft", Bucket: "move", Size: 1, Tenant: "move", Tags: map[string]string{"env": "prod"}}
+	taken := util.Row{Uuid: uuid.New().String(), FileName: "final", Bucket: "move", Size: 2, Tenant: "move"}
+	for _, row := range []util.Row{moved, taken} {
+		if err := db.InsertMetadata(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.DeleteMetadata(ctx, moved.Uuid)
+	if err := db.IndexContent(ctx, "move", moved.Uuid, util.ContentTerms("quarterly")); err != nil {
+		t.Fatal(err)
+	}
+
+	moved.FileName = "final"
+	if err := db.MoveMetadata(ctx, moved, ""); !util.ErrorIs(err, util.ConflictError{}) {
+		t.Errorf("Error should be %T, got %v", util.ConflictError{}, err)
+	}
+	if err := db.MoveMetadata(ctx, moved, taken.Uuid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.RetrieveMetadata(ctx, taken.Uuid); err != NotFoundError {
+		t.Errorf("Replaced object should be deleted, got %v", err)
+	}
+	if _, err := db.RetrieveMetadataByName(ctx, "move", "move", "draft"); err != NotFoundError {
+		t.Errorf("Old name should be free, got %v", err)
+	}
+	row, err := db.RetrieveMetadataByName(ctx, "move", "move", "final")
+	if err != nil || !reflect.DeepEqual(row, moved) {
+		t.Errorf("Wrong object found by name: %+v, %v", row, err)
+	}
+	if usage, err := db.TenantUsage(ctx, "move"); err != nil || usage != (util.Usage{Bytes: 1, Objects: 1}) {
+		t.Errorf("Wrong usage: %+v, %v", usage, err)
+	}
+	for query, expected := range map[string]int{"name:final content:quarterly tag:env=prod": 1, "name:draft": 0} {
+		expr, _ := util.ParseSearchQuery(query)
+		if hits, err := db.SearchMetadata(ctx, "move", util.SearchQuery{Expr: expr, Limit: 10}); err != nil || len(hits) != expected {
+			t.Errorf("Wrong hits of %q: %+v, %v", query, hits, err)
+		}
+	}
+}
+
+//
+// This test replaces the tags of an object twice from the same version, then lists and searches it by tag.
+// Pass if the second update finds the tags changed, and the object is found by its new tags only.
+func TestUpdateTags(t *testing.T) {
+
+	ctx := context.Background()
+	row := util.Row{Uuid: uuid.New().String(), FileName: "tagged", Tenant: "tags", Tags: map[string]string{"env": "prod"}}
+	if err := db.InsertMetadata(ctx, row); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteMetadata(ctx, row.Uuid)
+
+	tags := map[string]string{"env": "dev", "team": "web"}
+	if err := db.UpdateTags(ctx, row, tags); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateTags(ctx, row, nil); err != NotFoundError {
+		t.Errorf("Error should be %v, got %v", NotFoundError, err)
+	}
+	if updated, err := db.RetrieveMetadata(ctx, row.Uuid); err != nil || !reflect.DeepEqual(updated.Tags, tags) {
+		t.Errorf("Wrong tags: %+v, %v", updated.Tags, err)
+	}
+
+	for filter, expected := range map[string]int{"dev": 1, "prod": 0} {
+		query := util.ListQuery{Sort: util.SortByName, Limit: 10, Tags: map[string]string{"env": filter}}
+		if list, err := db.ListMetadata(ctx, "tags", query); err != nil || len(list) != expected {
+			t.Errorf("Wrong listing by env=%s: %+v, %v", filter, list, err)
+		}
+		expr, _ := util.ParseSearchQuery("tag:env=" + filter)
+		if hits, err := db.SearchMetadata(ctx, "tags", util.SearchQuery{Expr: expr, Limit: 10}); err != nil || len(hits) != expected {
+			t.Errorf("Wrong hits of env=%s: %+v, %v", filter, hits, err)
+		}
+	}
+}
+
+//
+// This test inserts tagged objects, then lists them by pages of two, and filtered.
+// Pass if pages follow each other in size order through the cursor, and only the matching objects are listed.
+func TestListMetadata(t *testing.T) {
+
+	ctx := context.Background()
+	rows := []util.Row{
+		{Uuid: uuid.New().String(), FileName: "a_1", Size: 30, Tenant: "list", CreatedAt: "2024-01-01T00:00:00.000000Z", Tags: map[string]string{"env": "prod"}},
+		{Uuid: uuid.New().String(), FileName: "ab", Size: 20, Tenant: "list", CreatedAt: "2024-01-02T00:00:00.000000Z", ContentType: "text/plain"},
+		{Uuid: uuid.New().String(), FileName: "b", Size: 10, Tenant: "list", CreatedAt: "2024-01-03T00:00:00.000000Z", Tags: map[string]string{"env": "prod", "team": "web"}},
+		{Uuid: uuid.New().String(), FileName: "a_2", Size: 40, Tenant: "other", Tags: map[string]string{"env": "prod"}},
+	}
+	for _, row := range rows {
+		if err := db.InsertMetadata(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteMetadata(ctx, row.Uuid)
+	}
+
+	query := util.ListQuery{Sort: util.SortBySize, Desc: true, Limit: 2}
+	page, err := db.ListMetadata(ctx, "list", query)
+	if err != nil || len(page) != 2 || !reflect.DeepEqual(page[0], rows[0]) || page[1].Uuid != rows[1].Uuid {
+		t.Fatalf("Wrong first page: %+v, %v", page, err)
+	}
+	after := util.CursorAfter(query, page[1])
+	query.After = &after
+	if page, err := db.ListMetadata(ctx, "list", query); err != nil || len(page) != 1 || page[0].Uuid != rows[2].Uuid {
+		t.Errorf("Wrong second page: %+v, %v", page, err)
+	}
+
+	for name, query := range map[string]util.ListQuery{
+		"prefix":  {Prefix: "a_"},
+		"tags":    {Tags: map[string]string{"env": "prod", "team": "web"}},
+		"size":    {MinSize: &rows[2].Size, MaxSize: &rows[2].Size},
+		"created": {CreatedFrom: "2024-01-03T00:00:00.000000Z"},
+		"type":    {ContentType: "text/plain"},
+	} {
+		query.Sort, query.Limit = util.SortByName, 10
+		expected := map[string]int{"prefix": 0, "tags": 2, "size": 2, "created": 2, "type": 1}[name]
+		if list, err := db.ListMetadata(ctx, "list", query); err != nil || len(list) != 1 || list[0].Uuid != rows[expected].Uuid {
+			t.Errorf("Wrong listing filtered by %s: %+v, %v", name, list, err)
+		}
+	}
+}
+
+//
+// This test inserts objects in two buckets, then sums the sizes of a folder of each, and lists the names in order.
+// Pass if only the objects of the bucket under the prefix are summed, and names are sorted byte by byte.
+func TestQueryUsage(t *testing.T) {
+
+	ctx := context.Background()
+	rows := []util.Row{
+		{Uuid: uuid.New().String(), FileName: "docs/a", Bucket: "usage", Size: 1, Tenant: "usage"},
+		{Uuid: uuid.New().String(), FileName: "docs/sub/b", Bucket: "usage", Size: 2, Tenant: "usage"},
+		{Uuid: uuid.New().String(), FileName: "Docs/c", Bucket: "usage", Size: 4, Tenant: "usage"},
+		{Uuid: uuid.New().String(), FileName: "docs/d", Size: 8, Tenant: "usage"},
+	}
+	for _, row := range rows {
+		if err := db.InsertMetadata(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteMetadata(ctx, row.Uuid)
+	}
+
+	bucket, none := "usage", ""
+	if usage, err := db.QueryUsage(ctx, "usage", util.ListQuery{Bucket: &bucket, Prefix: "docs/"}); err != nil || usage != (util.Usage{Bytes: 3, Objects: 2}) {
+		t.Errorf("Wrong usage of the folder: %+v, %v", usage, err)
+	}
+	if usage, err := db.QueryUsage(ctx, "usage", util.ListQuery{Bucket: &none, Prefix: "docs/"}); err != nil || usage != (util.Usage{Bytes: 8, Objects: 1}) {
+		t.Errorf("Wrong usage of the folder without bucket: %+v, %v", usage, err)
+	}
+
+	list, err := db.ListMetadata(ctx, "usage", util.ListQuery{Bucket: &bucket, Sort: util.SortByName, Limit: 10})
+	if err != nil || len(list) != 3 || list[0].FileName != "Docs/c" || list[1].FileName != "docs/a" || list[2].FileName != "docs/sub/b" {
+		t.Errorf("Wrong order of names: %+v, %v", list, err)
+	}
+}
+
+//
+// This test indexes objects by name, tags and content, then searches them with boolean queries, by pages.
+// Pass if the matching objects are found, ranked by the weight of the matched words, and counted by facets.
+func TestSearchMetadata(t *testing.T) {
+
+	ctx := context.Background()
+	rows := []util.Row{
+		{Uuid: uuid.New().String(), FileName: "reports/annual-report.pdf", Bucket: "search", ContentType: "application/pdf", Tags: map[string]string{"year": "2023", "kind": "report"}, Tenant: "search"},
+		{Uuid: uuid.New().String(), FileName: "notes.txt", Bucket: "search", ContentType: "text/plain", Tags: map[string]string{"topic": "report"}, Tenant: "search"},
+		{Uuid: uuid.New().String(), FileName: "draft-report.txt", ContentType: "text/plain", Tenant: "search"},
+		{Uuid: uuid.New().String(), FileName: "report.txt", ContentType: "text/plain", Tenant: "other"},
+	}
+	for _, row := range rows {
+		if err := db.InsertMetadata(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteMetadata(ctx, row.Uuid)
+	}
+	if err := db.IndexContent(ctx, "search", rows[1].Uuid, util.ContentTerms("Quarterly figures, see the annual report")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		// Names weigh more than tags, tags more than content
+		{"report", []string{rows[0].Uuid, rows[2].Uuid, rows[1].Uuid}},
+		// Tag pairs select, but don't rank
+		{"content:quarter* OR tag:year=2023", []string{rows[1].Uuid, rows[0].Uuid}},
+		{"report -draft", []string{rows[0].Uuid, rows[1].Uuid}},
+		{"report type:text/* bucket:search", []string{rows[1].Uuid}},
+		{"name:figures", nil},
+	} {
+		expr, err := util.ParseSearchQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found []string
+		query := util.SearchQuery{Expr: expr, Limit: 1}
+		for {
+			hits, err := db.SearchMetadata(ctx, "search", query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hits) == 0 {
+				break
+			}
+			found = append(found, hits[0].Uuid)
+			query.After = &util.SearchCursor{Score: hits[0].Score, Uuid: hits[0].Uuid}
+		}
+		if !reflect.DeepEqual(found, test.expected) {
+			t.Errorf("Query %q: expected %v, got %v", test.query, test.expected, found)
+		}
+	}
+
+	expr, _ := util.ParseSearchQuery("report")
+	facets, err := db.SearchFacets(ctx, "search", expr)
+	if err != nil || facets.ContentTypes["text/plain"] != 2 || facets.ContentTypes["application/pdf"] != 1 || facets.Buckets["search"] != 2 || facets.Buckets[""] != 1 {
+		t.Errorf("Wrong facets: %+v, %v", facets, err)
+	}
+}
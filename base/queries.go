@@ -0,0 +1,63 @@
+package base
+
+import "strings"
+
+// Columns of the metadata table, in the order they are scanned by scanMetadata
+var metaColumns = []string{"uuid", "fileName", "bucket", "size", "tenant", "createdAt", "contentType", "tags", "etag"}
+
+// queries are the statements of SqlDB, but the listings and searches whose filters vary.
+// They are prepared once per connection pool, see SqlDB.prepared, the others are never prepared
+type queries struct {
+	retrieveMetadata       string
+	retrieveMetadataByName string
+	tenantUsage            string
+	totalUsage             string
+	insertBucket           string
+	retrieveBucket         string
+	setBucketPolicy        string
+	insertAuditRecord      string
+	lastAuditRecord        string
+	// Metadata, tags and search terms are written together in transactions, by the statements prepared on the pool
+	insertMetadata   string
+	moveMetadata     string
+	updateTags       string
+	deleteMetadata   string
+	insertTag        string
+	deleteTags       string
+	deleteTerms      string
+	deleteIndexTerms string
+}
+
+// newQueries builds the queries for dialect. table returns the name of the table by label
+func newQueries(d dialect, table func(label string) string) queries {
+	meta, tag, term, bucket, audit := table("metadata"), table("tag"), table("term"), table("bucket"), table("audit")
+	auditColumns := "seq, time, principal, tenant, sourceIp, action, object, code, prevHash, hash"
+
+	return queries{
+		insertMetadata:         insertStatement(meta, metaColumns),
+		retrieveMetadata:       "SELECT " + strings.Join(metaColumns, ", ") + " FROM " + meta + " WHERE uuid = $1",
+		retrieveMetadataByName: "SELECT " + strings.Join(metaColumns, ", ") + " FROM " + meta + " WHERE tenant = $1 AND bucket = $2 AND fileName = $3",
+		moveMetadata:           "UPDATE " + meta + " SET bucket = $1, fileName = $2 WHERE uuid = $3",
+		updateTags:             "UPDATE " + meta + " SET tags = $1 WHERE uuid = $2 AND tags = $3",
+		deleteMetadata:         "DELETE FROM " + meta + " WHERE uuid = $1",
+		insertTag:              insertStatement(tag, []string{"uuid", "tenant", "tagKey", "tagValue"}),
+		deleteTags:             "DELETE FROM " + tag + " WHERE uuid = $1",
+		deleteTerms:            "DELETE FROM " + term + " WHERE uuid = $1",
+		deleteIndexTerms:       "DELETE FROM " + term + " WHERE uuid = $1 AND field <> $2",
+		tenantUsage:            "SELECT COALESCE(SUM(size), 0), COUNT(*) FROM " + meta + " WHERE tenant = $1",
+		totalUsage:             "SELECT COALESCE(SUM(size), 0), COUNT(*) FROM " + meta,
+		insertBucket:           d.insertIgnore(bucket, []string{"name", "owner", "tenant"}, "tenant, name"),
+		retrieveBucket:         "SELECT name, owner, policy, tenant FROM " + bucket + " WHERE tenant = $1 AND name = $2",
+		setBucketPolicy:        "UPDATE " + bucket + " SET policy = $1 WHERE tenant = $2 AND name = $3",
+		insertAuditRecord:      insertStatement(audit, []string{"seq", "time", "principal", "tenant", "sourceIp", "action", "object", "code", "prevHash", "hash"}),
+		lastAuditRecord:        "SELECT " + auditColumns + " FROM " + audit + " ORDER BY seq DESC LIMIT 1",
+	}
+}
+
+func (q queries) all() []string {
+	return []string{
+		q.retrieveMetadata, q.retrieveMetadataByName, q.tenantUsage, q.totalUsage,
+		q.insertBucket, q.retrieveBucket, q.setBucketPolicy, q.insertAuditRecord, q.lastAuditRecord,
+		q.insertMetadata, q.moveMetadata, q.updateTags, q.deleteMetadata, q.insertTag, q.deleteTags, q.deleteTerms, q.deleteIndexTerms,
+	}
+}
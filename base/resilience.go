@@ -0,0 +1,412 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+	sqldriver "database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+//================
+// Circuit breaker
+//================
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Values of the state gauge
+var breakerStateValues = map[string]float64{BreakerClosed: 0, BreakerHalfOpen: 1, BreakerOpen: 2}
+
+// Breaker stops calling the database after consecutive failures, failing calls fast with CircuitOpenError.
+// Once the cooldown is over, one call at a time probes the database: the first probe succeeding closes the breaker
+type Breaker struct {
+	mu sync.Mutex
+	// Consecutive failures opening the breaker. 0 disables it
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	gauge     metrics.Gauge
+	logger    *util.Logger
+}
+
+// NewBreaker returns a closed breaker, opening after threshold consecutive failures.
+// gauge is set to 0, 1 or 2 when the breaker is closed, half-open or open
+func NewBreaker(threshold int, cooldown time.Duration, gauge metrics.Gauge, logger *util.Logger) *Breaker {
+	gauge.Set(breakerStateValues[BreakerClosed])
+	return &Breaker{threshold: threshold, cooldown: cooldown, state: BreakerClosed, gauge: gauge, logger: logger}
+}
+
+// State returns the state of the breaker and, if open, when the next probe is let through
+func (b *Breaker) State() (string, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		return b.state, b.openedAt.Add(b.cooldown)
+	}
+	return b.state, time.Time{}
+}
+
+// allow returns CircuitOpenError if the call can't be attempted.
+// probe is true if the call probes a half-open breaker
+func (b *Breaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.setState(BreakerHalfOpen)
+	}
+	switch {
+	case b.state == BreakerOpen, b.state == BreakerHalfOpen && b.probing:
+		return false, CircuitOpenError
+	case b.state == BreakerHalfOpen:
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the outcome of a call let through by allow
+func (b *Breaker) done(probe bool, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		if probe {
+			b.probing = false
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if probe || (b.state == BreakerClosed && b.threshold > 0 && b.failures >= b.threshold) {
+		b.probing = false
+		b.openedAt = time.Now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// abort releases a call let through by allow, whose outcome tells nothing about the database
+func (b *Breaker) abort(probe bool) {
+	if probe {
+		b.mu.Lock()
+		b.probing = false
+		b.mu.Unlock()
+	}
+}
+
+// setState changes the state, b.mu must be held
+func (b *Breaker) setState(state string) {
+	if state == b.state {
+		return
+	}
+	if state == BreakerOpen {
+		b.logger.Warnf("Database circuit breaker open after %d consecutive failures, probing again in %s", b.failures, b.cooldown)
+	} else {
+		b.logger.Infof("Database circuit breaker %s", state)
+	}
+	b.state = state
+	b.gauge.Set(breakerStateValues[state])
+}
+
+//==============
+// Error classes
+//==============
+
+// errorClass tells whether an error is transient, and why
+type errorClass string
+
+const (
+	// Success, or an error that won't change by retrying
+	permanentError errorClass = ""
+	// The transaction was rolled back because of concurrent ones: safe to retry
+	conflictError errorClass = "conflict"
+	// The database is unreachable or overloaded. Counts as a failure of the breaker
+	unavailableError errorClass = "unavailable"
+)
+
+func classify(err error) errorClass {
+	if err == nil || err == NotFoundError {
+		return permanentError
+	}
+	for _, target := range []error{TimeoutError, sqldriver.ErrBadConn, sql.ErrConnDone, mysql.ErrInvalidConn, io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET} {
+		if errors.Is(err, target) {
+			return unavailableError
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return unavailableError
+	}
+
+	var pqErr *pq.Error
+	var mysqlErr *mysql.MySQLError
+	var sqliteErr *sqlite.Error
+	switch {
+	case errors.As(err, &pqErr):
+		// serialization_failure, deadlock_detected, then connection_exception, insufficient_resources, operator_intervention
+		switch {
+		case pqErr.Code == "40001" || pqErr.Code == "40P01":
+			return conflictError
+		case pqErr.Code.Class() == "08" || pqErr.Code.Class() == "53" || pqErr.Code.Class() == "57":
+			return unavailableError
+		}
+	case errors.As(err, &mysqlErr):
+		// ER_LOCK_DEADLOCK, ER_LOCK_WAIT_TIMEOUT, then ER_CON_COUNT_ERROR, ER_SERVER_SHUTDOWN
+		switch mysqlErr.Number {
+		case 1213, 1205:
+			return conflictError
+		case 1040, 1053:
+			return unavailableError
+		}
+	case errors.As(err, &sqliteErr):
+		// SQLITE_BUSY, SQLITE_LOCKED and their extended codes
+		if code := sqliteErr.Code() & 0xff; code == 5 || code == 6 {
+			return conflictError
+		}
+	}
+	return permanentError
+}
+
+//==============
+// Resilient DB
+//==============
+
+// resilientDB decorates a DB with a timeout for every attempt, retries of transient errors and a circuit breaker.
+type resilientDB struct {
+	next    DB
+	config  util.ResilienceConfig
+	breaker *Breaker
+	retries metrics.Counter
+	logger  *util.Logger
+}
+
+// NewResilientDB returns a DB whose calls to next go through breaker, are timed out, and are retried
+// with jittered exponential backoff. Conflicts are always retried; unavailability errors only by reads,
+// since a write may have been applied. retries counts the retries by method and reason
+func NewResilientDB(next DB, config util.ResilienceConfig, breaker *Breaker, retries metrics.Counter, logger *util.Logger) DB {
+	return &resilientDB{next: next, config: config, breaker: breaker, retries: retries, logger: logger}
+}
+
+// call runs fn as method, see NewResilientDB. Every attempt is given ctx with the timeout, unless fn returns rows:
+// they are read after the call returns, thus the timeout would cut them off.
+// Once ctx is done the call is neither retried nor counted by the breaker: the caller went away
+func call[T any](ctx context.Context, db *resilientDB, method string, idempotent bool, fn func(ctx context.Context) (T, error)) (T, error) {
+	var zero T
+	_, rows := any(zero).(*sql.Rows)
+	for attempt := 0; ; attempt++ {
+		probe, err := db.breaker.allow()
+		if err != nil {
+			return zero, err
+		}
+		attemptCtx, cancel := db.attempt(ctx, !rows)
+		ret, err := fn(attemptCtx)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			db.breaker.abort(probe)
+			return ret, err
+		}
+		if err != nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w: %s", TimeoutError, err.Error())
+		}
+		class := classify(err)
+		db.breaker.done(probe, class == unavailableError)
+
+		if class == permanentError || attempt >= db.config.Retries || (class == unavailableError && !idempotent) {
+			return ret, err
+		}
+		db.retries.With("method", method, "reason", string(class)).Add(1)
+		db.logger.WithContext(ctx).Warnf("%s failed, retrying: %s", method, err.Error())
+		select {
+		case <-time.After(db.backoff(attempt)):
+		case <-ctx.Done():
+			return ret, ctx.Err()
+		}
+	}
+}
+
+// callErr is call, for methods returning only an error
+func callErr(ctx context.Context, db *resilientDB, method string, idempotent bool, fn func(ctx context.Context) error) error {
+	_, err := call(ctx, db, method, idempotent, func(ctx context.Context) (struct{}, error) { return struct{}{}, fn(ctx) })
+	return err
+}
+
+// attempt returns the context of an attempt: ctx with the timeout, if set and timed
+func (db *resilientDB) attempt(ctx context.Context, timed bool) (context.Context, context.CancelFunc) {
+	if db.config.Timeout <= 0 || !timed {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, time.Duration(db.config.Timeout))
+}
+
+// backoff returns the delay before the retry after attempt: the base delay doubled at every attempt, half of it random
+func (db *resilientDB) backoff(attempt int) time.Duration {
+	d := time.Duration(db.config.RetryBackoff) << attempt
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (db *resilientDB) Connect(driver string, dsn string) error {
+	return db.next.Connect(driver, dsn)
+}
+
+func (db *resilientDB) Init(ctx context.Context) error {
+	return db.next.Init(ctx)
+}
+
+func (db *resilientDB) tearDown() error {
+	return db.next.tearDown()
+}
+
+func (db *resilientDB) ExecContext(ctx context.Context, statement string, params ...any) (sql.Result, error) {
+	return call(ctx, db, "ExecContext", false, func(ctx context.Context) (sql.Result, error) {
+		return db.next.ExecContext(ctx, statement, params...)
+	})
+}
+
+// Queries are not timed out, since their rows are read after the call returns. They are abandoned with ctx
+func (db *resilientDB) QueryContext(ctx context.Context, statement string, params ...any) (*sql.Rows, error) {
+	return call(ctx, db, "QueryContext", true, func(ctx context.Context) (*sql.Rows, error) {
+		return db.next.QueryContext(ctx, statement, params...)
+	})
+}
+
+func (db *resilientDB) InsertMetadata(ctx context.Context, row util.Row) error {
+	return callErr(ctx, db, "InsertMetadata", false, func(ctx context.Context) error { return db.next.InsertMetadata(ctx, row) })
+}
+
+func (db *resilientDB) ReplaceMetadata(ctx context.Context, uuid string, row util.Row) error {
+	return callErr(ctx, db, "ReplaceMetadata", false, func(ctx context.Context) error { return db.next.ReplaceMetadata(ctx, uuid, row) })
+}
+
+func (db *resilientDB) MoveMetadata(ctx context.Context, row util.Row, replaced string) error {
+	return callErr(ctx, db, "MoveMetadata", false, func(ctx context.Context) error { return db.next.MoveMetadata(ctx, row, replaced) })
+}
+
+// Retrying an applied update finds the tags changed
+func (db *resilientDB) UpdateTags(ctx context.Context, row util.Row, tags map[string]string) error {
+	return callErr(ctx, db, "UpdateTags", false, func(ctx context.Context) error { return db.next.UpdateTags(ctx, row, tags) })
+}
+
+func (db *resilientDB) RetrieveMetadata(ctx context.Context, uuid string) (util.Row, error) {
+	return call(ctx, db, "RetrieveMetadata", true, func(ctx context.Context) (util.Row, error) {
+		return db.next.RetrieveMetadata(ctx, uuid)
+	})
+}
+
+func (db *resilientDB) RetrieveMetadataByName(ctx context.Context, tenant, bucket, name string) (util.Row, error) {
+	return call(ctx, db, "RetrieveMetadataByName", true, func(ctx context.Context) (util.Row, error) {
+		return db.next.RetrieveMetadataByName(ctx, tenant, bucket, name)
+	})
+}
+
+func (db *resilientDB) DeleteMetadata(ctx context.Context, uuid string) error {
+	return callErr(ctx, db, "DeleteMetadata", false, func(ctx context.Context) error { return db.next.DeleteMetadata(ctx, uuid) })
+}
+
+func (db *resilientDB) ListMetadata(ctx context.Context, tenant string, query util.ListQuery) ([]util.Row, error) {
+	return call(ctx, db, "ListMetadata", true, func(ctx context.Context) ([]util.Row, error) {
+		return db.next.ListMetadata(ctx, tenant, query)
+	})
+}
+
+func (db *resilientDB) QueryUsage(ctx context.Context, tenant string, query util.ListQuery) (util.Usage, error) {
+	return call(ctx, db, "QueryUsage", true, func(ctx context.Context) (util.Usage, error) {
+		return db.next.QueryUsage(ctx, tenant, query)
+	})
+}
+
+func (db *resilientDB) SearchMetadata(ctx context.Context, tenant string, query util.SearchQuery) ([]util.SearchHit, error) {
+	return call(ctx, db, "SearchMetadata", true, func(ctx context.Context) ([]util.SearchHit, error) {
+		return db.next.SearchMetadata(ctx, tenant, query)
+	})
+}
+
+func (db *resilientDB) SearchFacets(ctx context.Context, tenant string, expr util.SearchExpr) (util.SearchFacets, error) {
+	return call(ctx, db, "SearchFacets", true, func(ctx context.Context) (util.SearchFacets, error) {
+		return db.next.SearchFacets(ctx, tenant, expr)
+	})
+}
+
+// The words of the content are replaced, thus retrying is safe
+func (db *resilientDB) IndexContent(ctx context.Context, tenant string, uuid string, terms []util.SearchTerm) error {
+	return callErr(ctx, db, "IndexContent", true, func(ctx context.Context) error {
+		return db.next.IndexContent(ctx, tenant, uuid, terms)
+	})
+}
+
+// Reindexing runs for much longer than an attempt, thus is not decorated, like Init
+func (db *resilientDB) ReindexMetadata(ctx context.Context) (int, error) {
+	return db.next.ReindexMetadata(ctx)
+}
+
+func (db *resilientDB) TenantUsage(ctx context.Context, tenant string) (util.Usage, error) {
+	return call(ctx, db, "TenantUsage", true, func(ctx context.Context) (util.Usage, error) {
+		return db.next.TenantUsage(ctx, tenant)
+	})
+}
+
+func (db *resilientDB) TotalUsage(ctx context.Context) (util.Usage, error) {
+	return call(ctx, db, "TotalUsage", true, db.next.TotalUsage)
+}
+
+func (db *resilientDB) InsertBucket(ctx context.Context, bucket util.Bucket) error {
+	return callErr(ctx, db, "InsertBucket", false, func(ctx context.Context) error { return db.next.InsertBucket(ctx, bucket) })
+}
+
+func (db *resilientDB) RetrieveBucket(ctx context.Context, tenant string, name string) (util.Bucket, error) {
+	return call(ctx, db, "RetrieveBucket", true, func(ctx context.Context) (util.Bucket, error) {
+		return db.next.RetrieveBucket(ctx, tenant, name)
+	})
+}
+
+func (db *resilientDB) SetBucketPolicy(ctx context.Context, tenant string, name string, policy string) error {
+	return callErr(ctx, db, "SetBucketPolicy", true, func(ctx context.Context) error {
+		return db.next.SetBucketPolicy(ctx, tenant, name, policy)
+	})
+}
+
+func (db *resilientDB) InsertAuditRecord(ctx context.Context, record util.AuditRecord) error {
+	return callErr(ctx, db, "InsertAuditRecord", false, func(ctx context.Context) error {
+		return db.next.InsertAuditRecord(ctx, record)
+	})
+}
+
+func (db *resilientDB) LastAuditRecord(ctx context.Context) (util.AuditRecord, error) {
+	return call(ctx, db, "LastAuditRecord", true, db.next.LastAuditRecord)
+}
+
+func (db *resilientDB) ListAuditRecords(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
+	return call(ctx, db, "ListAuditRecords", true, func(ctx context.Context) ([]util.AuditRecord, error) {
+		return db.next.ListAuditRecords(ctx, filter, limit, offset)
+	})
+}
+
+// Ping is not retried, so that readiness reflects the current state. It probes the breaker when half-open
+func (db *resilientDB) Ping(ctx context.Context) error {
+	return callErr(ctx, db, "Ping", false, func(ctx context.Context) error { return db.next.Ping(ctx) })
+}
+
+func (db *resilientDB) Close() error {
+	return db.next.Close()
+}
@@ -0,0 +1,105 @@
+package base
+
+import (
+	"context"
+	sqldriver "database/sql/driver"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-sql-driver/mysql"
+)
+
+// flakyDB fails its first calls with errs, then succeeds
+type flakyDB struct {
+	DB
+	errs  []error
+	calls int
+}
+
+func (db *flakyDB) next() error {
+	db.calls++
+	if len(db.errs) == 0 {
+		return nil
+	}
+	err := db.errs[0]
+	db.errs = db.errs[1:]
+	return err
+}
+
+func (db *flakyDB) TotalUsage(ctx context.Context) (util.Usage, error) {
+	return util.Usage{Objects: 1}, db.next()
+}
+func (db *flakyDB) DeleteMetadata(ctx context.Context, uuid string) error { return db.next() }
+
+//
+// This test calls a read and a write failing with transient errors, then makes the database unavailable.
+// Pass if the read is retried, the write is retried only after a conflict, and the breaker opens, then closes after a probe.
+func TestResilientDB(t *testing.T) {
+
+	ctx := context.Background()
+	config := util.ResilienceConfig{Retries: 2, BreakerFailures: 3, BreakerCooldown: util.Duration(50 * time.Millisecond)}
+	breaker := NewBreaker(config.BreakerFailures, time.Duration(config.BreakerCooldown), discard.NewGauge(), testLogger)
+	flaky := &flakyDB{}
+	db := NewResilientDB(flaky, config, breaker, discard.NewCounter(), testLogger)
+
+	flaky.errs = []error{sqldriver.ErrBadConn, sqldriver.ErrBadConn}
+	if usage, err := db.TotalUsage(ctx); err != nil || usage.Objects != 1 || flaky.calls != 3 {
+		t.Errorf("Read not retried: %d calls, %v", flaky.calls, err)
+	}
+	flaky.calls, flaky.errs = 0, []error{sqldriver.ErrBadConn}
+	if err := db.DeleteMetadata(ctx, "1"); err != sqldriver.ErrBadConn || flaky.calls != 1 {
+		t.Errorf("Write retried after a connection error: %d calls, %v", flaky.calls, err)
+	}
+	flaky.calls, flaky.errs = 0, []error{&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}}
+	if err := db.DeleteMetadata(ctx, "1"); err != nil || flaky.calls != 2 {
+		t.Errorf("Write not retried after a conflict: %d calls, %v", flaky.calls, err)
+	}
+
+	flaky.calls, flaky.errs = 0, []error{sqldriver.ErrBadConn, sqldriver.ErrBadConn, sqldriver.ErrBadConn}
+	db.TotalUsage(ctx)
+	if state, _ := breaker.State(); state != BreakerOpen {
+		t.Fatalf("Breaker %s after 3 failures", state)
+	}
+	if _, err := db.TotalUsage(ctx); err != CircuitOpenError || flaky.calls != 3 {
+		t.Errorf("Open breaker let a call through: %d calls, %v", flaky.calls, err)
+	}
+	time.Sleep(time.Duration(config.BreakerCooldown))
+	if _, err := db.TotalUsage(ctx); err != nil {
+		t.Error(err)
+	}
+	if state, _ := breaker.State(); state != BreakerClosed {
+		t.Errorf("Breaker %s after a successful probe", state)
+	}
+}
+
+//
+// This test runs a query through a resilient DB with a short timeout, and reads its rows after the timeout.
+// Pass if every row is read, since the rows of queries are not cut off by the timeout.
+func TestResilientQueryNotTimedOut(t *testing.T) {
+
+	ctx := context.Background()
+	store := NewSqliteDatabase(testLogger)
+	if err := store.Connect("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	config := util.ResilienceConfig{Timeout: util.Duration(10 * time.Millisecond)}
+	db := NewResilientDB(store, config, NewBreaker(0, 0, discard.NewGauge(), testLogger), discard.NewCounter(), testLogger)
+
+	rows, err := db.QueryContext(ctx, "SELECT 1 UNION ALL SELECT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	time.Sleep(50 * time.Millisecond)
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	if err := rows.Err(); err != nil || n != 2 {
+		t.Errorf("%d rows read: %v", n, err)
+	}
+}
@@ -0,0 +1,218 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/erizzardi/storage/util"
+)
+
+// Rows of search_term inserted per statement
+const termsPerInsert = 100
+
+// Objects reindexed per page by ReindexMetadata
+const reindexPageSize = 500
+
+// insertTerms inserts the terms of the object uuid, by batches of termsPerInsert rows
+func (sqldb *SqlDB) insertTerms(exec func(string, ...any) (sql.Result, error), tenant string, uuid string, terms []util.SearchTerm) error {
+
+	for len(terms) > 0 {
+		batch := terms
+		if len(batch) > termsPerInsert {
+			batch = batch[:termsPerInsert]
+		}
+		terms = terms[len(batch):]
+
+		values := make([]string, len(batch))
+		params := make([]any, 0, 5*len(batch))
+		for i, term := range batch {
+			n := len(params)
+			values[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5)
+			params = append(params, uuid, tenant, term.Field, term.Term, term.Weight)
+		}
+		if _, err := exec("INSERT INTO "+sqldb.GetTableFromLabel("term")+" (uuid, tenant, field, term, weight) VALUES "+strings.Join(values, ", "), params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IndexContent adds the words of the content of the object to the index, replacing the ones already there
+func (sqldb *SqlDB) IndexContent(ctx context.Context, tenant string, uuid string, terms []util.SearchTerm) error {
+
+	return sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+		if _, err := exec("DELETE FROM "+sqldb.GetTableFromLabel("term")+" WHERE uuid = $1 AND field = $2", uuid, util.SearchContent); err != nil {
+			return err
+		}
+		return sqldb.insertTerms(exec, tenant, uuid, terms)
+	})
+}
+
+// ReindexMetadata rewrites the words of names and tags of every object in the index, by pages in uuid order.
+// Words of the content are kept
+func (sqldb *SqlDB) ReindexMetadata(ctx context.Context) (int, error) {
+
+	statementString := "SELECT " + strings.Join(metaColumns, ", ") + " FROM " + sqldb.GetTableFromLabel("metadata") + " WHERE uuid > $1 ORDER BY uuid LIMIT $2"
+	// Smaller than every uuid, also for the uuid type of postgres
+	count, after := 0, "00000000-0000-0000-0000-000000000000"
+	for {
+		page, err := sqldb.queryRows(ctx, statementString, after, reindexPageSize)
+		if err != nil {
+			return count, err
+		}
+		for _, row := range page {
+			err := sqldb.inTx(ctx, func(exec func(string, ...any) (sql.Result, error)) error {
+				if _, err := exec(sqldb.queries.deleteIndexTerms, row.Uuid, util.SearchContent); err != nil {
+					return err
+				}
+				return sqldb.insertTerms(exec, row.Tenant, row.Uuid, util.IndexTerms(row))
+			})
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(page) < reindexPageSize {
+			return count, nil
+		}
+		after = page[len(page)-1].Uuid
+	}
+}
+
+// SearchMetadata returns the objects of tenant matching query.Expr, by decreasing score then uuid, following query.After.
+// The score is computed by a subquery, thus the matching objects are ranked before paging
+func (sqldb *SqlDB) SearchMetadata(ctx context.Context, tenant string, query util.SearchQuery) ([]util.SearchHit, error) {
+
+	where := &conditions{}
+	columns := make([]string, len(metaColumns))
+	for i, column := range metaColumns {
+		columns[i] = "m." + column
+	}
+	score := sqldb.searchScore(where, query.Expr)
+	where.add("m.tenant = $%d", tenant)
+	where.conditions = append(where.conditions, sqldb.searchCondition(where, tenant, query.Expr))
+	statementString := "SELECT " + strings.Join(metaColumns, ", ") + ", score FROM (SELECT " + strings.Join(columns, ", ") + ", " + score + " AS score FROM " +
+		sqldb.GetTableFromLabel("metadata") + " m" + where.clause() + ") r"
+	if query.After != nil {
+		score := where.param(query.After.Score)
+		statementString += " WHERE score < " + score + " OR (score = " + score + " AND uuid > " + where.param(query.After.Uuid) + ")"
+	}
+	where.params = append(where.params, query.Limit)
+	statementString += fmt.Sprintf(" ORDER BY score DESC, uuid ASC LIMIT $%d", len(where.params))
+
+	ret := make([]util.SearchHit, 0)
+	rows, err := sqldb.QueryContext(ctx, statementString, where.params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hit util.SearchHit
+		var bucket, tenant sql.NullString
+		var tags string
+		if err := rows.Scan(&hit.Uuid, &hit.FileName, &bucket, &hit.Size, &tenant, &hit.CreatedAt, &hit.ContentType, &tags, &hit.ETag, &hit.Score); err != nil {
+			return nil, err
+		}
+		hit.Bucket, hit.Tenant = bucket.String, tenant.String
+		if hit.Tags, err = unmarshalTags(tags); err != nil {
+			return nil, err
+		}
+		ret = append(ret, hit)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SearchFacets counts the objects of tenant matching expr by content type and by bucket
+func (sqldb *SqlDB) SearchFacets(ctx context.Context, tenant string, expr util.SearchExpr) (util.SearchFacets, error) {
+
+	ret := util.SearchFacets{ContentTypes: make(map[string]int64), Buckets: make(map[string]int64)}
+	for column, counts := range map[string]map[string]int64{"m.contentType": ret.ContentTypes, "COALESCE(m.bucket, '')": ret.Buckets} {
+		where := &conditions{}
+		where.add("m.tenant = $%d", tenant)
+		where.conditions = append(where.conditions, sqldb.searchCondition(where, tenant, expr))
+		statementString := "SELECT " + column + ", COUNT(*) FROM " + sqldb.GetTableFromLabel("metadata") + " m" + where.clause() + " GROUP BY " + column
+
+		rows, err := sqldb.QueryContext(ctx, statementString, where.params...)
+		if err != nil {
+			return util.SearchFacets{}, err
+		}
+		for rows.Next() {
+			var value string
+			var count int64
+			if err := rows.Scan(&value, &count); err != nil {
+				rows.Close()
+				return util.SearchFacets{}, err
+			}
+			counts[value] = count
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return util.SearchFacets{}, err
+		}
+	}
+	return ret, nil
+}
+
+// searchCondition compiles expr into a condition on the objects of tenant in the metadata table aliased m,
+// adding its parameters to where. Words are looked up in the (tenant, term, uuid) index
+func (sqldb *SqlDB) searchCondition(where *conditions, tenant string, expr util.SearchExpr) string {
+
+	switch expr.Op {
+	case util.SearchAnd, util.SearchOr:
+		operands := make([]string, len(expr.Operands))
+		for i, operand := range expr.Operands {
+			operands[i] = sqldb.searchCondition(where, tenant, operand)
+		}
+		return "(" + strings.Join(operands, " "+strings.ToUpper(expr.Op)+" ") + ")"
+	case util.SearchNot:
+		return "NOT " + sqldb.searchCondition(where, tenant, expr.Operands[0])
+	}
+
+	switch {
+	case expr.Key != "":
+		return fmt.Sprintf("m.uuid IN (SELECT uuid FROM "+sqldb.GetTableFromLabel("tag")+" WHERE tenant = %s AND tagKey = %s AND tagValue = %s)",
+			where.param(tenant), where.param(expr.Key), where.param(expr.Value))
+	case expr.Field == util.SearchType:
+		return "m.contentType" + matchValue(where, expr)
+	case expr.Field == util.SearchBucket:
+		return "COALESCE(m.bucket, '')" + matchValue(where, expr)
+	}
+	condition := "m.uuid IN (SELECT uuid FROM " + sqldb.GetTableFromLabel("term") + " WHERE tenant = " + where.param(tenant) + " AND term" + matchValue(where, expr)
+	if expr.Field != "" {
+		condition += " AND field = " + where.param(expr.Field)
+	}
+	return condition + ")"
+}
+
+// searchScore returns the expression of the score of the object m: the weights of its words matched by the scored terms of expr,
+// adding its parameters to where
+func (sqldb *SqlDB) searchScore(where *conditions, expr util.SearchExpr) string {
+
+	scored := expr.Scored()
+	if len(scored) == 0 {
+		return "0"
+	}
+	matches := make([]string, len(scored))
+	for i, term := range scored {
+		matches[i] = "(s.term" + matchValue(where, term)
+		if term.Field != "" {
+			matches[i] += " AND s.field = " + where.param(term.Field)
+		}
+		matches[i] += ")"
+	}
+	return "(SELECT COALESCE(SUM(s.weight), 0) FROM " + sqldb.GetTableFromLabel("term") + " s WHERE s.uuid = m.uuid AND (" + strings.Join(matches, " OR ") + "))"
+}
+
+// matchValue returns the comparison of a column with the value of expr, exact or by prefix
+func matchValue(where *conditions, expr util.SearchExpr) string {
+	if expr.Prefix {
+		return " LIKE " + where.param(likePrefix(expr.Value)) + " ESCAPE '!'"
+	}
+	return " = " + where.param(expr.Value)
+}
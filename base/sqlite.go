@@ -0,0 +1,46 @@
+package base
+
+import (
+	"strings"
+
+	"github.com/erizzardi/storage/util"
+	_ "modernc.org/sqlite"
+)
+
+// SQLite pragmas set on every connection: waiting on locked database instead of failing,
+// write-ahead logging, so that readers don't block the writer, and case sensitive LIKE, as in postgres,
+// which lets name prefixes use the indexes
+var sqlitePragmas = []string{
+	"busy_timeout(5000)",
+	"journal_mode(WAL)",
+	"case_sensitive_like(1)",
+}
+
+// SqliteDB is the SQLite implementation of DB, through the pure-Go modernc.org/sqlite driver.
+// Schema and queries are shared with SqlDB, through sqliteDialect
+type SqliteDB struct {
+	*SqlDB
+}
+
+func NewSqliteDatabase(logger *util.Logger) DB {
+	return &SqliteDB{SqlDB: newSqlDB(logger, sqliteDialect{})}
+}
+
+// Connect opens the database file at dsn, creating it if it doesn't exist
+func (sqlitedb *SqliteDB) Connect(driver string, dsn string) error {
+	return sqlitedb.SqlDB.Connect(driver, sqliteDSN(dsn))
+}
+
+// sqliteDSN turns a file path into a DSN that carries sqlitePragmas
+func sqliteDSN(path string) string {
+	dsn := path
+	for _, pragma := range sqlitePragmas {
+		if strings.Contains(dsn, "?") {
+			dsn += "&"
+		} else {
+			dsn += "?"
+		}
+		dsn += "_pragma=" + pragma
+	}
+	return dsn
+}
@@ -0,0 +1,129 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+)
+
+//
+// This test runs an endless query while serving a request, whose client gives up.
+// Pass if the query is canceled with the request.
+func TestQueryCanceledWithRequest(t *testing.T) {
+
+	store := NewSqliteDatabase(testLogger)
+	if err := store.Connect("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	queryErr := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rows, err := store.QueryContext(r.Context(), "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT COUNT(*) FROM c")
+		if err == nil {
+			for rows.Next() {
+			}
+			err = rows.Err()
+			rows.Close()
+		}
+		queryErr <- err
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Fatal("Endless query completed")
+	}
+
+	select {
+	case err := <-queryErr:
+		if err == nil {
+			t.Error("Query not canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Query still running 5 seconds after the client went away")
+	}
+}
+
+//
+// This test runs statements that aren't queries of the DB, as searches and listings with filters build.
+// Pass if they run, and only the queries of the DB are prepared.
+func TestDynamicStatementsNotPrepared(t *testing.T) {
+
+	ctx := context.Background()
+	store := NewSqliteDatabase(testLogger).(*SqliteDB)
+	if err := store.Connect("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		rows, err := store.QueryContext(ctx, "SELECT uuid FROM meta WHERE size > $1"+strings.Repeat(" AND size > $1", i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows.Close()
+	}
+	if _, err := store.RetrieveMetadata(ctx, "3f2a7c4e-9b1d-4e8a-a5c6-0d7e1f2b3c4d"); err == nil {
+		t.Error("Missing object found")
+	}
+	if n := len(store.statements); n != len(store.queries.all()) {
+		t.Errorf("%d statements prepared, expected the %d queries", n, len(store.queries.all()))
+	}
+}
+
+// questionMarkDialect is SQLite with the placeholders of MySQL, which SQLite accepts too
+type questionMarkDialect struct {
+	sqliteDialect
+}
+
+func (questionMarkDialect) bind(statement string, params []any) (string, []any) {
+	return mysqlDialect{}.bind(statement, params)
+}
+
+func (questionMarkDialect) placeholders(statement string) string {
+	return mysqlDialect{}.placeholders(statement)
+}
+
+//
+// This test initializes a database whose dialect rewrites placeholders, then writes and reads an object.
+// Pass if Init prepares every query, and ExecContext and QueryContext find the statements Init prepared.
+func TestPreparedStatementsFound(t *testing.T) {
+
+	ctx := context.Background()
+	store := &SqliteDB{SqlDB: newSqlDB(testLogger, questionMarkDialect{})}
+	if err := store.Connect("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range store.queries.all() {
+		if _, statement := store.statement(query); statement == nil {
+			t.Error("Statement not found: " + query)
+		}
+	}
+	row := util.Row{Uuid: "3f2a7c4e-9b1d-4e8a-a5c6-0d7e1f2b3c4d", FileName: "a.txt", Tags: map[string]string{"k": "v"}}
+	if err := store.InsertMetadata(ctx, row); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.RetrieveMetadata(ctx, row.Uuid); err != nil {
+		t.Error(err)
+	}
+	if n := len(store.statements); n != len(store.queries.all()) {
+		t.Errorf("%d statements prepared, expected the %d queries", n, len(store.queries.all()))
+	}
+}
@@ -0,0 +1,198 @@
+package base
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/erizzardi/storage/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/erizzardi/storage/base")
+
+// tracedDB decorates a DB, tracing every call as a child span of the span in its ctx.
+type tracedDB struct {
+	next DB
+}
+
+// NewTracedDB returns a DB whose calls are traced as children of the span in their ctx
+func NewTracedDB(next DB) DB {
+	return &tracedDB{next: next}
+}
+
+// start starts the span of method. The returned ctx carries it, to be passed to next
+func (db *tracedDB) start(ctx context.Context, method string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "db."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+}
+
+// end records err in the span and ends it
+func end(span trace.Span, err error) {
+	if err != nil && err != NotFoundError {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (db *tracedDB) Connect(driver string, dsn string) error {
+	return db.next.Connect(driver, dsn)
+}
+
+func (db *tracedDB) Init(ctx context.Context) error {
+	return db.next.Init(ctx)
+}
+
+func (db *tracedDB) tearDown() error {
+	return db.next.tearDown()
+}
+
+func (db *tracedDB) ExecContext(ctx context.Context, statement string, params ...any) (res sql.Result, err error) {
+	ctx, span := db.start(ctx, "ExecContext", attribute.String("db.statement", statement))
+	defer func() { end(span, err) }()
+	return db.next.ExecContext(ctx, statement, params...)
+}
+
+func (db *tracedDB) QueryContext(ctx context.Context, statement string, params ...any) (rows *sql.Rows, err error) {
+	ctx, span := db.start(ctx, "QueryContext", attribute.String("db.statement", statement))
+	defer func() { end(span, err) }()
+	return db.next.QueryContext(ctx, statement, params...)
+}
+
+func (db *tracedDB) InsertMetadata(ctx context.Context, row util.Row) (err error) {
+	ctx, span := db.start(ctx, "InsertMetadata")
+	defer func() { end(span, err) }()
+	return db.next.InsertMetadata(ctx, row)
+}
+
+func (db *tracedDB) ReplaceMetadata(ctx context.Context, uuid string, row util.Row) (err error) {
+	ctx, span := db.start(ctx, "ReplaceMetadata")
+	defer func() { end(span, err) }()
+	return db.next.ReplaceMetadata(ctx, uuid, row)
+}
+
+func (db *tracedDB) MoveMetadata(ctx context.Context, row util.Row, replaced string) (err error) {
+	ctx, span := db.start(ctx, "MoveMetadata")
+	defer func() { end(span, err) }()
+	return db.next.MoveMetadata(ctx, row, replaced)
+}
+
+func (db *tracedDB) UpdateTags(ctx context.Context, row util.Row, tags map[string]string) (err error) {
+	ctx, span := db.start(ctx, "UpdateTags")
+	defer func() { end(span, err) }()
+	return db.next.UpdateTags(ctx, row, tags)
+}
+
+func (db *tracedDB) RetrieveMetadata(ctx context.Context, uuid string) (row util.Row, err error) {
+	ctx, span := db.start(ctx, "RetrieveMetadata")
+	defer func() { end(span, err) }()
+	return db.next.RetrieveMetadata(ctx, uuid)
+}
+
+func (db *tracedDB) RetrieveMetadataByName(ctx context.Context, tenant, bucket, name string) (row util.Row, err error) {
+	ctx, span := db.start(ctx, "RetrieveMetadataByName")
+	defer func() { end(span, err) }()
+	return db.next.RetrieveMetadataByName(ctx, tenant, bucket, name)
+}
+
+func (db *tracedDB) DeleteMetadata(ctx context.Context, uuid string) (err error) {
+	ctx, span := db.start(ctx, "DeleteMetadata")
+	defer func() { end(span, err) }()
+	return db.next.DeleteMetadata(ctx, uuid)
+}
+
+func (db *tracedDB) ListMetadata(ctx context.Context, tenant string, query util.ListQuery) (rows []util.Row, err error) {
+	ctx, span := db.start(ctx, "ListMetadata", attribute.String("db.list.sort", query.Sort))
+	defer func() { end(span, err) }()
+	return db.next.ListMetadata(ctx, tenant, query)
+}
+
+func (db *tracedDB) QueryUsage(ctx context.Context, tenant string, query util.ListQuery) (usage util.Usage, err error) {
+	ctx, span := db.start(ctx, "QueryUsage")
+	defer func() { end(span, err) }()
+	return db.next.QueryUsage(ctx, tenant, query)
+}
+
+func (db *tracedDB) SearchMetadata(ctx context.Context, tenant string, query util.SearchQuery) (hits []util.SearchHit, err error) {
+	ctx, span := db.start(ctx, "SearchMetadata")
+	defer func() { end(span, err) }()
+	return db.next.SearchMetadata(ctx, tenant, query)
+}
+
+func (db *tracedDB) SearchFacets(ctx context.Context, tenant string, expr util.SearchExpr) (facets util.SearchFacets, err error) {
+	ctx, span := db.start(ctx, "SearchFacets")
+	defer func() { end(span, err) }()
+	return db.next.SearchFacets(ctx, tenant, expr)
+}
+
+func (db *tracedDB) IndexContent(ctx context.Context, tenant string, uuid string, terms []util.SearchTerm) (err error) {
+	ctx, span := db.start(ctx, "IndexContent")
+	defer func() { end(span, err) }()
+	return db.next.IndexContent(ctx, tenant, uuid, terms)
+}
+
+func (db *tracedDB) ReindexMetadata(ctx context.Context) (count int, err error) {
+	ctx, span := db.start(ctx, "ReindexMetadata")
+	defer func() { end(span, err) }()
+	return db.next.ReindexMetadata(ctx)
+}
+
+func (db *tracedDB) TenantUsage(ctx context.Context, tenant string) (usage util.Usage, err error) {
+	ctx, span := db.start(ctx, "TenantUsage")
+	defer func() { end(span, err) }()
+	return db.next.TenantUsage(ctx, tenant)
+}
+
+func (db *tracedDB) TotalUsage(ctx context.Context) (usage util.Usage, err error) {
+	ctx, span := db.start(ctx, "TotalUsage")
+	defer func() { end(span, err) }()
+	return db.next.TotalUsage(ctx)
+}
+
+func (db *tracedDB) InsertBucket(ctx context.Context, bucket util.Bucket) (err error) {
+	ctx, span := db.start(ctx, "InsertBucket")
+	defer func() { end(span, err) }()
+	return db.next.InsertBucket(ctx, bucket)
+}
+
+func (db *tracedDB) RetrieveBucket(ctx context.Context, tenant string, name string) (bucket util.Bucket, err error) {
+	ctx, span := db.start(ctx, "RetrieveBucket")
+	defer func() { end(span, err) }()
+	return db.next.RetrieveBucket(ctx, tenant, name)
+}
+
+func (db *tracedDB) SetBucketPolicy(ctx context.Context, tenant string, name string, policy string) (err error) {
+	ctx, span := db.start(ctx, "SetBucketPolicy")
+	defer func() { end(span, err) }()
+	return db.next.SetBucketPolicy(ctx, tenant, name, policy)
+}
+
+func (db *tracedDB) InsertAuditRecord(ctx context.Context, record util.AuditRecord) (err error) {
+	ctx, span := db.start(ctx, "InsertAuditRecord")
+	defer func() { end(span, err) }()
+	return db.next.InsertAuditRecord(ctx, record)
+}
+
+func (db *tracedDB) LastAuditRecord(ctx context.Context) (record util.AuditRecord, err error) {
+	ctx, span := db.start(ctx, "LastAuditRecord")
+	defer func() { end(span, err) }()
+	return db.next.LastAuditRecord(ctx)
+}
+
+func (db *tracedDB) ListAuditRecords(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) (records []util.AuditRecord, err error) {
+	ctx, span := db.start(ctx, "ListAuditRecords")
+	defer func() { end(span, err) }()
+	return db.next.ListAuditRecords(ctx, filter, limit, offset)
+}
+
+func (db *tracedDB) Ping(ctx context.Context) (err error) {
+	ctx, span := db.start(ctx, "Ping")
+	defer func() { end(span, err) }()
+	return db.next.Ping(ctx)
+}
+
+func (db *tracedDB) Close() error {
+	return db.next.Close()
+}
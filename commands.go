@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/erizzardi/storage/base"
+	"github.com/erizzardi/storage/util"
+)
+
+const usage = `Usage: storage [command]
+
+Without command, runs the server. Commands:
+  migrate up         applies the pending schema migrations
+  migrate down [N]   reverts the last N applied migrations, default 1
+  migrate status     lists the migrations, applied and pending
+  reindex            rebuilds the search index of names and tags, e.g. for objects stored before it existed`
+
+// runCommand runs the command in args, instead of the server
+func runCommand(config *util.Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(config, args[1:])
+	case "reindex":
+		return reindexCommand(config)
+	case "help", "-h", "--help":
+		fmt.Println(usage)
+		return nil
+	}
+	return errors.New("unknown command " + args[0] + "\n" + usage)
+}
+
+func migrateCommand(config *util.Config, args []string) error {
+
+	if len(args) == 0 || (args[0] != "up" && args[0] != "down" && args[0] != "status") {
+		return errors.New("migrate needs up, down or status\n" + usage)
+	}
+	steps := 1
+	if args[0] == "down" && len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number of migrations %s", args[1])
+		}
+		steps = n
+	}
+
+	db := newDB(config.DB)
+	migrator, ok := db.(base.Migrator)
+	if !ok {
+		return fmt.Errorf("the %s driver has no schema migrations", config.DB.Driver)
+	}
+	if err := db.Connect(config.DB.Driver, config.DB.DSN()); err != nil {
+		return errors.New("cannot connect to database: " + config.DB.Redact(err.Error()))
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	var migrations []base.MigrationStatus
+	var err error
+	switch args[0] {
+	case "up":
+		migrations, err = migrator.MigrateUp(ctx)
+		mainLogger.Infof("Applied %d migrations", len(migrations))
+	case "down":
+		migrations, err = migrator.MigrateDown(ctx, steps)
+		mainLogger.Infof("Reverted %d migrations", len(migrations))
+	case "status":
+		migrations, err = migrator.MigrationStatus(ctx)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range migrations {
+		appliedAt := m.AppliedAt
+		if appliedAt == "" {
+			appliedAt = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, appliedAt)
+	}
+	w.Flush()
+
+	return err
+}
+
+// reindexCommand runs on the undecorated database, since reindexing takes much longer than a query
+func reindexCommand(config *util.Config) error {
+
+	db := newDB(config.DB)
+	if err := db.Connect(config.DB.Driver, config.DB.DSN()); err != nil {
+		return errors.New("cannot connect to database: " + config.DB.Redact(err.Error()))
+	}
+	defer db.Close()
+
+	// Applies the migrations, as the server does at startup, thus the index exists
+	ctx := context.Background()
+	if err := db.Init(ctx); err != nil {
+		return errors.New("cannot initialize database: " + err.Error())
+	}
+	count, err := db.ReindexMetadata(ctx)
+	mainLogger.Infof("Reindexed %d objects", count)
+	return err
+}
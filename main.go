@@ -1,63 +1,56 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"syscall"
+	"time"
 
 	"github.com/erizzardi/storage/base"
 	"github.com/erizzardi/storage/pkg/storage"
+	"github.com/erizzardi/storage/pkg/storage/audit"
+	"github.com/erizzardi/storage/pkg/storage/certs"
 	"github.com/erizzardi/storage/pkg/storage/endpoints"
+	"github.com/erizzardi/storage/pkg/storage/health"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/presign"
 	"github.com/erizzardi/storage/pkg/storage/transport"
 	"github.com/erizzardi/storage/util"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/oklog/oklog/pkg/group"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
 
 	_ "github.com/lib/pq"
 )
 
-// defaults
-// some sensitive values shouldn't have defaults.
-// they'd need to be read from k8s secrets
-const (
-	defaultHTTPPort      = "8081"
-	defaultSSLMode       = "disable"
-	defaultLogLevel      = "INFO"
-	defaultStorageFolder = "./file-storage" // absolute path
-	defaultDBDriver      = "postgres"
-	defaultDBUsername    = "postgres"  // secret
-	defaultDBPassword    = "password"  // secret
-	defaultDBDatabase    = "metadata"  // secret
-	defaultDBIP          = "localhost" // secret
-	defaultDBPort        = "5432"      // secret
-	defaultDBTable       = "meta"
-)
+// Refresh interval of the metrics that need a database query
+const storageMetricsInterval = 30 * time.Second
 
-// global variables, read from environment
-var (
-	// variables with default
-	httpPort          = util.EnvString("STORAGE_HTTP_PORT", defaultHTTPPort)
-	sslMode           = util.EnvString("STORAGE_SSL_MODE", defaultSSLMode)
-	mainLogLevel      = util.EnvString("STORAGE_MAIN_LOG_LEVEL", defaultLogLevel)
-	serviceLogLevel   = util.EnvString("STORAGE_SERVICE_LOG_LEVEL", defaultLogLevel)
-	transportLogLevel = util.EnvString("STORAGE_TRANSPORT_LOG_LEVEL", defaultLogLevel)
-	endpointsLogLevel = util.EnvString("STORAGE_ENDPOINTS_LOG_LEVEL", defaultLogLevel)
-	databaseLogLevel  = util.EnvString("STORAGE_DB_LOG_LEVEL", defaultLogLevel)
-	storageFolder     = util.EnvString("STORAGE_FOLDER", defaultStorageFolder)
-	dbDriver          = util.EnvString("STORAGE_DB_DRIVER", defaultDBDriver)
-
-	// dbTable           = util.EnvString("STORAGE_DB_TABLE", defaultDBTable)
-
-	// variables without default (secrets)
-	dbUser     = os.Getenv("STORAGE_DB_USER")
-	dbPassword = os.Getenv("STORAGE_DB_PASSWORD")
-	dbDatabase = os.Getenv("STORAGE_DB_DATABASE")
-	dbHost     = os.Getenv("STORAGE_DB_HOST")
-	dbPort     = os.Getenv("STORAGE_DB_PORT")
-)
+// Interval between two checks of the database credential files
+const secretsCheckInterval = 10 * time.Second
+
+// Maximum duration of every readiness check
+const readinessCheckTimeout = 2 * time.Second
+
+// Time the status of finished background jobs is kept for
+const jobRetention = 24 * time.Hour
+
+// Path of the YAML configuration file. Optional: environment variables override it, defaults fill the gaps
+var configFile = os.Getenv("STORAGE_CONFIG_FILE")
 
 var (
 	// Loggers for every layer.
@@ -73,38 +66,114 @@ func main() {
 	//--------------
 	// Set up config
 	//--------------
-	var config = util.SetConfig(storageFolder)
+	config, err := util.LoadConfig(configFile)
+	if err != nil {
+		mainLogger.Fatal("Error: cannot load configuration: " + err.Error())
+	}
+	if err := setupLoggers(config.Logging); err != nil {
+		mainLogger.Fatal("Error: " + err.Error())
+	}
+	if len(os.Args) > 1 {
+		if err := runCommand(config, os.Args[1:]); err != nil {
+			mainLogger.Fatal("Error: " + err.Error())
+		}
+		return
+	}
+	mainLogger.Info("Configuration:\n" + config.Dump())
 	// Listening HTTP address
-	var httpAddr = net.JoinHostPort("localhost", httpPort)
+	var httpAddr = net.JoinHostPort("localhost", config.Server.Port)
+
+	//--------
+	// Metrics
+	//--------
+	var (
+		httpRequests = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "storage", Subsystem: "http", Name: "requests_total",
+			Help: "Number of HTTP requests, by route, method and status code.",
+		}, []string{"route", "method", "code"})
+		httpDuration = kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "storage", Subsystem: "http", Name: "request_duration_seconds",
+			Help:    "Latency of HTTP requests, by route, method and status code.",
+			Buckets: stdprometheus.DefBuckets,
+		}, []string{"route", "method", "code"})
+		dbDuration = kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "storage", Subsystem: "db", Name: "query_duration_seconds",
+			Help:    "Latency of database calls, by method.",
+			Buckets: stdprometheus.DefBuckets,
+		}, []string{"method"})
+		dbRetries = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "storage", Subsystem: "db", Name: "retries_total",
+			Help: "Retries of database calls, by method and reason: conflict or unavailable.",
+		}, []string{"method", "reason"})
+		dbBreakerState = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "storage", Subsystem: "db", Name: "circuit_breaker_state",
+			Help: "State of the database circuit breaker: 0 closed, 1 half-open, 2 open.",
+		}, []string{})
+		bytesUploaded = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "storage", Name: "uploaded_bytes_total",
+			Help: "Bytes received by uploads.",
+		}, []string{})
+		bytesDownloaded = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "storage", Name: "downloaded_bytes_total",
+			Help: "Bytes sent by downloads.",
+		}, []string{})
+		inFlightUploads = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "storage", Name: "uploads_in_flight",
+			Help: "Uploads in progress.",
+		}, []string{})
+		auditFailures = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "storage", Subsystem: "audit", Name: "failures_total",
+			Help: "Operations that could not be recorded in the audit log, by action.",
+		}, []string{"action"})
+		storedObjects = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "storage", Name: "stored_objects",
+			Help: "Number of objects stored.",
+		}, []string{})
+		storedBytes = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "storage", Name: "stored_bytes",
+			Help: "Bytes stored.",
+		}, []string{})
+	)
+
+	//--------
+	// Tracing
+	//--------
+	// W3C trace context is propagated even if tracing is disabled
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if config.Tracing.OTLPEndpoint != "" {
+		tp, err := newTracerProvider(config.Tracing)
+		if err != nil {
+			mainLogger.Fatal("Error: cannot set up tracing: " + err.Error())
+		}
+		otel.SetTracerProvider(tp)
+		// Flushes the pending spans
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tp.Shutdown(ctx); err != nil {
+				mainLogger.Error("Error: cannot flush traces: " + err.Error())
+			}
+		}()
+		mainLogger.Info("Tracing enabled, exporting to " + config.Tracing.OTLPEndpoint)
+	}
 
 	//---------------------------------
 	// DB connection and initialization
 	//---------------------------------
-	var db base.DB
-
-	connStr := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s?sslmode=%s", dbUser, dbPassword, dbHost, dbPort, dbDatabase, sslMode)
-	mainLogger.Debug(connStr)
-
-	switch dbDriver {
-	case "postgres":
-		db = base.NewSqlDatabase(databaseLogger)
-	// TODO - case "mysql":
-	// TODO - case "cockroach":
-	// TODO - case "cassandra":
-	default:
-		mainLogger.Error("Unsupported DB type. Supported types: postgres")
-		os.Exit(1)
-	}
-	mainLogger.Info("Connecting to database")
-	err := db.Connect(dbDriver, connStr)
+	// Latency is observed by the caller, retries included
+	resilience := config.DB.Resilience
+	breaker := base.NewBreaker(resilience.BreakerFailures, time.Duration(resilience.BreakerCooldown), dbBreakerState, databaseLogger)
+	db := base.NewTracedDB(base.NewInstrumentedDB(base.NewResilientDB(newDB(config.DB), resilience, breaker, dbRetries, databaseLogger), dbDuration))
+	mainLogger.Info("Connecting to database " + config.DB.RedactedDSN())
+	err = db.Connect(config.DB.Driver, config.DB.DSN())
 	if err != nil {
-		mainLogger.Fatal("Error: cannot connect to database: " + err.Error())
+		mainLogger.Fatal("Error: cannot connect to database: " + config.DB.Redact(err.Error()))
 		os.Exit(1)
 	}
 	mainLogger.Info("Database connected")
 	defer db.Close() // this fails if db connection is not established
 
-	err = db.Init()
+	err = db.Init(context.Background())
 	if err != nil {
 		mainLogger.Fatal("Error: cannot initialize database: " + err.Error())
 		os.Exit(1)
@@ -113,7 +182,18 @@ func main() {
 	//----------------------------------
 	// Logging and server initialization
 	//----------------------------------
-	mainLogger.Debugf("Config variables: %+v\n", config) // TODO
+	// Presigned URLs signing key. If not set, a random one is generated:
+	// URLs won't survive a restart, nor will be valid on other replicas
+	presignSecret := config.Auth.PresignSecret
+	if presignSecret == "" {
+		mainLogger.Warn("auth.presignSecret not set, using a random key for presigned URLs")
+		presignSecret = util.RandomString(32)
+	}
+	var signer = presign.NewSigner([]byte(presignSecret))
+
+	// Settings reloaded on SIGHUP
+	var quotas = util.NewQuotas(config.Limits.Quotas)
+	var rateLimiter = util.NewRateLimiter(config.Limits.RateLimit)
 
 	// All the loggers are passed to the service, so the logging level can be set ar runtime
 	var service = storage.NewService(db, serviceLogger, map[string]*util.Logger{
@@ -121,11 +201,54 @@ func main() {
 		"transport": transportLogger,
 		"endpoints": endpointsLogger,
 		"database":  databaseLogger,
+	}, signer, quotas, config.Storage.SearchContentBytes)
+	service = storage.MetricsMiddleware(bytesUploaded, bytesDownloaded, inFlightUploads)(service)
+	service = storage.AuthorizationMiddleware(db, config.Auth.Admins, serviceLogger)(service)
+
+	// Audit wraps authorization, so that denied operations are recorded too
+	trail, err := audit.NewTrail(context.Background(), db, serviceLogger)
+	if err != nil {
+		mainLogger.Fatal("Error: cannot load audit log: " + err.Error())
+	}
+	service = storage.AuditMiddleware(trail, auditFailures, serviceLogger)(service)
+	service = storage.TracingMiddleware()(service)
+
+	var checker = health.NewChecker(readinessCheckTimeout,
+		health.Database(db),
+		health.CircuitBreaker(breaker),
+		health.Writable(config.Storage.Folder),
+		health.FreeSpace(config.Storage.Folder, config.Storage.MinFreeBytes),
+	)
+	// Background jobs act through the whole middleware chain, thus they are authorized and audited as any request
+	var jobManager = jobs.NewManager(jobRetention, serviceLogger)
+	var endpointSet = endpoints.NewEndpointSet(service, config, checker, jobManager, endpointsLogger)
+	var router = transport.NewHTTPHandler(endpointSet)
+	var httpHandler = http.NewServeMux()
+	// Metrics are served outside of the API middlewares, unauthenticated and unlogged
+	httpHandler.Handle("/metrics", promhttp.Handler())
+	httpHandler.Handle("/", storage.TracingHTTPMiddleware{
+		Route: transport.RouteTemplate(router),
+		Next: storage.HTTPMetricsMiddleware{
+			Requests: httpRequests,
+			Duration: httpDuration,
+			Route:    transport.RouteTemplate(router),
+			Next: storage.TransportMiddleware{
+				Logger: transportLogger,
+				Next: storage.AuthenticationMiddleware{
+					Logger: transportLogger,
+					Keys:   config.Auth.APIKeys,
+					Signer: signer,
+					Next: storage.RateLimitMiddleware{
+						Logger:  transportLogger,
+						Limiter: rateLimiter,
+						Next:    router,
+					},
+				},
+			},
+		},
 	})
-	var endpointSet = endpoints.NewEndpointSet(service, config, endpointsLogger)
-	var httpHandler = storage.TransportMiddleware{Logger: transportLogger, Next: transport.NewHTTPHandler(endpointSet)}
 
-	mainLogger.Info("Service initialization complete. Listening on port " + httpPort)
+	mainLogger.Info("Service initialization complete. Listening on port " + config.Server.Port)
 
 	//-----------------------------
 	// Run HTTP listener and server
@@ -134,12 +257,72 @@ func main() {
 	{
 		httpListener, err := net.Listen("tcp", httpAddr)
 		if err != nil {
-			os.Exit(1)
+			mainLogger.Fatal("Error: cannot listen on " + httpAddr + ": " + err.Error())
+		}
+		server := &http.Server{
+			Handler:           httpHandler,
+			ReadHeaderTimeout: time.Duration(config.Server.ReadHeaderTimeout),
+			ReadTimeout:       time.Duration(config.Server.ReadTimeout),
+			WriteTimeout:      time.Duration(config.Server.WriteTimeout),
+			IdleTimeout:       time.Duration(config.Server.IdleTimeout),
+		}
+		if config.Server.TLS.CertFile != "" {
+			server.TLSConfig = newTLSConfig(config.Server.TLS)
 		}
+		drain := time.Duration(config.Server.DrainDelay)
+		timeout := time.Duration(config.Server.ShutdownTimeout)
 		g.Add(func() error {
-			return http.Serve(httpListener, httpHandler)
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(httpListener, "", "")
+			} else {
+				err = server.Serve(httpListener)
+			}
+			if err != http.ErrServerClosed {
+				return err
+			}
+			return nil
 		}, func(error) {
-			httpListener.Close()
+			// Readiness fails first, so that no new traffic is routed here
+			checker.Drain()
+			mainLogger.Infof("Draining: waiting %s before refusing new connections", drain)
+			time.Sleep(drain)
+
+			// In-flight requests are given time to complete. Then their connections are closed:
+			// uploads cut off this way are removed by the service, as any failed upload
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if err := server.Shutdown(ctx); err != nil {
+				mainLogger.Warn("Shutdown timed out, closing in-flight connections: " + err.Error())
+				server.Close()
+			}
+			// Jobs still running are canceled, they can't survive the process
+			if err := jobManager.Shutdown(ctx); err != nil {
+				mainLogger.Warn("Shutdown timed out, abandoning background jobs: " + err.Error())
+			}
+		})
+	}
+	{
+		// Refreshes the stored objects and bytes gauges
+		ticker := time.NewTicker(storageMetricsInterval)
+		stop := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-ticker.C:
+					usage, err := db.TotalUsage(context.Background())
+					if err != nil {
+						mainLogger.Error("Error: cannot refresh storage metrics: " + err.Error())
+						continue
+					}
+					storedObjects.Set(float64(usage.Objects))
+					storedBytes.Set(float64(usage.Bytes))
+				case <-stop:
+					return nil
+				}
+			}
+		}, func(error) {
+			ticker.Stop()
+			close(stop)
 		})
 	}
 	// {
@@ -147,6 +330,48 @@ func main() {
 		TODO - Implement object lifecycle
 	*/
 	// }
+	if watcher := util.NewFileWatcher(config.DB.UserFile, config.DB.PasswordFile); !watcher.Empty() {
+		// Reconnects to the database when the credential files change
+		ticker := time.NewTicker(secretsCheckInterval)
+		stop := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-ticker.C:
+					changed, err := watcher.Changed()
+					if err != nil {
+						mainLogger.Error("Error: cannot check database credential files: " + err.Error())
+					} else if changed {
+						reconnectDB(db, config.DB)
+					}
+				case <-stop:
+					return nil
+				}
+			}
+		}, func(error) {
+			ticker.Stop()
+			close(stop)
+		})
+	}
+	{
+		// Reloads the settings that are safe to change at runtime on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		stop := make(chan struct{})
+		g.Add(func() error {
+			for {
+				select {
+				case <-hup:
+					reloadConfig(config, quotas, rateLimiter)
+				case <-stop:
+					return nil
+				}
+			}
+		}, func(error) {
+			signal.Stop(hup)
+			close(stop)
+		})
+	}
 	{
 		// This function just sits and waits for ctrl-C.
 		cancelInterrupt := make(chan struct{})
@@ -166,11 +391,157 @@ func main() {
 	mainLogger.Warn("Exit: ", g.Run())
 }
 
-// init loggers
+// newDB returns the DB for the configured driver, not connected
+func newDB(config util.DBConfig) base.DB {
+	// Supported drivers are checked by config validation
+	switch config.Driver {
+	case "cockroach":
+		return base.NewCockroachDatabase(databaseLogger)
+	case "mysql":
+		return base.NewMysqlDatabase(databaseLogger)
+	case "sqlite":
+		return base.NewSqliteDatabase(databaseLogger)
+	case "bbolt":
+		return base.NewBoltDatabase(databaseLogger)
+		// TODO - case "cassandra":
+	}
+	return base.NewSqlDatabase(databaseLogger)
+}
+
+// reconnectDB reads the database credential files again, and reconnects with them.
+// If the new credentials don't work, the old connection pool is kept
+func reconnectDB(db base.DB, config util.DBConfig) {
+	var err error
+	if config.UserFile != "" {
+		if config.User, err = util.ReadSecretFile(config.UserFile); err != nil {
+			mainLogger.Error("Error: cannot read database user: " + err.Error())
+			return
+		}
+	}
+	if config.PasswordFile != "" {
+		if config.Password, err = util.ReadSecretFile(config.PasswordFile); err != nil {
+			mainLogger.Error("Error: cannot read database password: " + err.Error())
+			return
+		}
+	}
+	mainLogger.Info("Database credentials changed, reconnecting to " + config.RedactedDSN())
+	if err := db.Connect(config.Driver, config.DSN()); err != nil {
+		mainLogger.Error("Error: cannot reconnect to database, keeping the old connection: " + config.Redact(err.Error()))
+	}
+}
+
+// newTLSConfig returns the configuration of the HTTP server, reloading certificates when they change
+func newTLSConfig(config util.TLSConfig) *tls.Config {
+	clientAuth := tls.VerifyClientCertIfGiven
+	if config.ClientAuth == "require" {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	reloader, err := certs.NewReloader(config.CertFile, config.KeyFile, config.ClientCAFile, transportLogger)
+	if err != nil {
+		mainLogger.Fatal("Error: cannot load TLS certificates: " + err.Error())
+	}
+	if config.ClientCAFile != "" {
+		mainLogger.Info("Client certificates: " + config.ClientAuth)
+	}
+	return reloader.TLSConfig(clientAuth)
+}
+
+// newTracerProvider returns a tracer provider exporting spans in batches to an OTLP/HTTP collector
+func newTracerProvider(config util.TracingConfig) (*sdktrace.TracerProvider, error) {
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.OTLPEndpoint)}
+	if config.OTLPInsecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceNameKey.String("storage"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	), nil
+}
+
+// Loggers by layer
+var layerLoggers = map[string]*util.Logger{
+	"main":      mainLogger,
+	"service":   serviceLogger,
+	"transport": transportLogger,
+	"endpoints": endpointsLogger,
+	"database":  databaseLogger,
+}
+
+// setupLoggers sets format and levels of all the loggers
+func setupLoggers(config util.LoggingConfig) error {
+	for layer, logger := range layerLoggers {
+		if err := logger.SetFormat(config.Format); err != nil {
+			return err
+		}
+		if name, ok := config.Levels[layer]; ok {
+			level, err := util.LogLevelMapping(name)
+			if err != nil {
+				return err
+			}
+			logger.SetLevel(level)
+		}
+	}
+	return nil
+}
+
+// reloadConfig reads the configuration again, and applies logging, quotas and rate limits.
+// Other settings require a restart: changes are reported, but not applied
+func reloadConfig(current *util.Config, quotas *util.Quotas, rateLimiter *util.RateLimiter) {
+	mainLogger.Info("SIGHUP received, reloading configuration")
+	config, err := util.LoadConfig(configFile)
+	if err != nil {
+		mainLogger.Error("Error: configuration not reloaded: " + err.Error())
+		return
+	}
+	if err := setupLoggers(config.Logging); err != nil {
+		mainLogger.Error("Error: logging not reloaded: " + err.Error())
+	}
+	quotas.Set(config.Limits.Quotas)
+	rateLimiter.SetLimit(config.Limits.RateLimit)
+
+	for _, section := range []struct {
+		name    string
+		changed bool
+	}{
+		{"server", !reflect.DeepEqual(config.Server, current.Server)},
+		// Credentials read from files are renewed by the watcher
+		{"db", !reflect.DeepEqual(withoutFileCredentials(config.DB), withoutFileCredentials(current.DB))},
+		{"storage", !reflect.DeepEqual(config.Storage, current.Storage)},
+		{"auth", !reflect.DeepEqual(config.Auth, current.Auth)},
+		{"tracing", !reflect.DeepEqual(config.Tracing, current.Tracing)},
+	} {
+		if section.changed {
+			mainLogger.Warn("Changes to " + section.name + " require a restart, not applied")
+		}
+	}
+	mainLogger.Info("Configuration reloaded")
+}
+
+func withoutFileCredentials(config util.DBConfig) util.DBConfig {
+	if config.UserFile != "" {
+		config.User = ""
+	}
+	if config.PasswordFile != "" {
+		config.Password = ""
+	}
+	return config
+}
+
+// init loggers. Levels and format are set from the configuration in main
 func init() {
-	util.InitLogger(mainLogger, mainLogLevel, logrus.Fields{"level": "main"})
-	util.InitLogger(serviceLogger, serviceLogLevel, logrus.Fields{"level": "service"})
-	util.InitLogger(transportLogger, transportLogLevel, logrus.Fields{"level": "transport"})
-	util.InitLogger(endpointsLogger, endpointsLogLevel, logrus.Fields{"level": "endpoints"})
-	util.InitLogger(databaseLogger, databaseLogLevel, logrus.Fields{"level": "database"})
+	// The layer field can't be named "level", it would clash with the severity of the entry
+	for layer, logger := range layerLoggers {
+		util.InitLogger(logger, "INFO", logrus.Fields{"layer": layer})
+	}
 }
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erizzardi/storage/base"
+	"github.com/erizzardi/storage/util"
+)
+
+// Layout of the record timestamps, the one of every timestamp stored by the service
+const TimeFormat = util.TimeFormat
+
+// Previous hash of the first record
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// Hash computes the hash of the record, chained to the previous one through record.PrevHash
+func Hash(record util.AuditRecord) string {
+	// JSON array encoding, so that no field can bleed into the next one
+	canonical, _ := json.Marshal([]any{
+		record.Seq,
+		record.Time,
+		record.Principal,
+		record.Tenant,
+		record.SourceIP,
+		record.Action,
+		record.Object,
+		record.Code,
+		record.PrevHash,
+	})
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// FormatTime formats t as a record timestamp
+func FormatTime(t time.Time) string {
+	return util.FormatTime(t)
+}
+
+// Trail appends records to the audit log, keeping the hash chain.
+// Appends are serialized, thus a single instance must be shared by all the writers of the process.
+// The chain has a single writer per database: sequence numbers are allocated by the process, and kept unique by the
+// primary key. Replicas sharing a database conflict on them, and recover by reloading the tip, up to appendAttempts times
+type Trail struct {
+	mu     sync.Mutex
+	db     base.DB
+	logger *util.Logger
+	// Last appended record
+	last util.AuditRecord
+}
+
+// Attempts of Append. The tip of the chain is reloaded after every failure
+const appendAttempts = 3
+
+// NewTrail loads the tip of the chain from the database
+func NewTrail(ctx context.Context, db base.DB, logger *util.Logger) (*Trail, error) {
+	last, err := loadTip(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return &Trail{db: db, logger: logger, last: last}, nil
+}
+
+// loadTip returns the last record stored, or the one preceding the first record if there is none
+func loadTip(ctx context.Context, db base.DB) (util.AuditRecord, error) {
+	last, err := db.LastAuditRecord(ctx)
+	if errors.Is(err, base.NotFoundError) {
+		return util.AuditRecord{Seq: 0, Hash: genesisHash}, nil
+	}
+	return last, err
+}
+
+// Append sets sequence number, timestamp and hashes of record, and stores it.
+// A failed insert may have been stored anyway, or lost the sequence number to another writer: the tip is reloaded
+// before trying again
+func (t *Trail) Append(ctx context.Context, record util.AuditRecord) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record.Time = FormatTime(time.Now())
+	var err error
+	for attempt := 1; attempt <= appendAttempts; attempt++ {
+		if attempt > 1 {
+			tip, e := loadTip(ctx, t.db)
+			if e != nil {
+				return fmt.Errorf("%w, cannot reload the tip of the chain: %s", err, e.Error())
+			}
+			t.last = tip
+			if tip.Hash == record.Hash {
+				t.logger.Debugf("Audit record %d appended", record.Seq)
+				return nil
+			}
+		}
+		record.Seq = t.last.Seq + 1
+		record.PrevHash = t.last.Hash
+		record.Hash = Hash(record)
+		if err = t.db.InsertAuditRecord(ctx, record); err == nil {
+			t.last = record
+			t.logger.Debugf("Audit record %d appended", record.Seq)
+			return nil
+		}
+		t.logger.Debugf("Audit record %d not appended, attempt %d: %s", record.Seq, attempt, err.Error())
+	}
+	return err
+}
+
+// Verification is the result of the verification of the chain
+type Verification struct {
+	Valid bool `json:"valid"`
+	// Number of records checked
+	Records int64 `json:"records"`
+	// Sequence number of the first record that doesn't match the chain. 0 if valid
+	BrokenAt int64  `json:"brokenAt,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// Size of the pages read by Verify
+const verifyPageSize = 1000
+
+// Verify walks the whole audit log, recomputing every hash
+func Verify(ctx context.Context, db base.DB) (Verification, error) {
+	var ret Verification
+	prev := util.AuditRecord{Seq: 0, Hash: genesisHash}
+
+	for offset := uint(0); ; offset += verifyPageSize {
+		records, err := db.ListAuditRecords(ctx, util.AuditFilter{}, verifyPageSize, offset)
+		if err != nil {
+			return Verification{}, err
+		}
+		for _, record := range records {
+			ret.Records++
+			switch {
+			case record.Seq != prev.Seq+1:
+				ret.BrokenAt, ret.Reason = record.Seq, "sequence gap after record "+strconv.FormatInt(prev.Seq, 10)
+			case record.PrevHash != prev.Hash:
+				ret.BrokenAt, ret.Reason = record.Seq, "previous hash doesn't match"
+			case record.Hash != Hash(record):
+				ret.BrokenAt, ret.Reason = record.Seq, "hash doesn't match the record"
+			}
+			if ret.BrokenAt != 0 {
+				return ret, nil
+			}
+			prev = record
+		}
+		if len(records) < verifyPageSize {
+			break
+		}
+	}
+	ret.Valid = true
+	return ret, nil
+}
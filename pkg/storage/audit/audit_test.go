@@ -0,0 +1,52 @@
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/erizzardi/storage/base"
+	"github.com/erizzardi/storage/util"
+)
+
+// Unit tests for the audit log, on SQLite.
+
+//
+// This test appends records from two trails on the same database, the second one with a stale tip, then alters a record.
+// Pass if every append succeeds, the chain verifies, and the altered record breaks it.
+func TestAppendVerify(t *testing.T) {
+
+	ctx := context.Background()
+	logger := util.NewLogger()
+	db := base.NewSqliteDatabase(logger)
+	if err := db.Connect("sqlite", filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Init(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	trails := make([]*Trail, 2)
+	for i := range trails {
+		var err error
+		if trails[i], err = NewTrail(ctx, db, logger); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		if err := trails[i%2].Append(ctx, util.AuditRecord{Principal: "alice", Action: "WriteFile", Object: "a.txt", Code: 200}); err != nil {
+			t.Errorf("Record %d not appended: %v", i+1, err)
+		}
+	}
+	if v, err := Verify(ctx, db); err != nil || !v.Valid || v.Records != 4 {
+		t.Errorf("Chain not verified: %+v, %v", v, err)
+	}
+
+	if _, err := db.(*base.SqliteDB).ExecContext(ctx, "UPDATE audit SET principal = 'mallory' WHERE seq = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := Verify(ctx, db); err != nil || v.Valid || v.BrokenAt != 2 {
+		t.Errorf("Altered record not detected: %+v, %v", v, err)
+	}
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/erizzardi/storage/util"
+)
+
+// Objects listed per page by bulk operations
+const bulkPageSize = 100
+
+// Operations of a batch
+const (
+	BatchDelete = "delete"
+	BatchTag    = "tag"
+	BatchCopy   = "copy"
+)
+
+// BatchOperation is one operation of a batch on the object with ID Uuid
+type BatchOperation struct {
+	Op   string `json:"op"`
+	Uuid string `json:"uuid"`
+	// Tags set by tag, replacing the existing ones, and by copy with ReplaceMetadata
+	Tags map[string]string `json:"tags,omitempty"`
+	// Destination of copy
+	Bucket string `json:"bucket,omitempty"`
+	Name   string `json:"name,omitempty"`
+	// Content type of the copy, with ReplaceMetadata
+	ContentType     string `json:"contentType,omitempty"`
+	ReplaceMetadata bool   `json:"replaceMetadata,omitempty"`
+}
+
+// Code of the operations not run since the batch was canceled, the "client closed request" of nginx
+const BatchCanceled = 499
+
+// BatchResult is the outcome of an operation of a batch, as the response to the single request would be
+type BatchResult struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// ID of the copy
+	Uuid string `json:"uuid,omitempty"`
+}
+
+// DeletePrefix deletes the objects of bucket whose name starts with prefix, subfolders included, reporting its progress.
+// Objects are listed and deleted through svc, thus every deletion is authorized and audited as if requested one by one:
+// objects the principal of ctx can't delete are counted as failed, the ones it can't list are left alone.
+// It stops when ctx is canceled. Returns an error if any deletion failed
+func DeletePrefix(ctx context.Context, svc Service, storageFolder string, bucket string, prefix string, progress func(deleted int, failed int)) error {
+	query := util.ListQuery{Bucket: &bucket, Prefix: prefix, Sort: util.SortByName, Limit: bulkPageSize}
+	deleted, failed := 0, 0
+	for {
+		listing, err := svc.ListFiles(ctx, query)
+		if err != nil {
+			return err
+		}
+		for _, row := range listing.Files {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			// Deleted objects precede the cursor, thus don't shift the pages
+			if err := svc.DeleteFile(ctx, row.Uuid, storageFolder, util.Preconditions{}); err != nil {
+				failed++
+			} else {
+				deleted++
+			}
+			progress(deleted, failed)
+		}
+		if listing.NextCursor == "" {
+			break
+		}
+		if query.After, err = util.ParseListCursor(listing.NextCursor); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d objects not deleted", failed, deleted+failed)
+	}
+	return nil
+}
+
+// Batch runs the operations through svc, at most concurrency at once, reporting its progress. Operations are
+// authorized and audited as if requested one by one, in no particular order: an operation failing doesn't stop the others.
+// When ctx is canceled the operations not started are not run, with code BatchCanceled, and don't count in the progress.
+// Returns the result of every operation, in the order of ops
+func Batch(ctx context.Context, svc Service, storageFolder string, ops []BatchOperation, concurrency int, progress func(done int, failed int)) []BatchResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]BatchResult, len(ops))
+	indexes := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done, failed := 0, 0
+	for w := 0; w < concurrency && w < len(ops); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if ctx.Err() != nil {
+					results[i] = BatchResult{Code: BatchCanceled, Message: "batch canceled, not run"}
+					continue
+				}
+				result := batchOperation(ctx, svc, storageFolder, ops[i])
+				mu.Lock()
+				results[i] = result
+				if result.Code < 300 {
+					done++
+				} else {
+					failed++
+				}
+				progress(done, failed)
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range ops {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// batchOperation runs one operation of a batch
+func batchOperation(ctx context.Context, svc Service, storageFolder string, op BatchOperation) BatchResult {
+	var err error
+	switch op.Op {
+	case BatchDelete:
+		if err = svc.DeleteFile(ctx, op.Uuid, storageFolder, util.Preconditions{}); err == nil {
+			return BatchResult{Code: 200, Message: "File deleted"}
+		}
+	case BatchTag:
+		if err = svc.SetTags(ctx, op.Uuid, op.Tags); err == nil {
+			return BatchResult{Code: 200, Message: "File tagged"}
+		}
+	case BatchCopy:
+		if op.Name == "" {
+			return BatchResult{Code: 400, Message: "copy without name"}
+		}
+		dest := util.Metadata{Name: op.Name, Bucket: op.Bucket, ContentType: op.ContentType, Tags: op.Tags}
+		var uuid string
+		if uuid, err = svc.CopyFile(ctx, op.Uuid, dest, op.ReplaceMetadata, storageFolder, util.Preconditions{}); err == nil {
+			return BatchResult{Code: 201, Message: "File copied", Uuid: uuid}
+		}
+	default:
+		return BatchResult{Code: 400, Message: "unknown operation " + op.Op + ", must be delete, tag or copy"}
+	}
+	return BatchResult{Code: util.StatusCode(err), Message: err.Error()}
+}
+
+// BatchError returns an error if any operation of a batch failed. Operations not run don't count as failed
+func BatchError(results []BatchResult) error {
+	failed := 0
+	for _, result := range results {
+		if result.Code >= 300 && result.Code != BatchCanceled {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d operations failed", failed, len(results))
+	}
+	return nil
+}
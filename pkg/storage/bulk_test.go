@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/erizzardi/storage/util"
+)
+
+// Unit tests for the bulk operations, on a fake service.
+
+// batchService deletes and tags the objects in objects, and calls onDelete on every deletion
+type batchService struct {
+	Service
+	mu       sync.Mutex
+	objects  map[string]bool
+	onDelete func(uuid string)
+}
+
+func (s *batchService) DeleteFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) error {
+	if s.onDelete != nil {
+		s.onDelete(uuid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.objects[uuid] {
+		return util.NotFoundError{Message: "file " + uuid + " not found"}
+	}
+	delete(s.objects, uuid)
+	return nil
+}
+
+func (s *batchService) SetTags(ctx context.Context, uuid string, tags map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.objects[uuid] {
+		return util.NotFoundError{Message: "file " + uuid + " not found"}
+	}
+	return nil
+}
+
+//
+// This test runs a batch of deletions and tags, some on missing objects, and an unknown operation.
+// Pass if every result is in the order of the operations, failures don't stop the others, and the progress counts them.
+func TestBatch(t *testing.T) {
+
+	svc := &batchService{objects: map[string]bool{"a": true, "b": true, "c": true}}
+	// Operations on different objects, since they run in no particular order
+	ops := []BatchOperation{
+		{Op: BatchTag, Uuid: "a"},
+		{Op: BatchDelete, Uuid: "b"},
+		{Op: BatchDelete, Uuid: "missing"},
+		{Op: "rename", Uuid: "c"},
+		{Op: BatchTag, Uuid: "gone"},
+		{Op: BatchDelete, Uuid: "c"},
+	}
+	expected := []int{200, 200, 404, 400, 404, 200}
+
+	done, failed := 0, 0
+	results := Batch(context.Background(), svc, "", ops, 3, func(d int, f int) { done, failed = d, f })
+	for i, result := range results {
+		if result.Code != expected[i] {
+			t.Errorf("Operation %d %s %s: %+v, expected code %d", i, ops[i].Op, ops[i].Uuid, result, expected[i])
+		}
+	}
+	if done != 3 || failed != 3 {
+		t.Errorf("Progress should be 3 done and 3 failed, got %d and %d", done, failed)
+	}
+	if err := BatchError(results); err == nil {
+		t.Error("Failed operations not reported")
+	}
+}
+
+//
+// This test cancels a batch run with no concurrency during its second operation.
+// Pass if the first two operations run, and the others are reported canceled, without counting as failed.
+func TestBatchCanceled(t *testing.T) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := &batchService{objects: map[string]bool{"a": true, "b": true, "c": true, "d": true}, onDelete: func(uuid string) {
+		if uuid == "b" {
+			cancel()
+		}
+	}}
+	ops := []BatchOperation{{Op: BatchDelete, Uuid: "a"}, {Op: BatchDelete, Uuid: "b"}, {Op: BatchDelete, Uuid: "c"}, {Op: BatchDelete, Uuid: "d"}}
+
+	done, failed := 0, 0
+	// Concurrency is at least 1
+	results := Batch(ctx, svc, "", ops, 0, func(d int, f int) { done, failed = d, f })
+	for i, expected := range []int{200, 200, BatchCanceled, BatchCanceled} {
+		if results[i].Code != expected {
+			t.Errorf("Operation %d: %+v, expected code %d", i, results[i], expected)
+		}
+	}
+	if done != 2 || failed != 0 {
+		t.Errorf("Progress should be 2 done and none failed, got %d and %d", done, failed)
+	}
+	if err := BatchError(results); err != nil {
+		t.Errorf("Canceled operations reported as failed: %v", err)
+	}
+}
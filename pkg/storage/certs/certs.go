@@ -0,0 +1,147 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+)
+
+// Minimum interval between two checks of the files
+const checkInterval = 10 * time.Second
+
+// Reloader serves a certificate and a client CA bundle read from files, reloading them when they change,
+// so that rotated certificates are picked up without restarting
+type Reloader struct {
+	certFile string
+	keyFile  string
+	// Optional. Client certificates aren't verified if empty
+	caFile string
+	logger *util.Logger
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes []time.Time
+	checked  time.Time
+}
+
+// NewReloader loads the files, failing if they are not valid
+func NewReloader(certFile string, keyFile string, caFile string, logger *util.Logger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile, logger: logger}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// TLSConfig returns a server configuration using the current certificate and CA bundle on every handshake.
+// clientAuth is ignored if there is no CA bundle
+func (r *Reloader) TLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+			}
+			if pool != nil {
+				config.ClientCAs = pool
+				config.ClientAuth = clientAuth
+			}
+			return config, nil
+		},
+	}
+}
+
+// current returns certificate and CA bundle, reloading them if the files changed.
+// If the new files are not valid, e.g. because they are being written, the old ones are kept
+func (r *Reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= checkInterval {
+		r.checked = time.Now()
+		if modTimes, err := r.stat(); err == nil && !equal(modTimes, r.modTimes) {
+			if err := r.loadLocked(); err != nil {
+				r.logger.Error("Error: cannot reload TLS certificates: " + err.Error())
+			} else {
+				r.logger.Info("TLS certificates reloaded")
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+func (r *Reloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.loadLocked()
+}
+
+func (r *Reloader) loadLocked() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		bundle, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return errors.New("no certificate found in " + r.caFile)
+		}
+	}
+	r.cert, r.pool, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// stat returns the modification times of the files
+func (r *Reloader) stat() ([]time.Time, error) {
+	var ret []time.Time
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, info.ModTime())
+	}
+	return ret, nil
+}
+
+func equal(a []time.Time, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Principal maps the subject of a verified client certificate to a principal:
+// the common name is the principal name, the first organizational unit, if any, its tenant
+func Principal(cert *x509.Certificate) util.Principal {
+	p := util.Principal{Name: cert.Subject.CommonName}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		p.Tenant = cert.Subject.OrganizationalUnit[0]
+	}
+	return p
+}
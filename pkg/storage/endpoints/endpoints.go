@@ -2,36 +2,81 @@ package endpoints
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/erizzardi/storage/pkg/storage"
+	"github.com/erizzardi/storage/pkg/storage/health"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/presign"
 	"github.com/erizzardi/storage/util"
 	"github.com/go-kit/kit/endpoint"
 )
 
 type Set struct {
 	HealtzEndpoint           endpoint.Endpoint
+	LivezEndpoint            endpoint.Endpoint
+	ReadyzEndpoint           endpoint.Endpoint
 	NotFoundEndpoint         endpoint.Endpoint
 	MethodNotAllowedEndpoint endpoint.Endpoint
 	WriteFileEndpoint        endpoint.Endpoint
 	GetFileEndpoint          endpoint.Endpoint
 	DeleteFileEndpoint       endpoint.Endpoint
+	CopyFileEndpoint         endpoint.Endpoint
+	MoveFileEndpoint         endpoint.Endpoint
+	SetTagsEndpoint          endpoint.Endpoint
 	AddBucketEndpoint        endpoint.Endpoint
 	LogLevelEndpoint         endpoint.Endpoint
 	ListFilesEndpoint        endpoint.Endpoint
+	SetBucketPolicyEndpoint  endpoint.Endpoint
+	GetBucketPolicyEndpoint  endpoint.Endpoint
+	SimulatePolicyEndpoint   endpoint.Endpoint
+	PresignEndpoint          endpoint.Endpoint
+	TenantUsageEndpoint      endpoint.Endpoint
+	QueryAuditEndpoint       endpoint.Endpoint
+	VerifyAuditEndpoint      endpoint.Endpoint
+	PrefixUsageEndpoint      endpoint.Endpoint
+	DeletePrefixEndpoint     endpoint.Endpoint
+	GetJobEndpoint           endpoint.Endpoint
+	CancelJobEndpoint        endpoint.Endpoint
+	BatchEndpoint            endpoint.Endpoint
+	BatchJobEndpoint         endpoint.Endpoint
+	SearchEndpoint           endpoint.Endpoint
 }
 
-func NewEndpointSet(svc storage.Service, config *util.Config, logger *util.Logger) Set {
+func NewEndpointSet(svc storage.Service, config *util.Config, checker *health.Checker, manager *jobs.Manager, logger *util.Logger) Set {
 	return Set{
 		HealtzEndpoint:           MakeHealtzEndpoint(logger),
+		LivezEndpoint:            MakeHealtzEndpoint(logger),
+		ReadyzEndpoint:           MakeReadyzEndpoint(checker, logger),
 		NotFoundEndpoint:         MakeNotFoundEndpoint(logger),
 		MethodNotAllowedEndpoint: MakeMethodNotAllowedEndpoint(logger),
-		WriteFileEndpoint:        MakeWriteFileEndpoint(svc, config.StorageFolder, logger),
-		GetFileEndpoint:          MakeGetFileEndpoint(svc, config.StorageFolder, logger),
-		DeleteFileEndpoint:       MakeDeleteFileEndpoint(svc, config.StorageFolder, logger),
-		AddBucketEndpoint:        MakeAddBucketEndpoint(svc, config.StorageFolder, logger),
-		LogLevelEndpoint:         MakeLogLevelEndpoint(svc, config.StorageFolder, logger),
-		ListFilesEndpoint:        MakeListFilesEndpoint(svc, config.StorageFolder, logger),
+		WriteFileEndpoint:        MakeWriteFileEndpoint(svc, config.Storage.Folder, logger),
+		GetFileEndpoint:          MakeGetFileEndpoint(svc, config.Storage.Folder, logger),
+		DeleteFileEndpoint:       MakeDeleteFileEndpoint(svc, config.Storage.Folder, logger),
+		CopyFileEndpoint:         MakeCopyFileEndpoint(svc, config.Storage.Folder, logger),
+		MoveFileEndpoint:         MakeMoveFileEndpoint(svc, config.Storage.Folder, logger),
+		SetTagsEndpoint:          MakeSetTagsEndpoint(svc, logger),
+		AddBucketEndpoint:        MakeAddBucketEndpoint(svc, config.Storage.Folder, logger),
+		LogLevelEndpoint:         MakeLogLevelEndpoint(svc, config.Storage.Folder, logger),
+		ListFilesEndpoint:        MakeListFilesEndpoint(svc, config.Storage.Folder, logger),
+		SetBucketPolicyEndpoint:  MakeSetBucketPolicyEndpoint(svc, logger),
+		GetBucketPolicyEndpoint:  MakeGetBucketPolicyEndpoint(svc, logger),
+		SimulatePolicyEndpoint:   MakeSimulatePolicyEndpoint(svc, logger),
+		PresignEndpoint:          MakePresignEndpoint(svc, logger),
+		TenantUsageEndpoint:      MakeTenantUsageEndpoint(svc, logger),
+		QueryAuditEndpoint:       MakeQueryAuditEndpoint(svc, logger),
+		VerifyAuditEndpoint:      MakeVerifyAuditEndpoint(svc, logger),
+		PrefixUsageEndpoint:      MakePrefixUsageEndpoint(svc, logger),
+		DeletePrefixEndpoint:     MakeDeletePrefixEndpoint(svc, manager, config.Storage.Folder, logger),
+		GetJobEndpoint:           MakeGetJobEndpoint(svc, manager, logger),
+		CancelJobEndpoint:        MakeCancelJobEndpoint(svc, manager, logger),
+		BatchEndpoint:            MakeBatchEndpoint(svc, config.Storage.Folder, logger),
+		BatchJobEndpoint:         MakeBatchJobEndpoint(svc, manager, config.Storage.Folder, logger),
+		SearchEndpoint:           MakeSearchEndpoint(svc, logger),
 	}
 }
 
@@ -46,10 +91,25 @@ func MakeHealtzEndpoint(logger *util.Logger) endpoint.Endpoint {
 	}
 }
 
+func MakeReadyzEndpoint(checker *health.Checker, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		report := checker.Ready(ctx)
+		if !report.Ready {
+			for _, result := range report.Checks {
+				if result.Status != health.StatusOk {
+					logger.WithContext(ctx).Warnf("Readiness check %s failed: %s", result.Name, result.Error)
+				}
+			}
+			return ReadyzResponse{Code: 503, Message: "Not ready", Report: report}, nil
+		}
+		return ReadyzResponse{Code: 200, Message: "Ready", Report: report}, nil
+	}
+}
+
 func MakeNotFoundEndpoint(logger *util.Logger) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		endpoint := request.(NotFoundRequest).Endpoint
-		logger.Error("Requested endpoint not found: " + endpoint)
+		logger.WithContext(ctx).Error("Requested endpoint not found: " + endpoint)
 		return HealtzResponse{Message: "Not found: " + endpoint, Code: 404}, nil
 	}
 }
@@ -57,24 +117,58 @@ func MakeNotFoundEndpoint(logger *util.Logger) endpoint.Endpoint {
 func MakeMethodNotAllowedEndpoint(logger *util.Logger) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		method := request.(MethodNotAllowedRequest).Method
-		logger.Error("Requested method not allowed: " + method)
+		logger.WithContext(ctx).Error("Requested method not allowed: " + method)
 		return HealtzResponse{Message: "Method not allowed: " + method, Code: 415}, nil
 	}
 }
 
+// Page size of listings, unless requested. Larger requests are capped to maxListLimit
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
 func MakeListFilesEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
 
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(ListFilesRequest)
 		if req.Err != nil {
-			return ListFilesResponse{Code: 400, Message: "Could not read body: " + req.Err.Error(), Files: []util.Row{}}, nil
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
+			return ListFilesResponse{Code: 400, Message: req.Err.Error()}, nil
+		}
+		if req.Query.Limit == 0 {
+			req.Query.Limit = defaultListLimit
+		} else if req.Query.Limit > maxListLimit {
+			req.Query.Limit = maxListLimit
+		}
+		listing, err := svc.ListFiles(ctx, req.Query)
+		if err != nil {
+			// 400, 500
+			return ListFilesResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return ListFilesResponse{Code: 200, Message: "Ok", Files: listing.Files, Prefixes: listing.Prefixes, NextCursor: listing.NextCursor}, nil
+	}
+}
+
+// Pages of search results are sized as listings
+func MakeSearchEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SearchRequest)
+		if req.Err != nil {
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
+			return SearchResponse{Code: 400, Message: req.Err.Error()}, nil
 		}
-		files, err := svc.ListFiles(ctx, req.Limit, req.Offset)
-		// if error is 500
-		if util.ErrorIs(err, util.InternalServerError{}) {
-			return ListFilesResponse{Code: 500, Message: err.Error(), Files: nil}, nil
+		if req.Query.Limit == 0 {
+			req.Query.Limit = defaultListLimit
+		} else if req.Query.Limit > maxListLimit {
+			req.Query.Limit = maxListLimit
+		}
+		result, err := svc.Search(ctx, req.Query)
+		if err != nil {
+			// 400, 500
+			return SearchResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
 		}
-		return ListFilesResponse{Code: 200, Message: "Ok", Files: files}, nil
+		return SearchResponse{Code: 200, Message: "Ok", Hits: result.Hits, Facets: result.Facets, NextCursor: result.NextCursor}, nil
 	}
 }
 
@@ -83,16 +177,13 @@ func MakeWriteFileEndpoint(svc storage.Service, storageFolder string, logger *ut
 	// TODO - possibly cluster all config variables in one struct and pass that to the WriteFile method
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(WriteFileRequest)
-		uuid, err := svc.WriteFile(ctx, req.File, req.Metadata, storageFolder)
-		if util.ErrorIs(err, util.BadRequestError{}) {
-			// if error is 400
-			return WriteFileResponse{Code: 400, Message: err.Error(), Uuid: ""}, nil
-		} else if util.ErrorIs(err, util.ConflictError{}) {
-			// if error is 409
-			return WriteFileResponse{Code: 409, Message: err.Error(), Uuid: ""}, nil
-		} else if util.ErrorIs(err, util.InternalServerError{}) {
-			// if error is 500
-			return WriteFileResponse{Code: 500, Message: err.Error(), Uuid: ""}, nil
+		if req.Err != nil {
+			return WriteFileResponse{Code: 400, Message: "Could not read file: " + req.Err.Error(), Uuid: ""}, nil
+		}
+		uuid, err := svc.WriteFile(ctx, req.File, req.Metadata, storageFolder, req.Preconditions)
+		if err != nil {
+			// 400, 403, 404, 409, 412, 500
+			return WriteFileResponse{Code: util.StatusCode(err), Message: err.Error(), Uuid: ""}, nil
 		}
 		return WriteFileResponse{Code: 201, Message: "File created", Uuid: uuid}, nil
 	}
@@ -101,31 +192,81 @@ func MakeWriteFileEndpoint(svc storage.Service, storageFolder string, logger *ut
 func MakeGetFileEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(GetFileRequest)
-		file, err := svc.GetFile(ctx, req.Uuid, storageFolder)
-		if util.ErrorIs(err, util.InternalServerError{}) {
-			// if error is 500
-			return GetFileResponse{Code: 500, Message: err.Error(), File: nil}, nil
+		row, file, err := svc.GetFile(ctx, req.Uuid, storageFolder, req.Preconditions)
+		if err != nil {
+			// 304, 403, 404, 412, 500. Not modified responses carry the validators of the object
+			return GetFileResponse{Code: util.StatusCode(err), Message: err.Error(), Object: row}, nil
 		}
-		return GetFileResponse{200, "File retrieved", file}, nil
+		return GetFileResponse{Code: 200, Message: "File retrieved", File: file, Object: row}, nil
 	}
 }
 
 func MakeDeleteFileEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(DeleteFileRequest)
-		err := svc.DeleteFile(ctx, req.Uuid, storageFolder)
+		err := svc.DeleteFile(ctx, req.Uuid, storageFolder, req.Preconditions)
 		if err != nil {
-			er := err.(*util.ResponseError) // TODO - as above
-			return DeleteFileResponse{er.StatusCode, err.Error()}, nil
+			// 403, 404, 412, 500
+			return DeleteFileResponse{util.StatusCode(err), err.Error()}, nil
 		}
 		return DeleteFileResponse{200, "File deleted"}, nil
 	}
 }
 
+func MakeCopyFileEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(CopyFileRequest)
+		if req.Err != nil {
+			return CopyFileResponse{Code: 400, Message: req.Err.Error()}, nil
+		}
+		uuid, err := svc.CopyFile(ctx, req.Uuid, req.Metadata, req.ReplaceMetadata, storageFolder, req.Preconditions)
+		if err != nil {
+			// 400, 403, 404, 409, 412, 413, 500
+			return CopyFileResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return CopyFileResponse{Code: 201, Message: "File copied", Uuid: uuid}, nil
+	}
+}
+
+func MakeMoveFileEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(MoveFileRequest)
+		if req.Err != nil {
+			return MoveFileResponse{Code: 400, Message: req.Err.Error()}, nil
+		}
+		if err := svc.MoveFile(ctx, req.Uuid, req.Bucket, req.Name, storageFolder, req.Preconditions); err != nil {
+			// 400, 403, 404, 409, 412, 500
+			return MoveFileResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return MoveFileResponse{Code: 200, Message: "File moved"}, nil
+	}
+}
+
+func MakeSetTagsEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SetTagsRequest)
+		if req.Err != nil {
+			return SetTagsResponse{Code: 400, Message: req.Err.Error()}, nil
+		}
+		if err := svc.SetTags(ctx, req.Uuid, req.Tags); err != nil {
+			// 400, 403, 404, 409, 500
+			return SetTagsResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return SetTagsResponse{Code: 200, Message: "File tagged"}, nil
+	}
+}
+
 func MakeAddBucketEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
-		// req := request.(AddBucketRequest)
-		return AddBucketResponse{200, "Bucket created"}, nil
+		req := request.(AddBucketRequest)
+		if req.Err != nil {
+			return AddBucketResponse{400, "Could not read body: " + req.Err.Error()}, nil
+		}
+		if err := svc.AddBucket(ctx, req.Name); err != nil {
+			// 400, 409, 500
+			return AddBucketResponse{util.StatusCode(err), err.Error()}, nil
+		}
+		return AddBucketResponse{201, "Bucket created"}, nil
 	}
 }
 
@@ -134,18 +275,260 @@ func MakeLogLevelEndpoint(svc storage.Service, storageFolder string, logger *uti
 	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(LogLevelRequest)
 		if req.Err != nil {
-			logger.Error("Error: " + req.Err.Error())
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
 			return LogLevelResponse{Code: 400, Message: req.Err.Error()}, nil
 		}
 		err := svc.SetLogLevel(ctx, req.Layer, req.Level)
 		if util.ErrorIs(err, util.BadRequestError{}) && err != nil {
-			logger.Error("Error: " + err.Error())
+			logger.WithContext(ctx).Error("Error: " + err.Error())
 			return LogLevelResponse{Code: 400, Message: err.Error()}, nil
 		}
 		if errors.Is(err, util.BadRequestError{}) {
-			logger.Error("Error: " + err.Error())
+			logger.WithContext(ctx).Error("Error: " + err.Error())
 			return LogLevelResponse{Code: 400, Message: err.Error()}, nil
 		}
 		return LogLevelResponse{200, "Logging level for layer " + req.Layer + " changed to " + req.Level}, nil
 	}
 }
+
+func MakeSetBucketPolicyEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SetBucketPolicyRequest)
+		if req.Err != nil {
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
+			return SetBucketPolicyResponse{400, "Could not read body: " + req.Err.Error()}, nil
+		}
+		if err := svc.SetBucketPolicy(ctx, req.Bucket, string(req.Policy)); err != nil {
+			// 400, 403, 404, 500
+			return SetBucketPolicyResponse{util.StatusCode(err), err.Error()}, nil
+		}
+		if len(req.Policy) == 0 {
+			return SetBucketPolicyResponse{200, "Policy of bucket " + req.Bucket + " deleted"}, nil
+		}
+		return SetBucketPolicyResponse{200, "Policy of bucket " + req.Bucket + " updated"}, nil
+	}
+}
+
+func MakeGetBucketPolicyEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetBucketPolicyRequest)
+		document, err := svc.GetBucketPolicy(ctx, req.Bucket)
+		if err != nil {
+			// 403, 404, 500
+			return GetBucketPolicyResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return GetBucketPolicyResponse{Code: 200, Message: "Ok", Policy: json.RawMessage(document)}, nil
+	}
+}
+
+func MakeSimulatePolicyEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(SimulatePolicyRequest)
+		if req.Err != nil {
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
+			return SimulatePolicyResponse{Code: 400, Message: "Could not read body: " + req.Err.Error()}, nil
+		}
+		decision, err := svc.SimulatePolicy(ctx, req.Bucket, string(req.Policy), req.Request)
+		if err != nil {
+			// 400, 403, 404, 500
+			return SimulatePolicyResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return SimulatePolicyResponse{Code: 200, Message: "Ok", Decision: &decision}, nil
+	}
+}
+
+// Default validity of presigned URLs, in minutes
+const defaultPresignExpiry = 15
+
+func MakePresignEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(PresignRequest)
+		if req.Err != nil {
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
+			return PresignResponse{Code: 400, Message: "Could not read body: " + req.Err.Error()}, nil
+		}
+		if req.ExpiresIn == 0 {
+			req.ExpiresIn = defaultPresignExpiry
+		}
+		expires := time.Now().Add(time.Duration(req.ExpiresIn) * time.Minute)
+		path, err := svc.Presign(ctx, presign.Params{
+			Method:      strings.ToUpper(req.Method),
+			Uuid:        req.Uuid,
+			Bucket:      req.Bucket,
+			Name:        req.Name,
+			Expires:     expires,
+			MaxLength:   req.MaxLength,
+			ContentType: req.ContentType,
+		})
+		if err != nil {
+			// 400, 403, 404, 500
+			return PresignResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return PresignResponse{Code: 200, Message: "Ok", Url: req.BaseURL + path, Expires: expires.UTC().Format(time.RFC3339)}, nil
+	}
+}
+
+func MakeTenantUsageEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		usage, quota, err := svc.TenantUsage(ctx)
+		if err != nil {
+			// 500
+			return TenantUsageResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return TenantUsageResponse{Code: 200, Message: "Ok", Tenant: util.PrincipalFromContext(ctx).Tenant, Usage: &usage, Quota: quota}, nil
+	}
+}
+
+// Default page size of the audit log
+const defaultAuditLimit = 100
+
+func MakeQueryAuditEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(QueryAuditRequest)
+		if req.Err != nil {
+			logger.WithContext(ctx).Error("Error: " + req.Err.Error())
+			return QueryAuditResponse{Code: 400, Message: req.Err.Error()}, nil
+		}
+		if req.Limit == 0 {
+			req.Limit = defaultAuditLimit
+		}
+		records, err := svc.QueryAudit(ctx, req.Filter, req.Limit, req.Offset)
+		if err != nil {
+			// 400, 500
+			return QueryAuditResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return QueryAuditResponse{Code: 200, Message: "Ok", Records: records}, nil
+	}
+}
+
+func MakeVerifyAuditEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		verification, err := svc.VerifyAudit(ctx)
+		if err != nil {
+			// 500
+			return VerifyAuditResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return VerifyAuditResponse{Code: 200, Message: "Ok", Verification: &verification}, nil
+	}
+}
+
+func MakePrefixUsageEndpoint(svc storage.Service, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(PrefixUsageRequest)
+		usage, err := svc.PrefixUsage(ctx, req.Bucket, req.Prefix)
+		if err != nil {
+			// 403, 404, 500
+			return PrefixUsageResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return PrefixUsageResponse{Code: 200, Message: "Ok", Bucket: req.Bucket, Prefix: req.Prefix, Usage: &usage}, nil
+	}
+}
+
+// Type of the jobs deleting a folder
+const deletePrefixJob = "DeletePrefix"
+
+func MakeDeletePrefixEndpoint(svc storage.Service, manager *jobs.Manager, storageFolder string, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(DeletePrefixRequest)
+		// Deleting a whole bucket takes an explicit prefix per folder
+		if req.Prefix == "" {
+			logger.WithContext(ctx).Error("Error: prefix not set")
+			return JobResponse{Code: 400, Message: "prefix must be set"}, nil
+		}
+		// Unknown buckets and folders the principal can't list are rejected before starting
+		if _, err := svc.PrefixUsage(ctx, req.Bucket, req.Prefix); err != nil {
+			// 403, 404, 500
+			return JobResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		job := manager.Start(ctx, deletePrefixJob, func(ctx context.Context, progress func(int, int)) error {
+			return storage.DeletePrefix(ctx, svc, storageFolder, req.Bucket, req.Prefix, progress)
+		})
+		return JobResponse{Code: 202, Message: "Deleting " + req.Bucket + "/" + req.Prefix, Job: &job}, nil
+	}
+}
+
+func MakeGetJobEndpoint(svc storage.Service, manager *jobs.Manager, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetJobRequest)
+		job, err := svc.GetJob(ctx, manager, req.ID)
+		if err != nil {
+			// 403, 404
+			return JobResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		return JobResponse{Code: 200, Message: "Ok", Job: &job}, nil
+	}
+}
+
+func MakeCancelJobEndpoint(svc storage.Service, manager *jobs.Manager, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(GetJobRequest)
+		job, err := svc.CancelJob(ctx, manager, req.ID)
+		var conflict util.ConflictError
+		if errors.As(err, &conflict) {
+			// The job has already finished
+			return JobResponse{Code: 409, Message: err.Error(), Job: &job}, nil
+		} else if err != nil {
+			// 403, 404
+			return JobResponse{Code: util.StatusCode(err), Message: err.Error()}, nil
+		}
+		// The job stops after the items in progress
+		return JobResponse{Code: 202, Message: "Canceling job " + req.ID, Job: &job}, nil
+	}
+}
+
+// Operations per batch, run synchronously or as a job, and operations of a batch run at once
+const (
+	maxBatchOperations    = 1000
+	maxBatchJobOperations = 10000
+	batchConcurrency      = 8
+)
+
+const batchJob = "Batch"
+
+func MakeBatchEndpoint(svc storage.Service, storageFolder string, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchRequest)
+		if err := validateBatch(req, maxBatchOperations); err != nil {
+			logger.WithContext(ctx).Error("Error: " + err.Error())
+			return BatchResponse{Code: 400, Message: err.Error()}, nil
+		}
+		results := storage.Batch(ctx, svc, storageFolder, req.Operations, batchConcurrency, func(int, int) {})
+		// Operations fail one by one, thus the batch succeeds: the results tell which ones failed
+		if err := storage.BatchError(results); err != nil {
+			return BatchResponse{Code: 200, Message: err.Error(), Results: results}, nil
+		}
+		return BatchResponse{Code: 200, Message: "Ok", Results: results}, nil
+	}
+}
+
+func MakeBatchJobEndpoint(svc storage.Service, manager *jobs.Manager, storageFolder string, logger *util.Logger) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(BatchRequest)
+		if err := validateBatch(req, maxBatchJobOperations); err != nil {
+			logger.WithContext(ctx).Error("Error: " + err.Error())
+			return JobResponse{Code: 400, Message: err.Error()}, nil
+		}
+		// The results of the operations are returned by GET /jobs/{id} once the job finishes
+		job := manager.StartWithResults(ctx, batchJob, func(ctx context.Context, progress func(int, int)) (any, error) {
+			results := storage.Batch(ctx, svc, storageFolder, req.Operations, batchConcurrency, progress)
+			if err := ctx.Err(); err != nil {
+				return results, err
+			}
+			return results, storage.BatchError(results)
+		})
+		return JobResponse{Code: 202, Message: "Running " + strconv.Itoa(len(req.Operations)) + " operations", Job: &job}, nil
+	}
+}
+
+// validateBatch checks that the batch has between 1 and limit operations
+func validateBatch(req BatchRequest, limit int) error {
+	switch {
+	case req.Err != nil:
+		return req.Err
+	case len(req.Operations) == 0:
+		return errors.New("no operations")
+	case len(req.Operations) > limit:
+		return errors.New("too many operations: at most " + strconv.Itoa(limit))
+	}
+	return nil
+}
@@ -1,9 +1,15 @@
 package endpoints
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 
+	"github.com/erizzardi/storage/pkg/storage"
+	"github.com/erizzardi/storage/pkg/storage/audit"
+	"github.com/erizzardi/storage/pkg/storage/health"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/policy"
 	"github.com/erizzardi/storage/util"
 )
 
@@ -24,20 +30,49 @@ type MethodNotAllowedRequest struct {
 }
 
 type WriteFileRequest struct {
-	File     io.Reader
-	Metadata util.Metadata
-	Headers  http.Header
-	Err      error `json:"-"`
+	File          io.Reader
+	Metadata      util.Metadata
+	Preconditions util.Preconditions
+	Headers       http.Header
+	Err           error `json:"-"`
 }
 
 type GetFileRequest struct {
-	Uuid    string
-	Headers http.Header
-	Err     error `json:"-"`
+	Uuid          string
+	Preconditions util.Preconditions
+	Headers       http.Header
+	Err           error `json:"-"`
 }
 
 type DeleteFileRequest struct {
-	Uuid    string
+	Uuid          string
+	Preconditions util.Preconditions
+	Headers       http.Header
+	Err           error `json:"-"`
+}
+
+type CopyFileRequest struct {
+	Uuid string
+	// Destination. Content type and tags are set only if ReplaceMetadata
+	Metadata        util.Metadata
+	ReplaceMetadata bool
+	Preconditions   util.Preconditions
+	Headers         http.Header
+	Err             error `json:"-"`
+}
+
+type MoveFileRequest struct {
+	Uuid          string
+	Bucket        string
+	Name          string
+	Preconditions util.Preconditions
+	Headers       http.Header
+	Err           error `json:"-"`
+}
+
+type SetTagsRequest struct {
+	Uuid    string            `json:"-"`
+	Tags    map[string]string `json:"tags"`
 	Headers http.Header
 	Err     error `json:"-"`
 }
@@ -58,8 +93,89 @@ type LogLevelRequest struct {
 }
 
 type ListFilesRequest struct {
-	Limit   uint `json:"limit"`
-	Offset  uint `json:"offset"`
+	Query   util.ListQuery
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type SetBucketPolicyRequest struct {
+	Bucket string
+	// Raw policy document. Empty to detach the policy
+	Policy  json.RawMessage
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type GetBucketPolicyRequest struct {
+	Bucket  string
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type SimulatePolicyRequest struct {
+	Bucket string `json:"bucket"`
+	// Optional policy document. If not set, the policy attached to the bucket is evaluated
+	Policy  json.RawMessage `json:"policy,omitempty"`
+	Request policy.Request  `json:"request"`
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type PresignRequest struct {
+	// GET (download) or PUT (upload)
+	Method string `json:"method"`
+	// Object to download
+	Uuid string `json:"uuid"`
+	// Object to upload
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+	// Validity of the URL, in minutes
+	ExpiresIn uint `json:"expiresIn"`
+	// Optional upload constraints
+	MaxLength   int64  `json:"maxLength"`
+	ContentType string `json:"contentType"`
+	// Scheme and host the URL is built on
+	BaseURL string `json:"-"`
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type QueryAuditRequest struct {
+	Filter  util.AuditFilter
+	Limit   uint
+	Offset  uint
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type PrefixUsageRequest struct {
+	Bucket  string
+	Prefix  string
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type DeletePrefixRequest struct {
+	Bucket  string
+	Prefix  string
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type SearchRequest struct {
+	Query   util.SearchQuery
+	Headers http.Header
+	Err     error `json:"-"`
+}
+
+type BatchRequest struct {
+	Operations []storage.BatchOperation `json:"operations"`
+	Headers    http.Header
+	Err        error `json:"-"`
+}
+
+type GetJobRequest struct {
+	ID      string
 	Headers http.Header
 	Err     error `json:"-"`
 }
@@ -73,6 +189,12 @@ type HealtzResponse struct {
 	Message string `json:"message"`
 }
 
+type ReadyzResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	health.Report
+}
+
 type NotFoundResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
@@ -88,6 +210,8 @@ type GetFileResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
 	File    []byte `json:"-"`
+	// Metadata of the file, for the validators ETag and Last-Modified
+	Object util.Row `json:"-"`
 }
 
 type DeleteFileResponse struct {
@@ -95,6 +219,22 @@ type DeleteFileResponse struct {
 	Message string `json:"message"`
 }
 
+type CopyFileResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Uuid    string `json:"uuid,omitempty"`
+}
+
+type MoveFileResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type SetTagsResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
 type AddBucketResponse struct {
 	Code    int    `json:"code"`
 	Message string `json:"message"`
@@ -109,4 +249,84 @@ type ListFilesResponse struct {
 	Code    int        `json:"code"`
 	Message string     `json:"message"`
 	Files   []util.Row `json:"files,omitempty"`
+	// Folders, with a delimiter
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Continuation token of the next page. Empty on the last one
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type SetBucketPolicyResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type GetBucketPolicyResponse struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Policy  json.RawMessage `json:"policy,omitempty"`
+}
+
+type SimulatePolicyResponse struct {
+	Code     int              `json:"code"`
+	Message  string           `json:"message"`
+	Decision *policy.Decision `json:"decision,omitempty"`
+}
+
+type PresignResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Url     string `json:"url,omitempty"`
+	Expires string `json:"expires,omitempty"`
+}
+
+type TenantUsageResponse struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Tenant  string      `json:"tenant"`
+	Usage   *util.Usage `json:"usage,omitempty"`
+	// Not set if the tenant has no quota
+	Quota *util.Quota `json:"quota,omitempty"`
+}
+
+type QueryAuditResponse struct {
+	Code    int                `json:"code"`
+	Message string             `json:"message"`
+	Records []util.AuditRecord `json:"records,omitempty"`
+}
+
+type VerifyAuditResponse struct {
+	Code         int                 `json:"code"`
+	Message      string              `json:"message"`
+	Verification *audit.Verification `json:"verification,omitempty"`
+}
+
+type PrefixUsageResponse struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Bucket  string      `json:"bucket"`
+	Prefix  string      `json:"prefix"`
+	Usage   *util.Usage `json:"usage,omitempty"`
+}
+
+type SearchResponse struct {
+	Code    int              `json:"code"`
+	Message string           `json:"message"`
+	Hits    []util.SearchHit `json:"hits,omitempty"`
+	// Of the whole result, on the first page only
+	Facets *util.SearchFacets `json:"facets,omitempty"`
+	// Continuation token of the next page. Empty on the last one
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type BatchResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// In the order of the operations
+	Results []storage.BatchResult `json:"results,omitempty"`
+}
+
+type JobResponse struct {
+	Code    int       `json:"code"`
+	Message string    `json:"message"`
+	Job     *jobs.Job `json:"job,omitempty"`
 }
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package health
+
+func freeBytes(dir string) (uint64, error) {
+	return 0, errUnsupported
+}
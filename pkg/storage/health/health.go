@@ -0,0 +1,163 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/erizzardi/storage/base"
+)
+
+// Status of a check
+const (
+	StatusOk   = "ok"
+	StatusFail = "fail"
+)
+
+// Check is a readiness check of one dependency
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// Report is the outcome of all the checks
+type Report struct {
+	Ready bool `json:"ready"`
+	// True if the service is shutting down. Checks are not run
+	Draining bool     `json:"draining,omitempty"`
+	Checks   []Result `json:"checks"`
+}
+
+// Checker runs the readiness checks
+type Checker struct {
+	checks []Check
+	// Maximum duration of every check
+	timeout  time.Duration
+	draining int32
+}
+
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// Drain marks the service as shutting down: from now on it is never ready
+func (c *Checker) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+// Draining returns true if Drain has been called
+func (c *Checker) Draining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// Ready runs all the checks concurrently. The service is ready if every check passes
+func (c *Checker) Ready(ctx context.Context) Report {
+	if c.Draining() {
+		return Report{Ready: false, Draining: true, Checks: []Result{}}
+	}
+
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for i, check := range c.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			results[i] = c.run(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	report := Report{Ready: true, Checks: results}
+	for _, result := range results {
+		if result.Status != StatusOk {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+// run runs check, giving up after the timeout.
+// Checks that ignore ctx are left running in background, their result is discarded
+func (c *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	begin := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Run(ctx) }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %s", c.timeout)
+	}
+	result := Result{Name: check.Name, Status: StatusOk, LatencyMs: float64(time.Since(begin).Microseconds()) / 1000}
+	if err != nil {
+		result.Status, result.Error = StatusFail, err.Error()
+	}
+	return result
+}
+
+//=======
+// Checks
+//=======
+
+// Database checks that the database is reachable
+func Database(db base.DB) Check {
+	return Check{Name: "database", Run: db.Ping}
+}
+
+// CircuitBreaker fails while the database circuit breaker is open
+func CircuitBreaker(breaker *base.Breaker) Check {
+	return Check{Name: "databaseCircuitBreaker", Run: func(ctx context.Context) error {
+		if state, probeAt := breaker.State(); state == base.BreakerOpen {
+			return fmt.Errorf("circuit breaker open, probing the database again at %s", probeAt.UTC().Format(time.RFC3339))
+		}
+		return nil
+	}}
+}
+
+// Writable checks that files can be created in dir, by writing and removing a probe file
+func Writable(dir string) Check {
+	return Check{Name: "storageWritable", Run: func(ctx context.Context) error {
+		file, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		if _, err := file.Write([]byte("ok")); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}}
+}
+
+// FreeSpace checks that the filesystem of dir has at least min bytes available
+func FreeSpace(dir string, min uint64) Check {
+	return Check{Name: "storageFreeSpace", Run: func(ctx context.Context) error {
+		free, err := freeBytes(dir)
+		if err != nil {
+			return err
+		}
+		if free < min {
+			return fmt.Errorf("%d bytes free, %d required", free, min)
+		}
+		return nil
+	}}
+}
+
+var errUnsupported = errors.New("free space check not supported on this platform")
@@ -0,0 +1,52 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Unit tests for the readiness checks.
+
+var (
+	okCheck     = Check{Name: "ok", Run: func(ctx context.Context) error { return nil }}
+	failedCheck = Check{Name: "failed", Run: func(ctx context.Context) error { return errors.New("down") }}
+	// Ignores ctx, so that the timeout is enforced by the checker
+	slowCheck = Check{Name: "slow", Run: func(ctx context.Context) error { time.Sleep(time.Second); return nil }}
+)
+
+//
+// This test runs passing, failing and slow checks.
+// Pass if the service is ready only when all the checks pass in time.
+func TestReady(t *testing.T) {
+
+	if report := NewChecker(time.Second, okCheck, Writable(t.TempDir()), FreeSpace(t.TempDir(), 1)).Ready(context.Background()); !report.Ready {
+		t.Errorf("Expected ready, got %+v", report)
+	}
+
+	report := NewChecker(50*time.Millisecond, okCheck, failedCheck, slowCheck).Ready(context.Background())
+	if report.Ready {
+		t.Error("Expected not ready")
+	}
+	for i, expected := range []string{StatusOk, StatusFail, StatusFail} {
+		if report.Checks[i].Status != expected {
+			t.Errorf("Check %s: expected %s, got %s", report.Checks[i].Name, expected, report.Checks[i].Status)
+		}
+	}
+	if report.Checks[2].LatencyMs >= 1000 {
+		t.Errorf("Slow check not timed out: %f ms", report.Checks[2].LatencyMs)
+	}
+}
+
+//
+// This test drains a checker whose checks pass.
+// Pass if the service is not ready anymore.
+func TestDrain(t *testing.T) {
+
+	checker := NewChecker(time.Second, okCheck)
+	checker.Drain()
+	if report := checker.Ready(context.Background()); report.Ready || !report.Draining {
+		t.Errorf("Expected draining, got %+v", report)
+	}
+}
@@ -0,0 +1,175 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+)
+
+// States of a job
+const (
+	StateRunning   = "running"
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateCanceled  = "canceled"
+)
+
+// Job is the status of a background job
+type Job struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Principal string `json:"principal"`
+	Tenant    string `json:"-"`
+	State     string `json:"state"`
+	// Items processed successfully, and the ones that failed
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+	Error  string `json:"error,omitempty"`
+	// Results of the items, for the jobs that have them. Set when the job finishes
+	Results any `json:"results,omitempty"`
+	// Timestamps, in util.TimeFormat
+	Started  string `json:"started"`
+	Finished string `json:"finished,omitempty"`
+}
+
+// Func is the work of a job. It reports its progress, and stops when ctx is canceled
+type Func func(ctx context.Context, progress func(done int, failed int)) error
+
+// ResultsFunc is the work of a job returning results, kept with its status. Results are kept when it fails too
+type ResultsFunc func(ctx context.Context, progress func(done int, failed int)) (any, error)
+
+// Manager runs jobs in background, and keeps their status in memory: jobs are lost on restart,
+// and each replica knows only its own. Finished jobs are forgotten after the retention
+type Manager struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+	wg   sync.WaitGroup
+
+	retention time.Duration
+	logger    *util.Logger
+}
+
+type job struct {
+	Job
+	cancel context.CancelFunc
+}
+
+func NewManager(retention time.Duration, logger *util.Logger) *Manager {
+	return &Manager{jobs: make(map[string]*job), retention: retention, logger: logger}
+}
+
+// Start runs fn in background, on behalf of the principal of ctx. The job outlives the request:
+// it keeps the values of ctx, but not its cancellation
+func (m *Manager) Start(ctx context.Context, kind string, fn Func) Job {
+	return m.StartWithResults(ctx, kind, func(ctx context.Context, progress func(int, int)) (any, error) {
+		return nil, fn(ctx, progress)
+	})
+}
+
+// StartWithResults runs fn in background as Start, keeping its results with the status of the job
+func (m *Manager) StartWithResults(ctx context.Context, kind string, fn ResultsFunc) Job {
+	principal := util.PrincipalFromContext(ctx)
+	ctx, cancel := context.WithCancel(util.DetachedContext(ctx))
+	j := &job{
+		Job: Job{
+			ID:        util.RandomString(16),
+			Type:      kind,
+			Principal: principal.Name,
+			Tenant:    principal.Tenant,
+			State:     StateRunning,
+			Started:   util.FormatTime(time.Now()),
+		},
+		cancel: cancel,
+	}
+
+	m.mu.Lock()
+	m.prune()
+	m.jobs[j.ID] = j
+	status := j.Job
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer cancel()
+		results, err := fn(ctx, func(done int, failed int) {
+			m.mu.Lock()
+			j.Done, j.Failed = done, failed
+			m.mu.Unlock()
+		})
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		j.Results, j.Finished = results, util.FormatTime(time.Now())
+		switch {
+		case err == nil:
+			j.State = StateSucceeded
+		case ctx.Err() != nil && errors.Is(err, ctx.Err()):
+			j.State, j.Error = StateCanceled, err.Error()
+		default:
+			j.State, j.Error = StateFailed, err.Error()
+		}
+		m.logger.WithContext(ctx).Infof("Job %s %s %s: %d done, %d failed", j.Type, j.ID, j.State, j.Done, j.Failed)
+	}()
+
+	m.logger.WithContext(ctx).Infof("Job %s %s started", kind, status.ID)
+	return status
+}
+
+// Get returns the status of the job with ID id, false if there is none
+func (m *Manager) Get(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return j.Job, true
+}
+
+// Cancel cancels the job with ID id, which stops when its work notices. Finished jobs are left as they are.
+// Returns the status of the job before it stops, false if there is none
+func (m *Manager) Cancel(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	j.cancel()
+	return j.Job, true
+}
+
+// Shutdown cancels the running jobs, then waits for them to stop until ctx is done
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	for _, j := range m.jobs {
+		j.cancel()
+	}
+	m.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// prune forgets the jobs finished before the retention. Called with mu held
+func (m *Manager) prune() {
+	oldest := util.FormatTime(time.Now().Add(-m.retention))
+	for id, j := range m.jobs {
+		if j.State != StateRunning && j.Finished < oldest {
+			delete(m.jobs, id)
+		}
+	}
+}
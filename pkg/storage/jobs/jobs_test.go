@@ -0,0 +1,103 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/erizzardi/storage/util"
+)
+
+// Unit tests for the background jobs.
+
+//
+// This test runs a job reporting its progress, a failing one and one that runs until the manager shuts down.
+// Pass if each ends in the expected state, with its progress, and the request context doesn't cancel them.
+func TestManager(t *testing.T) {
+
+	manager := NewManager(time.Hour, util.NewLogger())
+	ctx, cancel := context.WithCancel(util.ContextWithPrincipal(context.Background(), util.Principal{Name: "alice", Tenant: "acme"}))
+
+	succeeded := manager.Start(ctx, "test", func(ctx context.Context, progress func(int, int)) error {
+		progress(3, 0)
+		return nil
+	})
+	failed := manager.Start(ctx, "test", func(ctx context.Context, progress func(int, int)) error {
+		progress(1, 1)
+		return errors.New("1 of 2 objects not deleted")
+	})
+	started := make(chan struct{})
+	canceled := manager.Start(ctx, "test", func(ctx context.Context, progress func(int, int)) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if canceled.State != StateRunning || canceled.Principal != "alice" || canceled.Tenant != "acme" {
+		t.Errorf("Wrong job started: %+v", canceled)
+	}
+	// The request is over, the jobs go on
+	cancel()
+	<-started
+
+	if err := manager.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []Job{
+		{ID: succeeded.ID, State: StateSucceeded, Done: 3},
+		{ID: failed.ID, State: StateFailed, Done: 1, Failed: 1},
+		{ID: canceled.ID, State: StateCanceled},
+	} {
+		job, ok := manager.Get(expected.ID)
+		if !ok || job.State != expected.State || job.Done != expected.Done || job.Failed != expected.Failed || job.Finished == "" {
+			t.Errorf("Expected %+v, got %+v", expected, job)
+		}
+	}
+	if _, ok := manager.Get("unknown"); ok {
+		t.Error("Unknown job found")
+	}
+}
+
+//
+// This test cancels a running job, then an unknown one.
+// Pass if the job ends canceled with the progress it made, and the unknown job is not found.
+func TestCancel(t *testing.T) {
+
+	manager := NewManager(time.Hour, util.NewLogger())
+	job := manager.Start(context.Background(), "test", func(ctx context.Context, progress func(int, int)) error {
+		progress(2, 0)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if _, ok := manager.Cancel(job.ID); !ok {
+		t.Fatal("Running job not found")
+	}
+	if err := manager.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if job, _ := manager.Get(job.ID); job.State != StateCanceled || job.Done != 2 {
+		t.Errorf("Job should be canceled after 2 items, got %+v", job)
+	}
+	if _, ok := manager.Cancel("unknown"); ok {
+		t.Error("Unknown job found")
+	}
+}
+
+//
+// This test runs a job returning results, and failing.
+// Pass if the results are kept with the status once it finishes.
+func TestStartWithResults(t *testing.T) {
+
+	manager := NewManager(time.Hour, util.NewLogger())
+	job := manager.StartWithResults(context.Background(), "test", func(ctx context.Context, progress func(int, int)) (any, error) {
+		progress(1, 1)
+		return []string{"ok", "failed"}, errors.New("1 of 2 items failed")
+	})
+	if err := manager.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	job, _ = manager.Get(job.ID)
+	if results, ok := job.Results.([]string); job.State != StateFailed || !ok || len(results) != 2 {
+		t.Errorf("Expected failed job with 2 results, got %+v", job)
+	}
+}
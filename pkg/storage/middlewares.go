@@ -1,9 +1,31 @@
 package storage
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/erizzardi/storage/base"
+	"github.com/erizzardi/storage/pkg/storage/audit"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/certs"
+	"github.com/erizzardi/storage/pkg/storage/policy"
+	"github.com/erizzardi/storage/pkg/storage/presign"
 	"github.com/erizzardi/storage/util"
+	"github.com/go-kit/kit/metrics"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 //==================
@@ -14,15 +36,987 @@ type TransportMiddleware struct {
 	Next   http.Handler
 }
 
-// Middleware for transport layer. It logs every incoming transaction.
-// Maybe not needed? Istio/Nginx could do this for free
+// Header carrying the request ID, in requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// Maximum length of a request ID set by the client
+const maxRequestIDLength = 128
+
+// accessLog collects the values of the access log line known only to inner handlers
+type accessLog struct {
+	principal string
+}
+
+type accessLogContextKey struct{}
+
+// Middleware for transport layer. It assigns an ID to every request, and logs every transaction when it completes.
+// The ID is taken from the X-Request-ID header if valid, generated otherwise, and returned in the response
 func (mw TransportMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+
+	requestID := r.Header.Get(RequestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = util.RandomString(16)
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+	trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", requestID))
 
-	// Logs every incoming request
-	mw.Logger.Infof("Incoming request: %s %s", r.Method, r.URL.String())
+	entry := &accessLog{principal: util.AnonymousPrincipal}
+	ctx := util.ContextWithRequestID(r.Context(), requestID)
+	ctx = context.WithValue(ctx, accessLogContextKey{}, entry)
+	logger := mw.Logger.WithContext(ctx)
+	url := redactedURL(r)
+	logger.Debugf("Incoming request: %s %s", r.Method, url)
 
 	// Sets content-type header for every request. If different, it has to be set in the appropriate decodeResponse function
 	w.Header().Set("Content-Type", "application/json")
+	recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+	mw.Next.ServeHTTP(recorder, r.WithContext(ctx))
+
+	logger.WithFields(logrus.Fields{
+		"method":      r.Method,
+		"url":         url,
+		"status":      recorder.code,
+		"bytes":       recorder.bytes,
+		"duration_ms": float64(time.Since(begin).Microseconds()) / 1000,
+		"principal":   entry.principal,
+		"remote_addr": r.RemoteAddr,
+	}).Infof("%s %s %d", r.Method, r.URL.Path, recorder.code)
+}
+
+// validRequestID returns true if id is short and made of printable ASCII characters only, thus safe to log
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// redactedURL returns the URL of the request without the signature of presigned URLs, which is a credential
+func redactedURL(r *http.Request) string {
+	if !presign.IsPresigned(r) {
+		return r.URL.String()
+	}
+	u := *r.URL
+	query := u.Query()
+	query.Set(presign.SignatureParam, "REDACTED")
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+//=========================
+// Transport authentication
+//=========================
+type AuthenticationMiddleware struct {
+	Logger *util.Logger
+	// API key -> principal
+	Keys map[string]util.Principal
+	// Verifies presigned URLs
+	Signer *presign.Signer
+	Next   http.Handler
+}
+
+// Middleware for transport layer. It resolves the presigned URL, the API key or the client certificate of the request
+// into a principal, in this order, and stores it in the request context together with the source IP.
+// Requests without API key are served as the anonymous principal. Requests with an unknown key are rejected.
+func (mw AuthenticationMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	principal := util.Principal{Name: util.AnonymousPrincipal}
+
+	key := r.Header.Get("X-Api-Key")
+	if auth := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if presign.IsPresigned(r) {
+		// Presigned URLs act on behalf of the principal that minted them
+		params, err := mw.Signer.Verify(r, time.Now())
+		if err != nil {
+			mw.Logger.WithContext(r.Context()).Error("Error: " + err.Error())
+			writeAuthError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		if params.Method == http.MethodPut {
+			if err := params.CheckUpload(r); err != nil {
+				mw.Logger.WithContext(r.Context()).Error("Error: " + err.Error())
+				writeAuthError(w, http.StatusForbidden, err.Error())
+				return
+			}
+			if params.MaxLength > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, params.MaxLength)
+			}
+		}
+		principal = util.Principal{Name: params.Principal, Tenant: params.Tenant}
+	} else if key != "" {
+		p, ok := mw.Keys[key]
+		if !ok {
+			mw.Logger.WithContext(r.Context()).Error("Error: invalid API key")
+			writeAuthError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		principal = p
+	} else if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		// Client certificate, verified against the CA bundle during the handshake
+		p := certs.Principal(r.TLS.VerifiedChains[0][0])
+		if p.Name == "" {
+			mw.Logger.WithContext(r.Context()).Error("Error: client certificate without common name")
+			writeAuthError(w, http.StatusUnauthorized, "client certificate without common name")
+			return
+		}
+		principal = p
+	}
+
+	sourceIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		sourceIP = r.RemoteAddr
+	}
 
+	if entry, ok := r.Context().Value(accessLogContextKey{}).(*accessLog); ok {
+		entry.principal = principal.Name
+	}
+	ctx := util.ContextWithPrincipal(r.Context(), principal)
+	ctx = util.ContextWithSourceIP(ctx, sourceIP)
+	mw.Next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+//=======================
+// Transport rate limiting
+//=======================
+type RateLimitMiddleware struct {
+	Logger  *util.Logger
+	Limiter *util.RateLimiter
+	Next    http.Handler
+}
+
+// Middleware for transport layer. It limits the request rate of every principal, answering 429 when exceeded.
+// Anonymous requests are limited by source IP. It needs the principal, thus goes after authentication
+func (mw RateLimitMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	principal := util.PrincipalFromContext(r.Context())
+	key := principal.Name + "@" + principal.Tenant
+	if principal.Name == util.AnonymousPrincipal {
+		key = principal.Name + "/" + util.SourceIPFromContext(r.Context())
+	}
+	if !mw.Limiter.Allow(key, time.Now()) {
+		mw.Logger.WithContext(r.Context()).Errorf("Error: rate limit exceeded by %s", key)
+		w.Header().Set("Retry-After", "1")
+		writeAuthError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
 	mw.Next.ServeHTTP(w, r)
 }
+
+//==================
+// Transport metrics
+//==================
+type HTTPMetricsMiddleware struct {
+	// Labeled by route, method and code
+	Requests metrics.Counter
+	Duration metrics.Histogram
+	// Resolves the route template of a request, so that paths with IDs don't explode the label cardinality
+	Route func(*http.Request) string
+	Next  http.Handler
+}
+
+// Middleware for transport layer. It counts requests and observes their latency
+func (mw HTTPMetricsMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	begin := time.Now()
+	recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+	mw.Next.ServeHTTP(recorder, r)
+
+	labels := []string{"route", mw.Route(r), "method", r.Method, "code", strconv.Itoa(recorder.code)}
+	mw.Requests.With(labels...).Add(1)
+	mw.Duration.With(labels...).Observe(time.Since(begin).Seconds())
+}
+
+// statusRecorder records status code and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.code = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+//===================
+// Transport tracing
+//===================
+type TracingHTTPMiddleware struct {
+	// Resolves the route template of a request, used as span name
+	Route func(*http.Request) string
+	Next  http.Handler
+}
+
+// Middleware for transport layer. It continues the trace propagated by the client, if any,
+// and wraps the request in a server span
+func (mw TracingHTTPMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	route := mw.Route(r)
+	ctx, span := tracer.Start(ctx, r.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("storage", route, r)...),
+	)
+	defer span.End()
+	recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+
+	mw.Next.ServeHTTP(recorder, r.WithContext(ctx))
+
+	span.SetAttributes(semconv.HTTPAttributesFromHTTPStatusCode(recorder.code)...)
+	span.SetAttributes(attribute.Int64("http.response_content_length", recorder.bytes))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(recorder.code, trace.SpanKindServer))
+}
+
+func writeAuthError(w http.ResponseWriter, code int, message string) {
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]any{"code": code, "message": message})
+}
+
+//====================
+// Service middlewares
+//====================
+
+// Middleware describes a service middleware
+type Middleware func(Service) Service
+
+// AuthorizationMiddleware evaluates the bucket policies for every service call.
+// Buckets without a policy are accessible by everyone. Policy management is reserved to the bucket owner.
+func AuthorizationMiddleware(db base.DB, admins []util.Principal, logger *util.Logger) Middleware {
+	return func(next Service) Service {
+		return &authorizationMiddleware{db: db, admins: admins, logger: logger, next: next}
+	}
+}
+
+type authorizationMiddleware struct {
+	db base.DB
+	// Administrators of their tenant
+	admins []util.Principal
+	logger *util.Logger
+	next   Service
+}
+
+// authorize evaluates action on the object named resource in bucket.
+// Returns ForbiddenError if the policy denies it
+func (mw *authorizationMiddleware) authorize(ctx context.Context, bucket string, action string, resource string) error {
+	return mw.authorizeWith(ctx, mw.policy, bucket, action, resource)
+}
+
+// authorizeWith is authorize, with the policy of bucket returned by policies
+func (mw *authorizationMiddleware) authorizeWith(ctx context.Context, policies policyFunc, bucket string, action string, resource string) error {
+	doc, err := policies(ctx, bucket)
+	if err != nil || doc == nil {
+		return err
+	}
+	decision := doc.Evaluate(policyRequest(ctx, action, resource))
+	if !decision.Allowed {
+		mw.logger.WithContext(ctx).Errorf("Error: %s %s/%s denied to %s: %s", action, bucket, resource, util.PrincipalFromContext(ctx).Name, decision.Reason)
+		return util.ForbiddenError{Message: decision.Reason}
+	}
+	return nil
+}
+
+// policyRequest is the request of the principal, to be evaluated against bucket policies
+func policyRequest(ctx context.Context, action string, resource string) policy.Request {
+	return policy.Request{
+		Principal: util.PrincipalFromContext(ctx).Name,
+		Action:    action,
+		Resource:  resource,
+		SourceIP:  util.SourceIPFromContext(ctx),
+	}
+}
+
+// policyFunc returns the policy attached to a bucket, as authorizationMiddleware.policy
+type policyFunc func(ctx context.Context, bucket string) (*policy.Document, error)
+
+// cachedPolicies returns mw.policy, reading and parsing the policy of every bucket once.
+// For the methods that authorize every entry of a page: the cache lasts as long as the call
+func (mw *authorizationMiddleware) cachedPolicies() policyFunc {
+	cache := make(map[string]*policy.Document)
+	return func(ctx context.Context, bucket string) (*policy.Document, error) {
+		if doc, ok := cache[bucket]; ok {
+			return doc, nil
+		}
+		doc, err := mw.policy(ctx, bucket)
+		if err != nil {
+			return nil, err
+		}
+		cache[bucket] = doc
+		return doc, nil
+	}
+}
+
+// policy returns the policy attached to bucket, nil if there is none.
+// Unknown buckets are left to the service, which reports them as not found
+func (mw *authorizationMiddleware) policy(ctx context.Context, bucket string) (*policy.Document, error) {
+	if bucket == "" {
+		return nil, nil
+	}
+	b, err := mw.db.RetrieveBucket(ctx, util.PrincipalFromContext(ctx).Tenant, bucket)
+	if errors.Is(err, base.NotFoundError) {
+		return nil, nil
+	} else if err != nil {
+		mw.logger.WithContext(ctx).Error("Error: " + err.Error())
+		return nil, util.InternalServerError{}
+	}
+	if b.Policy == "" {
+		return nil, nil
+	}
+	doc, err := policy.Parse([]byte(b.Policy))
+	if err != nil {
+		mw.logger.WithContext(ctx).Errorf("Error: policy of bucket %s is invalid: %s", bucket, err.Error())
+		return nil, util.InternalServerError{}
+	}
+	return &doc, nil
+}
+
+// requireOwner returns ForbiddenError if the principal of the request doesn't own the bucket
+func (mw *authorizationMiddleware) requireOwner(ctx context.Context, bucket string) error {
+	principal := util.PrincipalFromContext(ctx)
+	b, err := mw.db.RetrieveBucket(ctx, principal.Tenant, bucket)
+	if errors.Is(err, base.NotFoundError) {
+		return util.NotFoundError{Message: "bucket " + bucket + " not found"}
+	} else if err != nil {
+		mw.logger.WithContext(ctx).Error("Error: " + err.Error())
+		return util.InternalServerError{}
+	}
+	if principal.Name != b.Owner {
+		return util.ForbiddenError{Message: principal.Name + " is not the owner of bucket " + bucket}
+	}
+	return nil
+}
+
+// requireAdmin fails unless the principal is an administrator of its tenant.
+// Unauthenticated requests are rejected, rather than served as the anonymous principal of the default tenant
+func (mw *authorizationMiddleware) requireAdmin(ctx context.Context) error {
+	principal := util.PrincipalFromContext(ctx)
+	if principal.Name == util.AnonymousPrincipal {
+		return util.UnauthorizedError{Message: "authentication required"}
+	}
+	if mw.isAdmin(principal) {
+		return nil
+	}
+	mw.logger.WithContext(ctx).Errorf("Error: %s is not an administrator of tenant %q", principal.Name, principal.Tenant)
+	return util.ForbiddenError{Message: "reserved to administrators"}
+}
+
+// isAdmin tells whether the principal is an administrator of its tenant
+func (mw *authorizationMiddleware) isAdmin(principal util.Principal) bool {
+	for _, admin := range mw.admins {
+		if admin == principal {
+			return true
+		}
+	}
+	return false
+}
+
+// object returns the metadata of the object, to find out its bucket.
+// If the object can't be found the call is forwarded, to let the service report the error
+func (mw *authorizationMiddleware) object(ctx context.Context, uuid string) util.Row {
+	row, _ := mw.db.RetrieveMetadata(ctx, uuid)
+	return row
+}
+
+func (mw *authorizationMiddleware) ListFiles(ctx context.Context, query util.ListQuery) (util.Listing, error) {
+	listing, err := mw.next.ListFiles(ctx, query)
+	if err != nil {
+		return listing, err
+	}
+	// Objects and folders the principal can't list are filtered out. The cursor stays after the last entry
+	// of the page, thus pages may be shorter than the limit
+	policies := mw.cachedPolicies()
+	allowed := make([]util.Row, 0, len(listing.Files))
+	for _, row := range listing.Files {
+		if err := mw.authorizeWith(ctx, policies, row.Bucket, policy.ListBucket, row.FileName); err == nil {
+			allowed = append(allowed, row)
+		} else if !util.ErrorIs(err, util.ForbiddenError{}) {
+			return util.Listing{}, err
+		}
+	}
+	listing.Files = allowed
+	if len(listing.Prefixes) > 0 {
+		// Folders are listed within one bucket only
+		bucket := ""
+		if query.Bucket != nil {
+			bucket = *query.Bucket
+		}
+		prefixes := make([]string, 0, len(listing.Prefixes))
+		for _, prefix := range listing.Prefixes {
+			if err := mw.authorizeWith(ctx, policies, bucket, policy.ListBucket, prefix); err == nil {
+				prefixes = append(prefixes, prefix)
+			} else if !util.ErrorIs(err, util.ForbiddenError{}) {
+				return util.Listing{}, err
+			}
+		}
+		listing.Prefixes = prefixes
+	}
+	return listing, nil
+}
+
+func (mw *authorizationMiddleware) WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string, cond util.Preconditions) (string, error) {
+	if err := mw.authorize(ctx, metadata.Bucket, policy.PutObject, metadata.Name); err != nil {
+		return "", err
+	}
+	return mw.next.WriteFile(ctx, file, metadata, storageFolder, cond)
+}
+
+func (mw *authorizationMiddleware) GetFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (util.Row, []byte, error) {
+	row := mw.object(ctx, uuid)
+	if err := mw.authorize(ctx, row.Bucket, policy.GetObject, row.FileName); err != nil {
+		return util.Row{}, nil, err
+	}
+	return mw.next.GetFile(ctx, uuid, storageFolder, cond)
+}
+
+func (mw *authorizationMiddleware) DeleteFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) error {
+	row := mw.object(ctx, uuid)
+	if err := mw.authorize(ctx, row.Bucket, policy.DeleteObject, row.FileName); err != nil {
+		return err
+	}
+	return mw.next.DeleteFile(ctx, uuid, storageFolder, cond)
+}
+
+// Copies read the source and write the destination
+func (mw *authorizationMiddleware) CopyFile(ctx context.Context, uuid string, dest util.Metadata, replaceMetadata bool, storageFolder string, cond util.Preconditions) (string, error) {
+	row := mw.object(ctx, uuid)
+	if err := mw.authorize(ctx, row.Bucket, policy.GetObject, row.FileName); err != nil {
+		return "", err
+	}
+	if err := mw.authorize(ctx, dest.Bucket, policy.PutObject, dest.Name); err != nil {
+		return "", err
+	}
+	return mw.next.CopyFile(ctx, uuid, dest, replaceMetadata, storageFolder, cond)
+}
+
+// Moves delete the source and write the destination
+func (mw *authorizationMiddleware) MoveFile(ctx context.Context, uuid string, bucket string, name string, storageFolder string, cond util.Preconditions) error {
+	row := mw.object(ctx, uuid)
+	if err := mw.authorize(ctx, row.Bucket, policy.DeleteObject, row.FileName); err != nil {
+		return err
+	}
+	if err := mw.authorize(ctx, bucket, policy.PutObject, name); err != nil {
+		return err
+	}
+	return mw.next.MoveFile(ctx, uuid, bucket, name, storageFolder, cond)
+}
+
+// Tags are part of the object, thus set by whom can write it
+func (mw *authorizationMiddleware) SetTags(ctx context.Context, uuid string, tags map[string]string) error {
+	row := mw.object(ctx, uuid)
+	if err := mw.authorize(ctx, row.Bucket, policy.PutObject, row.FileName); err != nil {
+		return err
+	}
+	return mw.next.SetTags(ctx, uuid, tags)
+}
+
+// Objects the principal can't list are filtered out, as in listings.
+// Facets count every matching object of the tenant, thus they are left out unless the principal can list
+// the whole of every bucket they count
+func (mw *authorizationMiddleware) Search(ctx context.Context, query util.SearchQuery) (util.SearchResult, error) {
+	result, err := mw.next.Search(ctx, query)
+	if err != nil {
+		return result, err
+	}
+	policies := mw.cachedPolicies()
+	allowed := make([]util.SearchHit, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		if err := mw.authorizeWith(ctx, policies, hit.Bucket, policy.ListBucket, hit.FileName); err == nil {
+			allowed = append(allowed, hit)
+		} else if !util.ErrorIs(err, util.ForbiddenError{}) {
+			return util.SearchResult{}, err
+		}
+	}
+	result.Hits = allowed
+	if result.Facets != nil {
+		for bucket := range result.Facets.Buckets {
+			doc, err := policies(ctx, bucket)
+			if err != nil {
+				return util.SearchResult{}, err
+			}
+			if doc != nil && !doc.EvaluateBucket(policyRequest(ctx, policy.ListBucket, "")) {
+				result.Facets = nil
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// Logging level is not bucket-scoped, thus not subject to bucket policies
+func (mw *authorizationMiddleware) SetLogLevel(ctx context.Context, layer string, level string) error {
+	return mw.next.SetLogLevel(ctx, layer, level)
+}
+
+// Usage is tenant-scoped, thus not subject to bucket policies
+func (mw *authorizationMiddleware) TenantUsage(ctx context.Context) (util.Usage, *util.Quota, error) {
+	return mw.next.TenantUsage(ctx)
+}
+
+// The size of a folder discloses as much as its listing
+func (mw *authorizationMiddleware) PrefixUsage(ctx context.Context, bucket string, prefix string) (util.Usage, error) {
+	if err := mw.authorize(ctx, bucket, policy.ListBucket, prefix); err != nil {
+		return util.Usage{}, err
+	}
+	return mw.next.PrefixUsage(ctx, bucket, prefix)
+}
+
+// The audit log is tenant-scoped, thus not subject to bucket policies. It is reserved to administrators
+func (mw *authorizationMiddleware) QueryAudit(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
+	if err := mw.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	return mw.next.QueryAudit(ctx, filter, limit, offset)
+}
+
+func (mw *authorizationMiddleware) VerifyAudit(ctx context.Context) (audit.Verification, error) {
+	if err := mw.requireAdmin(ctx); err != nil {
+		return audit.Verification{}, err
+	}
+	return mw.next.VerifyAudit(ctx)
+}
+
+// Jobs, and the results of batches, are reserved to the principal that started them and to the administrators
+func (mw *authorizationMiddleware) GetJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error) {
+	job, err := mw.next.GetJob(ctx, manager, id)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	if err := mw.authorizeJob(ctx, job); err != nil {
+		return jobs.Job{}, err
+	}
+	return job, nil
+}
+
+func (mw *authorizationMiddleware) CancelJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error) {
+	job, err := mw.next.GetJob(ctx, manager, id)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	if err := mw.authorizeJob(ctx, job); err != nil {
+		return jobs.Job{}, err
+	}
+	return mw.next.CancelJob(ctx, manager, id)
+}
+
+// authorizeJob fails unless the principal started the job or is an administrator of its tenant
+func (mw *authorizationMiddleware) authorizeJob(ctx context.Context, job jobs.Job) error {
+	principal := util.PrincipalFromContext(ctx)
+	if principal.Name == job.Principal || mw.isAdmin(principal) {
+		return nil
+	}
+	mw.logger.WithContext(ctx).Errorf("Error: %s did not start job %s", principal.Name, job.ID)
+	return util.ForbiddenError{Message: "job " + job.ID + " was started by another principal"}
+}
+
+func (mw *authorizationMiddleware) AddBucket(ctx context.Context, name string) error {
+	return mw.next.AddBucket(ctx, name)
+}
+
+func (mw *authorizationMiddleware) SetBucketPolicy(ctx context.Context, bucket string, document string) error {
+	if err := mw.requireOwner(ctx, bucket); err != nil {
+		return err
+	}
+	return mw.next.SetBucketPolicy(ctx, bucket, document)
+}
+
+func (mw *authorizationMiddleware) GetBucketPolicy(ctx context.Context, bucket string) (string, error) {
+	if err := mw.requireOwner(ctx, bucket); err != nil {
+		return "", err
+	}
+	return mw.next.GetBucketPolicy(ctx, bucket)
+}
+
+// Simulating an inline document discloses nothing, simulating the attached policy is reserved to the owner
+func (mw *authorizationMiddleware) SimulatePolicy(ctx context.Context, bucket string, document string, req policy.Request) (policy.Decision, error) {
+	if document == "" {
+		if err := mw.requireOwner(ctx, bucket); err != nil {
+			return policy.Decision{}, err
+		}
+	}
+	return mw.next.SimulatePolicy(ctx, bucket, document, req)
+}
+
+func (mw *authorizationMiddleware) Presign(ctx context.Context, params presign.Params) (string, error) {
+	// The URL can't grant more than what the principal minting it is allowed to do
+	switch params.Method {
+	case http.MethodGet:
+		row := mw.object(ctx, params.Uuid)
+		if err := mw.authorize(ctx, row.Bucket, policy.GetObject, row.FileName); err != nil {
+			return "", err
+		}
+	case http.MethodPut:
+		if err := mw.authorize(ctx, params.Bucket, policy.PutObject, params.Name); err != nil {
+			return "", err
+		}
+	}
+	return mw.next.Presign(ctx, params)
+}
+
+// AuditMiddleware records every data and admin operation in the audit log, with its outcome.
+// Read-only calls on policies, usage and the audit log itself are not recorded.
+// Operations that couldn't be recorded are counted by failures, by action
+func AuditMiddleware(trail *audit.Trail, failures metrics.Counter, logger *util.Logger) Middleware {
+	return func(next Service) Service {
+		return &auditMiddleware{trail: trail, failures: failures, logger: logger, next: next}
+	}
+}
+
+type auditMiddleware struct {
+	trail    *audit.Trail
+	failures metrics.Counter
+	logger   *util.Logger
+	next     Service
+}
+
+// record appends the outcome of action on object to the audit log.
+// A failure to record doesn't fail the operation, which has already been executed
+func (mw *auditMiddleware) record(ctx context.Context, action string, object string, err error) {
+	principal := util.PrincipalFromContext(ctx)
+	// Recorded even if the client went away
+	if e := mw.trail.Append(util.DetachedContext(ctx), util.AuditRecord{
+		Principal: principal.Name,
+		Tenant:    principal.Tenant,
+		SourceIP:  util.SourceIPFromContext(ctx),
+		Action:    action,
+		Object:    object,
+		Code:      util.StatusCode(err),
+	}); e != nil {
+		mw.failures.With("action", action).Add(1)
+		mw.logger.WithContext(ctx).Errorf("Error: cannot record %s %s in the audit log: %s", action, object, e.Error())
+	}
+}
+
+func (mw *auditMiddleware) ListFiles(ctx context.Context, query util.ListQuery) (listing util.Listing, err error) {
+	defer func() { mw.record(ctx, "ListFiles", "", err) }()
+	return mw.next.ListFiles(ctx, query)
+}
+
+func (mw *auditMiddleware) WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string, cond util.Preconditions) (uuid string, err error) {
+	defer func() {
+		object := uuid
+		if object == "" {
+			object = metadata.Bucket + "/" + metadata.Name
+		}
+		mw.record(ctx, "WriteFile", object, err)
+	}()
+	return mw.next.WriteFile(ctx, file, metadata, storageFolder, cond)
+}
+
+func (mw *auditMiddleware) GetFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (row util.Row, file []byte, err error) {
+	defer func() { mw.record(ctx, "GetFile", uuid, err) }()
+	return mw.next.GetFile(ctx, uuid, storageFolder, cond)
+}
+
+func (mw *auditMiddleware) DeleteFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (err error) {
+	defer func() { mw.record(ctx, "DeleteFile", uuid, err) }()
+	return mw.next.DeleteFile(ctx, uuid, storageFolder, cond)
+}
+
+// Copies and moves are recorded with their source, whose uuid a move keeps
+func (mw *auditMiddleware) CopyFile(ctx context.Context, uuid string, dest util.Metadata, replaceMetadata bool, storageFolder string, cond util.Preconditions) (copied string, err error) {
+	defer func() { mw.record(ctx, "CopyFile", uuid, err) }()
+	return mw.next.CopyFile(ctx, uuid, dest, replaceMetadata, storageFolder, cond)
+}
+
+func (mw *auditMiddleware) MoveFile(ctx context.Context, uuid string, bucket string, name string, storageFolder string, cond util.Preconditions) (err error) {
+	defer func() { mw.record(ctx, "MoveFile", uuid, err) }()
+	return mw.next.MoveFile(ctx, uuid, bucket, name, storageFolder, cond)
+}
+
+func (mw *auditMiddleware) SetTags(ctx context.Context, uuid string, tags map[string]string) (err error) {
+	defer func() { mw.record(ctx, "SetTags", uuid, err) }()
+	return mw.next.SetTags(ctx, uuid, tags)
+}
+
+func (mw *auditMiddleware) SetLogLevel(ctx context.Context, layer string, level string) (err error) {
+	defer func() { mw.record(ctx, "SetLogLevel", layer+"="+level, err) }()
+	return mw.next.SetLogLevel(ctx, layer, level)
+}
+
+func (mw *auditMiddleware) AddBucket(ctx context.Context, name string) (err error) {
+	defer func() { mw.record(ctx, "AddBucket", name, err) }()
+	return mw.next.AddBucket(ctx, name)
+}
+
+func (mw *auditMiddleware) SetBucketPolicy(ctx context.Context, bucket string, document string) (err error) {
+	action := "SetBucketPolicy"
+	if document == "" {
+		action = "DeleteBucketPolicy"
+	}
+	defer func() { mw.record(ctx, action, bucket, err) }()
+	return mw.next.SetBucketPolicy(ctx, bucket, document)
+}
+
+func (mw *auditMiddleware) GetBucketPolicy(ctx context.Context, bucket string) (string, error) {
+	return mw.next.GetBucketPolicy(ctx, bucket)
+}
+
+func (mw *auditMiddleware) SimulatePolicy(ctx context.Context, bucket string, document string, req policy.Request) (policy.Decision, error) {
+	return mw.next.SimulatePolicy(ctx, bucket, document, req)
+}
+
+// Presigned URLs are credentials, thus minting one is recorded
+func (mw *auditMiddleware) Presign(ctx context.Context, params presign.Params) (url string, err error) {
+	defer func() {
+		object := params.Uuid
+		if params.Method == http.MethodPut {
+			object = params.Bucket + "/" + params.Name
+		}
+		mw.record(ctx, "Presign"+params.Method, object, err)
+	}()
+	return mw.next.Presign(ctx, params)
+}
+
+func (mw *auditMiddleware) Search(ctx context.Context, query util.SearchQuery) (result util.SearchResult, err error) {
+	defer func() { mw.record(ctx, "Search", "", err) }()
+	return mw.next.Search(ctx, query)
+}
+
+func (mw *auditMiddleware) TenantUsage(ctx context.Context) (util.Usage, *util.Quota, error) {
+	return mw.next.TenantUsage(ctx)
+}
+
+func (mw *auditMiddleware) PrefixUsage(ctx context.Context, bucket string, prefix string) (util.Usage, error) {
+	return mw.next.PrefixUsage(ctx, bucket, prefix)
+}
+
+func (mw *auditMiddleware) QueryAudit(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
+	return mw.next.QueryAudit(ctx, filter, limit, offset)
+}
+
+func (mw *auditMiddleware) VerifyAudit(ctx context.Context) (audit.Verification, error) {
+	return mw.next.VerifyAudit(ctx)
+}
+
+func (mw *auditMiddleware) GetJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error) {
+	return mw.next.GetJob(ctx, manager, id)
+}
+
+func (mw *auditMiddleware) CancelJob(ctx context.Context, manager *jobs.Manager, id string) (job jobs.Job, err error) {
+	defer func() { mw.record(ctx, "CancelJob", id, err) }()
+	return mw.next.CancelJob(ctx, manager, id)
+}
+
+// MetricsMiddleware counts the bytes uploaded and downloaded, and the uploads in progress.
+// Only the data methods are instrumented, the others are served by the embedded Service
+func MetricsMiddleware(uploaded metrics.Counter, downloaded metrics.Counter, inFlightUploads metrics.Gauge) Middleware {
+	return func(next Service) Service {
+		return &metricsMiddleware{Service: next, uploaded: uploaded, downloaded: downloaded, inFlightUploads: inFlightUploads}
+	}
+}
+
+type metricsMiddleware struct {
+	Service
+	uploaded        metrics.Counter
+	downloaded      metrics.Counter
+	inFlightUploads metrics.Gauge
+}
+
+func (mw *metricsMiddleware) WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string, cond util.Preconditions) (string, error) {
+	mw.inFlightUploads.Add(1)
+	defer mw.inFlightUploads.Add(-1)
+
+	if file != nil {
+		file = &countingReader{Reader: file, counter: mw.uploaded}
+	}
+	return mw.Service.WriteFile(ctx, file, metadata, storageFolder, cond)
+}
+
+func (mw *metricsMiddleware) GetFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (util.Row, []byte, error) {
+	row, file, err := mw.Service.GetFile(ctx, uuid, storageFolder, cond)
+	mw.downloaded.Add(float64(len(file)))
+	return row, file, err
+}
+
+// countingReader adds the bytes read to a counter
+type countingReader struct {
+	io.Reader
+	counter metrics.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.counter.Add(float64(n))
+	return n, err
+}
+
+// TracingMiddleware wraps every service call in a span, recording its error
+func TracingMiddleware() Middleware {
+	return func(next Service) Service {
+		return &tracingMiddleware{next: next}
+	}
+}
+
+type tracingMiddleware struct {
+	next Service
+}
+
+// endSpan records err in the span and ends it.
+// Client errors are part of the normal operation, thus only server errors set the span status
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if util.StatusCode(err) >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+func (mw *tracingMiddleware) ListFiles(ctx context.Context, query util.ListQuery) (listing util.Listing, err error) {
+	ctx, span := tracer.Start(ctx, "storage.ListFiles", trace.WithAttributes(
+		attribute.String("storage.list.sort", query.Sort),
+		attribute.Bool("storage.list.delimited", query.Delimiter != ""),
+	))
+	if query.Bucket != nil {
+		span.SetAttributes(attribute.String("storage.bucket", *query.Bucket))
+	}
+	defer func() { endSpan(span, err) }()
+	return mw.next.ListFiles(ctx, query)
+}
+
+func (mw *tracingMiddleware) WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string, cond util.Preconditions) (uuid string, err error) {
+	ctx, span := tracer.Start(ctx, "storage.WriteFile", trace.WithAttributes(
+		attribute.String("storage.bucket", metadata.Bucket),
+		attribute.String("storage.name", metadata.Name),
+	))
+	defer func() {
+		span.SetAttributes(attribute.String("storage.uuid", uuid))
+		endSpan(span, err)
+	}()
+	return mw.next.WriteFile(ctx, file, metadata, storageFolder, cond)
+}
+
+func (mw *tracingMiddleware) GetFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (row util.Row, file []byte, err error) {
+	ctx, span := tracer.Start(ctx, "storage.GetFile", trace.WithAttributes(attribute.String("storage.uuid", uuid)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.GetFile(ctx, uuid, storageFolder, cond)
+}
+
+func (mw *tracingMiddleware) DeleteFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.DeleteFile", trace.WithAttributes(attribute.String("storage.uuid", uuid)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.DeleteFile(ctx, uuid, storageFolder, cond)
+}
+
+func (mw *tracingMiddleware) CopyFile(ctx context.Context, uuid string, dest util.Metadata, replaceMetadata bool, storageFolder string, cond util.Preconditions) (copied string, err error) {
+	ctx, span := tracer.Start(ctx, "storage.CopyFile", trace.WithAttributes(
+		attribute.String("storage.uuid", uuid),
+		attribute.String("storage.bucket", dest.Bucket),
+		attribute.String("storage.name", dest.Name),
+	))
+	defer func() {
+		span.SetAttributes(attribute.String("storage.copy.uuid", copied))
+		endSpan(span, err)
+	}()
+	return mw.next.CopyFile(ctx, uuid, dest, replaceMetadata, storageFolder, cond)
+}
+
+func (mw *tracingMiddleware) MoveFile(ctx context.Context, uuid string, bucket string, name string, storageFolder string, cond util.Preconditions) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.MoveFile", trace.WithAttributes(
+		attribute.String("storage.uuid", uuid),
+		attribute.String("storage.bucket", bucket),
+		attribute.String("storage.name", name),
+	))
+	defer func() { endSpan(span, err) }()
+	return mw.next.MoveFile(ctx, uuid, bucket, name, storageFolder, cond)
+}
+
+func (mw *tracingMiddleware) SetTags(ctx context.Context, uuid string, tags map[string]string) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.SetTags", trace.WithAttributes(attribute.String("storage.uuid", uuid)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.SetTags(ctx, uuid, tags)
+}
+
+func (mw *tracingMiddleware) SetLogLevel(ctx context.Context, layer string, level string) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.SetLogLevel")
+	defer func() { endSpan(span, err) }()
+	return mw.next.SetLogLevel(ctx, layer, level)
+}
+
+func (mw *tracingMiddleware) AddBucket(ctx context.Context, name string) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.AddBucket", trace.WithAttributes(attribute.String("storage.bucket", name)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.AddBucket(ctx, name)
+}
+
+func (mw *tracingMiddleware) SetBucketPolicy(ctx context.Context, bucket string, document string) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.SetBucketPolicy", trace.WithAttributes(attribute.String("storage.bucket", bucket)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.SetBucketPolicy(ctx, bucket, document)
+}
+
+func (mw *tracingMiddleware) GetBucketPolicy(ctx context.Context, bucket string) (document string, err error) {
+	ctx, span := tracer.Start(ctx, "storage.GetBucketPolicy", trace.WithAttributes(attribute.String("storage.bucket", bucket)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.GetBucketPolicy(ctx, bucket)
+}
+
+func (mw *tracingMiddleware) SimulatePolicy(ctx context.Context, bucket string, document string, req policy.Request) (decision policy.Decision, err error) {
+	ctx, span := tracer.Start(ctx, "storage.SimulatePolicy", trace.WithAttributes(attribute.String("storage.bucket", bucket)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.SimulatePolicy(ctx, bucket, document, req)
+}
+
+func (mw *tracingMiddleware) Presign(ctx context.Context, params presign.Params) (url string, err error) {
+	ctx, span := tracer.Start(ctx, "storage.Presign", trace.WithAttributes(attribute.String("http.method", params.Method)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.Presign(ctx, params)
+}
+
+func (mw *tracingMiddleware) TenantUsage(ctx context.Context) (usage util.Usage, quota *util.Quota, err error) {
+	ctx, span := tracer.Start(ctx, "storage.TenantUsage")
+	defer func() { endSpan(span, err) }()
+	return mw.next.TenantUsage(ctx)
+}
+
+func (mw *tracingMiddleware) Search(ctx context.Context, query util.SearchQuery) (result util.SearchResult, err error) {
+	ctx, span := tracer.Start(ctx, "storage.Search", trace.WithAttributes(attribute.Bool("storage.search.paged", query.After != nil)))
+	defer func() {
+		span.SetAttributes(attribute.Int("storage.search.hits", len(result.Hits)))
+		endSpan(span, err)
+	}()
+	return mw.next.Search(ctx, query)
+}
+
+func (mw *tracingMiddleware) PrefixUsage(ctx context.Context, bucket string, prefix string) (usage util.Usage, err error) {
+	ctx, span := tracer.Start(ctx, "storage.PrefixUsage", trace.WithAttributes(attribute.String("storage.bucket", bucket)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.PrefixUsage(ctx, bucket, prefix)
+}
+
+func (mw *tracingMiddleware) QueryAudit(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) (records []util.AuditRecord, err error) {
+	ctx, span := tracer.Start(ctx, "storage.QueryAudit")
+	defer func() { endSpan(span, err) }()
+	return mw.next.QueryAudit(ctx, filter, limit, offset)
+}
+
+func (mw *tracingMiddleware) VerifyAudit(ctx context.Context) (verification audit.Verification, err error) {
+	ctx, span := tracer.Start(ctx, "storage.VerifyAudit")
+	defer func() { endSpan(span, err) }()
+	return mw.next.VerifyAudit(ctx)
+}
+
+func (mw *tracingMiddleware) GetJob(ctx context.Context, manager *jobs.Manager, id string) (job jobs.Job, err error) {
+	ctx, span := tracer.Start(ctx, "storage.GetJob", trace.WithAttributes(attribute.String("storage.job", id)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.GetJob(ctx, manager, id)
+}
+
+func (mw *tracingMiddleware) CancelJob(ctx context.Context, manager *jobs.Manager, id string) (job jobs.Job, err error) {
+	ctx, span := tracer.Start(ctx, "storage.CancelJob", trace.WithAttributes(attribute.String("storage.job", id)))
+	defer func() { endSpan(span, err) }()
+	return mw.next.CancelJob(ctx, manager, id)
+}
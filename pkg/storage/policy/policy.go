@@ -0,0 +1,251 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Actions that can be granted or denied by a bucket policy
+const (
+	GetObject    = "GetObject"
+	PutObject    = "PutObject"
+	DeleteObject = "DeleteObject"
+	ListBucket   = "ListBucket"
+)
+
+// Statement effects
+const (
+	Allow = "Allow"
+	Deny  = "Deny"
+)
+
+// Wildcard matches every principal, action or resource
+const Wildcard = "*"
+
+var validActions = map[string]bool{
+	GetObject:    true,
+	PutObject:    true,
+	DeleteObject: true,
+	ListBucket:   true,
+	Wildcard:     true,
+}
+
+// Document is the JSON policy attached to a bucket.
+//
+//	{
+//	  "statements": [
+//	    {
+//	      "effect": "Allow",
+//	      "principals": ["team-a"],
+//	      "actions": ["GetObject", "PutObject"],
+//	      "resources": ["logs/*"],
+//	      "conditions": {"sourceIp": ["10.0.0.0/8"], "notAfter": "2026-12-31T00:00:00Z"}
+//	    }
+//	  ]
+//	}
+type Document struct {
+	Statements []Statement `json:"statements"`
+}
+
+type Statement struct {
+	// Optional identifier, reported back by the evaluation
+	Sid        string     `json:"sid,omitempty"`
+	Effect     string     `json:"effect"`
+	Principals []string   `json:"principals"`
+	Actions    []string   `json:"actions"`
+	Resources  []string   `json:"resources,omitempty"`
+	Conditions Conditions `json:"conditions,omitempty"`
+}
+
+// Conditions restrict a statement further. All the set conditions must hold.
+type Conditions struct {
+	// Source address of the request must belong to one of these CIDRs (or be one of these IPs)
+	SourceIP []string `json:"sourceIp,omitempty"`
+	// The request must happen after NotBefore and before NotAfter
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+}
+
+// Request is the access being evaluated
+type Request struct {
+	Principal string    `json:"principal"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"`
+	SourceIP  string    `json:"sourceIp,omitempty"`
+	Time      time.Time `json:"time,omitempty"`
+}
+
+// Decision is the result of the evaluation of a request against a document
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Effect  string `json:"effect"`
+	// Sid (or index, if Sid is empty) of the statement that determined the decision.
+	// Empty if no statement matched (implicit deny).
+	Statement string `json:"statement,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// Parse decodes and validates a policy document
+func Parse(data []byte) (Document, error) {
+	var doc Document
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&doc); err != nil {
+		return Document{}, fmt.Errorf("invalid policy document: %w", err)
+	}
+	if err := doc.Validate(); err != nil {
+		return Document{}, err
+	}
+	return doc, nil
+}
+
+// Validate checks that every statement is well formed
+func (doc Document) Validate() error {
+	if len(doc.Statements) == 0 {
+		return errors.New("policy must contain at least one statement")
+	}
+	for i, st := range doc.Statements {
+		if st.Effect != Allow && st.Effect != Deny {
+			return fmt.Errorf("statement %d: effect must be %s or %s", i, Allow, Deny)
+		}
+		if len(st.Principals) == 0 {
+			return fmt.Errorf("statement %d: no principals", i)
+		}
+		if len(st.Actions) == 0 {
+			return fmt.Errorf("statement %d: no actions", i)
+		}
+		for _, action := range st.Actions {
+			if !validActions[action] {
+				return fmt.Errorf("statement %d: unknown action %s", i, action)
+			}
+		}
+		for _, cidr := range st.Conditions.SourceIP {
+			if _, err := parseCIDR(cidr); err != nil {
+				return fmt.Errorf("statement %d: invalid sourceIp %s", i, cidr)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate evaluates req against the document.
+// An explicit Deny always takes precedence over any Allow.
+// If no statement matches, the request is implicitly denied.
+func (doc Document) Evaluate(req Request) Decision {
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	var allow *Decision
+	for i, st := range doc.Statements {
+		if !st.matches(req) {
+			continue
+		}
+		id := st.Sid
+		if id == "" {
+			id = fmt.Sprint(i)
+		}
+		if st.Effect == Deny {
+			return Decision{Allowed: false, Effect: Deny, Statement: id, Reason: "explicitly denied by statement " + id}
+		}
+		if allow == nil {
+			allow = &Decision{Allowed: true, Effect: Allow, Statement: id, Reason: "allowed by statement " + id}
+		}
+	}
+	if allow != nil {
+		return *allow
+	}
+	return Decision{Allowed: false, Effect: Deny, Reason: "no statement allows the request"}
+}
+
+// EvaluateBucket tells whether req is allowed on every resource of the bucket, req.Resource being ignored:
+// a statement without resource restrictions allows it, and no statement denies it on any resource
+func (doc Document) EvaluateBucket(req Request) bool {
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	allowed := false
+	for _, st := range doc.Statements {
+		if !matchAny(st.Principals, req.Principal, false) || !matchAny(st.Actions, req.Action, false) || !st.Conditions.hold(req) {
+			continue
+		}
+		if st.Effect == Deny {
+			return false
+		}
+		if len(st.Resources) == 0 || matchAny(st.Resources, "", true) {
+			allowed = true
+		}
+	}
+	return allowed
+}
+
+func (st Statement) matches(req Request) bool {
+	return matchAny(st.Principals, req.Principal, false) &&
+		matchAny(st.Actions, req.Action, false) &&
+		(len(st.Resources) == 0 || matchAny(st.Resources, req.Resource, true)) &&
+		st.Conditions.hold(req)
+}
+
+func (c Conditions) hold(req Request) bool {
+	if c.NotBefore != nil && req.Time.Before(*c.NotBefore) {
+		return false
+	}
+	if c.NotAfter != nil && req.Time.After(*c.NotAfter) {
+		return false
+	}
+	if len(c.SourceIP) > 0 {
+		ip := net.ParseIP(req.SourceIP)
+		if ip == nil {
+			return false
+		}
+		found := false
+		for _, cidr := range c.SourceIP {
+			if network, err := parseCIDR(cidr); err == nil && network.Contains(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAny returns true if value matches one of the patterns.
+// If prefix is true the patterns are resource prefixes, and a trailing '*' is ignored.
+func matchAny(patterns []string, value string, prefix bool) bool {
+	for _, pattern := range patterns {
+		if pattern == Wildcard || pattern == value {
+			return true
+		}
+		if prefix && strings.HasPrefix(value, strings.TrimSuffix(pattern, Wildcard)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDR accepts both CIDRs and single IPs
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %s", s)
+		}
+		bits := 8 * len(ip.To16())
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
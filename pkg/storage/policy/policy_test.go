@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+// Unit tests for the evaluation of bucket policies.
+
+var testDocument = []byte(`{
+	"statements": [
+		{"sid": "team-a-rw", "effect": "Allow", "principals": ["team-a"], "actions": ["GetObject", "PutObject", "ListBucket"], "resources": ["logs/*"]},
+		{"sid": "team-b-ro", "effect": "Allow", "principals": ["team-b"], "actions": ["GetObject", "ListBucket"]},
+		{"sid": "no-secrets", "effect": "Deny", "principals": ["*"], "actions": ["*"], "resources": ["logs/secret/"]},
+		{"sid": "office", "effect": "Allow", "principals": ["team-c"], "actions": ["GetObject"], "conditions": {"sourceIp": ["10.0.0.0/8"], "notAfter": "2030-01-01T00:00:00Z"}}
+	]
+}`)
+
+//
+// This test evaluates a set of requests against testDocument.
+// Pass if every decision is the expected one.
+func TestEvaluate(t *testing.T) {
+
+	doc, err := Parse(testDocument)
+	if err != nil {
+		t.Fatal("Cannot parse policy: " + err.Error())
+	}
+
+	now := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		req       Request
+		allowed   bool
+		statement string
+	}{
+		{Request{Principal: "team-a", Action: PutObject, Resource: "logs/app.log"}, true, "team-a-rw"},
+		{Request{Principal: "team-a", Action: PutObject, Resource: "other/app.log"}, false, ""},
+		{Request{Principal: "team-a", Action: DeleteObject, Resource: "logs/app.log"}, false, ""},
+		{Request{Principal: "team-b", Action: GetObject, Resource: "logs/app.log"}, true, "team-b-ro"},
+		{Request{Principal: "team-b", Action: PutObject, Resource: "logs/app.log"}, false, ""},
+		// explicit deny wins over allow
+		{Request{Principal: "team-a", Action: GetObject, Resource: "logs/secret/key"}, false, "no-secrets"},
+		{Request{Principal: "team-c", Action: GetObject, Resource: "x", SourceIP: "10.1.2.3", Time: now}, true, "office"},
+		{Request{Principal: "team-c", Action: GetObject, Resource: "x", SourceIP: "192.168.1.1", Time: now}, false, ""},
+		{Request{Principal: "team-c", Action: GetObject, Resource: "x", SourceIP: "10.1.2.3", Time: now.AddDate(10, 0, 0)}, false, ""},
+	}
+
+	for i, test := range tests {
+		decision := doc.Evaluate(test.req)
+		if decision.Allowed != test.allowed {
+			t.Errorf("Request %d: expected allowed=%t, got %t (%s)", i, test.allowed, decision.Allowed, decision.Reason)
+		}
+		if decision.Statement != test.statement {
+			t.Errorf("Request %d: expected statement %q, got %q", i, test.statement, decision.Statement)
+		}
+	}
+}
+
+//
+// This test evaluates requests on whole buckets, against testDocument and against a document without denials of other principals.
+// Pass if only requests allowed on every resource, and denied on none, are allowed.
+func TestEvaluateBucket(t *testing.T) {
+
+	doc, err := Parse(testDocument)
+	if err != nil {
+		t.Fatal("Cannot parse policy: " + err.Error())
+	}
+	open, err := Parse([]byte(`{"statements": [
+		{"effect": "Allow", "principals": ["team-b"], "actions": ["ListBucket"], "resources": ["*"]},
+		{"effect": "Deny", "principals": ["team-a"], "actions": ["*"], "resources": ["private/"]}
+	]}`))
+	if err != nil {
+		t.Fatal("Cannot parse policy: " + err.Error())
+	}
+
+	tests := []struct {
+		doc     Document
+		req     Request
+		allowed bool
+	}{
+		// allowed on a prefix only
+		{doc, Request{Principal: "team-a", Action: ListBucket}, false},
+		// allowed everywhere, but denied on a prefix
+		{doc, Request{Principal: "team-b", Action: ListBucket}, false},
+		{doc, Request{Principal: "team-c", Action: ListBucket}, false},
+		{open, Request{Principal: "team-b", Action: ListBucket}, true},
+		{open, Request{Principal: "team-b", Action: GetObject}, false},
+		{open, Request{Principal: "team-a", Action: ListBucket}, false},
+	}
+	for i, test := range tests {
+		if allowed := test.doc.EvaluateBucket(test.req); allowed != test.allowed {
+			t.Errorf("Request %d: expected allowed=%t, got %t", i, test.allowed, allowed)
+		}
+	}
+}
+
+//
+// This test parses invalid documents.
+// Pass if errors
+func TestParseInvalid(t *testing.T) {
+
+	documents := []string{
+		`{}`,
+		`{"statements": [{"effect": "Maybe", "principals": ["*"], "actions": ["*"]}]}`,
+		`{"statements": [{"effect": "Allow", "principals": ["*"], "actions": ["Explode"]}]}`,
+		`{"statements": [{"effect": "Allow", "principals": ["*"], "actions": ["*"], "conditions": {"sourceIp": ["nope"]}}]}`,
+		`{"statements": [], "unknown": true}`,
+	}
+	for i, document := range documents {
+		if _, err := Parse([]byte(document)); err == nil {
+			t.Errorf("Document %d should not be valid", i)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package presign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameters of a presigned URL
+const (
+	PrincipalParam   = "X-Storage-Principal"
+	TenantParam      = "X-Storage-Tenant"
+	ExpiresParam     = "X-Storage-Expires"
+	MaxLengthParam   = "X-Storage-Max-Length"
+	ContentTypeParam = "X-Storage-Content-Type"
+	SignatureParam   = "X-Storage-Signature"
+	// Object of presigned uploads
+	BucketParam = "bucket"
+	NameParam   = "name"
+)
+
+// Path of the file routes
+const filesPath = "/files"
+
+// Maximum validity of a presigned URL
+const MaxExpiry = 7 * 24 * time.Hour
+
+var (
+	ErrExpired          = errors.New("presigned URL expired")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Params are the values a presigned URL is bound to
+type Params struct {
+	// GET (download) or PUT (upload)
+	Method string
+	// Object of downloads
+	Uuid string
+	// Object of uploads
+	Bucket string
+	Name   string
+	// Principal that minted the URL, and its tenant. The request is authorized as this principal
+	Principal string
+	Tenant    string
+	Expires   time.Time
+	// Optional constraints on uploads. Zero values mean no constraint
+	MaxLength   int64
+	ContentType string
+}
+
+// Signer mints and verifies HMAC-SHA256 signed URLs
+type Signer struct {
+	secret []byte
+}
+
+func NewSigner(secret []byte) *Signer {
+	return &Signer{secret: secret}
+}
+
+// Sign returns the path and query string of the presigned URL
+func (s *Signer) Sign(p Params) string {
+	query := url.Values{}
+	if p.Method == http.MethodPut {
+		query.Set(BucketParam, p.Bucket)
+		query.Set(NameParam, p.Name)
+	}
+	query.Set(PrincipalParam, p.Principal)
+	if p.Tenant != "" {
+		query.Set(TenantParam, p.Tenant)
+	}
+	query.Set(ExpiresParam, strconv.FormatInt(p.Expires.Unix(), 10))
+	if p.MaxLength > 0 {
+		query.Set(MaxLengthParam, strconv.FormatInt(p.MaxLength, 10))
+	}
+	if p.ContentType != "" {
+		query.Set(ContentTypeParam, p.ContentType)
+	}
+	query.Set(SignatureParam, hex.EncodeToString(s.mac(p)))
+	return p.Path() + "?" + query.Encode()
+}
+
+// Path returns the path of the URL: /files/{id} for downloads, /files for uploads
+func (p Params) Path() string {
+	if p.Method == http.MethodPut {
+		return filesPath
+	}
+	return filesPath + "/" + p.Uuid
+}
+
+// IsPresigned returns true if the request carries a presigned URL signature
+func IsPresigned(r *http.Request) bool {
+	return r.URL.Query().Has(SignatureParam)
+}
+
+// Verify checks the signature, the expiration and the method of a presigned request,
+// and returns the parameters the URL is bound to
+func (s *Signer) Verify(r *http.Request, now time.Time) (Params, error) {
+	query := r.URL.Query()
+
+	expires, err := strconv.ParseInt(query.Get(ExpiresParam), 10, 64)
+	if err != nil {
+		return Params{}, ErrInvalidSignature
+	}
+	var maxLength int64
+	if v := query.Get(MaxLengthParam); v != "" {
+		if maxLength, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return Params{}, ErrInvalidSignature
+		}
+	}
+	p := Params{
+		Method:      r.Method,
+		Principal:   query.Get(PrincipalParam),
+		Tenant:      query.Get(TenantParam),
+		Expires:     time.Unix(expires, 0),
+		MaxLength:   maxLength,
+		ContentType: query.Get(ContentTypeParam),
+	}
+	switch p.Method {
+	case http.MethodPut:
+		p.Bucket = query.Get(BucketParam)
+		p.Name = query.Get(NameParam)
+	case http.MethodGet:
+		p.Uuid = strings.TrimPrefix(r.URL.Path, filesPath+"/")
+	default:
+		return Params{}, ErrInvalidSignature
+	}
+	if p.Path() != r.URL.Path {
+		return Params{}, ErrInvalidSignature
+	}
+
+	signature, err := hex.DecodeString(query.Get(SignatureParam))
+	if err != nil || !hmac.Equal(signature, s.mac(p)) {
+		// Signature is computed on the method too, thus a mismatch means either tampering or wrong method
+		return Params{}, ErrInvalidSignature
+	}
+	if now.After(p.Expires) {
+		return Params{}, ErrExpired
+	}
+	return p, nil
+}
+
+// CheckUpload enforces the content-length and content-type constraints of the URL
+func (p Params) CheckUpload(r *http.Request) error {
+	if p.ContentType != "" && !strings.EqualFold(r.Header.Get("Content-Type"), p.ContentType) {
+		return errors.New("content type must be " + p.ContentType)
+	}
+	if p.MaxLength > 0 && r.ContentLength > p.MaxLength {
+		return errors.New("content length exceeds " + strconv.FormatInt(p.MaxLength, 10) + " bytes")
+	}
+	return nil
+}
+
+func (s *Signer) mac(p Params) []byte {
+	canonical := strings.Join([]string{
+		p.Method,
+		p.Path(),
+		p.Bucket,
+		p.Name,
+		p.Principal,
+		p.Tenant,
+		strconv.FormatInt(p.Expires.Unix(), 10),
+		strconv.FormatInt(p.MaxLength, 10),
+		p.ContentType,
+	}, "\n")
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(canonical))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,82 @@
+package presign
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unit tests for presigned URLs.
+
+var testSigner = NewSigner([]byte("secret"))
+
+//
+// This test signs a download URL and verifies it, then tampers with it.
+// Pass if only the original URL is valid.
+func TestSignVerify(t *testing.T) {
+
+	now := time.Now()
+	url := testSigner.Sign(Params{Method: http.MethodGet, Uuid: "abc", Principal: "team-a", Expires: now.Add(time.Minute)})
+
+	p, err := testSigner.Verify(httptest.NewRequest(http.MethodGet, url, nil), now)
+	if err != nil {
+		t.Fatal("Valid URL rejected: " + err.Error())
+	}
+	if p.Uuid != "abc" || p.Principal != "team-a" {
+		t.Errorf("Wrong params: %+v", p)
+	}
+
+	// expired
+	if _, err := testSigner.Verify(httptest.NewRequest(http.MethodGet, url, nil), now.Add(time.Hour)); err != ErrExpired {
+		t.Errorf("Expired URL: expected %v, got %v", ErrExpired, err)
+	}
+	// wrong method
+	if _, err := testSigner.Verify(httptest.NewRequest(http.MethodDelete, url, nil), now); err == nil {
+		t.Error("URL should not be valid for DELETE")
+	}
+	// other object
+	if _, err := testSigner.Verify(httptest.NewRequest(http.MethodGet, "/files/abd"+url[len("/files/abc"):], nil), now); err == nil {
+		t.Error("URL should not be valid for another object")
+	}
+	// other signer
+	if _, err := NewSigner([]byte("other")).Verify(httptest.NewRequest(http.MethodGet, url, nil), now); err == nil {
+		t.Error("URL should not be valid with another key")
+	}
+}
+
+//
+// This test signs an upload URL with constraints.
+// Pass if the constraints are enforced.
+func TestUploadConstraints(t *testing.T) {
+
+	now := time.Now()
+	url := testSigner.Sign(Params{Method: http.MethodPut, Bucket: "b", Name: "report.pdf", Expires: now.Add(time.Minute), MaxLength: 10, ContentType: "application/pdf"})
+
+	r := httptest.NewRequest(http.MethodPut, url, nil)
+	r.Header.Set("Content-Type", "application/pdf")
+	r.ContentLength = 5
+	p, err := testSigner.Verify(r, now)
+	if err != nil {
+		t.Fatal("Valid URL rejected: " + err.Error())
+	}
+	if err := p.CheckUpload(r); err != nil {
+		t.Error("Valid upload rejected: " + err.Error())
+	}
+
+	r.ContentLength = 11
+	if err := p.CheckUpload(r); err == nil {
+		t.Error("Upload too large should be rejected")
+	}
+	r.ContentLength = 5
+	r.Header.Set("Content-Type", "text/plain")
+	if err := p.CheckUpload(r); err == nil {
+		t.Error("Upload with wrong content type should be rejected")
+	}
+
+	// the object name is signed
+	if _, err := testSigner.Verify(httptest.NewRequest(http.MethodPut, strings.Replace(url, "name=report.pdf", "name=other.pdf", 1), nil), now); err == nil {
+		t.Error("URL should not be valid for another object")
+	}
+}
@@ -4,28 +4,95 @@ import (
 	"context"
 	"io"
 
+	"github.com/erizzardi/storage/pkg/storage/audit"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/policy"
+	"github.com/erizzardi/storage/pkg/storage/presign"
 	"github.com/erizzardi/storage/util"
 )
 
 type Service interface {
 	//
 	//
-	// ListFiles list all files paging the request by limit and offset
-	ListFiles(ctx context.Context, limit uint, offset uint) ([]util.Row, error)
+	// ListFiles lists a page of the files selected by query, or of the files and folders under a prefix with a delimiter
+	ListFiles(ctx context.Context, query util.ListQuery) (util.Listing, error)
 	//
 	//
-	// WriteFile writes a file to disk, saving the metadata into the database
-	WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string) (string, error)
+	// WriteFile writes a file to disk, saving the metadata into the database.
+	// With preconditions, replaces the file of the same name if they hold
+	WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string, cond util.Preconditions) (string, error)
 	//
 	//
-	// GetFile gets a file by UUID
-	GetFile(ctx context.Context, uuid string, storageFolder string) ([]byte, error)
+	// GetFile gets metadata and content of a file by UUID, if the preconditions hold
+	GetFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (util.Row, []byte, error)
 	//
 	//
-	// DeleteFile deletes a file by UUID
-	DeleteFile(ctx context.Context, uuid string, storageFolder string) error
+	// DeleteFile deletes a file by UUID, if the preconditions hold
+	DeleteFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) error
+	//
+	//
+	// CopyFile copies a file by UUID to a name in a bucket, without copying its content.
+	// The copy has the content type and tags of the source, unless replaceMetadata
+	CopyFile(ctx context.Context, uuid string, dest util.Metadata, replaceMetadata bool, storageFolder string, cond util.Preconditions) (string, error)
+	//
+	//
+	// MoveFile renames a file by UUID, within or across buckets. The file keeps its UUID
+	MoveFile(ctx context.Context, uuid string, bucket string, name string, storageFolder string, cond util.Preconditions) error
+	//
+	//
+	// SetTags replaces the tags of a file by UUID
+	SetTags(ctx context.Context, uuid string, tags map[string]string) error
 	//
 	//
 	// SetLogLevel sets the logging level per layer at runtime
 	SetLogLevel(ctx context.Context, layer string, level string) error
+	//
+	//
+	// AddBucket creates a bucket owned by the principal of the request
+	AddBucket(ctx context.Context, name string) error
+	//
+	//
+	// SetBucketPolicy attaches a JSON policy document to a bucket. An empty document detaches it
+	SetBucketPolicy(ctx context.Context, bucket string, document string) error
+	//
+	//
+	// GetBucketPolicy returns the policy document attached to a bucket
+	GetBucketPolicy(ctx context.Context, bucket string) (string, error)
+	//
+	//
+	// SimulatePolicy evaluates a request against a policy document, without executing it.
+	// If document is empty, the policy attached to the bucket is used
+	SimulatePolicy(ctx context.Context, bucket string, document string, req policy.Request) (policy.Decision, error)
+	//
+	//
+	// Presign returns the path and query of a signed URL granting temporary access to one object
+	Presign(ctx context.Context, params presign.Params) (string, error)
+	//
+	//
+	// TenantUsage returns storage usage and quota of the tenant of the request
+	TenantUsage(ctx context.Context) (util.Usage, *util.Quota, error)
+	//
+	//
+	// PrefixUsage returns storage usage of the objects of a bucket under a prefix: the size of a folder
+	PrefixUsage(ctx context.Context, bucket string, prefix string) (util.Usage, error)
+	//
+	//
+	// Search returns a page of the files matching a search query, ranked by relevance, with facets on the first page
+	Search(ctx context.Context, query util.SearchQuery) (util.SearchResult, error)
+	//
+	//
+	// QueryAudit returns the audit records of the tenant of the request, paged
+	QueryAudit(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error)
+	//
+	//
+	// VerifyAudit checks the hash chain of the whole audit log
+	VerifyAudit(ctx context.Context) (audit.Verification, error)
+	//
+	//
+	// GetJob returns a background job of manager, started by the principal of the request
+	GetJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error)
+	//
+	//
+	// CancelJob cancels a running background job of manager, started by the principal of the request
+	CancelJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error)
 }
@@ -2,17 +2,33 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
 	"io/ioutil"
+	"mime"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/erizzardi/storage/base"
+	"github.com/erizzardi/storage/pkg/storage/audit"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/policy"
+	"github.com/erizzardi/storage/pkg/storage/presign"
 	"github.com/erizzardi/storage/util"
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var tracer = otel.Tracer("github.com/erizzardi/storage/pkg/storage")
+
 // storageService implements the storage.Service interface
 type storageService struct {
 	// Pointer to a DB interface, that allows DB operations.
@@ -21,10 +37,16 @@ type storageService struct {
 	logger *util.Logger
 	// Map[layer]logger. To change logging level at run time
 	layerLoggersMap map[string]*util.Logger
+	// Signs presigned URLs
+	signer *presign.Signer
+	// Storage quotas per tenant
+	quotas *util.Quotas
+	// Bytes of text content indexed for search, 0 disables content indexing
+	searchContentBytes int64
 }
 
-func NewService(db base.DB, logger *util.Logger, layerLoggersMap map[string]*util.Logger) Service {
-	return &storageService{db: db, logger: logger, layerLoggersMap: layerLoggersMap}
+func NewService(db base.DB, logger *util.Logger, layerLoggersMap map[string]*util.Logger, signer *presign.Signer, quotas *util.Quotas, searchContentBytes int64) Service {
+	return &storageService{db: db, logger: logger, layerLoggersMap: layerLoggersMap, signer: signer, quotas: quotas, searchContentBytes: searchContentBytes}
 }
 
 //===================================================================================
@@ -34,126 +56,424 @@ func NewService(db base.DB, logger *util.Logger, layerLoggersMap map[string]*uti
 // This just returns the type of error.
 //===================================================================================
 
-// ListFiles list metadata, paged.
-// returns 200, 500
-func (ss *storageService) ListFiles(ctx context.Context, limit uint, offset uint) ([]util.Row, error) {
+// ListFiles lists metadata, by pages following each other through continuation tokens.
+// With a delimiter, the objects under the prefix are listed as folders, see listLevel.
+// returns 200, 400, 500
+func (ss *storageService) ListFiles(ctx context.Context, query util.ListQuery) (util.Listing, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method ListFiles invoked.")
+
+	if query.Limit == 0 {
+		return util.Listing{}, util.BadRequestError{Message: "limit must be positive"}
+	}
+	if query.Sort == "" {
+		query.Sort = util.SortByName
+	}
+	if query.After != nil && (query.After.Sort != query.Sort || query.After.Desc != query.Desc) {
+		return util.Listing{}, util.BadRequestError{Message: "cursor of a listing in another order"}
+	}
+	if query.Delimiter != "" {
+		if query.Sort != util.SortByName {
+			return util.Listing{}, util.BadRequestError{Message: "listings with a delimiter are sorted by name"}
+		}
+		// Folders belong to one bucket
+		if query.Bucket == nil {
+			query.Bucket = new(string)
+		}
+	}
+	// Timestamps are normalized to the layout of the stored ones, so that they can be compared
+	for _, bound := range []*string{&query.CreatedFrom, &query.CreatedTo} {
+		if *bound == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, *bound)
+		if err != nil {
+			return util.Listing{}, util.BadRequestError{Message: "invalid timestamp " + *bound + ": must be RFC3339"}
+		}
+		*bound = util.FormatTime(t)
+	}
 
-	ss.logger.Debug("Method ListFiles invoked.")
-	rows, err := ss.db.ListAllPaged(limit, offset)
+	var listing util.Listing
+	var err error
+	if query.Delimiter != "" {
+		listing, err = ss.listLevel(ctx, query)
+	} else {
+		listing, err = ss.listPage(ctx, query)
+	}
 	if err != nil {
-		ss.logger.Error(err.Error())
-		return nil, util.InternalServerError{}
+		logger.Error(err.Error())
+		return util.Listing{}, util.InternalServerError{}
+	}
+	return listing, nil
+}
+
+// listPage returns the page of objects selected by query
+func (ss *storageService) listPage(ctx context.Context, query util.ListQuery) (util.Listing, error) {
+
+	// One more object than requested tells whether there is a next page
+	limit := query.Limit
+	query.Limit++
+	rows, err := ss.db.ListMetadata(ctx, util.PrincipalFromContext(ctx).Tenant, query)
+	if err != nil {
+		return util.Listing{}, err
+	}
+	if uint(len(rows)) <= limit {
+		return util.Listing{Files: rows}, nil
+	}
+	rows = rows[:limit]
+	return util.Listing{Files: rows, NextCursor: util.CursorAfter(query, rows[limit-1]).Token()}, nil
+}
+
+// listLevel returns the page of objects right under the prefix of query, and of the folders under it:
+// the names of the other objects up to the delimiter after the prefix. Both count towards the limit.
+// Names compare byte by byte in every database, thus the objects of a folder are contiguous:
+// each folder takes one query, skipping all of its objects
+func (ss *storageService) listLevel(ctx context.Context, query util.ListQuery) (util.Listing, error) {
+
+	tenant := util.PrincipalFromContext(ctx).Tenant
+	listing := util.Listing{Files: []util.Row{}, Prefixes: []string{}}
+	limit := query.Limit
+	for {
+		entries := uint(len(listing.Files) + len(listing.Prefixes))
+		// One more entry than requested tells whether there is a next page
+		query.Limit = limit - entries + 1
+		rows, err := ss.db.ListMetadata(ctx, tenant, query)
+		if err != nil {
+			return util.Listing{}, err
+		}
+
+		skipped := false
+		for _, row := range rows {
+			if uint(len(listing.Files)+len(listing.Prefixes)) == limit {
+				listing.NextCursor = query.After.Token()
+				return listing, nil
+			}
+			rest := strings.TrimPrefix(row.FileName, query.Prefix)
+			if i := strings.Index(rest, query.Delimiter); i >= 0 {
+				folder := query.Prefix + rest[:i+len(query.Delimiter)]
+				// The same folder again, if a name goes on after it with the greatest code point
+				if n := len(listing.Prefixes); n == 0 || listing.Prefixes[n-1] != folder {
+					listing.Prefixes = append(listing.Prefixes, folder)
+					query.After = afterFolder(query, folder)
+					skipped = true
+					break
+				}
+			} else {
+				listing.Files = append(listing.Files, row)
+			}
+			after := util.CursorAfter(query, row)
+			query.After = &after
+		}
+		if !skipped && uint(len(rows)) < query.Limit {
+			return listing, nil
+		}
 	}
-	return rows, nil
 }
 
-// WriteFile writes a file to disk, and updates metadata in DB.
-// Returns 200, 400, 409, 500
-func (ss *storageService) WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string) (string, error) {
-	ss.logger.Debug("Method WriteFile invoked.")
+// afterFolder returns the position after all the names starting with folder, in the order of query
+func afterFolder(query util.ListQuery, folder string) *util.ListCursor {
+	if query.Desc {
+		return &util.ListCursor{Sort: query.Sort, Desc: true, Name: folder, Uuid: "00000000-0000-0000-0000-000000000000"}
+	}
+	return &util.ListCursor{Sort: query.Sort, Name: folder + string(utf8.MaxRune), Uuid: "ffffffff-ffff-ffff-ffff-ffffffffffff"}
+}
+
+// WriteFile writes a file to disk, and updates metadata in DB. With preconditions, the object of the same name is replaced
+// if they hold: its uuid changes.
+// Returns 200, 400, 404, 409, 412, 413, 500
+func (ss *storageService) WriteFile(ctx context.Context, file io.Reader, metadata util.Metadata, storageFolder string, cond util.Preconditions) (string, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method WriteFile invoked.")
 
 	uuid := uuid.New().String()
 	fileName := filepath.Join(storageFolder, uuid)
+	tenant := util.PrincipalFromContext(ctx).Tenant
 
 	if file == nil {
-		ss.logger.Error("Error: no file in request")
+		logger.Error("Error: no file in request")
 		return "", util.BadRequestError{Message: "no file in request"}
 	}
 
-	// Check if file exists by querying the DB by fileName.
-	// A filesystem check should not be necessary, since UUIDs are unique.
-	if _, err := ss.db.RetrieveMetadata("filename", metadata.Name); errors.Is(err, base.NotFoundError) {
-		ss.logger.Debug("Creating file " + fileName + "...")
-		newFile, err := os.Create(fileName)
-		if err != nil {
-			ss.logger.Error("Error: " + err.Error())
-			return "", util.InternalServerError{}
-		}
-		defer newFile.Close()
-		ss.logger.Debug("Created file " + fileName)
-		ss.logger.Debug("Copying file content to new destination...")
-		if _, err := io.Copy(newFile, file); err != nil {
-			ss.logger.Error("Error: " + err.Error())
-			_ = os.Remove(fileName)
-			return "", util.InternalServerError{}
-		}
-		ss.logger.Debug("File content copied")
-
-		ss.logger.Debug(uuid, metadata.Name)
-
-		// Write metadata to db
-		err = ss.db.InsertMetadata(util.Row{
-			Uuid:     uuid,
-			FileName: metadata.Name,
-		})
-		if err != nil {
-			ss.logger.Error("Error: " + err.Error())
-			return "", util.InternalServerError{}
+	// Stored in a varchar(255) column
+	if len(metadata.ContentType) > 255 {
+		return "", util.BadRequestError{Message: "content type longer than 255 bytes"}
+	}
+
+	// Bucket is optional, but if set it must exist
+	if metadata.Bucket != "" {
+		if _, err := ss.retrieveBucket(ctx, metadata.Bucket); err != nil {
+			return "", err
 		}
+	}
 
-		ss.logger.Info("File " + uuid + " created successfully")
-	} else {
-		ss.logger.Error("file already exists")
-		return "", util.ConflictError{Message: "file already exists"}
+	replaced, err := ss.replacedObject(ctx, tenant, metadata.Bucket, metadata.Name, cond)
+	if err != nil {
+		return "", err
+	}
+
+	// Remaining bytes in the tenant quota. The size declared by the client is checked here,
+	// the actual size while copying
+	remaining, err := ss.checkQuota(ctx, tenant, metadata.Size, replaced)
+	if err != nil {
+		return "", err
+	}
+	if remaining >= 0 {
+		file = io.LimitReader(file, remaining+1)
+	}
+	// The beginning of text content is kept while copying, to be indexed
+	var content *headBuffer
+	if ss.searchContentBytes > 0 && indexableContent(metadata.ContentType) {
+		content = &headBuffer{limit: int(ss.searchContentBytes)}
+		file = io.TeeReader(file, content)
+	}
+
+	size, etag, err := ss.writeBlob(ctx, fileName, file)
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return "", util.InternalServerError{}
+	}
+	if remaining >= 0 && size > remaining {
+		logger.Errorf("Error: tenant %q storage quota exceeded", tenant)
+		_ = os.Remove(fileName)
+		return "", util.PayloadTooLargeError{Message: "storage quota exceeded"}
+	}
+	logger.Debug("File content copied")
+
+	logger.Debug(uuid, metadata.Name)
+
+	// Write metadata to db, replacing the object of the same name if the preconditions allow it
+	row := util.Row{
+		Uuid:        uuid,
+		FileName:    metadata.Name,
+		Bucket:      metadata.Bucket,
+		Size:        size,
+		CreatedAt:   util.FormatTime(time.Now()),
+		ContentType: metadata.ContentType,
+		Tags:        metadata.Tags,
+		ETag:        etag,
+		Tenant:      tenant,
+	}
+	if err := ss.storeMetadata(ctx, row, replaced, storageFolder, cond); err != nil {
+		return "", err
+	}
+	if content != nil {
+		ss.indexContent(ctx, row, content.bytes)
 	}
 
+	logger.Info("File " + uuid + " created successfully")
 	return uuid, nil
 }
 
-// GetFile returns the metadata of a file from its Uuid.
-// Returns 200, 404, 500
-func (ss *storageService) GetFile(ctx context.Context, uuid string, storageFolder string) ([]byte, error) {
-	ss.logger.Debug("Method GetFile invoked.")
+// CopyFile copies a file to a name in a bucket. The copy shares the content of the source, and has its content type
+// and tags unless replaceMetadata. With preconditions, the object of the same name is replaced as by WriteFile.
+// Returns 200, 400, 404, 409, 412, 413, 500
+func (ss *storageService) CopyFile(ctx context.Context, id string, dest util.Metadata, replaceMetadata bool, storageFolder string, cond util.Preconditions) (string, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method CopyFile invoked.")
+	tenant := util.PrincipalFromContext(ctx).Tenant
 
-	// Check db for entry corresponding to file
-	row, err := ss.db.RetrieveMetadata("uuid", uuid)
+	source, err := ss.retrieveFile(ctx, id)
 	if err != nil {
-		ss.logger.Error("Error: " + err.Error())
-		return nil, util.InternalServerError{Message: err.Error()}
+		return "", err
+	}
+	if !replaceMetadata {
+		dest.ContentType, dest.Tags = source.ContentType, source.Tags
 	}
-	if row == (util.Row{}) {
-		ss.logger.Errorf("Error: file %s not found", uuid)
-		return nil, util.NotFoundError{Message: "file not found"}
+	if len(dest.ContentType) > 255 {
+		return "", util.BadRequestError{Message: "content type longer than 255 bytes"}
+	}
+	if dest.Bucket != "" {
+		if _, err := ss.retrieveBucket(ctx, dest.Bucket); err != nil {
+			return "", err
+		}
+	}
+	replaced, err := ss.replacedObject(ctx, tenant, dest.Bucket, dest.Name, cond)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ss.checkQuota(ctx, tenant, source.Size, replaced); err != nil {
+		return "", err
 	}
 
-	fileName := filepath.Join(storageFolder, uuid)
-	if _, err := os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
-		ss.logger.Error("Error: " + err.Error())
-		return nil, util.NotFoundError{Message: err.Error()}
+	copied := uuid.New().String()
+	if err := ss.linkBlob(ctx, filepath.Join(storageFolder, source.Uuid), filepath.Join(storageFolder, copied)); errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error: " + err.Error())
+		return "", util.NotFoundError{Message: "file " + id + " not found"}
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
+		return "", util.InternalServerError{}
+	}
+	row := util.Row{
+		Uuid:        copied,
+		FileName:    dest.Name,
+		Bucket:      dest.Bucket,
+		Size:        source.Size,
+		CreatedAt:   util.FormatTime(time.Now()),
+		ContentType: dest.ContentType,
+		Tags:        dest.Tags,
+		ETag:        source.ETag,
+		Tenant:      tenant,
+	}
+	if err := ss.storeMetadata(ctx, row, replaced, storageFolder, cond); err != nil {
+		return "", err
+	}
+	// The words of the content are read again, since the content type may have changed
+	if ss.searchContentBytes > 0 && indexableContent(row.ContentType) {
+		if content, err := ss.readBlobHead(ctx, filepath.Join(storageFolder, copied), ss.searchContentBytes); err != nil {
+			logger.Error("Error: cannot index content of " + copied + ": " + err.Error())
+		} else {
+			ss.indexContent(ctx, row, content)
+		}
+	}
+
+	logger.Info("File " + id + " copied to " + copied)
+	return copied, nil
+}
+
+// MoveFile moves a file to a name in a bucket, keeping its uuid, content and metadata. With preconditions,
+// the object of the same name is replaced as by WriteFile. The content is not touched, only the metadata.
+// Returns 200, 400, 404, 409, 412, 500
+func (ss *storageService) MoveFile(ctx context.Context, uuid string, bucket string, name string, storageFolder string, cond util.Preconditions) error {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method MoveFile invoked.")
+	tenant := util.PrincipalFromContext(ctx).Tenant
+
+	row, err := ss.retrieveFile(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if row.Bucket == bucket && row.FileName == name {
+		return util.BadRequestError{Message: "file " + uuid + " is already named " + name}
+	}
+	if bucket != "" {
+		if _, err := ss.retrieveBucket(ctx, bucket); err != nil {
+			return err
+		}
 	}
-	file, err := ioutil.ReadFile(fileName)
+	replaced, err := ss.replacedObject(ctx, tenant, bucket, name, cond)
 	if err != nil {
-		ss.logger.Error("Error: " + err.Error())
-		return nil, util.InternalServerError{Message: err.Error()}
+		return err
+	}
+
+	row.Bucket, row.FileName = bucket, name
+	if replaced == nil {
+		err = ss.db.MoveMetadata(ctx, row, "")
+	} else {
+		err = ss.db.MoveMetadata(ctx, row, replaced.Uuid)
+	}
+	if errors.Is(err, base.NotFoundError) && !cond.WriteSet() {
+		logger.Errorf("Error: file %s not found", uuid)
+		return util.NotFoundError{Message: "file " + uuid + " not found"}
+	} else if err != nil {
+		return ss.storeError(ctx, name, cond, err)
 	}
-	ss.logger.Info("File " + uuid + " retrieved successfully")
-	return file, nil
+	if replaced != nil {
+		ss.removeReplaced(ctx, replaced, storageFolder)
+	}
+
+	logger.Info("File " + uuid + " moved to " + bucket + "/" + name)
+	return nil
 }
 
-// DeleteFile deletes a file from disk by its Uuid.
-// Returns 200, 404, 500
-func (ss *storageService) DeleteFile(ctx context.Context, uuid string, storageFolder string) error {
-	ss.logger.Debug("Method DeleteFile invoked.")
+// GetFile returns metadata and content of a file from its Uuid. If the cached copy of the client is fresh,
+// the metadata is returned with NotModifiedError, without content.
+// Returns 200, 304, 404, 412, 500
+func (ss *storageService) GetFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) (util.Row, []byte, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method GetFile invoked.")
+
+	// Check db for entry corresponding to file
+	row, err := ss.retrieveFile(ctx, uuid)
+	if err != nil {
+		return util.Row{}, nil, err
+	}
+	if err := cond.Check(&row, true); err != nil {
+		logger.Debug(err.Error())
+		return row, nil, err
+	}
+
 	fileName := filepath.Join(storageFolder, uuid)
+	file, err := ss.readBlob(ctx, fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error: " + err.Error())
+		return util.Row{}, nil, util.NotFoundError{Message: err.Error()}
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.Row{}, nil, util.InternalServerError{Message: err.Error()}
+	}
+	logger.Info("File " + uuid + " retrieved successfully")
+	return row, file, nil
+}
 
-	if _, err := os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
-		ss.logger.Error("Error: " + err.Error())
-		return util.NotFoundError{}
+// DeleteFile deletes a file from disk by its Uuid, if the preconditions hold.
+// Returns 200, 404, 412, 500
+func (ss *storageService) DeleteFile(ctx context.Context, uuid string, storageFolder string, cond util.Preconditions) error {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method DeleteFile invoked.")
+	fileName := filepath.Join(storageFolder, uuid)
+
+	row, err := ss.retrieveFile(ctx, uuid)
+	if err != nil {
+		return err
 	}
-	if err := os.Remove(fileName); err != nil {
-		ss.logger.Error("Error: " + err.Error())
+	// The content of an uuid never changes, thus the preconditions hold until the deletion
+	if err := cond.Check(&row, false); err != nil {
+		logger.Error("Error: " + err.Error())
+		return err
+	}
+
+	if err := ss.removeBlob(ctx, fileName); errors.Is(err, os.ErrNotExist) {
+		logger.Error("Error: " + err.Error())
+		return util.NotFoundError{}
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
 		return util.InternalServerError{}
 	}
-	if err := ss.db.DeleteMetadata("uuid", uuid); err != nil {
-		ss.logger.Error("Error: " + err.Error())
+	// The blob is gone: its metadata is deleted even if the client went away
+	if err := ss.db.DeleteMetadata(util.DetachedContext(ctx), uuid); err != nil {
+		logger.Error("Error: " + err.Error())
 
 	}
-	ss.logger.Info("File " + fileName + "deleted successfully")
+	logger.Info("File " + fileName + "deleted successfully")
+	return nil
+}
+
+// SetTags replaces the tags of a file. Content and entity tag don't change.
+// Returns 200, 400, 404, 409, 500
+func (ss *storageService) SetTags(ctx context.Context, uuid string, tags map[string]string) error {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method SetTags invoked.")
+
+	if err := util.ValidateTags(tags); err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.BadRequestError{Message: err.Error()}
+	}
+	row, err := ss.retrieveFile(ctx, uuid)
+	if err != nil {
+		return err
+	}
+	if util.EqualTags(row.Tags, tags) {
+		return nil
+	}
+
+	if err := ss.db.UpdateTags(ctx, row, tags); errors.Is(err, base.NotFoundError) {
+		// Deleted, or tagged by another request meanwhile
+		if _, err := ss.retrieveFile(ctx, uuid); err != nil {
+			return err
+		}
+		logger.Error("Error: tags of " + uuid + " changed meanwhile")
+		return util.ConflictError{Message: "tags of " + uuid + " changed meanwhile"}
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.InternalServerError{}
+	}
+	logger.Info("File " + uuid + " tagged successfully")
 	return nil
 }
 
 func (ss *storageService) SetLogLevel(ctx context.Context, layer string, level string) error {
-	ss.logger.Debug("Method SetLogLevel invoked")
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method SetLogLevel invoked")
 	logLevel, err := util.LogLevelMapping(level)
 	if err != nil {
 		return util.BadRequestError{Message: err.Error()}
@@ -165,3 +485,525 @@ func (ss *storageService) SetLogLevel(ctx context.Context, layer string, level s
 	}
 	return nil
 }
+
+// AddBucket creates a new bucket, owned by the principal of the request.
+// Returns 201, 400, 409, 500
+func (ss *storageService) AddBucket(ctx context.Context, name string) error {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method AddBucket invoked")
+
+	if name == "" {
+		return util.BadRequestError{Message: "bucket name cannot be empty"}
+	}
+	principal := util.PrincipalFromContext(ctx)
+	err := ss.db.InsertBucket(ctx, util.Bucket{Name: name, Owner: principal.Name, Tenant: principal.Tenant})
+	if util.ErrorIs(err, util.ConflictError{}) {
+		logger.Error("Error: " + err.Error())
+		return err
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.InternalServerError{}
+	}
+	logger.Info("Bucket " + name + " created successfully")
+	return nil
+}
+
+// SetBucketPolicy validates the policy document and attaches it to the bucket.
+// Returns 200, 400, 404, 500
+func (ss *storageService) SetBucketPolicy(ctx context.Context, bucket string, document string) error {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method SetBucketPolicy invoked")
+
+	if document != "" {
+		if _, err := policy.Parse([]byte(document)); err != nil {
+			logger.Error("Error: " + err.Error())
+			return util.BadRequestError{Message: err.Error()}
+		}
+	}
+	if _, err := ss.retrieveBucket(ctx, bucket); err != nil {
+		return err
+	}
+	if err := ss.db.SetBucketPolicy(ctx, util.PrincipalFromContext(ctx).Tenant, bucket, document); err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.InternalServerError{}
+	}
+	logger.Info("Policy of bucket " + bucket + " updated")
+	return nil
+}
+
+// GetBucketPolicy returns the policy document attached to the bucket.
+// Returns 200, 404, 500
+func (ss *storageService) GetBucketPolicy(ctx context.Context, bucket string) (string, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method GetBucketPolicy invoked")
+
+	b, err := ss.retrieveBucket(ctx, bucket)
+	if err != nil {
+		return "", err
+	}
+	if b.Policy == "" {
+		return "", util.NotFoundError{Message: "bucket " + bucket + " has no policy"}
+	}
+	return b.Policy, nil
+}
+
+// SimulatePolicy evaluates req against document, or against the policy attached to the bucket.
+// Returns 200, 400, 404, 500
+func (ss *storageService) SimulatePolicy(ctx context.Context, bucket string, document string, req policy.Request) (policy.Decision, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method SimulatePolicy invoked")
+
+	if req.Principal == "" || req.Action == "" {
+		return policy.Decision{}, util.BadRequestError{Message: "principal and action are mandatory"}
+	}
+	if document == "" {
+		b, err := ss.retrieveBucket(ctx, bucket)
+		if err != nil {
+			return policy.Decision{}, err
+		}
+		if b.Policy == "" {
+			return policy.Decision{Allowed: true, Effect: policy.Allow, Reason: "bucket has no policy attached"}, nil
+		}
+		document = b.Policy
+	}
+	doc, err := policy.Parse([]byte(document))
+	if err != nil {
+		return policy.Decision{}, util.BadRequestError{Message: err.Error()}
+	}
+	return doc.Evaluate(req), nil
+}
+
+// Presign mints a URL that grants params.Method on one object until params.Expires,
+// on behalf of the principal of the request.
+// Returns 200, 400, 404, 500
+func (ss *storageService) Presign(ctx context.Context, params presign.Params) (string, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method Presign invoked")
+
+	if params.Expires.Before(time.Now()) || params.Expires.After(time.Now().Add(presign.MaxExpiry)) {
+		return "", util.BadRequestError{Message: "expiry must be in the future, and at most " + presign.MaxExpiry.String()}
+	}
+
+	switch params.Method {
+	case http.MethodGet:
+		if _, err := ss.retrieveFile(ctx, params.Uuid); err != nil {
+			return "", err
+		}
+	case http.MethodPut:
+		if params.Name == "" {
+			return "", util.BadRequestError{Message: "name is mandatory for uploads"}
+		}
+		if params.Bucket != "" {
+			if _, err := ss.retrieveBucket(ctx, params.Bucket); err != nil {
+				return "", err
+			}
+		}
+	default:
+		return "", util.BadRequestError{Message: "method must be GET or PUT"}
+	}
+
+	params.Principal = util.PrincipalFromContext(ctx).Name
+	params.Tenant = util.PrincipalFromContext(ctx).Tenant
+	logger.Infof("Presigned %s URL minted for %s, expiring at %s", params.Method, params.Principal, params.Expires.Format(time.RFC3339))
+	return ss.signer.Sign(params), nil
+}
+
+// TenantUsage returns usage and quota of the tenant of the request. The quota is nil if the tenant is unlimited.
+// Returns 200, 500
+func (ss *storageService) TenantUsage(ctx context.Context) (util.Usage, *util.Quota, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method TenantUsage invoked")
+
+	tenant := util.PrincipalFromContext(ctx).Tenant
+	usage, err := ss.db.TenantUsage(ctx, tenant)
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.Usage{}, nil, util.InternalServerError{}
+	}
+	if quota, ok := ss.quotas.Get(tenant); ok {
+		return usage, &quota, nil
+	}
+	return usage, nil, nil
+}
+
+// PrefixUsage returns bytes and number of the objects of bucket whose name starts with prefix, i.e. the size of the folder,
+// subfolders included. Empty bucket for the objects without bucket.
+// Returns 200, 404, 500
+func (ss *storageService) PrefixUsage(ctx context.Context, bucket string, prefix string) (util.Usage, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method PrefixUsage invoked")
+
+	if bucket != "" {
+		if _, err := ss.retrieveBucket(ctx, bucket); err != nil {
+			return util.Usage{}, err
+		}
+	}
+	usage, err := ss.db.QueryUsage(ctx, util.PrincipalFromContext(ctx).Tenant, util.ListQuery{Bucket: &bucket, Prefix: prefix})
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.Usage{}, util.InternalServerError{}
+	}
+	return usage, nil
+}
+
+// Search returns a page of the objects of the tenant of the request matching the query, by decreasing relevance.
+// Facets are counted on the first page only, since they are the same on every page.
+// Returns 200, 400, 500
+func (ss *storageService) Search(ctx context.Context, query util.SearchQuery) (util.SearchResult, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method Search invoked")
+
+	if query.Limit == 0 {
+		return util.SearchResult{}, util.BadRequestError{Message: "limit must be positive"}
+	}
+	// Compared to a uuid column by postgres, which would fail on anything else
+	if query.After != nil {
+		if _, err := uuid.Parse(query.After.Uuid); err != nil {
+			return util.SearchResult{}, util.BadRequestError{Message: "invalid cursor"}
+		}
+	}
+	tenant := util.PrincipalFromContext(ctx).Tenant
+
+	// One more object than requested tells whether there is a next page
+	limit := query.Limit
+	query.Limit++
+	hits, err := ss.db.SearchMetadata(ctx, tenant, query)
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.SearchResult{}, util.InternalServerError{}
+	}
+	result := util.SearchResult{Hits: hits}
+	if uint(len(hits)) > limit {
+		result.Hits = hits[:limit]
+		last := result.Hits[limit-1]
+		result.NextCursor = util.SearchCursor{Score: last.Score, Uuid: last.Uuid}.Token()
+	}
+	if query.After == nil {
+		facets, err := ss.db.SearchFacets(ctx, tenant, query.Expr)
+		if err != nil {
+			logger.Error("Error: " + err.Error())
+			return util.SearchResult{}, util.InternalServerError{}
+		}
+		result.Facets = &facets
+	}
+	return result, nil
+}
+
+// QueryAudit returns the audit records of the tenant of the request, paged.
+// Returns 200, 400, 500
+func (ss *storageService) QueryAudit(ctx context.Context, filter util.AuditFilter, limit uint, offset uint) ([]util.AuditRecord, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method QueryAudit invoked")
+
+	// Tenants only see their own records
+	tenant := util.PrincipalFromContext(ctx).Tenant
+	filter.Tenant = &tenant
+
+	// Timestamps are normalized to the layout of the records, so that they can be compared
+	for _, bound := range []*string{&filter.From, &filter.To} {
+		if *bound == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, *bound)
+		if err != nil {
+			return nil, util.BadRequestError{Message: "invalid timestamp " + *bound + ": must be RFC3339"}
+		}
+		*bound = audit.FormatTime(t)
+	}
+
+	records, err := ss.db.ListAuditRecords(ctx, filter, limit, offset)
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return nil, util.InternalServerError{}
+	}
+	return records, nil
+}
+
+// VerifyAudit recomputes the hash chain of the audit log.
+// Returns 200, 500
+func (ss *storageService) VerifyAudit(ctx context.Context) (audit.Verification, error) {
+	logger := ss.logger.WithContext(ctx)
+	logger.Debug("Method VerifyAudit invoked")
+
+	verification, err := audit.Verify(ctx, ss.db)
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return audit.Verification{}, util.InternalServerError{}
+	}
+	if !verification.Valid {
+		logger.Errorf("Audit log chain broken at record %d: %s", verification.BrokenAt, verification.Reason)
+	}
+	return verification, nil
+}
+
+// GetJob returns a background job of manager. Jobs of other tenants are reported as not found.
+// Returns 200, 404
+func (ss *storageService) GetJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error) {
+	ss.logger.WithContext(ctx).Debug("Method GetJob invoked")
+
+	job, ok := manager.Get(id)
+	if !ok || job.Tenant != util.PrincipalFromContext(ctx).Tenant {
+		return jobs.Job{}, util.NotFoundError{Message: "job " + id + " not found"}
+	}
+	return job, nil
+}
+
+// CancelJob cancels a running background job of manager, which stops after the items in progress.
+// The job is returned also if it has already finished.
+// Returns 202, 404, 409
+func (ss *storageService) CancelJob(ctx context.Context, manager *jobs.Manager, id string) (jobs.Job, error) {
+	ss.logger.WithContext(ctx).Debug("Method CancelJob invoked")
+
+	job, err := ss.GetJob(ctx, manager, id)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	if job.State != jobs.StateRunning {
+		return job, util.ConflictError{Message: "job " + id + " already " + job.State}
+	}
+	job, _ = manager.Cancel(id)
+	return job, nil
+}
+
+//============
+// Miscellanea
+//============
+
+// retrieveBucket returns the bucket of the tenant of the request
+func (ss *storageService) retrieveBucket(ctx context.Context, name string) (util.Bucket, error) {
+	logger := ss.logger.WithContext(ctx)
+	b, err := ss.db.RetrieveBucket(ctx, util.PrincipalFromContext(ctx).Tenant, name)
+	if errors.Is(err, base.NotFoundError) {
+		logger.Error("Error: bucket " + name + " not found")
+		return util.Bucket{}, util.NotFoundError{Message: "bucket " + name + " not found"}
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.Bucket{}, util.InternalServerError{}
+	}
+	return b, nil
+}
+
+// retrieveFile returns the metadata of the file, if it belongs to the tenant of the request.
+// Files of other tenants are reported as not found
+func (ss *storageService) retrieveFile(ctx context.Context, uuid string) (util.Row, error) {
+	logger := ss.logger.WithContext(ctx)
+	row, err := ss.db.RetrieveMetadata(ctx, uuid)
+	if errors.Is(err, base.NotFoundError) || (err == nil && row.Tenant != util.PrincipalFromContext(ctx).Tenant) {
+		logger.Errorf("Error: file %s not found", uuid)
+		return util.Row{}, util.NotFoundError{Message: "file " + uuid + " not found"}
+	} else if err != nil {
+		logger.Error("Error: " + err.Error())
+		return util.Row{}, util.InternalServerError{}
+	}
+	return row, nil
+}
+
+// replacedObject returns the object stored under the name in bucket, which is replaced if the preconditions allow it.
+// Without preconditions, names are never overwritten
+func (ss *storageService) replacedObject(ctx context.Context, tenant string, bucket string, name string, cond util.Preconditions) (*util.Row, error) {
+	logger := ss.logger.WithContext(ctx)
+
+	var replaced *util.Row
+	if current, err := ss.db.RetrieveMetadataByName(ctx, tenant, bucket, name); err == nil {
+		replaced = &current
+	} else if !errors.Is(err, base.NotFoundError) {
+		logger.Error("Error: " + err.Error())
+		return nil, util.InternalServerError{}
+	}
+	if replaced != nil && !cond.WriteSet() {
+		logger.Error("file already exists")
+		return nil, util.ConflictError{Message: "file already exists"}
+	}
+	if err := cond.Check(replaced, false); err != nil {
+		logger.Error("Error: " + err.Error())
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// storeMetadata inserts row, or replaces the replaced object with it. Names are unique per tenant and bucket in the
+// database: of concurrent writes of the same name, only one is stored. The content of the object that isn't stored
+// is removed, being unreachable
+func (ss *storageService) storeMetadata(ctx context.Context, row util.Row, replaced *util.Row, storageFolder string, cond util.Preconditions) error {
+	var err error
+	if replaced == nil {
+		err = ss.db.InsertMetadata(ctx, row)
+	} else {
+		err = ss.db.ReplaceMetadata(ctx, replaced.Uuid, row)
+	}
+	if err != nil {
+		_ = ss.removeBlob(ctx, filepath.Join(storageFolder, row.Uuid))
+		return ss.storeError(ctx, row.FileName, cond, err)
+	}
+	if replaced != nil {
+		ss.removeReplaced(ctx, replaced, storageFolder)
+	}
+	return nil
+}
+
+// storeError maps an error storing the metadata of an object named name
+func (ss *storageService) storeError(ctx context.Context, name string, cond util.Preconditions, err error) error {
+	logger := ss.logger.WithContext(ctx)
+	switch {
+	// Stored, replaced or deleted meanwhile by another request: the preconditions don't hold anymore
+	case cond.WriteSet() && (util.ErrorIs(err, util.ConflictError{}) || errors.Is(err, base.NotFoundError)):
+		logger.Error("Error: " + name + " changed meanwhile")
+		return util.PreconditionFailedError{Message: name + " changed meanwhile"}
+	case util.ErrorIs(err, util.ConflictError{}):
+		logger.Error("file already exists")
+		return util.ConflictError{Message: "file already exists"}
+	}
+	logger.Error("Error: " + err.Error())
+	return util.InternalServerError{}
+}
+
+// removeReplaced removes the content of a replaced object, which is not referenced anymore
+func (ss *storageService) removeReplaced(ctx context.Context, replaced *util.Row, storageFolder string) {
+	if err := ss.removeBlob(util.DetachedContext(ctx), filepath.Join(storageFolder, replaced.Uuid)); err != nil {
+		ss.logger.WithContext(ctx).Error("Error: cannot remove content of replaced " + replaced.Uuid + ": " + err.Error())
+	}
+}
+
+// indexContent adds the words of the beginning of the content of row to the search index.
+// The object is stored even if its content can't be indexed: it is still found by name and tags
+func (ss *storageService) indexContent(ctx context.Context, row util.Row, content []byte) {
+	if err := ss.db.IndexContent(util.DetachedContext(ctx), row.Tenant, row.Uuid, util.ContentTerms(string(content))); err != nil {
+		ss.logger.WithContext(ctx).Error("Error: cannot index content of " + row.Uuid + ": " + err.Error())
+	}
+}
+
+// writeBlob copies content to a new file. The file is removed if the copy fails.
+// Returns the bytes written and their SHA-256, hex encoded
+func (ss *storageService) writeBlob(ctx context.Context, fileName string, content io.Reader) (size int64, etag string, err error) {
+	ctx, span := tracer.Start(ctx, "blob.Write", trace.WithAttributes(attribute.String("blob.path", fileName)))
+	defer func() { endSpan(span, err) }()
+	logger := ss.logger.WithContext(ctx)
+
+	logger.Debug("Creating file " + fileName + "...")
+	newFile, err := os.Create(fileName)
+	if err != nil {
+		return 0, "", err
+	}
+	defer newFile.Close()
+	logger.Debug("Created file " + fileName)
+	logger.Debug("Copying file content to new destination...")
+	hash := sha256.New()
+	size, err = io.Copy(io.MultiWriter(newFile, hash), content)
+	if err != nil {
+		_ = os.Remove(fileName)
+		return 0, "", err
+	}
+	span.SetAttributes(attribute.Int64("blob.size", size))
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readBlob reads a whole file
+func (ss *storageService) readBlob(ctx context.Context, fileName string) (content []byte, err error) {
+	_, span := tracer.Start(ctx, "blob.Read", trace.WithAttributes(attribute.String("blob.path", fileName)))
+	defer func() { endSpan(span, err) }()
+
+	content, err = ioutil.ReadFile(fileName)
+	span.SetAttributes(attribute.Int("blob.size", len(content)))
+	return content, err
+}
+
+// readBlobHead reads the first limit bytes of a file
+func (ss *storageService) readBlobHead(ctx context.Context, fileName string, limit int64) (content []byte, err error) {
+	_, span := tracer.Start(ctx, "blob.Read", trace.WithAttributes(attribute.String("blob.path", fileName)))
+	defer func() { endSpan(span, err) }()
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	content, err = io.ReadAll(io.LimitReader(file, limit))
+	span.SetAttributes(attribute.Int("blob.size", len(content)))
+	return content, err
+}
+
+// linkBlob makes newName share the content of fileName: a hard link, or a copy if the file system has none.
+// Sharing is safe since the content of an uuid never changes, and removing either file keeps the other one
+func (ss *storageService) linkBlob(ctx context.Context, fileName string, newName string) (err error) {
+	ctx, span := tracer.Start(ctx, "blob.Link", trace.WithAttributes(attribute.String("blob.path", fileName)))
+	defer func() { endSpan(span, err) }()
+
+	if err = os.Link(fileName, newName); err == nil || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	ss.logger.WithContext(ctx).Debug("Cannot link " + fileName + ", copying: " + err.Error())
+	source, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	_, _, err = ss.writeBlob(ctx, newName, source)
+	return err
+}
+
+// removeBlob removes a file
+func (ss *storageService) removeBlob(ctx context.Context, fileName string) (err error) {
+	_, span := tracer.Start(ctx, "blob.Remove", trace.WithAttributes(attribute.String("blob.path", fileName)))
+	defer func() { endSpan(span, err) }()
+
+	return os.Remove(fileName)
+}
+
+// indexableContent returns true if content of the type is text, whose words can be indexed
+func indexableContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/xml"
+}
+
+// headBuffer keeps the first limit bytes written to it, discarding the rest
+type headBuffer struct {
+	limit int
+	bytes []byte
+}
+
+func (b *headBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - len(b.bytes); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		b.bytes = append(b.bytes, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// checkQuota checks that the tenant can store one more object of the given size (if known),
+// or replace the replaced object, whose bytes are freed.
+// Quotas are soft limits: usage is read before writing, thus concurrent writes of a tenant, each within the quota,
+// may together exceed it. Returns the bytes left in the quota, -1 if the tenant has no bytes quota
+func (ss *storageService) checkQuota(ctx context.Context, tenant string, size int64, replaced *util.Row) (int64, error) {
+	logger := ss.logger.WithContext(ctx)
+	quota, ok := ss.quotas.Get(tenant)
+	if !ok || (quota.Bytes == 0 && quota.Objects == 0) {
+		return -1, nil
+	}
+	usage, err := ss.db.TenantUsage(ctx, tenant)
+	if err != nil {
+		logger.Error("Error: " + err.Error())
+		return 0, util.InternalServerError{}
+	}
+	added := int64(1)
+	if replaced != nil {
+		added, usage.Bytes = 0, usage.Bytes-replaced.Size
+	}
+	if quota.Objects > 0 && usage.Objects+added > quota.Objects {
+		logger.Errorf("Error: tenant %q object quota exceeded", tenant)
+		return 0, util.PayloadTooLargeError{Message: "object quota exceeded"}
+	}
+	if quota.Bytes == 0 {
+		return -1, nil
+	}
+	remaining := quota.Bytes - usage.Bytes
+	if remaining < 0 || (size > 0 && size > remaining) {
+		logger.Errorf("Error: tenant %q storage quota exceeded", tenant)
+		return 0, util.PayloadTooLargeError{Message: "storage quota exceeded"}
+	}
+	return remaining, nil
+}
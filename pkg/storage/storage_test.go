@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/erizzardi/storage/base"
+	"github.com/erizzardi/storage/pkg/storage/audit"
+	"github.com/erizzardi/storage/pkg/storage/jobs"
+	"github.com/erizzardi/storage/pkg/storage/presign"
+	"github.com/erizzardi/storage/util"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// Unit tests for the service, on SQLite.
+
+// newTestDB returns a database in a temporary directory, which also stores the files
+func newTestDB(t *testing.T) (base.DB, string) {
+	dir := t.TempDir()
+	db := base.NewSqliteDatabase(util.NewLogger())
+	if err := db.Connect("sqlite", filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := db.Init(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return db, dir
+}
+
+// newTestService returns a service storing in a temporary directory, with quotas
+func newTestService(t *testing.T, quotas map[string]util.Quota) (Service, string) {
+	db, dir := newTestDB(t)
+	return NewService(db, util.NewLogger(), nil, presign.NewSigner([]byte("secret")), util.NewQuotas(quotas), 0), dir
+}
+
+//
+// This test stores an object and a bucket in a tenant, then acts on them from another tenant.
+// Pass if the other tenant can't read, list, delete or tag the object, and creates its own bucket with the same name.
+func TestTenantIsolation(t *testing.T) {
+
+	svc, dir := newTestService(t, nil)
+	acme := util.ContextWithPrincipal(context.Background(), util.Principal{Name: "alice", Tenant: "acme"})
+	globex := util.ContextWithPrincipal(context.Background(), util.Principal{Name: "bob", Tenant: "globex"})
+
+	if err := svc.AddBucket(acme, "logs"); err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := svc.WriteFile(acme, strings.NewReader("hello"), util.Metadata{Name: "a.txt", Bucket: "logs"}, dir, util.Preconditions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := svc.GetFile(globex, uuid, dir, util.Preconditions{}); !util.ErrorIs(err, util.NotFoundError{}) {
+		t.Errorf("Read from another tenant: %v", err)
+	}
+	if err := svc.DeleteFile(globex, uuid, dir, util.Preconditions{}); !util.ErrorIs(err, util.NotFoundError{}) {
+		t.Errorf("Deleted from another tenant: %v", err)
+	}
+	if err := svc.SetTags(globex, uuid, map[string]string{"k": "v"}); !util.ErrorIs(err, util.NotFoundError{}) {
+		t.Errorf("Tagged from another tenant: %v", err)
+	}
+	if listing, err := svc.ListFiles(globex, util.ListQuery{Limit: 10}); err != nil || len(listing.Files) != 0 {
+		t.Errorf("Listed from another tenant: %+v, %v", listing, err)
+	}
+	if err := svc.AddBucket(globex, "logs"); err != nil {
+		t.Errorf("Bucket name of another tenant not available: %v", err)
+	}
+	if _, _, err := svc.GetFile(acme, uuid, dir, util.Preconditions{}); err != nil {
+		t.Errorf("Object not readable by its tenant: %v", err)
+	}
+}
+
+//
+// This test uploads objects until the quotas of two tenants, one limited in objects and the other in bytes, are exceeded.
+// Pass if the uploads over quota are rejected with 413, replacing an object within the quota succeeds, and unlimited tenants are not limited.
+func TestQuotas(t *testing.T) {
+
+	svc, dir := newTestService(t, map[string]util.Quota{"objects": {Objects: 2}, "bytes": {Bytes: 10}})
+	upload := func(tenant string, name string, content string, cond util.Preconditions) error {
+		ctx := util.ContextWithPrincipal(context.Background(), util.Principal{Name: "alice", Tenant: tenant})
+		_, err := svc.WriteFile(ctx, strings.NewReader(content), util.Metadata{Name: name}, dir, cond)
+		return err
+	}
+
+	for i, test := range []struct {
+		tenant, name, content string
+		cond                  util.Preconditions
+		code                  int
+	}{
+		{"objects", "a", "1", util.Preconditions{}, 200},
+		{"objects", "b", "2", util.Preconditions{}, 200},
+		{"objects", "c", "3", util.Preconditions{}, 413},
+		// Replacing doesn't add an object
+		{"objects", "a", "4", util.Preconditions{IfMatch: []string{"*"}}, 200},
+		{"bytes", "a", "123456", util.Preconditions{}, 200},
+		{"bytes", "b", "123456", util.Preconditions{}, 413},
+		// The bytes of the replaced object are freed
+		{"bytes", "a", "1234567890", util.Preconditions{IfMatch: []string{"*"}}, 200},
+		{"unlimited", "a", "12345678901234567890", util.Preconditions{}, 200},
+	} {
+		if code := util.StatusCode(upload(test.tenant, test.name, test.content, test.cond)); code != test.code {
+			t.Errorf("%d: upload of %s by %s: %d, expected %d", i, test.name, test.tenant, code, test.code)
+		}
+	}
+}
+
+//
+// This test starts a job as a principal, then reads and cancels it as other principals of the tenant, an administrator and another tenant.
+// Pass if only the principal that started the job and the administrator can read and cancel it, and the cancel is recorded in the audit log.
+func TestJobOwnership(t *testing.T) {
+
+	ctx := context.Background()
+	db, _ := newTestDB(t)
+	logger := util.NewLogger()
+	trail, err := audit.NewTrail(ctx, db, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewService(db, logger, nil, presign.NewSigner([]byte("secret")), util.NewQuotas(nil), 0)
+	svc = AuthorizationMiddleware(db, []util.Principal{{Name: "root", Tenant: "acme"}}, logger)(svc)
+	svc = AuditMiddleware(trail, discard.NewCounter(), logger)(svc)
+	principal := func(name string, tenant string) context.Context {
+		return util.ContextWithPrincipal(ctx, util.Principal{Name: name, Tenant: tenant})
+	}
+	alice, root := principal("alice", "acme"), principal("root", "acme")
+
+	manager := jobs.NewManager(time.Hour, logger)
+	defer manager.Shutdown(ctx)
+	job := manager.Start(alice, "Test", func(ctx context.Context, progress func(int, int)) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	for _, test := range []struct {
+		ctx  context.Context
+		code int
+	}{
+		{principal("bob", "acme"), 403},
+		{principal(util.AnonymousPrincipal, "acme"), 403},
+		{principal("alice", "globex"), 404},
+		{root, 200},
+		{alice, 200},
+	} {
+		if _, err := svc.GetJob(test.ctx, manager, job.ID); util.StatusCode(err) != test.code {
+			t.Errorf("Read by %+v: %v, expected %d", util.PrincipalFromContext(test.ctx), err, test.code)
+		}
+		if test.code == 200 {
+			continue
+		}
+		if _, err := svc.CancelJob(test.ctx, manager, job.ID); util.StatusCode(err) != test.code {
+			t.Errorf("Canceled by %+v: %v, expected %d", util.PrincipalFromContext(test.ctx), err, test.code)
+		}
+	}
+	if _, err := svc.CancelJob(root, manager, job.ID); err != nil {
+		t.Errorf("Not canceled by an administrator: %v", err)
+	}
+
+	tenant := "acme"
+	records, err := db.ListAuditRecords(ctx, util.AuditFilter{Tenant: &tenant, Action: "CancelJob"}, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The denied cancels are recorded too
+	if len(records) != 3 || records[2].Principal != "root" || records[2].Object != job.ID || records[2].Code != 200 {
+		t.Errorf("Cancels not recorded: %+v", records)
+	}
+}
+
+//
+// This test searches objects in a bucket with a policy and in one without, as the principal allowed by the policy and as another one.
+// Pass if the other principal gets the hits of the open bucket only, and facets only when the search is restricted to it.
+func TestSearchFacetsAuthorized(t *testing.T) {
+
+	ctx := context.Background()
+	db, dir := newTestDB(t)
+	logger := util.NewLogger()
+	svc := NewService(db, logger, nil, presign.NewSigner([]byte("secret")), util.NewQuotas(nil), 0)
+	svc = AuthorizationMiddleware(db, nil, logger)(svc)
+	alice := util.ContextWithPrincipal(ctx, util.Principal{Name: "alice", Tenant: "acme"})
+	bob := util.ContextWithPrincipal(ctx, util.Principal{Name: "bob", Tenant: "acme"})
+
+	for _, bucket := range []string{"open", "closed"} {
+		if err := svc.AddBucket(alice, bucket); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := svc.WriteFile(alice, strings.NewReader("hello"), util.Metadata{Name: "report.txt", Bucket: bucket}, dir, util.Preconditions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.SetBucketPolicy(alice, "closed", `{"statements": [{"effect": "Allow", "principals": ["alice"], "actions": ["*"]}]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, test := range []struct {
+		ctx    context.Context
+		query  string
+		hits   int
+		facets bool
+	}{
+		{alice, "report", 2, true},
+		{bob, "report", 1, false},
+		{bob, "report bucket:open", 1, true},
+	} {
+		expr, err := util.ParseSearchQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := svc.Search(test.ctx, util.SearchQuery{Expr: expr, Limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Hits) != test.hits || (result.Facets != nil) != test.facets {
+			t.Errorf("%d: %d hits, facets %+v", i, len(result.Hits), result.Facets)
+		}
+	}
+}
+
+// countingDB counts the buckets retrieved
+type countingDB struct {
+	base.DB
+	buckets int
+}
+
+func (db *countingDB) RetrieveBucket(ctx context.Context, tenant string, name string) (util.Bucket, error) {
+	db.buckets++
+	return db.DB.RetrieveBucket(ctx, tenant, name)
+}
+
+//
+// This test lists and searches a page of objects of a bucket with a policy.
+// Pass if the policy of the bucket is read once per call, rather than once per object.
+func TestPoliciesReadOncePerPage(t *testing.T) {
+
+	db, dir := newTestDB(t)
+	logger := util.NewLogger()
+	counting := &countingDB{DB: db}
+	svc := AuthorizationMiddleware(counting, nil, logger)(NewService(db, logger, nil, presign.NewSigner([]byte("secret")), util.NewQuotas(nil), 0))
+	alice := util.ContextWithPrincipal(context.Background(), util.Principal{Name: "alice", Tenant: "acme"})
+
+	if err := svc.AddBucket(alice, "logs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.SetBucketPolicy(alice, "logs", `{"statements": [{"effect": "Allow", "principals": ["alice"], "actions": ["*"]}]}`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := svc.WriteFile(alice, strings.NewReader("hello"), util.Metadata{Name: fmt.Sprintf("report-%d.txt", i), Bucket: "logs"}, dir, util.Preconditions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counting.buckets = 0
+	if listing, err := svc.ListFiles(alice, util.ListQuery{Limit: 100}); err != nil || len(listing.Files) != 10 {
+		t.Fatalf("Listing: %+v, %v", listing, err)
+	}
+	if counting.buckets != 1 {
+		t.Errorf("Listing read the bucket %d times", counting.buckets)
+	}
+
+	counting.buckets = 0
+	expr, err := util.ParseSearchQuery("report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := svc.Search(alice, util.SearchQuery{Expr: expr, Limit: 100}); err != nil || len(result.Hits) != 10 {
+		t.Fatalf("Search: %+v, %v", result, err)
+	}
+	if counting.buckets != 1 {
+		t.Errorf("Search read the bucket %d times", counting.buckets)
+	}
+}
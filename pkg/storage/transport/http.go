@@ -3,7 +3,12 @@ package transport
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/erizzardi/storage/pkg/storage/endpoints"
 	"github.com/erizzardi/storage/util"
@@ -32,6 +37,18 @@ func NewHTTPHandler(ep endpoints.Set) http.Handler {
 		encodeHealthzResponse,
 	))
 
+	r.Methods("GET").Path("/livez").Handler(httptransport.NewServer(
+		ep.LivezEndpoint,
+		decodeHTTPHealtzRequest,
+		encodeHealthzResponse,
+	))
+
+	r.Methods("GET").Path("/readyz").Handler(httptransport.NewServer(
+		ep.ReadyzEndpoint,
+		decodeHTTPHealtzRequest,
+		encodeReadyzResponse,
+	))
+
 	r.Methods("GET").Path("/files").Handler(httptransport.NewServer(
 		ep.ListFilesEndpoint,
 		decodeHTTPListFilesRequest,
@@ -44,6 +61,13 @@ func NewHTTPHandler(ep endpoints.Set) http.Handler {
 		encodeWriteFileResponse,
 	))
 
+	// Raw body upload, used by presigned URLs
+	r.Methods("PUT").Path("/files").Handler(httptransport.NewServer(
+		ep.WriteFileEndpoint,
+		decodeHTTPPutFileRequest,
+		encodeWriteFileResponse,
+	))
+
 	r.Methods("GET").Path("/files/{id}").Handler(httptransport.NewServer(
 		ep.GetFileEndpoint,
 		decodeHTTPGetFileRequest,
@@ -56,6 +80,24 @@ func NewHTTPHandler(ep endpoints.Set) http.Handler {
 		encodeDeleteFileResponse,
 	))
 
+	r.Methods("POST").Path("/files/{id}/copy").Handler(httptransport.NewServer(
+		ep.CopyFileEndpoint,
+		decodeHTTPCopyFileRequest,
+		encodeCopyFileResponse,
+	))
+
+	r.Methods("POST").Path("/files/{id}/move").Handler(httptransport.NewServer(
+		ep.MoveFileEndpoint,
+		decodeHTTPMoveFileRequest,
+		encodeMoveFileResponse,
+	))
+
+	r.Methods("PUT").Path("/files/{id}/tags").Handler(httptransport.NewServer(
+		ep.SetTagsEndpoint,
+		decodeHTTPSetTagsRequest,
+		encodeSetTagsResponse,
+	))
+
 	r.Methods("PUT").Path("/buckets").Handler(httptransport.NewServer(
 		ep.AddBucketEndpoint,
 		decodeHTTPAddBucketRequest,
@@ -68,9 +110,109 @@ func NewHTTPHandler(ep endpoints.Set) http.Handler {
 		encodeLogLevelResponse,
 	))
 
+	r.Methods("PUT", "DELETE").Path("/buckets/{name}/policy").Handler(httptransport.NewServer(
+		ep.SetBucketPolicyEndpoint,
+		decodeHTTPSetBucketPolicyRequest,
+		encodeSetBucketPolicyResponse,
+	))
+
+	r.Methods("GET").Path("/buckets/{name}/policy").Handler(httptransport.NewServer(
+		ep.GetBucketPolicyEndpoint,
+		decodeHTTPGetBucketPolicyRequest,
+		encodeGetBucketPolicyResponse,
+	))
+
+	r.Methods("POST").Path("/policies/simulate").Handler(httptransport.NewServer(
+		ep.SimulatePolicyEndpoint,
+		decodeHTTPSimulatePolicyRequest,
+		encodeSimulatePolicyResponse,
+	))
+
+	r.Methods("POST").Path("/presign").Handler(httptransport.NewServer(
+		ep.PresignEndpoint,
+		decodeHTTPPresignRequest,
+		encodePresignResponse,
+	))
+
+	r.Methods("GET").Path("/tenant/usage").Handler(httptransport.NewServer(
+		ep.TenantUsageEndpoint,
+		decodeHTTPTenantUsageRequest,
+		encodeTenantUsageResponse,
+	))
+
+	r.Methods("GET").Path("/audit").Handler(httptransport.NewServer(
+		ep.QueryAuditEndpoint,
+		decodeHTTPQueryAuditRequest,
+		encodeQueryAuditResponse,
+	))
+
+	r.Methods("GET").Path("/audit/verify").Handler(httptransport.NewServer(
+		ep.VerifyAuditEndpoint,
+		decodeHTTPVerifyAuditRequest,
+		encodeVerifyAuditResponse,
+	))
+
+	r.Methods("GET").Path("/folders/size").Handler(httptransport.NewServer(
+		ep.PrefixUsageEndpoint,
+		decodeHTTPPrefixUsageRequest,
+		encodePrefixUsageResponse,
+	))
+
+	r.Methods("DELETE").Path("/folders").Handler(httptransport.NewServer(
+		ep.DeletePrefixEndpoint,
+		decodeHTTPDeletePrefixRequest,
+		encodeJobResponse,
+	))
+
+	r.Methods("GET").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		ep.GetJobEndpoint,
+		decodeHTTPGetJobRequest,
+		encodeJobResponse,
+	))
+
+	r.Methods("DELETE").Path("/jobs/{id}").Handler(httptransport.NewServer(
+		ep.CancelJobEndpoint,
+		decodeHTTPGetJobRequest,
+		encodeJobResponse,
+	))
+
+	// Long batches run as jobs, with async=true
+	r.Methods("POST").Path("/batch").Queries("async", "true").Handler(httptransport.NewServer(
+		ep.BatchJobEndpoint,
+		decodeHTTPBatchRequest,
+		encodeJobResponse,
+	))
+
+	r.Methods("POST").Path("/batch").Handler(httptransport.NewServer(
+		ep.BatchEndpoint,
+		decodeHTTPBatchRequest,
+		encodeBatchResponse,
+	))
+
+	r.Methods("GET").Path("/search").Handler(httptransport.NewServer(
+		ep.SearchEndpoint,
+		decodeHTTPSearchRequest,
+		encodeSearchResponse,
+	))
+
 	return r
 }
 
+// RouteTemplate returns a function resolving the path template of the route that matches a request,
+// e.g. /files/{id}. Requests that match no route resolve to "unmatched"
+func RouteTemplate(handler http.Handler) func(*http.Request) string {
+	router, ok := handler.(*mux.Router)
+	return func(r *http.Request) string {
+		var match mux.RouteMatch
+		if ok && router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				return template
+			}
+		}
+		return "unmatched"
+	}
+}
+
 //==============================================================================================
 // Request Decoders
 // ---------------------------------------------------------------------------------------------
@@ -91,25 +233,111 @@ func decodeHTTPMethodNotAllowedRequest(ctx context.Context, r *http.Request) (in
 }
 
 func decodeHTTPListFilesRequest(ctx context.Context, r *http.Request) (interface{}, error) {
-	req := &endpoints.ListFilesRequest{}
-	err := json.NewDecoder(r.Body).Decode(req)
-	req.Err = err
+	query := r.URL.Query()
+	req := endpoints.ListFilesRequest{
+		Query: util.ListQuery{
+			Prefix:      query.Get("prefix"),
+			Delimiter:   query.Get("delimiter"),
+			CreatedFrom: query.Get("createdFrom"),
+			CreatedTo:   query.Get("createdTo"),
+			ContentType: query.Get("contentType"),
+		},
+	}
+	// An empty bucket selects the objects without bucket, no bucket at all every object
+	if query.Has("bucket") {
+		bucket := query.Get("bucket")
+		req.Query.Bucket = &bucket
+	}
+	req.Err = decodeListQuery(query, &req.Query)
 
-	return *req, nil
+	return req, nil
+}
+
+// decodeListQuery decodes the parameters of listings that aren't plain strings into q
+func decodeListQuery(query url.Values, q *util.ListQuery) error {
+	if limit := query.Get("limit"); limit != "" {
+		v, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil {
+			return errors.New("invalid limit: " + limit)
+		}
+		q.Limit = uint(v)
+	}
+	for param, bound := range map[string]**int64{"minSize": &q.MinSize, "maxSize": &q.MaxSize} {
+		if query.Get(param) == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(query.Get(param), 10, 64)
+		if err != nil {
+			return errors.New("invalid " + param + ": " + query.Get(param))
+		}
+		*bound = &v
+	}
+	// Sort key, descending if prefixed by '-'
+	if sort := query.Get("sort"); sort != "" {
+		q.Sort, q.Desc = strings.TrimPrefix(sort, "-"), strings.HasPrefix(sort, "-")
+		if !util.ValidSort(q.Sort) {
+			return errors.New("invalid sort: " + sort)
+		}
+	}
+	tags, err := util.ParseTags(query.Get("tags"))
+	if err != nil {
+		return err
+	}
+	q.Tags = tags
+	if cursor := query.Get("cursor"); cursor != "" {
+		if q.After, err = util.ParseListCursor(cursor); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func decodeHTTPWriteFileRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 
 	file, multipartHeader, err := r.FormFile("file")
+	if err != nil {
+		return endpoints.WriteFileRequest{Err: err}, nil
+	}
+	tags, err := util.ParseTags(r.FormValue("tags"))
+	if err != nil {
+		file.Close()
+		return endpoints.WriteFileRequest{Err: err}, nil
+	}
 
 	return endpoints.WriteFileRequest{
 		File: file,
 		Metadata: util.Metadata{
-			Name: multipartHeader.Filename,
-			Size: multipartHeader.Size,
+			Name:        multipartHeader.Filename,
+			Size:        multipartHeader.Size,
+			Bucket:      r.FormValue("bucket"),
+			ContentType: multipartHeader.Header.Get("Content-Type"),
+			Tags:        tags,
+		},
+		Preconditions: util.ParsePreconditions(r.Header),
+	}, nil
+}
+
+func decodeHTTPPutFileRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	if query.Get("name") == "" {
+		return endpoints.WriteFileRequest{Err: errors.New("missing name query parameter")}, nil
+	}
+	tags, err := util.ParseTags(query.Get("tags"))
+	if err != nil {
+		return endpoints.WriteFileRequest{Err: err}, nil
+	}
+
+	return endpoints.WriteFileRequest{
+		File: r.Body,
+		Metadata: util.Metadata{
+			Name:        query.Get("name"),
+			Size:        r.ContentLength,
+			Bucket:      query.Get("bucket"),
+			ContentType: r.Header.Get("Content-Type"),
+			Tags:        tags,
 		},
-		Err: err,
+		Preconditions: util.ParsePreconditions(r.Header),
 	}, nil
 }
 
@@ -119,7 +347,8 @@ func decodeHTTPGetFileRequest(ctx context.Context, r *http.Request) (interface{}
 	uuid := vars["id"]
 
 	return endpoints.GetFileRequest{
-		Uuid: uuid,
+		Uuid:          uuid,
+		Preconditions: util.ParsePreconditions(r.Header),
 	}, nil
 }
 
@@ -129,10 +358,63 @@ func decodeHTTPDeleteFileRequest(ctx context.Context, r *http.Request) (interfac
 	uuid := vars["id"]
 
 	return endpoints.DeleteFileRequest{
-		Uuid: uuid,
+		Uuid:          uuid,
+		Preconditions: util.ParsePreconditions(r.Header),
 	}, nil
 }
 
+// The destination is set in the query, as for PUT /files. Content type and tags are replaced with metadata=replace
+func decodeHTTPCopyFileRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	req := endpoints.CopyFileRequest{
+		Uuid: mux.Vars(r)["id"],
+		Metadata: util.Metadata{
+			Name:   query.Get("name"),
+			Bucket: query.Get("bucket"),
+		},
+		Preconditions: util.ParsePreconditions(r.Header),
+	}
+	switch {
+	case req.Metadata.Name == "":
+		req.Err = errors.New("missing name query parameter")
+	case query.Get("metadata") == "replace":
+		req.ReplaceMetadata = true
+		req.Metadata.ContentType = query.Get("contentType")
+		req.Metadata.Tags, req.Err = util.ParseTags(query.Get("tags"))
+	case query.Get("metadata") != "" && query.Get("metadata") != "copy":
+		req.Err = errors.New("invalid metadata: " + query.Get("metadata") + ", must be copy or replace")
+	case query.Has("contentType") || query.Has("tags"):
+		req.Err = errors.New("contentType and tags require metadata=replace")
+	}
+
+	return req, nil
+}
+
+func decodeHTTPMoveFileRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	req := endpoints.MoveFileRequest{
+		Uuid:          mux.Vars(r)["id"],
+		Bucket:        query.Get("bucket"),
+		Name:          query.Get("name"),
+		Preconditions: util.ParsePreconditions(r.Header),
+	}
+	if req.Name == "" {
+		req.Err = errors.New("missing name query parameter")
+	}
+
+	return req, nil
+}
+
+func decodeHTTPSetTagsRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &endpoints.SetTagsRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		req.Err = err
+	}
+	req.Uuid = mux.Vars(r)["id"]
+
+	return *req, nil
+}
+
 func decodeHTTPAddBucketRequest(ctx context.Context, r *http.Request) (interface{}, error) {
 	req := &endpoints.AddBucketRequest{}
 	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
@@ -151,6 +433,136 @@ func decodeHTTPLogLevelRequest(ctx context.Context, r *http.Request) (interface{
 	return *req, nil
 }
 
+func decodeHTTPSetBucketPolicyRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := endpoints.SetBucketPolicyRequest{Bucket: mux.Vars(r)["name"]}
+	if r.Method == http.MethodDelete {
+		return req, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		req.Err = err
+	} else if len(body) == 0 {
+		req.Err = errors.New("empty policy document")
+	}
+	req.Policy = body
+
+	return req, nil
+}
+
+func decodeHTTPGetBucketPolicyRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return endpoints.GetBucketPolicyRequest{Bucket: mux.Vars(r)["name"]}, nil
+}
+
+func decodeHTTPSimulatePolicyRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &endpoints.SimulatePolicyRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		req.Err = err
+	}
+
+	return *req, nil
+}
+
+func decodeHTTPPresignRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &endpoints.PresignRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		req.Err = err
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	} else if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	req.BaseURL = scheme + "://" + r.Host
+
+	return *req, nil
+}
+
+func decodeHTTPTenantUsageRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func decodeHTTPQueryAuditRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	req := endpoints.QueryAuditRequest{
+		Filter: util.AuditFilter{
+			Principal: query.Get("principal"),
+			Action:    query.Get("action"),
+			Object:    query.Get("object"),
+			From:      query.Get("from"),
+			To:        query.Get("to"),
+		},
+	}
+	for param, value := range map[string]*uint{"limit": &req.Limit, "offset": &req.Offset} {
+		if query.Get(param) == "" {
+			continue
+		}
+		v, err := strconv.ParseUint(query.Get(param), 10, 32)
+		if err != nil {
+			req.Err = errors.New("invalid " + param + ": " + query.Get(param))
+			break
+		}
+		*value = uint(v)
+	}
+
+	return req, nil
+}
+
+func decodeHTTPVerifyAuditRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return nil, nil
+}
+
+func decodeHTTPPrefixUsageRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	return endpoints.PrefixUsageRequest{
+		Bucket: query.Get("bucket"),
+		Prefix: query.Get("prefix"),
+	}, nil
+}
+
+func decodeHTTPDeletePrefixRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	return endpoints.DeletePrefixRequest{
+		Bucket: query.Get("bucket"),
+		Prefix: query.Get("prefix"),
+	}, nil
+}
+
+func decodeHTTPGetJobRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	return endpoints.GetJobRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeHTTPBatchRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &endpoints.BatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		req.Err = err
+	}
+
+	return *req, nil
+}
+
+func decodeHTTPSearchRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	var req endpoints.SearchRequest
+	req.Query.Expr, req.Err = util.ParseSearchQuery(query.Get("q"))
+	if req.Err != nil {
+		req.Err = errors.New("invalid query: " + req.Err.Error())
+		return req, nil
+	}
+	if limit := query.Get("limit"); limit != "" {
+		v, err := strconv.ParseUint(limit, 10, 32)
+		if err != nil {
+			req.Err = errors.New("invalid limit: " + limit)
+			return req, nil
+		}
+		req.Query.Limit = uint(v)
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		req.Query.After, req.Err = util.ParseSearchCursor(cursor)
+	}
+	return req, nil
+}
+
 //==================
 // Response Encoders
 //==================
@@ -159,7 +571,15 @@ func encodeHealthzResponse(ctx context.Context, w http.ResponseWriter, response
 	return json.NewEncoder(w).Encode(response)
 }
 
+func encodeReadyzResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.ReadyzResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
 func encodeListFilesResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.ListFilesResponse)
+	w.WriteHeader(res.Code)
 	return json.NewEncoder(w).Encode(response)
 }
 
@@ -171,9 +591,27 @@ func encodeWriteFileResponse(ctx context.Context, w http.ResponseWriter, respons
 
 func encodeGetFileResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	res := response.(endpoints.GetFileResponse)
+	// Validators, for conditional requests
+	if res.Code == http.StatusOK || res.Code == http.StatusNotModified {
+		w.Header().Set("ETag", res.Object.EntityTag())
+		if modified := res.Object.LastModified(); !modified.IsZero() {
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		}
+	}
+	// Objects stored without a content type are served with the one sniffed from their content by net/http
+	if res.Code == http.StatusOK && res.Object.ContentType != "" {
+		w.Header().Set("Content-Type", res.Object.ContentType)
+	}
+	if res.Code == http.StatusNotModified {
+		w.WriteHeader(res.Code)
+		return nil
+	}
+	if res.Code != 200 {
+		w.WriteHeader(res.Code)
+		return json.NewEncoder(w).Encode(response)
+	}
 
 	w.Write(res.File)
-	w.Header().Set("Content-Type", "image/jpg")
 	return nil
 }
 
@@ -183,6 +621,24 @@ func encodeDeleteFileResponse(ctx context.Context, w http.ResponseWriter, respon
 	return json.NewEncoder(w).Encode(response)
 }
 
+func encodeCopyFileResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.CopyFileResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeMoveFileResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.MoveFileResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeSetTagsResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.SetTagsResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
 func encodeAddBucketResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	res := response.(endpoints.AddBucketResponse)
 	w.WriteHeader(res.Code)
@@ -202,3 +658,69 @@ func encodeNotFoundResponse(ctx context.Context, w http.ResponseWriter, response
 func encodeMethodNotAllowedResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	return json.NewEncoder(w).Encode(response)
 }
+
+func encodeSetBucketPolicyResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.SetBucketPolicyResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeGetBucketPolicyResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.GetBucketPolicyResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeSimulatePolicyResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.SimulatePolicyResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodePresignResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.PresignResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeTenantUsageResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.TenantUsageResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeQueryAuditResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.QueryAuditResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeVerifyAuditResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.VerifyAuditResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodePrefixUsageResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.PrefixUsageResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeJobResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.JobResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeBatchResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.BatchResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
+
+func encodeSearchResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	res := response.(endpoints.SearchResponse)
+	w.WriteHeader(res.Code)
+	return json.NewEncoder(w).Encode(response)
+}
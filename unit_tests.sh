@@ -1,6 +1,7 @@
 #! /bin/bash
 
 # N.B. at the moment (Jun 2022) this works EXCLUSIVELY with Postgres.
+# Without TEST_DB_CONN_STR, `go test` uses SQLite instead.
 
 cleanup() {
     CONTAINER_NAME="test-$TEST_DB"
@@ -21,16 +22,21 @@ cleanup() {
 trap cleanup EXIT
 
 
-DB_SUPPORTED=("postgres")
+DB_SUPPORTED=("postgres" "mysql" "cockroach")
 
 # Default values for the database name and version to be used for the tests.
-# The service supports (maybe in the future!) different databases, so override this value
-# to use another kind of db (cockroach, mysql, cassandra etc)
+# The service supports different databases, so override this value
+# to use another kind of db (cockroach, mysql)
 if [[ -z $TEST_DB ]]; then
     TEST_DB="postgres"
 fi
+case "$TEST_DB" in
+  "postgres") TEST_DB_IMAGE="postgres"; DEFAULT_VERSION="alpine3.16"; DEFAULT_PORT="5432" ;;
+  "mysql") TEST_DB_IMAGE="mysql"; DEFAULT_VERSION="8.0"; DEFAULT_PORT="3306" ;;
+  "cockroach") TEST_DB_IMAGE="cockroachdb/cockroach"; DEFAULT_VERSION="v22.1.2"; DEFAULT_PORT="26257" ;;
+esac
 if [[ -z $TEST_DB_VERSION ]]; then
-    TEST_DB_VERSION="alpine3.16"
+    TEST_DB_VERSION="$DEFAULT_VERSION"
 fi
 # Defaults the test db to localhost:5432.
 # This values can be overridden if using, for example, 
@@ -39,7 +45,7 @@ if [[ -z $TEST_DB_HOST ]]; then
     TEST_DB_HOST="127.0.0.1"
 fi
 if [[ -z $TEST_DB_PORT ]]; then
-    TEST_DB_PORT="5432"
+    TEST_DB_PORT="$DEFAULT_PORT"
 fi
 # Default values for user authentication.
 if [[ -z $TEST_DB_USER ]]; then
@@ -62,7 +68,7 @@ cleanup
 # The docker client can already tell whether
 # the image is already present in the local registry (exit code still 0)
 if [[ " ${DB_SUPPORTED[*]} " =~ " ${TEST_DB} " ]]; then
-    docker pull "$TEST_DB:$TEST_DB_VERSION"
+    docker pull "$TEST_DB_IMAGE:$TEST_DB_VERSION"
 fi
 
 if [[ ! " ${DB_SUPPORTED[*]} " =~ " ${TEST_DB} " ]]; then
@@ -84,14 +90,40 @@ case "$TEST_DB" in
 	    --name "$CONTAINER_NAME" \
         -e POSTGRES_USER="$TEST_DB_USER" \
 	    -e POSTGRES_PASSWORD="$TEST_DB_PASSWORD" \
-        -p "$TEST_DB_PORT:$TEST_DB_PORT" \
-	    "$TEST_DB:$TEST_DB_VERSION"
+        -p "$TEST_DB_PORT:5432" \
+	    "$TEST_DB_IMAGE:$TEST_DB_VERSION"
+    ;;
+
+  "mysql")
+
+    TEST_DB_CONN_STR="${TEST_DB_USER}:${TEST_DB_PASSWORD}@tcp(${TEST_DB_HOST}:${TEST_DB_PORT})/${TEST_DB_DATABASE}"
+
+    docker run -d \
+        --name "$CONTAINER_NAME" \
+        -e MYSQL_ROOT_PASSWORD="$TEST_DB_PASSWORD" \
+        -e MYSQL_USER="$TEST_DB_USER" \
+        -e MYSQL_PASSWORD="$TEST_DB_PASSWORD" \
+        -e MYSQL_DATABASE="$TEST_DB_DATABASE" \
+        -p "$TEST_DB_PORT:3306" \
+        "$TEST_DB_IMAGE:$TEST_DB_VERSION"
+    ;;
+
+  "cockroach")
+
+    # Insecure single node: root user, no password
+    TEST_DB_CONN_STR="postgresql://root@${TEST_DB_HOST}:${TEST_DB_PORT}/defaultdb?sslmode=disable"
+
+    docker run -d \
+        --name "$CONTAINER_NAME" \
+        -p "$TEST_DB_PORT:26257" \
+        "$TEST_DB_IMAGE:$TEST_DB_VERSION" start-single-node --insecure
     ;;
 esac
 
-# TODO Add unit tests execution here
-# TODO Add unit tests
-# TEST_DB_CONN_STR="$TEST_DB_CONN_STR" go test -v
+echo "Waiting for $TEST_DB..."
+sleep 20
+
 echo "Running tests..."
+TEST_DB="$TEST_DB" TEST_DB_CONN_STR="$TEST_DB_CONN_STR" go test -v ./base/
 
 # The end! The trap should now activate
\ No newline at end of file
@@ -0,0 +1,27 @@
+package util
+
+// AuditRecord is one entry of the audit log.
+// Records are chained: Hash is computed over the record and the hash of the previous one
+type AuditRecord struct {
+	Seq       int64  `json:"seq"`
+	Time      string `json:"time"`
+	Principal string `json:"principal"`
+	Tenant    string `json:"tenant,omitempty"`
+	SourceIP  string `json:"sourceIp,omitempty"`
+	Action    string `json:"action"`
+	Object    string `json:"object,omitempty"`
+	Code      int    `json:"code"`
+	PrevHash  string `json:"prevHash"`
+	Hash      string `json:"hash"`
+}
+
+// AuditFilter selects audit records. Empty fields match everything.
+// From and To are RFC3339 timestamps
+type AuditFilter struct {
+	Tenant    *string
+	Principal string
+	Action    string
+	Object    string
+	From      string
+	To        string
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Name of the principal of unauthenticated requests
+const AnonymousPrincipal = "anonymous"
+
+type contextKey int
+
+const (
+	principalContextKey contextKey = iota
+	sourceIPContextKey
+	requestIDContextKey
+)
+
+// Principal is the identity performing a request
+type Principal struct {
+	Name string `json:"name" yaml:"name"`
+	// Tenant the principal belongs to. Empty for the default tenant
+	Tenant string `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+}
+
+// ContextWithPrincipal returns a copy of ctx carrying the principal p
+func ContextWithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalContextKey, p)
+}
+
+// PrincipalFromContext returns the principal stored in ctx, or the anonymous principal
+func PrincipalFromContext(ctx context.Context) Principal {
+	if p, ok := ctx.Value(principalContextKey).(Principal); ok {
+		return p
+	}
+	return Principal{Name: AnonymousPrincipal}
+}
+
+// ContextWithSourceIP returns a copy of ctx carrying the IP address of the client
+func ContextWithSourceIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, sourceIPContextKey, ip)
+}
+
+// SourceIPFromContext returns the IP address of the client, if any
+func SourceIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(sourceIPContextKey).(string)
+	return ip
+}
+
+// ContextWithRequestID returns a copy of ctx carrying the ID of the request
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey, id)
+}
+
+// RequestIDFromContext returns the ID of the request, if any
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
+
+// DetachedContext returns a context carrying the values of ctx, principal, request ID and trace included,
+// that is never canceled. For writes that must complete even if the client goes away
+func DetachedContext(ctx context.Context) context.Context {
+	return detachedContext{parent: ctx}
+}
+
+type detachedContext struct{ parent context.Context }
+
+func (c detachedContext) Deadline() (time.Time, bool)       { return time.Time{}, false }
+func (c detachedContext) Done() <-chan struct{}             { return nil }
+func (c detachedContext) Err() error                        { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// ParseAPIKeys parses a list of API keys in the form "key1=principal1@tenant1,key2=principal2".
+// Principals without tenant belong to the default tenant
+func ParseAPIKeys(s string) map[string]Principal {
+	keys := make(map[string]Principal)
+	for _, entry := range strings.Split(s, ",") {
+		key, name, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || key == "" || name == "" {
+			continue
+		}
+		keys[key] = ParsePrincipal(name)
+	}
+	return keys
+}
+
+// ParsePrincipal parses a principal in the form "principal@tenant", or "principal" for the default tenant
+func ParsePrincipal(s string) Principal {
+	name, tenant, _ := strings.Cut(s, "@")
+	return Principal{Name: name, Tenant: tenant}
+}
+
+// ParsePrincipals parses a list of principals in the form "principal1@tenant1,principal2"
+func ParsePrincipals(s string) []Principal {
+	ret := make([]Principal, 0)
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			ret = append(ret, ParsePrincipal(entry))
+		}
+	}
+	return ret
+}
@@ -0,0 +1,115 @@
+package util
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EntityTag returns the entity tag of the object, quoted as in the ETag header.
+// Objects stored before entity tags are tagged by their uuid: the content of an object never changes
+func (r Row) EntityTag() string {
+	if r.ETag != "" {
+		return `"` + r.ETag + `"`
+	}
+	return `"` + r.Uuid + `"`
+}
+
+// LastModified returns the upload time of the object, zero if unknown
+func (r Row) LastModified() time.Time {
+	t, err := time.Parse(TimeFormat, r.CreatedAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Preconditions are the conditional headers of a request, see RFC 9110 section 13
+type Preconditions struct {
+	// Entity tags of If-Match and If-None-Match, quoted. "*" matches any object
+	IfMatch     []string
+	IfNoneMatch []string
+	// Zero if not set
+	IfModifiedSince time.Time
+}
+
+// ParsePreconditions reads the conditional headers. An invalid If-Modified-Since is ignored, as the RFC requires
+func ParsePreconditions(header http.Header) Preconditions {
+	p := Preconditions{
+		IfMatch:     parseEntityTags(header.Get("If-Match")),
+		IfNoneMatch: parseEntityTags(header.Get("If-None-Match")),
+	}
+	if since := header.Get("If-Modified-Since"); since != "" {
+		p.IfModifiedSince, _ = http.ParseTime(since)
+	}
+	return p
+}
+
+// WriteSet returns true if there is any precondition of writes: If-Match or If-None-Match.
+// If-Modified-Since applies to reads only, thus doesn't make a write conditional
+func (p Preconditions) WriteSet() bool {
+	return len(p.IfMatch) > 0 || len(p.IfNoneMatch) > 0
+}
+
+// Check evaluates the preconditions on current, the object the request acts on, nil if it doesn't exist.
+// Reads, i.e. GET, fail with NotModifiedError where writes fail with PreconditionFailedError,
+// and If-Modified-Since applies to reads only
+func (p Preconditions) Check(current *Row, read bool) error {
+	if len(p.IfMatch) > 0 && (current == nil || !matchEntityTag(p.IfMatch, current.EntityTag(), false)) {
+		return PreconditionFailedError{Message: "If-Match"}
+	}
+	if len(p.IfNoneMatch) > 0 {
+		if current != nil && matchEntityTag(p.IfNoneMatch, current.EntityTag(), true) {
+			if read {
+				return NotModifiedError{}
+			}
+			return PreconditionFailedError{Message: "If-None-Match"}
+		}
+		// If-Modified-Since is ignored along with If-None-Match
+		return nil
+	}
+	if read && current != nil && !p.IfModifiedSince.IsZero() {
+		// HTTP dates have a resolution of one second
+		if modified := current.LastModified(); !modified.IsZero() && !modified.Truncate(time.Second).After(p.IfModifiedSince) {
+			return NotModifiedError{}
+		}
+	}
+	return nil
+}
+
+// matchEntityTag returns true if tags has "*" or tag. Weak comparison ignores the W/ prefix of weak tags
+func matchEntityTag(tags []string, tag string, weak bool) bool {
+	for _, t := range tags {
+		if t == "*" {
+			return true
+		}
+		if strings.HasPrefix(t, "W/") {
+			if !weak {
+				continue
+			}
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseEntityTags splits a list of entity tags, e.g. `"a", W/"b"`. Commas within quotes don't split
+func parseEntityTags(header string) []string {
+	var tags []string
+	quoted, start := false, 0
+	for i := 0; i <= len(header); i++ {
+		if i < len(header) && header[i] == '"' {
+			quoted = !quoted
+		}
+		if i == len(header) || (header[i] == ',' && !quoted) {
+			if tag := strings.TrimSpace(header[start:i]); tag != "" {
+				tags = append(tags, tag)
+			}
+			start = i + 1
+		}
+	}
+	return tags
+}
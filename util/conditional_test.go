@@ -0,0 +1,88 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Unit tests for the conditional requests.
+
+//
+// This test parses conditional headers, with lists of entity tags and invalid dates.
+// Pass if tags are split as in the header, invalid dates are ignored, and only If-Match and If-None-Match make writes conditional.
+func TestParsePreconditions(t *testing.T) {
+
+	since := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header      http.Header
+		ifMatch     []string
+		ifNoneMatch []string
+		since       time.Time
+		writeSet    bool
+	}{
+		{http.Header{}, nil, nil, time.Time{}, false},
+		{http.Header{"If-Match": {`"a", W/"b,c"`}}, []string{`"a"`, `W/"b,c"`}, nil, time.Time{}, true},
+		{http.Header{"If-None-Match": {"*"}}, nil, []string{"*"}, time.Time{}, true},
+		{http.Header{"If-Modified-Since": {since.Format(http.TimeFormat)}}, nil, nil, since, false},
+		{http.Header{"If-Modified-Since": {"yesterday"}}, nil, nil, time.Time{}, false},
+	}
+	for i, test := range tests {
+		p := ParsePreconditions(test.header)
+		if !equalStrings(p.IfMatch, test.ifMatch) || !equalStrings(p.IfNoneMatch, test.ifNoneMatch) || !p.IfModifiedSince.Equal(test.since) {
+			t.Errorf("%d: wrong preconditions %+v", i, p)
+		}
+		if p.WriteSet() != test.writeSet {
+			t.Errorf("%d: WriteSet is %v", i, p.WriteSet())
+		}
+	}
+}
+
+//
+// This test checks preconditions on an existing object and on a missing one, for reads and writes.
+// Pass if each check succeeds, or fails with 304 or 412, as RFC 9110 requires.
+func TestCheckPreconditions(t *testing.T) {
+
+	current := &Row{Uuid: "u1", ETag: "abc", CreatedAt: "2026-10-19T12:00:00.500000Z"}
+	created := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		p       Preconditions
+		current *Row
+		read    bool
+		code    int
+	}{
+		{Preconditions{}, current, false, http.StatusOK},
+		{Preconditions{IfMatch: []string{`"abc"`}}, current, false, http.StatusOK},
+		{Preconditions{IfMatch: []string{"*"}}, current, false, http.StatusOK},
+		{Preconditions{IfMatch: []string{`"xyz"`}}, current, false, http.StatusPreconditionFailed},
+		{Preconditions{IfMatch: []string{`W/"abc"`}}, current, false, http.StatusPreconditionFailed},
+		{Preconditions{IfMatch: []string{"*"}}, nil, false, http.StatusPreconditionFailed},
+		{Preconditions{IfNoneMatch: []string{"*"}}, nil, false, http.StatusOK},
+		{Preconditions{IfNoneMatch: []string{"*"}}, current, false, http.StatusPreconditionFailed},
+		{Preconditions{IfNoneMatch: []string{`W/"abc"`}}, current, true, http.StatusNotModified},
+		{Preconditions{IfNoneMatch: []string{`"xyz"`}}, current, true, http.StatusOK},
+		// If-Modified-Since is ignored along with If-None-Match, and by writes
+		{Preconditions{IfNoneMatch: []string{`"xyz"`}, IfModifiedSince: created}, current, true, http.StatusOK},
+		{Preconditions{IfModifiedSince: created}, current, true, http.StatusNotModified},
+		{Preconditions{IfModifiedSince: created.Add(-time.Second)}, current, true, http.StatusOK},
+		{Preconditions{IfModifiedSince: created}, current, false, http.StatusOK},
+		{Preconditions{IfModifiedSince: created}, nil, true, http.StatusOK},
+	}
+	for i, test := range tests {
+		if code := StatusCode(test.p.Check(test.current, test.read)); code != test.code {
+			t.Errorf("%d: %+v on %v, read %v: %d, expected %d", i, test.p, test.current, test.read, code, test.code)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,9 +1,563 @@
 package util
 
-// Config struct definition
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the whole configuration of the service.
+// It is read from a YAML file, then overridden by environment variables, see LoadConfig
 type Config struct {
-	StorageFolder string
+	Server  ServerConfig  `yaml:"server"`
+	DB      DBConfig      `yaml:"db"`
+	Storage StorageConfig `yaml:"storage"`
+	Auth    AuthConfig    `yaml:"auth"`
+	Limits  LimitsConfig  `yaml:"limits"`
+	Logging LoggingConfig `yaml:"logging"`
+	Tracing TracingConfig `yaml:"tracing"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port"`
+	// Uploads and downloads of large files on slow links need long read and write timeouts
+	ReadHeaderTimeout Duration `yaml:"readHeaderTimeout"`
+	ReadTimeout       Duration `yaml:"readTimeout"`
+	WriteTimeout      Duration `yaml:"writeTimeout"`
+	IdleTimeout       Duration `yaml:"idleTimeout"`
+	// Time between readiness failing and the server refusing new connections, to let the load balancer notice
+	DrainDelay Duration `yaml:"drainDelay"`
+	// Maximum time in-flight requests are given to complete on shutdown
+	ShutdownTimeout Duration  `yaml:"shutdownTimeout"`
+	TLS             TLSConfig `yaml:"tls"`
+}
+
+type TLSConfig struct {
+	// Certificate and key of the HTTP server. The server is plaintext if not set
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// CA bundle verifying client certificates. Client certificates are ignored if not set
+	ClientCAFile string `yaml:"clientCAFile"`
+	// optional (verified if presented) or require
+	ClientAuth string `yaml:"clientAuth"`
 }
 
-// Config constructor
-func SetConfig(storageFolder string) *Config { return &Config{StorageFolder: storageFolder} }
+type DBConfig struct {
+	Driver string `yaml:"driver"`
+	Host   string `yaml:"host"`
+	// Defaults to the port of the driver, see DBPorts
+	Port     string `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	// Files the credentials are read from, alternative to User and Password.
+	// The connection is renewed when they change
+	UserFile     string `yaml:"userFile"`
+	PasswordFile string `yaml:"passwordFile"`
+	// Database name, or path of the database file for sqlite and bbolt
+	Database   string           `yaml:"database"`
+	SSLMode    string           `yaml:"sslMode"`
+	Resilience ResilienceConfig `yaml:"resilience"`
+}
+
+// ResilienceConfig sets how database calls are timed out and retried, and when they stop being attempted
+type ResilienceConfig struct {
+	// Maximum duration of every attempt of a call. 0 disables the timeout
+	Timeout Duration `yaml:"timeout"`
+	// Attempts after the first one, for transient errors
+	Retries int `yaml:"retries"`
+	// Base delay between attempts, doubled at every retry and jittered
+	RetryBackoff Duration `yaml:"retryBackoff"`
+	// Consecutive failures opening the circuit breaker. 0 disables the breaker
+	BreakerFailures int `yaml:"breakerFailures"`
+	// Time the breaker stays open before letting a call probe the database
+	BreakerCooldown Duration `yaml:"breakerCooldown"`
+}
+
+// StorageConfig is the configuration of the blob backend
+type StorageConfig struct {
+	Folder string `yaml:"folder"`
+	// Free space of the folder below which the service is not ready
+	MinFreeBytes uint64 `yaml:"minFreeBytes"`
+	// Bytes of text content indexed for search at upload, 0 indexes names and tags only
+	SearchContentBytes int64 `yaml:"searchContentBytes"`
+}
+
+type AuthConfig struct {
+	// API key -> principal
+	APIKeys map[string]Principal `yaml:"apiKeys"`
+	// File the API keys are read from, in the STORAGE_API_KEYS format. Alternative to APIKeys
+	APIKeysFile string `yaml:"apiKeysFile"`
+	// HMAC key of presigned URLs
+	PresignSecret string `yaml:"presignSecret"`
+	// File the HMAC key is read from. Alternative to PresignSecret
+	PresignSecretFile string `yaml:"presignSecretFile"`
+	// Principals administering their tenant, allowed to read and verify the audit log
+	Admins []Principal `yaml:"admins"`
+}
+
+type LimitsConfig struct {
+	// Tenant -> quota
+	Quotas    map[string]Quota `yaml:"quotas"`
+	RateLimit RateLimit        `yaml:"rateLimit"`
+}
+
+type LoggingConfig struct {
+	// text or json
+	Format string `yaml:"format"`
+	// Layer -> level
+	Levels map[string]string `yaml:"levels"`
+}
+
+type TracingConfig struct {
+	// host:port of the OTLP/HTTP trace collector. Tracing is disabled if not set
+	OTLPEndpoint string `yaml:"otlpEndpoint"`
+	// Send spans over plain HTTP
+	OTLPInsecure bool `yaml:"otlpInsecure"`
+	// Ratio of the traces started by this service that are sampled
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Level of the layers not configured
+const defaultLogLevel = "INFO"
+
+// Logging layers
+var LogLayers = []string{"main", "service", "transport", "endpoints", "database"}
+
+// Supported database drivers
+var DBDrivers = []string{"postgres", "cockroach", "mysql", "sqlite", "bbolt"}
+
+// Default ports of the database drivers
+var DBPorts = map[string]string{"postgres": "5432", "cockroach": "26257", "mysql": "3306"}
+
+// Duration is a time.Duration read and written as a Go duration string, e.g. "1m30s"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// DefaultConfig returns the configuration used when nothing is set
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              "8081",
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(10 * time.Minute),
+			WriteTimeout:      Duration(10 * time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			DrainDelay:        Duration(5 * time.Second),
+			ShutdownTimeout:   Duration(30 * time.Second),
+			TLS:               TLSConfig{ClientAuth: "optional"},
+		},
+		DB: DBConfig{Driver: "postgres", SSLMode: "disable", Resilience: ResilienceConfig{
+			Timeout:         Duration(10 * time.Second),
+			Retries:         2,
+			RetryBackoff:    Duration(100 * time.Millisecond),
+			BreakerFailures: 5,
+			BreakerCooldown: Duration(30 * time.Second),
+		}},
+		Storage: StorageConfig{Folder: "./file-storage", MinFreeBytes: 100 << 20},
+		// Levels of the layers not configured are set by LoadConfig, maps can't be merged
+		Logging: LoggingConfig{Format: "text"},
+		Tracing: TracingConfig{SampleRatio: 1},
+	}
+}
+
+// LoadConfig reads the configuration: defaults, overridden by the YAML file at path, if not empty,
+// overridden by the environment variables. The result is validated
+func LoadConfig(path string) (*Config, error) {
+	config := DefaultConfig()
+	if path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(content, config); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if config.Logging.Levels == nil {
+		config.Logging.Levels = make(map[string]string)
+	}
+	for _, layer := range LogLayers {
+		if _, ok := config.Logging.Levels[layer]; !ok {
+			config.Logging.Levels[layer] = defaultLogLevel
+		}
+	}
+	if err := config.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := config.ReadSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// applyEnv overrides the configuration with the environment variables that are set and not empty
+func (c *Config) applyEnv() error {
+	var errs []string
+	str := func(env string, dst *string) {
+		if v := os.Getenv(env); v != "" {
+			*dst = v
+		}
+	}
+	parse := func(env string, set func(string) error) {
+		if v := os.Getenv(env); v != "" {
+			if err := set(v); err != nil {
+				errs = append(errs, env+": "+err.Error())
+			}
+		}
+	}
+	duration := func(env string, dst *Duration) {
+		parse(env, func(v string) error {
+			d, err := time.ParseDuration(v)
+			*dst = Duration(d)
+			return err
+		})
+	}
+
+	str("STORAGE_HTTP_PORT", &c.Server.Port)
+	duration("STORAGE_HTTP_READ_HEADER_TIMEOUT", &c.Server.ReadHeaderTimeout)
+	duration("STORAGE_HTTP_READ_TIMEOUT", &c.Server.ReadTimeout)
+	duration("STORAGE_HTTP_WRITE_TIMEOUT", &c.Server.WriteTimeout)
+	duration("STORAGE_HTTP_IDLE_TIMEOUT", &c.Server.IdleTimeout)
+	duration("STORAGE_SHUTDOWN_DRAIN_DELAY", &c.Server.DrainDelay)
+	duration("STORAGE_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	str("STORAGE_TLS_CERT_FILE", &c.Server.TLS.CertFile)
+	str("STORAGE_TLS_KEY_FILE", &c.Server.TLS.KeyFile)
+	str("STORAGE_TLS_CLIENT_CA_FILE", &c.Server.TLS.ClientCAFile)
+	str("STORAGE_TLS_CLIENT_AUTH", &c.Server.TLS.ClientAuth)
+
+	str("STORAGE_DB_DRIVER", &c.DB.Driver)
+	str("STORAGE_DB_HOST", &c.DB.Host)
+	str("STORAGE_DB_PORT", &c.DB.Port)
+	str("STORAGE_DB_USER", &c.DB.User)
+	str("STORAGE_DB_PASSWORD", &c.DB.Password)
+	str("STORAGE_DB_USER_FILE", &c.DB.UserFile)
+	str("STORAGE_DB_PASSWORD_FILE", &c.DB.PasswordFile)
+	str("STORAGE_DB_DATABASE", &c.DB.Database)
+	str("STORAGE_SSL_MODE", &c.DB.SSLMode)
+	duration("STORAGE_DB_TIMEOUT", &c.DB.Resilience.Timeout)
+	parse("STORAGE_DB_RETRIES", func(v string) (err error) {
+		c.DB.Resilience.Retries, err = strconv.Atoi(v)
+		return err
+	})
+	duration("STORAGE_DB_RETRY_BACKOFF", &c.DB.Resilience.RetryBackoff)
+	parse("STORAGE_DB_BREAKER_FAILURES", func(v string) (err error) {
+		c.DB.Resilience.BreakerFailures, err = strconv.Atoi(v)
+		return err
+	})
+	duration("STORAGE_DB_BREAKER_COOLDOWN", &c.DB.Resilience.BreakerCooldown)
+
+	str("STORAGE_FOLDER", &c.Storage.Folder)
+	parse("STORAGE_READYZ_MIN_FREE_BYTES", func(v string) (err error) {
+		c.Storage.MinFreeBytes, err = strconv.ParseUint(v, 10, 64)
+		return err
+	})
+	parse("STORAGE_SEARCH_CONTENT_BYTES", func(v string) (err error) {
+		c.Storage.SearchContentBytes, err = strconv.ParseInt(v, 10, 64)
+		return err
+	})
+
+	parse("STORAGE_API_KEYS", func(v string) error {
+		c.Auth.APIKeys = ParseAPIKeys(v)
+		return nil
+	})
+	str("STORAGE_API_KEYS_FILE", &c.Auth.APIKeysFile)
+	str("STORAGE_PRESIGN_SECRET", &c.Auth.PresignSecret)
+	str("STORAGE_PRESIGN_SECRET_FILE", &c.Auth.PresignSecretFile)
+	parse("STORAGE_ADMINS", func(v string) error {
+		c.Auth.Admins = ParsePrincipals(v)
+		return nil
+	})
+
+	parse("STORAGE_TENANT_QUOTAS", func(v string) (err error) {
+		c.Limits.Quotas, err = ParseQuotas(v)
+		return err
+	})
+	parse("STORAGE_RATE_LIMIT_RPS", func(v string) (err error) {
+		c.Limits.RateLimit.RequestsPerSecond, err = strconv.ParseFloat(v, 64)
+		return err
+	})
+	parse("STORAGE_RATE_LIMIT_BURST", func(v string) (err error) {
+		c.Limits.RateLimit.Burst, err = strconv.Atoi(v)
+		return err
+	})
+
+	str("STORAGE_LOG_FORMAT", &c.Logging.Format)
+	for _, layer := range LogLayers {
+		env := "STORAGE_" + strings.ToUpper(layer) + "_LOG_LEVEL"
+		if layer == "database" {
+			env = "STORAGE_DB_LOG_LEVEL"
+		}
+		if v := os.Getenv(env); v != "" {
+			c.Logging.Levels[layer] = v
+		}
+	}
+
+	str("STORAGE_OTLP_ENDPOINT", &c.Tracing.OTLPEndpoint)
+	parse("STORAGE_OTLP_INSECURE", func(v string) (err error) {
+		c.Tracing.OTLPInsecure, err = strconv.ParseBool(v)
+		return err
+	})
+	parse("STORAGE_TRACE_SAMPLE_RATIO", func(v string) (err error) {
+		c.Tracing.SampleRatio, err = strconv.ParseFloat(v, 64)
+		return err
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// ReadSecretFiles reads the secrets whose file is set. A secret can't be set both directly and through a file
+func (c *Config) ReadSecretFiles() error {
+	var errs []string
+	secret := func(name string, file string, dst *string) {
+		if file == "" {
+			return
+		}
+		if *dst != "" {
+			errs = append(errs, name+": set both directly and through a file")
+			return
+		}
+		value, err := ReadSecretFile(file)
+		if err != nil {
+			errs = append(errs, name+": "+err.Error())
+		}
+		*dst = value
+	}
+
+	secret("db.user", c.DB.UserFile, &c.DB.User)
+	secret("db.password", c.DB.PasswordFile, &c.DB.Password)
+	secret("auth.presignSecret", c.Auth.PresignSecretFile, &c.Auth.PresignSecret)
+	if c.Auth.APIKeysFile != "" {
+		var keys string
+		secret("auth.apiKeys", c.Auth.APIKeysFile, &keys)
+		if len(c.Auth.APIKeys) > 0 {
+			errs = append(errs, "auth.apiKeys: set both directly and through a file")
+		}
+		c.Auth.APIKeys = ParseAPIKeys(keys)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot read secrets:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// ReadSecretFile reads a secret from a file, e.g. a mounted Kubernetes secret.
+// Trailing newlines are trimmed
+func ReadSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Validate checks the whole configuration, reporting all the invalid settings at once
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port < 65536, "server.port: %q is not a valid port", c.Server.Port)
+	for _, d := range []struct {
+		name  string
+		value Duration
+	}{
+		{"server.readHeaderTimeout", c.Server.ReadHeaderTimeout},
+		{"server.readTimeout", c.Server.ReadTimeout},
+		{"server.writeTimeout", c.Server.WriteTimeout},
+		{"server.idleTimeout", c.Server.IdleTimeout},
+		{"server.drainDelay", c.Server.DrainDelay},
+		{"server.shutdownTimeout", c.Server.ShutdownTimeout},
+		{"db.resilience.timeout", c.DB.Resilience.Timeout},
+		{"db.resilience.retryBackoff", c.DB.Resilience.RetryBackoff},
+		{"db.resilience.breakerCooldown", c.DB.Resilience.BreakerCooldown},
+	} {
+		check(d.value >= 0, "%s: must not be negative", d.name)
+	}
+	tls := c.Server.TLS
+	check((tls.CertFile == "") == (tls.KeyFile == ""), "server.tls: certFile and keyFile must be set together")
+	check(tls.ClientCAFile == "" || tls.CertFile != "", "server.tls.clientCAFile: requires certFile and keyFile")
+	check(tls.ClientAuth == "optional" || tls.ClientAuth == "require", "server.tls.clientAuth: %q must be optional or require", tls.ClientAuth)
+
+	check(contains(DBDrivers, c.DB.Driver), "db.driver: %q is not supported. Supported drivers: %s", c.DB.Driver, strings.Join(DBDrivers, ", "))
+	check(c.DB.embedded() || c.DB.Host != "", "db.host: must be set")
+	check(c.DB.Database != "", "db.database: must be set")
+	_, ok := mysqlTLS[c.DB.SSLMode]
+	check(c.DB.Driver != "mysql" || ok, "db.sslMode: %q is not supported by mysql", c.DB.SSLMode)
+	check(c.DB.Resilience.Retries >= 0, "db.resilience.retries: must not be negative")
+	check(c.DB.Resilience.BreakerFailures >= 0, "db.resilience.breakerFailures: must not be negative")
+
+	check(c.Storage.Folder != "", "storage.folder: must be set")
+	check(c.Storage.SearchContentBytes >= 0, "storage.searchContentBytes: must not be negative")
+
+	for key, principal := range c.Auth.APIKeys {
+		check(key != "" && principal.Name != "", "auth.apiKeys: every key must map to a principal name")
+	}
+	for _, admin := range c.Auth.Admins {
+		check(admin.Name != "" && admin.Name != AnonymousPrincipal, "auth.admins: %q is not a valid principal name", admin.Name)
+	}
+
+	for tenant, quota := range c.Limits.Quotas {
+		check(quota.Bytes >= 0 && quota.Objects >= 0, "limits.quotas.%s: must not be negative", tenant)
+	}
+	rl := c.Limits.RateLimit
+	check(rl.RequestsPerSecond >= 0, "limits.rateLimit.requestsPerSecond: must not be negative")
+	check(rl.RequestsPerSecond == 0 || rl.Burst >= 1, "limits.rateLimit.burst: must be at least 1")
+
+	check(c.Logging.Format == "text" || c.Logging.Format == "json", "logging.format: %q must be text or json", c.Logging.Format)
+	for layer, level := range c.Logging.Levels {
+		check(contains(LogLayers, layer), "logging.levels: unknown layer %q. Layers: %s", layer, strings.Join(LogLayers, ", "))
+		_, err := LogLevelMapping(level)
+		check(err == nil, "logging.levels.%s: %q must be DEBUG, INFO, WARN, ERROR or FATAL", layer, level)
+	}
+
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sampleRatio: must be between 0 and 1")
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// Placeholder of redacted secrets
+const Redacted = "REDACTED"
+
+// Redacted returns a copy of the configuration without secrets, safe to be logged
+func (c *Config) Redacted() *Config {
+	ret := *c
+	if ret.DB.Password != "" {
+		ret.DB.Password = Redacted
+	}
+	if ret.Auth.PresignSecret != "" {
+		ret.Auth.PresignSecret = Redacted
+	}
+	// Keys are secrets, principals are not
+	ret.Auth.APIKeys = make(map[string]Principal, len(c.Auth.APIKeys))
+	i := 0
+	for _, principal := range c.Auth.APIKeys {
+		i++
+		ret.Auth.APIKeys[Redacted+"-"+strconv.Itoa(i)] = principal
+	}
+	return &ret
+}
+
+// Dump returns the configuration in YAML, with secrets redacted
+func (c *Config) Dump() string {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
+
+// DSN returns the connection string of the database. It contains the password: log RedactedDSN instead
+func (c DBConfig) DSN() string {
+	switch {
+	case c.embedded():
+		return c.Database
+	case c.Driver == "mysql":
+		return c.mysqlDSN(c.Password)
+	}
+	return c.url().String()
+}
+
+// RedactedDSN returns the connection string of the database without the password
+func (c DBConfig) RedactedDSN() string {
+	switch {
+	case c.embedded():
+		return c.Database
+	case c.Driver == "mysql":
+		return c.mysqlDSN("xxxxx")
+	}
+	return c.url().Redacted()
+}
+
+// Redact removes the password from s, e.g. an error returned by the driver, which may quote the DSN
+func (c DBConfig) Redact(s string) string {
+	if c.Password == "" {
+		return s
+	}
+	s = strings.ReplaceAll(s, url.UserPassword(c.User, c.Password).String(), url.UserPassword(c.User, "xxxxx").String())
+	return strings.ReplaceAll(s, c.Password, "xxxxx")
+}
+
+func (c DBConfig) url() *url.URL {
+	return &url.URL{
+		Scheme:   "postgresql",
+		User:     url.UserPassword(c.User, c.Password),
+		Host:     net.JoinHostPort(c.Host, c.port()),
+		Path:     "/" + c.Database,
+		RawQuery: "sslmode=" + url.QueryEscape(c.SSLMode),
+	}
+}
+
+// mysqlDSN returns the connection string in the format of the MySQL driver, user:password@tcp(host:port)/database.
+// The password can contain any character, the driver splits at the last @
+func (c DBConfig) mysqlDSN(password string) string {
+	params := url.Values{}
+	params.Set("tls", mysqlTLS[c.SSLMode])
+	return c.User + ":" + password + "@tcp(" + net.JoinHostPort(c.Host, c.port()) + ")/" + c.Database + "?" + params.Encode()
+}
+
+// TLS settings of the MySQL driver for the postgres SSL modes
+var mysqlTLS = map[string]string{
+	"disable":     "false",
+	"allow":       "preferred",
+	"prefer":      "preferred",
+	"require":     "skip-verify",
+	"verify-ca":   "true",
+	"verify-full": "true",
+}
+
+// embedded tells whether the database is a file opened by the process, whose path is Database
+func (c DBConfig) embedded() bool {
+	return c.Driver == "sqlite" || c.Driver == "bbolt"
+}
+
+func (c DBConfig) port() string {
+	if c.Port != "" {
+		return c.Port
+	}
+	return DBPorts[c.Driver]
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Unit tests for the configuration.
+
+const testConfig = `
+server:
+  port: "9000"
+  readTimeout: 1m
+db:
+  host: db.local
+  database: metadata
+  password: hunter2
+auth:
+  apiKeys:
+    k1: {name: alice, tenant: acme}
+logging:
+  levels:
+    service: DEBUG
+`
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+//
+// This test loads a file, overriding some settings through the environment.
+// Pass if file and environment override the defaults, the environment overrides the file.
+func TestLoadConfig(t *testing.T) {
+
+	t.Setenv("STORAGE_HTTP_PORT", "9001")
+	config, err := LoadConfig(writeConfig(t, testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Server.Port != "9001" {
+		t.Errorf("Expected port from environment, got %s", config.Server.Port)
+	}
+	if time.Duration(config.Server.ReadTimeout) != time.Minute {
+		t.Errorf("Expected read timeout from file, got %s", time.Duration(config.Server.ReadTimeout))
+	}
+	if config.Logging.Levels["service"] != "DEBUG" || config.Logging.Levels["main"] != "INFO" {
+		t.Errorf("Expected levels from file merged with defaults, got %v", config.Logging.Levels)
+	}
+	if config.Auth.APIKeys["k1"].Tenant != "acme" {
+		t.Errorf("Expected API key from file, got %v", config.Auth.APIKeys)
+	}
+
+	dump := config.Dump()
+	if strings.Contains(dump, "hunter2") || strings.Contains(dump, "k1") {
+		t.Error("Secrets not redacted:\n" + dump)
+	}
+}
+
+//
+// This test loads invalid configurations.
+// Pass if every invalid setting is reported.
+func TestValidateConfig(t *testing.T) {
+
+	_, err := LoadConfig(writeConfig(t, testConfig+`
+  format: xml
+tracing:
+  sampleRatio: 2
+`))
+	if err == nil {
+		t.Fatal("Invalid configuration accepted")
+	}
+	for _, field := range []string{"logging.format", "tracing.sampleRatio"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("%s not reported: %s", field, err.Error())
+		}
+	}
+
+	if _, err := LoadConfig(writeConfig(t, testConfig+"unknown: 1\n")); err == nil {
+		t.Error("Unknown field accepted")
+	}
+}
+
+//
+// This test reads the database password from a file.
+// Pass if the password is read, and never appears in the redacted DSN nor in redacted messages.
+func TestSecretFiles(t *testing.T) {
+
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("p@ss:word\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STORAGE_DB_PASSWORD_FILE", passwordFile)
+	_, err := LoadConfig(writeConfig(t, testConfig))
+	if err == nil || !strings.Contains(err.Error(), "db.password") {
+		t.Errorf("Password set both directly and through a file: expected error, got %v", err)
+	}
+
+	config, err := LoadConfig(writeConfig(t, strings.Replace(testConfig, "password: hunter2", "user: admin", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DB.Password != "p@ss:word" {
+		t.Errorf("Expected password from file, got %q", config.DB.Password)
+	}
+	for _, s := range []string{config.DB.RedactedDSN(), config.DB.Redact("cannot connect to " + config.DB.DSN())} {
+		if strings.Contains(s, "ss:word") || strings.Contains(s, "ss%3Aword") {
+			t.Error("Password not redacted: " + s)
+		}
+	}
+}
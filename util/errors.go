@@ -15,6 +15,15 @@ func (e *ResponseError) Error() string {
 // HTTP ERRORS
 // ===========
 
+//===========
+// 3xx errors
+//===========
+
+// 304 Not modified. Not a failure: the cached copy of the client is fresh, and the response has no body
+type NotModifiedError struct{ Message string }
+
+func (e NotModifiedError) Error() string { return "Not modified: " + e.Message }
+
 //===========
 // 4xx errors
 //===========
@@ -51,6 +60,11 @@ type ConflictError struct{ Message string }
 
 func (e ConflictError) Error() string { return "Conflict : " + e.Message }
 
+// 412 Precondition failed
+type PreconditionFailedError struct{ Message string }
+
+func (e PreconditionFailedError) Error() string { return "Precondition failed: " + e.Message }
+
 // 413 Payload too large
 type PayloadTooLargeError struct{ Message string }
 
@@ -81,3 +95,38 @@ func (e GatewayTimeoutError) Error() string { return "Gateway timeout: " + e.Mes
 func ErrorIs(err error, target error) bool {
 	return reflect.TypeOf(err) == reflect.TypeOf(target)
 }
+
+// StatusCode maps the error types above to their HTTP status code.
+// Returns 200 if err is nil, 500 if err is not one of the types above
+func StatusCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 200
+	case NotModifiedError:
+		return 304
+	case BadRequestError:
+		return 400
+	case UnauthorizedError:
+		return 401
+	case ForbiddenError:
+		return 403
+	case NotFoundError:
+		return 404
+	case MethodNotAllowedError:
+		return 405
+	case ConflictError:
+		return 409
+	case PreconditionFailedError:
+		return 412
+	case PayloadTooLargeError:
+		return 413
+	case UnsupportedMediaTypeError:
+		return 415
+	case GatewayTimeoutError:
+		return 504
+	case *ResponseError:
+		return e.StatusCode
+	default:
+		return 500
+	}
+}
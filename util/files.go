@@ -0,0 +1,57 @@
+package util
+
+import (
+	"os"
+	"time"
+)
+
+// FileWatcher detects changes of a set of files, comparing their modification times.
+// Mounted Kubernetes secrets are updated by swapping a symlink, which changes the modification time too
+type FileWatcher struct {
+	files    []string
+	modTimes []time.Time
+}
+
+// NewFileWatcher returns a watcher of files. Empty paths are ignored
+func NewFileWatcher(files ...string) *FileWatcher {
+	w := &FileWatcher{}
+	for _, file := range files {
+		if file != "" {
+			w.files = append(w.files, file)
+		}
+	}
+	w.modTimes, _ = w.stat()
+	return w
+}
+
+// Empty returns true if there are no files to watch
+func (w *FileWatcher) Empty() bool {
+	return len(w.files) == 0
+}
+
+// Changed returns true if any file changed since the last call. Files that can't be read are reported as errors,
+// and considered unchanged
+func (w *FileWatcher) Changed() (bool, error) {
+	modTimes, err := w.stat()
+	if err != nil {
+		return false, err
+	}
+	changed := len(modTimes) != len(w.modTimes)
+	for i := 0; !changed && i < len(modTimes); i++ {
+		changed = !modTimes[i].Equal(w.modTimes[i])
+	}
+	w.modTimes = modTimes
+	return changed, nil
+}
+
+func (w *FileWatcher) stat() ([]time.Time, error) {
+	ret := make([]time.Time, 0, len(w.files))
+	for _, file := range w.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, info.ModTime())
+	}
+	return ret, nil
+}
@@ -0,0 +1,111 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Sort keys of object listings
+const (
+	SortByName    = "name"
+	SortByCreated = "created"
+	SortBySize    = "size"
+)
+
+// ValidSort returns true if sort is one of the SortBy constants
+func ValidSort(sort string) bool {
+	return sort == SortByName || sort == SortByCreated || sort == SortBySize
+}
+
+// ListQuery selects, sorts and pages the objects of a tenant. Empty fields match everything
+type ListQuery struct {
+	// Objects whose name starts with Prefix
+	Prefix string
+	// Objects of the bucket. Nil matches every bucket, empty the objects without bucket
+	Bucket *string
+	// Rolls the names having Delimiter after Prefix up into Listing.Prefixes. Done by the service, above the database
+	Delimiter string
+	// Size range, bounds included
+	MinSize *int64
+	MaxSize *int64
+	// Upload time range, from included, to excluded. RFC3339 timestamps
+	CreatedFrom string
+	CreatedTo   string
+	ContentType string
+	// Objects carrying all of Tags
+	Tags map[string]string
+	// One of the SortBy constants. Ties are broken by uuid
+	Sort  string
+	Desc  bool
+	Limit uint
+	// Position the page starts after. Nil for the first page
+	After *ListCursor
+}
+
+// Listing is a page of a listing
+type Listing struct {
+	Files []Row
+	// With a delimiter, the names of the other objects up to the delimiter following the prefix, once each: the folders
+	Prefixes []string
+	// Continuation token of the next page. Empty on the last one
+	NextCursor string
+}
+
+// ListCursor is a position in a listing: the sort key and uuid of the last object returned.
+// Clients get it as an opaque continuation token
+type ListCursor struct {
+	Sort    string `json:"s"`
+	Desc    bool   `json:"d,omitempty"`
+	Name    string `json:"n,omitempty"`
+	Created string `json:"c,omitempty"`
+	Size    int64  `json:"z,omitempty"`
+	Uuid    string `json:"u"`
+}
+
+// CursorAfter returns the position of row in the listing sorted as query
+func CursorAfter(query ListQuery, row Row) ListCursor {
+	cursor := ListCursor{Sort: query.Sort, Desc: query.Desc, Uuid: row.Uuid}
+	switch query.Sort {
+	case SortByCreated:
+		cursor.Created = row.CreatedAt
+	case SortBySize:
+		cursor.Size = row.Size
+	default:
+		cursor.Name = row.FileName
+	}
+	return cursor
+}
+
+// Key returns the sort key of the cursor
+func (c ListCursor) Key() any {
+	switch c.Sort {
+	case SortByCreated:
+		return c.Created
+	case SortBySize:
+		return c.Size
+	default:
+		return c.Name
+	}
+}
+
+// Token encodes the cursor as a continuation token
+func (c ListCursor) Token() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// ParseListCursor decodes a continuation token returned by Token
+func ParseListCursor(token string) (*ListCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor ListCursor
+	if err := json.Unmarshal(b, &cursor); err != nil || cursor.Uuid == "" || !ValidSort(cursor.Sort) {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
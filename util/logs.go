@@ -1,10 +1,13 @@
 package util
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Wrapper around logrus.Logger and logrus.Entry.
@@ -42,6 +45,58 @@ func (logger *Logger) SetDefaultFields(fields logrus.Fields) {
 	logger.fields = fields
 }
 
+// SetFormat sets the output format: "text" (default) or "json", one object per line
+func (logger *Logger) SetFormat(format string) error {
+	switch format {
+	case "text":
+		logger.logger.SetFormatter(&logrus.TextFormatter{
+			TimestampFormat: "2006-01-02 15:04:05",
+			FullTimestamp:   true,
+		})
+	case "json":
+		logger.logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+		})
+	default:
+		return fmt.Errorf("invalid log format %s", format)
+	}
+	return nil
+}
+
+// WithContext returns a logger sharing output and level with this one,
+// whose entries also carry the request ID and the trace and span IDs found in ctx, if any
+func (logger *Logger) WithContext(ctx context.Context) *Logger {
+	requestID := RequestIDFromContext(ctx)
+	spanContext := trace.SpanContextFromContext(ctx)
+	if requestID == "" && !spanContext.IsValid() {
+		return logger
+	}
+	fields := make(logrus.Fields, len(logger.fields)+3)
+	for k, v := range logger.fields {
+		fields[k] = v
+	}
+	if requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if spanContext.IsValid() {
+		fields["trace_id"] = spanContext.TraceID().String()
+		fields["span_id"] = spanContext.SpanID().String()
+	}
+	return &Logger{logger: logger.logger, fields: fields}
+}
+
+// WithFields returns a logger sharing output and level with this one, whose entries also carry fields
+func (logger *Logger) WithFields(fields logrus.Fields) *Logger {
+	merged := make(logrus.Fields, len(logger.fields)+len(fields))
+	for k, v := range logger.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{logger: logger.logger, fields: merged}
+}
+
 func (logger *Logger) Debug(args ...interface{}) {
 	logger.logger.WithFields(logger.fields).Debug(args...)
 }
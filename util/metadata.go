@@ -1,6 +1,85 @@
 package util
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type Metadata struct {
-	Name string
-	Size int64
+	Name        string
+	Size        int64
+	Bucket      string
+	ContentType string
+	Tags        map[string]string
+}
+
+// Limits of the tags of an object
+const (
+	MaxTags           = 10
+	MaxTagKeyLength   = 128
+	MaxTagValueLength = 256
+)
+
+// ParseTags parses comma separated key=value pairs, e.g. "env=prod,team=web".
+// Keys can't contain '=' nor ',', values can't contain ','. An empty string has no tags
+func ParseTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(pair, "=")
+		switch {
+		case key == "":
+			return nil, fmt.Errorf("invalid tag %q: empty key", pair)
+		case len(key) > MaxTagKeyLength:
+			return nil, fmt.Errorf("invalid tag %q: key longer than %d bytes", pair, MaxTagKeyLength)
+		case len(value) > MaxTagValueLength:
+			return nil, fmt.Errorf("invalid tag %q: value longer than %d bytes", pair, MaxTagValueLength)
+		}
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", key)
+		}
+		tags[key] = value
+	}
+	if len(tags) > MaxTags {
+		return nil, fmt.Errorf("too many tags: at most %d", MaxTags)
+	}
+	return tags, nil
+}
+
+// ValidateTags checks tags not parsed by ParseTags, e.g. decoded from JSON, against the same limits
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("too many tags: at most %d", MaxTags)
+	}
+	for key, value := range tags {
+		switch {
+		case key == "":
+			return errors.New("invalid tag: empty key")
+		case strings.ContainsAny(key, "=,"):
+			return fmt.Errorf("invalid tag %q: key contains '=' or ','", key)
+		case strings.Contains(value, ","):
+			return fmt.Errorf("invalid tag %q: value contains ','", key)
+		case len(key) > MaxTagKeyLength:
+			return fmt.Errorf("invalid tag %q: key longer than %d bytes", key, MaxTagKeyLength)
+		case len(value) > MaxTagValueLength:
+			return fmt.Errorf("invalid tag %q: value longer than %d bytes", key, MaxTagValueLength)
+		}
+	}
+	return nil
+}
+
+// EqualTags returns true if a and b have the same tags. Nil has none
+func EqualTags(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
 }
@@ -1,6 +1,19 @@
 package util
 
-import "os"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"time"
+)
+
+// Layout of the timestamps stored by the service. Fixed width, so that timestamps can be compared as strings
+const TimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// FormatTime formats t as a stored timestamp
+func FormatTime(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
 
 func EnvString(env, fallback string) string {
 	e := os.Getenv(env)
@@ -9,3 +22,12 @@ func EnvString(env, fallback string) string {
 	}
 	return e
 }
+
+// RandomString returns n random bytes, hex encoded
+func RandomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Quota of a tenant. Zero values mean no limit
+type Quota struct {
+	Bytes   int64 `json:"bytes" yaml:"bytes"`
+	Objects int64 `json:"objects" yaml:"objects"`
+}
+
+// Usage of a tenant
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// Quotas is the tenant -> quota map. Safe for concurrent use, so it can be replaced at runtime
+type Quotas struct {
+	mu     sync.RWMutex
+	quotas map[string]Quota
+}
+
+func NewQuotas(quotas map[string]Quota) *Quotas {
+	return &Quotas{quotas: quotas}
+}
+
+// Get returns the quota of the tenant. Tenants without quota are unlimited
+func (q *Quotas) Get(tenant string) (Quota, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	quota, ok := q.quotas[tenant]
+	return quota, ok
+}
+
+// Set replaces all the quotas
+func (q *Quotas) Set(quotas map[string]Quota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.quotas = quotas
+}
+
+// ParseQuotas parses a list of quotas in the form "tenant1=bytes:objects,tenant2=bytes:objects".
+// 0 means no limit
+func ParseQuotas(s string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, limits, found := strings.Cut(entry, "=")
+		bytes, objects, found2 := strings.Cut(limits, ":")
+		if !found || !found2 {
+			return nil, fmt.Errorf("invalid quota %s: expected tenant=bytes:objects", entry)
+		}
+		var quota Quota
+		var err error
+		if quota.Bytes, err = strconv.ParseInt(bytes, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid quota %s: %w", entry, err)
+		}
+		if quota.Objects, err = strconv.ParseInt(objects, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid quota %s: %w", entry, err)
+		}
+		quotas[tenant] = quota
+	}
+	return quotas, nil
+}
@@ -0,0 +1,503 @@
+package util
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fields of search queries. Name, tag and content are indexed as words, type and bucket are matched as a whole
+const (
+	SearchName    = "name"
+	SearchTag     = "tag"
+	SearchContent = "content"
+	SearchType    = "type"
+	SearchBucket  = "bucket"
+)
+
+// Operators of search expressions
+const (
+	SearchAnd   = "and"
+	SearchOr    = "or"
+	SearchNot   = "not"
+	SearchMatch = "match"
+)
+
+// Limits of the search index and of search queries
+const (
+	// Longer words are truncated, in the index and in queries alike
+	MaxTermLength = 64
+	// Distinct words of the content of an object indexed, the first ones found
+	MaxContentTerms = 2000
+	MaxQueryLength  = 1024
+	MaxQueryTerms   = 32
+)
+
+// Weight of an occurrence of a word in each field: a match in the name counts more than in tags,
+// and in tags more than in the content
+var searchWeights = map[string]int64{SearchName: 8, SearchTag: 4, SearchContent: 1}
+
+// SearchTerm is a word of an object in the search index
+type SearchTerm struct {
+	Field string `json:"f"`
+	Term  string `json:"t"`
+	// Weight of the field, times the occurrences of the word
+	Weight int64 `json:"w"`
+}
+
+// Tokenize splits text into lowercase words of letters and digits, truncated to MaxTermLength bytes
+func Tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, word := range words {
+		if len(word) > MaxTermLength {
+			end := MaxTermLength
+			for !utf8.RuneStart(word[end]) {
+				end--
+			}
+			words[i] = word[:end]
+		}
+	}
+	return words
+}
+
+// IndexTerms returns the words of name and tags of row, keys and values, sorted by field and word
+func IndexTerms(row Row) []SearchTerm {
+	terms := newTermSet()
+	terms.add(SearchName, Tokenize(row.FileName))
+	for key, value := range row.Tags {
+		terms.add(SearchTag, Tokenize(key))
+		terms.add(SearchTag, Tokenize(value))
+	}
+	return terms.sorted()
+}
+
+// ContentTerms returns the words of the text content of an object, at most MaxContentTerms, sorted
+func ContentTerms(text string) []SearchTerm {
+	terms := newTermSet()
+	for _, word := range Tokenize(text) {
+		if len(terms) == MaxContentTerms && terms[termKey{SearchContent, word}] == 0 {
+			continue
+		}
+		terms.add(SearchContent, []string{word})
+	}
+	return terms.sorted()
+}
+
+type termKey struct{ field, term string }
+
+// termSet sums the weights of the occurrences of every word of every field
+type termSet map[termKey]int64
+
+func newTermSet() termSet { return make(termSet) }
+
+func (s termSet) add(field string, words []string) {
+	for _, word := range words {
+		s[termKey{field, word}] += searchWeights[field]
+	}
+}
+
+func (s termSet) sorted() []SearchTerm {
+	terms := make([]SearchTerm, 0, len(s))
+	for key, weight := range s {
+		terms = append(terms, SearchTerm{Field: key.field, Term: key.term, Weight: weight})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].Field != terms[j].Field {
+			return terms[i].Field < terms[j].Field
+		}
+		return terms[i].Term < terms[j].Term
+	})
+	return terms
+}
+
+// SearchExpr is a boolean search query, parsed by ParseSearchQuery
+type SearchExpr struct {
+	// One of the Search operators
+	Op string
+	// Of and, or, not
+	Operands []SearchExpr
+	// Of match: one of the Search fields, empty for name, tags and content
+	Field string
+	// Of tag pairs, e.g. tag:env=prod, matched exactly
+	Key string
+	// Word, or content type or bucket
+	Value string
+	// Matches the values starting with Value
+	Prefix bool
+}
+
+// Text returns true if the expression matches words of the index
+func (e SearchExpr) Text() bool {
+	return e.Op == SearchMatch && e.Key == "" && e.Field != SearchType && e.Field != SearchBucket
+}
+
+// Match returns true if row, whose words in the index are terms, matches the expression
+func (e SearchExpr) Match(row Row, terms []SearchTerm) bool {
+	switch e.Op {
+	case SearchAnd:
+		for _, operand := range e.Operands {
+			if !operand.Match(row, terms) {
+				return false
+			}
+		}
+		return true
+	case SearchOr:
+		for _, operand := range e.Operands {
+			if operand.Match(row, terms) {
+				return true
+			}
+		}
+		return false
+	case SearchNot:
+		return !e.Operands[0].Match(row, terms)
+	}
+	switch {
+	case e.Key != "":
+		value, ok := row.Tags[e.Key]
+		return ok && value == e.Value
+	case e.Field == SearchType:
+		return e.matchValue(row.ContentType)
+	case e.Field == SearchBucket:
+		return e.matchValue(row.Bucket)
+	}
+	for _, term := range terms {
+		if e.MatchTerm(term) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTerm returns true if the text expression matches a word of the index
+func (e SearchExpr) MatchTerm(term SearchTerm) bool {
+	return (e.Field == "" || e.Field == term.Field) && e.matchValue(term.Term)
+}
+
+func (e SearchExpr) matchValue(value string) bool {
+	if e.Prefix {
+		return strings.HasPrefix(value, e.Value)
+	}
+	return value == e.Value
+}
+
+// Scored returns the text expressions that rank the results: the ones not negated
+func (e SearchExpr) Scored() []SearchExpr {
+	switch e.Op {
+	case SearchAnd, SearchOr:
+		var scored []SearchExpr
+		for _, operand := range e.Operands {
+			scored = append(scored, operand.Scored()...)
+		}
+		return scored
+	case SearchMatch:
+		if e.Text() {
+			return []SearchExpr{e}
+		}
+	}
+	return nil
+}
+
+// Score ranks an object, whose words in the index are terms: the weights of the words matched by the scored expressions
+func (e SearchExpr) Score(terms []SearchTerm) int64 {
+	scored := e.Scored()
+	var score int64
+	for _, term := range terms {
+		for _, expr := range scored {
+			if expr.MatchTerm(term) {
+				score += term.Weight
+				break
+			}
+		}
+	}
+	return score
+}
+
+// ParseSearchQuery parses a search query. Words are ANDed, unless joined by OR; NOT or a leading '-' negate,
+// parentheses group. A word matches name, tags and content, unless qualified by a field:
+// name:, tag:, content:, type: and bucket:, e.g. "report -draft type:application/pdf".
+// tag:key=value matches a tag exactly. A trailing '*' matches the words, types or buckets starting with the value.
+// Double quotes keep spaces and parentheses in a value
+func ParseSearchQuery(query string) (SearchExpr, error) {
+	if len(query) > MaxQueryLength {
+		return SearchExpr{}, fmt.Errorf("query longer than %d bytes", MaxQueryLength)
+	}
+	tokens, err := lexSearchQuery(query)
+	if err != nil {
+		return SearchExpr{}, err
+	}
+	if len(tokens) == 0 {
+		return SearchExpr{}, errors.New("empty query")
+	}
+	p := &searchParser{tokens: tokens}
+	expr, err := p.or()
+	if err != nil {
+		return SearchExpr{}, err
+	}
+	if p.pos < len(p.tokens) {
+		return SearchExpr{}, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if p.terms > MaxQueryTerms {
+		return SearchExpr{}, fmt.Errorf("too many terms: at most %d", MaxQueryTerms)
+	}
+	return expr, nil
+}
+
+type searchToken struct {
+	text string
+	// Operators and parentheses are never quoted
+	quoted bool
+	// Length of the field qualifier, colon included, 0 if none
+	field  int
+	prefix bool
+}
+
+func lexSearchQuery(query string) ([]searchToken, error) {
+	var tokens []searchToken
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '(' || c == ')':
+			tokens = append(tokens, searchToken{text: string(c)})
+			i++
+			continue
+		}
+		var token searchToken
+		var text strings.Builder
+		inQuotes := false
+		for ; i < len(query); i++ {
+			c := query[i]
+			if !inQuotes && (c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '(' || c == ')') {
+				break
+			}
+			switch {
+			case c == '"':
+				inQuotes, token.quoted = !inQuotes, true
+			case !inQuotes && c == ':' && token.field == 0 && !token.quoted:
+				text.WriteByte(c)
+				token.field = text.Len()
+			default:
+				text.WriteByte(c)
+			}
+		}
+		if inQuotes {
+			return nil, errors.New("unterminated quotes")
+		}
+		token.text = text.String()
+		// A trailing '*' outside quotes
+		if strings.HasSuffix(query[:i], "*") && strings.HasSuffix(token.text, "*") {
+			token.text, token.prefix = strings.TrimSuffix(token.text, "*"), true
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+	// Match expressions parsed
+	terms int
+}
+
+// operator returns true if the next token is the unquoted op, consuming it
+func (p *searchParser) operator(op string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && !p.tokens[p.pos].prefix && p.tokens[p.pos].text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *searchParser) or() (SearchExpr, error) {
+	expr, err := p.and()
+	if err != nil {
+		return SearchExpr{}, err
+	}
+	operands := []SearchExpr{expr}
+	for p.operator("OR") {
+		expr, err := p.and()
+		if err != nil {
+			return SearchExpr{}, err
+		}
+		operands = append(operands, expr)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return SearchExpr{Op: SearchOr, Operands: operands}, nil
+}
+
+func (p *searchParser) and() (SearchExpr, error) {
+	var operands []SearchExpr
+	for p.pos < len(p.tokens) {
+		and := len(operands) > 0 && p.operator("AND")
+		if and && p.pos == len(p.tokens) {
+			return SearchExpr{}, errors.New("AND without operand")
+		}
+		if next := p.tokens[p.pos]; !next.quoted && !next.prefix && (next.text == ")" || next.text == "OR") {
+			if and {
+				return SearchExpr{}, errors.New("AND without operand")
+			}
+			break
+		}
+		expr, err := p.unary()
+		if err != nil {
+			return SearchExpr{}, err
+		}
+		operands = append(operands, expr)
+	}
+	switch len(operands) {
+	case 0:
+		return SearchExpr{}, errors.New("missing operand")
+	case 1:
+		return operands[0], nil
+	}
+	return SearchExpr{Op: SearchAnd, Operands: operands}, nil
+}
+
+func (p *searchParser) unary() (SearchExpr, error) {
+	token := p.tokens[p.pos]
+	switch {
+	case p.operator("NOT"), p.operator("-"):
+		if p.pos == len(p.tokens) {
+			return SearchExpr{}, errors.New("NOT without operand")
+		}
+		expr, err := p.unary()
+		if err != nil {
+			return SearchExpr{}, err
+		}
+		return SearchExpr{Op: SearchNot, Operands: []SearchExpr{expr}}, nil
+	case p.operator("("):
+		expr, err := p.or()
+		if err != nil {
+			return SearchExpr{}, err
+		}
+		if !p.operator(")") {
+			return SearchExpr{}, errors.New("missing )")
+		}
+		return expr, nil
+	case !token.quoted && len(token.text) > 1 && token.text[0] == '-':
+		p.tokens[p.pos].text = token.text[1:]
+		if token.field > 0 {
+			p.tokens[p.pos].field--
+		}
+		expr, err := p.unary()
+		if err != nil {
+			return SearchExpr{}, err
+		}
+		return SearchExpr{Op: SearchNot, Operands: []SearchExpr{expr}}, nil
+	}
+	p.pos++
+	return p.match(token)
+}
+
+// match parses a word, optionally qualified by a field
+func (p *searchParser) match(token searchToken) (SearchExpr, error) {
+	field, value := "", token.text
+	if token.field > 0 {
+		switch name := token.text[:token.field-1]; name {
+		case SearchName, SearchTag, SearchContent, SearchType, SearchBucket:
+			field, value = name, token.text[token.field:]
+		}
+	}
+
+	switch {
+	case field == SearchType || field == SearchBucket:
+		if value == "" && !token.quoted {
+			return SearchExpr{}, fmt.Errorf("missing value of %s", field)
+		}
+		p.terms++
+		return SearchExpr{Op: SearchMatch, Field: field, Value: value, Prefix: token.prefix}, nil
+	case field == SearchTag && strings.Contains(value, "="):
+		if token.prefix {
+			return SearchExpr{}, fmt.Errorf("tag pair %s can't be a prefix", value)
+		}
+		key, value, _ := strings.Cut(value, "=")
+		p.terms++
+		return SearchExpr{Op: SearchMatch, Field: field, Key: key, Value: value}, nil
+	}
+
+	words := Tokenize(value)
+	if len(words) == 0 {
+		return SearchExpr{}, fmt.Errorf("no words in %q", token.text)
+	}
+	p.terms += len(words)
+	operands := make([]SearchExpr, len(words))
+	for i, word := range words {
+		operands[i] = SearchExpr{Op: SearchMatch, Field: field, Value: word}
+	}
+	operands[len(words)-1].Prefix = token.prefix
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return SearchExpr{Op: SearchAnd, Operands: operands}, nil
+}
+
+// SearchQuery selects and pages the objects of a tenant matching an expression, by decreasing score
+type SearchQuery struct {
+	Expr  SearchExpr
+	Limit uint
+	// Position the page starts after. Nil for the first page
+	After *SearchCursor
+}
+
+// SearchHit is an object matching a search, with its score
+type SearchHit struct {
+	Row
+	Score int64 `json:"score"`
+}
+
+// SearchFacets counts the objects matching a search by content type and by bucket.
+// Objects without content type or bucket are counted under the empty string
+type SearchFacets struct {
+	ContentTypes map[string]int64 `json:"contentType"`
+	Buckets      map[string]int64 `json:"bucket"`
+}
+
+// SearchResult is a page of search results
+type SearchResult struct {
+	Hits []SearchHit
+	// Of the whole result, on the first page only
+	Facets *SearchFacets
+	// Continuation token of the next page. Empty on the last one
+	NextCursor string
+}
+
+// SearchCursor is a position in search results: score and uuid of the last object returned
+type SearchCursor struct {
+	Score int64  `json:"r"`
+	Uuid  string `json:"u"`
+}
+
+// Precedes returns true if hit comes after the position: by decreasing score, then increasing uuid
+func (c SearchCursor) Precedes(hit SearchHit) bool {
+	return c.Score > hit.Score || (c.Score == hit.Score && c.Uuid < hit.Uuid)
+}
+
+// Token encodes the cursor as a continuation token
+func (c SearchCursor) Token() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseSearchCursor decodes a continuation token returned by Token
+func ParseSearchCursor(token string) (*SearchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var cursor SearchCursor
+	if err := json.Unmarshal(b, &cursor); err != nil || cursor.Uuid == "" {
+		return nil, errInvalidCursor
+	}
+	return &cursor, nil
+}
@@ -4,4 +4,21 @@ type Row struct {
 	Uuid     string `json:"uuid"`
 	FileName string `json:"name"`
 	Bucket   string `json:"bucket,omitempty"`
+	Size     int64  `json:"size"`
+	// Upload time, in TimeFormat
+	CreatedAt   string            `json:"created,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// SHA-256 of the content, hex encoded. Empty for the objects stored before entity tags
+	ETag string `json:"etag,omitempty"`
+	// Tenants can't see each other's objects, thus there is no need to expose it
+	Tenant string `json:"-"`
+}
+
+type Bucket struct {
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	// JSON policy document attached to the bucket. Empty if none.
+	Policy string `json:"policy,omitempty"`
+	Tenant string `json:"-"`
 }